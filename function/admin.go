@@ -0,0 +1,246 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/completion"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/eventlog"
+	"github.com/hsmtkk/ubiquitous-couscous/function/experiment"
+	"github.com/hsmtkk/ubiquitous-couscous/function/health"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/multicast"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var adminCommands = []string{"/stats", "/flags", "/broadcast"}
+
+// protectedFlags cannot be set from chat: they decide who is an admin and
+// what is recorded about users, so a leaked admin account must not be able
+// to change them.
+var protectedFlags = map[string]bool{
+	"ADMIN_USER_IDS":     true,
+	"CONSENT":            true,
+	"CONVERSATION_LOG":   true,
+	"WEBHOOK_ARCHIVE":    true,
+	"VISION_RAW_ARCHIVE": true,
+}
+
+func isAdminCommand(command string) bool {
+	name := strings.Fields(command + " ")[0]
+	for _, c := range adminCommands {
+		if name == c {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdmin reports whether the user is one of the comma separated LINE user
+// IDs in ADMIN_USER_IDS. Only hashes reach the handlers, so the configured
+// IDs are hashed the same way for the comparison.
+func isAdmin(ctx context.Context, userIDHash string) bool {
+	if userIDHash == "" {
+		return false
+	}
+	for _, userID := range strings.Split(dynconfig.Get(ctx, "ADMIN_USER_IDS"), ",") {
+		userID = strings.TrimSpace(userID)
+		if userID != "" && logging.HashUserID(userID) == userIDHash {
+			return true
+		}
+	}
+	return false
+}
+
+// adminCommand runs an admin command sent in chat and returns the text to
+// answer with. text is the message as sent, broadcasts keep its case.
+func adminCommand(ctx context.Context, client *firestore.Client, userIDHash, correlationID, text string) (string, error) {
+	if !isAdmin(ctx, userIDHash) {
+		logging.Warnf(ctx, "admin command refused")
+		return "This command is for administrators only.", nil
+	}
+	text = strings.TrimSpace(text)
+	args := strings.Fields(text)
+	logging.Printf(ctx, "admin command %s", strings.ToLower(args[0]))
+	switch strings.ToLower(args[0]) {
+	case "/stats":
+		return adminStats(ctx, client)
+	case "/flags":
+		if len(args) >= 3 && strings.ToLower(args[1]) == "set" {
+			return adminSetFlag(ctx, client, args[2], strings.Join(args[3:], " "))
+		}
+		return adminFlags(ctx, client)
+	default:
+		message := strings.TrimSpace(text[len(args[0]):])
+		if message == "" {
+			return "Usage: /broadcast <message>", nil
+		}
+		return adminBroadcast(ctx, client, correlationID, message)
+	}
+}
+
+func adminStats(ctx context.Context, client *firestore.Client) (string, error) {
+	counts, err := health.NewRecorder(client).Counts(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(counts) == 0 {
+		return "No activity today.", nil
+	}
+	functions := make([]string, 0, len(counts))
+	for function := range counts {
+		functions = append(functions, function)
+	}
+	sort.Strings(functions)
+	lines := []string{"Today:"}
+	for _, function := range functions {
+		c := counts[function]
+		lines = append(lines, fmt.Sprintf("%s: %d ok, %d failed (%.0f%%)", function, c.Success, c.Failure, c.SuccessRate()*100))
+	}
+	events, err := eventlog.New(client).Counts(ctx, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if len(events) > 0 {
+		parts := []string{}
+		for _, state := range eventlog.States {
+			if n, ok := events[state]; ok {
+				parts = append(parts, fmt.Sprintf("%d %s", n, state))
+			}
+		}
+		lines = append(lines, "", "Messages: "+strings.Join(parts, ", "))
+	}
+	variants, err := experiment.NewRecorder(client).Counts(ctx, replyFormat.Name)
+	if err != nil {
+		return "", err
+	}
+	if len(variants) > 0 {
+		lines = append(lines, "", "Reply format:")
+	}
+	for _, variant := range replyFormat.Variants {
+		if c, ok := variants[variant]; ok {
+			lines = append(lines, fmt.Sprintf("%s: %d shown, %d follow-ups (%.0f%%)", variant, c.Exposures, c.Engagements, c.EngagementRate()*100))
+		}
+	}
+	statuses, err := sloStatuses(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	if len(statuses) > 0 {
+		lines = append(lines, "", "SLOs:")
+	}
+	for _, s := range statuses {
+		lines = append(lines, formatSLOStatus(s))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// notifyAdmins pushes text to every user in ADMIN_USER_IDS.
+func notifyAdmins(ctx context.Context, text string) error {
+	userIDs := []string{}
+	for _, userID := range strings.Split(dynconfig.Get(ctx, "ADMIN_USER_IDS"), ",") {
+		if userID = strings.TrimSpace(userID); userID != "" {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	if len(userIDs) == 0 {
+		logging.Warnf(ctx, "notification dropped; ADMIN_USER_IDS is not set")
+		return nil
+	}
+	req := reply.Request{Messages: []reply.Message{reply.NewText(text)}}
+	if dryRunEnabled(ctx) {
+		return dryRunReply(ctx, req)
+	}
+	lineClient, err := newLineClient(ctx, projectIDOf(ctx))
+	if err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		if err := lineClient.Push(ctx, userID, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adminFlags lists the config/runtime document dynconfig serves settings
+// from; settings only set in the environment are not shown.
+func adminFlags(ctx context.Context, client *firestore.Client) (string, error) {
+	snap, err := client.Collection(namespace.Collection("config")).Doc("runtime").Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return "No flags set.", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	values := snap.Data()
+	if len(values) == 0 {
+		return "No flags set.", nil
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("%s=%v", key, values[key]))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// adminSetFlag takes effect on every instance within CONFIG_TTL.
+func adminSetFlag(ctx context.Context, client *firestore.Client, key, value string) (string, error) {
+	if protectedFlags[strings.ToUpper(key)] {
+		logging.Warnf(ctx, "admin flag %s refused", key)
+		return fmt.Sprintf("%s cannot be set from chat.", key), nil
+	}
+	if _, err := client.Collection(namespace.Collection("config")).Doc("runtime").Set(ctx, map[string]interface{}{key: value}, firestore.MergeAll); err != nil {
+		return "", fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	return fmt.Sprintf("%s=%s", key, value), nil
+}
+
+// adminBroadcast sends message to every friend once per command: the
+// broadcast carries a retry key derived from the correlation ID, and a
+// completion marker written before the answer keeps a redelivered command
+// from broadcasting again.
+func adminBroadcast(ctx context.Context, client *firestore.Client, correlationID, message string) (string, error) {
+	req := reply.Request{Messages: []reply.Message{reply.NewText(message)}}
+	if dryRunEnabled(ctx) {
+		return "Broadcast skipped in dry run.", dryRunReply(ctx, req)
+	}
+	markers := completion.New(client)
+	if correlationID != "" {
+		done, err := markers.Done(ctx, "broadcast", correlationID)
+		if err != nil {
+			return "", err
+		}
+		if done {
+			logging.Printf(ctx, "skip broadcast; sent before")
+			return "Broadcast sent.", nil
+		}
+		req.RetryKey = multicast.RetryKey(correlationID, 0)
+	}
+	lineClient, err := newLineClient(ctx, projectIDOf(ctx))
+	if err != nil {
+		return "", err
+	}
+	if err := lineClient.Broadcast(ctx, req); err != nil {
+		return "", err
+	}
+	if correlationID != "" {
+		if err := markers.Mark(ctx, "broadcast", correlationID); err != nil {
+			return "", err
+		}
+	}
+	return "Broadcast sent.", nil
+}
@@ -0,0 +1,117 @@
+package analysis
+
+// Version is written with every Result so that readers can tell which
+// fields to expect.
+const Version = 1
+
+// Feature names of Result.Features.
+const (
+	FeatureLabels     = "labels"
+	FeatureObjects    = "objects"
+	FeatureText       = "text"
+	FeatureColors     = "colors"
+	FeatureSafeSearch = "safesearch"
+)
+
+// Result is what analyzing one image found, as it moves through the
+// pipeline, gets archived and is served by the results API. Its JSON form is
+// a contract with readers outside this module, such as BigQuery tables over
+// the archive: fields may be added but never renamed or removed.
+type Result struct {
+	Version int `json:"version" firestore:"version"`
+	// Features lists what was run on the image, in order.
+	Features []string `json:"features" firestore:"features"`
+	// Labels are sorted by score, highest first.
+	Labels     []Label     `json:"labels" firestore:"labels"`
+	Objects    []Object    `json:"objects,omitempty" firestore:"objects,omitempty"`
+	TextBlocks []TextBlock `json:"textBlocks,omitempty" firestore:"textBlocks,omitempty"`
+	Colors     []Color     `json:"colors,omitempty" firestore:"colors,omitempty"`
+	SafeSearch *SafeSearch `json:"safeSearch,omitempty" firestore:"safeSearch,omitempty"`
+	// Timings are only recorded for users in debug mode.
+	Timings []Timing `json:"timings,omitempty" firestore:"timings,omitempty"`
+}
+
+// Label is a concept found in the image. Score is in [0, 1], 0 when the
+// source does not report one.
+type Label struct {
+	Name  string  `json:"name" firestore:"name"`
+	Score float32 `json:"score" firestore:"score"`
+}
+
+// Object is a localized object. The box coordinates are normalized to
+// [0, 1] of the image width and height.
+type Object struct {
+	Name  string  `json:"name" firestore:"name"`
+	Score float32 `json:"score" firestore:"score"`
+	MinX  float64 `json:"minX" firestore:"minX"`
+	MinY  float64 `json:"minY" firestore:"minY"`
+	MaxX  float64 `json:"maxX" firestore:"maxX"`
+	MaxY  float64 `json:"maxY" firestore:"maxY"`
+}
+
+type TextBlock struct {
+	Text string `json:"text" firestore:"text"`
+	// Locale is the BCP-47 code Vision detected, empty when unknown.
+	Locale string `json:"locale,omitempty" firestore:"locale,omitempty"`
+}
+
+// Color is a dominant color as "#rrggbb" with the fraction of pixels it
+// covers.
+type Color struct {
+	Hex           string  `json:"hex" firestore:"hex"`
+	Score         float32 `json:"score" firestore:"score"`
+	PixelFraction float32 `json:"pixelFraction" firestore:"pixelFraction"`
+}
+
+// SafeSearch carries the Vision likelihood names and the verdict drawn from
+// them.
+type SafeSearch struct {
+	Adult    string `json:"adult" firestore:"adult"`
+	Violence string `json:"violence" firestore:"violence"`
+	Racy     string `json:"racy" firestore:"racy"`
+	Unsafe   bool   `json:"unsafe" firestore:"unsafe"`
+}
+
+type Timing struct {
+	Stage  string `json:"stage" firestore:"stage"`
+	Millis int64  `json:"millis" firestore:"millis"`
+}
+
+// New returns an empty Result of the current Version.
+func New() Result {
+	return Result{Version: Version, Features: []string{}, Labels: []Label{}}
+}
+
+// AddFeature records that feature ran, once.
+func (r *Result) AddFeature(feature string) {
+	for _, f := range r.Features {
+		if f == feature {
+			return
+		}
+	}
+	r.Features = append(r.Features, feature)
+}
+
+// LabelNames returns the names of the labels in order.
+func (r Result) LabelNames() []string {
+	return Names(r.Labels)
+}
+
+// Names returns the names of labels in order.
+func Names(labels []Label) []string {
+	names := make([]string, len(labels))
+	for i, label := range labels {
+		names[i] = label.Name
+	}
+	return names
+}
+
+// Unscored turns bare names, e.g. from records written before scores were
+// kept, into labels without a score.
+func Unscored(names []string) []Label {
+	labels := make([]Label, len(names))
+	for i, name := range names {
+		labels[i] = Label{Name: name}
+	}
+	return labels
+}
@@ -0,0 +1,262 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cas"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/costguard"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/tuning"
+)
+
+const defaultAnalyzeCacheTTL = 24 * time.Hour
+
+// analyzeRequest names the image by exactly one of ImageURL, an https URL,
+// or GCSURI, gs://bucket/object.
+type analyzeRequest struct {
+	ImageURL string `json:"imageUrl"`
+	GCSURI   string `json:"gcsUri"`
+	// MinScore overrides LABEL_MIN_SCORE when set.
+	MinScore float32 `json:"minScore"`
+}
+
+func analyzeCacheKey(hash string, minScore float32) string {
+	return fmt.Sprintf("analysis:%s:%.2f", hash, minScore)
+}
+
+// analyzeAPI is for other internal services: it labels the image the request
+// names and returns the analysis.Result, reusing a result cached for the
+// same bytes for ANALYZE_CACHE_TTL and otherwise going through labelImage,
+// so that near-duplicates, the Vision budget and the canary apply as they
+// do for LINE.
+func analyzeAPI(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "analyze"})
+	logging.Printf(ctx, "analyze")
+
+	if r.Method != http.MethodPost {
+		returnError(ctx, w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed; %s", r.Method))
+		return
+	}
+	var req analyzeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("json.Decoder.Decode failed; %w", err))
+		return
+	}
+	if (req.ImageURL == "") == (req.GCSURI == "") {
+		returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("one of imageUrl and gcsUri is required"))
+		return
+	}
+	if req.MinScore < 0 || req.MinScore > 1 {
+		returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("invalid minScore; %v", req.MinScore))
+		return
+	}
+
+	var image []byte
+	var err error
+	if req.GCSURI != "" {
+		image, err = readGCSImage(ctx, req.GCSURI)
+	} else {
+		image, err = fetchImage(ctx, req.ImageURL)
+	}
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+
+	result, err := analyzeCached(ctx, projectIDOf(ctx), image, req.MinScore)
+	if errors.Is(err, costguard.ErrBudgetExceeded) {
+		returnError(ctx, w, http.StatusTooManyRequests, err)
+		return
+	}
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		logging.Errorf(ctx, "json.Encoder.Encode failed; %v", err)
+	}
+}
+
+// analyzeCached labels image, or returns what an earlier call found for the
+// same bytes. A broken cache is only logged.
+func analyzeCached(ctx context.Context, projectID string, image []byte, minScore float32) (analysis.Result, error) {
+	hash := cas.Hash(image)
+	if minScore == 0 {
+		minScore = labelMinScore(ctx, userPreferences{})
+	}
+	key := analyzeCacheKey(hash, minScore)
+	// every API caller shares one identity for duplicate detection
+	ctx = logging.With(ctx, logging.Fields{CorrelationID: newCorrelationID(), UserIDHash: logging.HashUserID("api"), ImageID: hash})
+
+	var c cache.Cache
+	if opened, err := cache.Open(ctx, cache.ConfigFromEnv()); err != nil {
+		logging.Errorf(ctx, "cache.Open failed; %v", err)
+	} else {
+		c = opened
+		defer c.Close()
+		value, err := c.Get(ctx, key)
+		if err == nil {
+			var result analysis.Result
+			if err := json.Unmarshal(value, &result); err == nil {
+				logging.Printf(ctx, "analysis cache hit")
+				return result, nil
+			}
+		} else if !errors.Is(err, cache.ErrMiss) {
+			logging.Errorf(ctx, "cache get failed; %v", err)
+		}
+	}
+
+	labels, _, err := labelImage(ctx, projectID, logging.FromContext(ctx).UserIDHash, hash, image, minScore)
+	if err != nil {
+		return analysis.Result{}, err
+	}
+	result := analysis.New()
+	result.AddFeature(analysis.FeatureLabels)
+	result.Labels = labels
+
+	if c != nil {
+		value, err := json.Marshal(result)
+		if err != nil {
+			return result, fmt.Errorf("json.Marshal failed; %w", err)
+		}
+		ttl := defaultAnalyzeCacheTTL
+		if d, err := time.ParseDuration(dynconfig.Get(ctx, "ANALYZE_CACHE_TTL")); err == nil && d > 0 {
+			ttl = d
+		}
+		if err := c.Set(ctx, key, value, ttl); err != nil {
+			logging.Errorf(ctx, "cache set failed; %v", err)
+		}
+	}
+	return result, nil
+}
+
+const maxImageRedirects = 5
+
+// imageFetchClient only connects to public addresses, checked on the
+// resolved IP so that neither a redirect nor DNS can reach the metadata
+// server or the VPC.
+var imageFetchClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return fmt.Errorf("net.SplitHostPort failed; %w", err)
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return fmt.Errorf("address not allowed; %s", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxImageRedirects {
+			return fmt.Errorf("too many redirects")
+		}
+		return checkImageURL(req.URL)
+	},
+}
+
+func publicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast()
+}
+
+func checkImageURL(u *url.URL) error {
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return fmt.Errorf("invalid imageUrl; %s", u)
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !publicIP(ip) {
+		return fmt.Errorf("invalid imageUrl; %s", u)
+	}
+	return nil
+}
+
+// fetchImage downloads an https URL from a public address, up to the upload
+// size limit.
+func fetchImage(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid imageUrl; %s", rawURL)
+	}
+	if err := checkImageURL(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	resp, err := imageFetchClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http.Client.Do failed; %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch image failed; %d", resp.StatusCode)
+	}
+	return readImage(resp.Body)
+}
+
+// analyzeBucketAllowed tells whether ANALYZE_GCS_BUCKETS, a comma separated
+// list, names bucket. Without it no bucket can be read.
+func analyzeBucketAllowed(bucket string) bool {
+	for _, allowed := range strings.Split(os.Getenv("ANALYZE_GCS_BUCKETS"), ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && allowed == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// readGCSImage reads gs://bucket/object as named, outside any NAMESPACE,
+// from the buckets in ANALYZE_GCS_BUCKETS.
+func readGCSImage(ctx context.Context, uri string) ([]byte, error) {
+	bucket, object, ok := strings.Cut(strings.TrimPrefix(uri, "gs://"), "/")
+	if !strings.HasPrefix(uri, "gs://") || !ok || bucket == "" || object == "" {
+		return nil, fmt.Errorf("invalid gcsUri; %s", uri)
+	}
+	if !analyzeBucketAllowed(bucket) {
+		return nil, fmt.Errorf("bucket not allowed; %s", bucket)
+	}
+	client, err := clients.Storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.ObjectHandle.NewReader failed; %w", err)
+	}
+	defer reader.Close()
+	return readImage(reader)
+}
+
+func readImage(r io.Reader) ([]byte, error) {
+	image, err := tuning.ReadAll(io.LimitReader(r, maxUploadBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("tuning.ReadAll failed; %w", err)
+	}
+	if len(image) > maxUploadBytes {
+		return nil, fmt.Errorf("image larger than %d bytes", maxUploadBytes)
+	}
+	return image, nil
+}
@@ -0,0 +1,179 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/canary"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"golang.org/x/oauth2/google"
+)
+
+// analyzer turns an image into labels.
+type analyzer interface {
+	Name() string
+	Labels(ctx context.Context, image []byte) ([]analysis.Label, error)
+}
+
+// visionAnalyzer drops labels scoring below minScore.
+type visionAnalyzer struct {
+	minScore float32
+}
+
+func (visionAnalyzer) Name() string {
+	return "vision"
+}
+
+// Labels reserves the call on the daily Vision budget first, so that Vision
+// is counted however it is reached: alone, in a chain or as the canary.
+func (a visionAnalyzer) Labels(ctx context.Context, image []byte) ([]analysis.Label, error) {
+	if err := reserveLabelDetection(ctx); err != nil {
+		return nil, err
+	}
+	return analyzeImage(ctx, image, a.minScore)
+}
+
+// vertexAnalyzer calls an image classification model deployed to a Vertex AI
+// endpoint, VERTEX_ENDPOINT being its full resource name
+// (projects/p/locations/l/endpoints/e).
+type vertexAnalyzer struct {
+	endpoint string
+	location string
+}
+
+// vertexPredictRequest follows the AutoML image classification schema.
+type vertexPredictRequest struct {
+	Instances  []vertexInstance `json:"instances"`
+	Parameters vertexParameters `json:"parameters"`
+}
+
+type vertexInstance struct {
+	Content string `json:"content"`
+}
+
+type vertexParameters struct {
+	ConfidenceThreshold float64 `json:"confidenceThreshold"`
+	MaxPredictions      int     `json:"maxPredictions"`
+}
+
+type vertexPredictResponse struct {
+	Predictions []struct {
+		DisplayNames []string  `json:"displayNames"`
+		Confidences  []float32 `json:"confidences"`
+	} `json:"predictions"`
+}
+
+func (a vertexAnalyzer) Name() string {
+	return "vertex"
+}
+
+func (a vertexAnalyzer) Labels(ctx context.Context, image []byte) ([]analysis.Label, error) {
+	body, err := json.Marshal(vertexPredictRequest{
+		Instances:  []vertexInstance{{Content: base64.StdEncoding.EncodeToString(image)}},
+		Parameters: vertexParameters{ConfidenceThreshold: 0.5, MaxPredictions: 10},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal failed; %w", err)
+	}
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, fmt.Errorf("google.DefaultClient failed; %w", err)
+	}
+	url := fmt.Sprintf("https://%s-aiplatform.googleapis.com/v1/%s:predict", a.location, a.endpoint)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http.Client.Do failed; %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vertex predict failed; %d %s", resp.StatusCode, respBody)
+	}
+	var predictResp vertexPredictResponse
+	if err := json.Unmarshal(respBody, &predictResp); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	labels := []analysis.Label{}
+	for _, prediction := range predictResp.Predictions {
+		for i, name := range prediction.DisplayNames {
+			label := analysis.Label{Name: name}
+			if i < len(prediction.Confidences) {
+				label.Score = prediction.Confidences[i]
+			}
+			labels = append(labels, label)
+		}
+	}
+	return labels, nil
+}
+
+// candidateAnalyzer returns the analyzer under evaluation, nil when none is
+// configured.
+func candidateAnalyzer() analyzer {
+	endpoint := os.Getenv("VERTEX_ENDPOINT")
+	if endpoint == "" {
+		return nil
+	}
+	location := os.Getenv("VERTEX_LOCATION")
+	if location == "" {
+		location = "us-central1"
+	}
+	return vertexAnalyzer{endpoint: endpoint, location: location}
+}
+
+// analyzeWithCanary labels image with the primary analyzer, Vision or the
+// ANALYZER_CHAIN, or, for the share of keys CANARY_PERCENT routes to it, the
+// candidate. In shadow mode both run and their agreement is logged while the
+// primary answers.
+func analyzeWithCanary(ctx context.Context, key string, image []byte, minScore float32) ([]analysis.Label, error) {
+	primary := primaryAnalyzer(ctx, minScore)
+	candidate := candidateAnalyzer()
+	cfg := canary.ConfigFrom(settingsGetter(ctx))
+	if candidate == nil {
+		return primary.Labels(ctx, image)
+	}
+	if !cfg.Shadow {
+		if cfg.Routed(key) {
+			logging.Printf(ctx, "canary: %s", candidate.Name())
+			return candidate.Labels(ctx, image)
+		}
+		return primary.Labels(ctx, image)
+	}
+
+	type result struct {
+		labels []analysis.Label
+		err    error
+	}
+	shadow := make(chan result, 1)
+	go func() {
+		labels, err := candidate.Labels(ctx, image)
+		shadow <- result{labels, err}
+	}()
+	labels, err := primary.Labels(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	r := <-shadow
+	if r.err != nil {
+		logging.Warnf(ctx, "shadow %s failed; %v", candidate.Name(), r.err)
+		return labels, nil
+	}
+	c := canary.Compare(analysis.Names(labels), analysis.Names(r.labels))
+	logging.Printf(ctx, "shadow %s: agreement=%.2f common=%v only-%s=%v only-%s=%v",
+		candidate.Name(), c.Agreement, c.Common, primary.Name(), c.OnlyPrimary, candidate.Name(), c.OnlyCandidate)
+	return labels, nil
+}
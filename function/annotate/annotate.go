@@ -0,0 +1,90 @@
+package annotate
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	lineWidth    = 3
+	labelPadding = 3
+)
+
+// palette cycles through colors that stay visible on most photos.
+var palette = []color.RGBA{
+	{R: 0xe6, G: 0x19, B: 0x4b, A: 0xff},
+	{R: 0x3c, G: 0xb4, B: 0x4b, A: 0xff},
+	{R: 0x43, G: 0x63, B: 0xd8, A: 0xff},
+	{R: 0xf5, G: 0x82, B: 0x31, A: 0xff},
+	{R: 0x91, G: 0x1e, B: 0xb4, A: 0xff},
+	{R: 0x42, G: 0xd4, B: 0xf4, A: 0xff},
+}
+
+// Box is a detected object. The coordinates are normalized to [0, 1] as
+// Vision returns them.
+type Box struct {
+	Name                   string
+	Score                  float32
+	MinX, MinY, MaxX, MaxY float64
+}
+
+func (b Box) rect(bounds image.Rectangle) image.Rectangle {
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	r := image.Rect(int(b.MinX*w), int(b.MinY*h), int(b.MaxX*w), int(b.MaxY*h))
+	return r.Add(bounds.Min).Intersect(bounds)
+}
+
+// Draw returns a copy of img with each box outlined and captioned with its
+// name and score.
+func Draw(img image.Image, boxes []Box) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+	face := basicfont.Face7x13
+	for i, box := range boxes {
+		c := palette[i%len(palette)]
+		r := box.rect(bounds)
+		if r.Empty() {
+			continue
+		}
+		outline(dst, r, c)
+
+		text := fmt.Sprintf("%s %.0f%%", box.Name, box.Score*100)
+		width := font.MeasureString(face, text).Ceil()
+		height := face.Metrics().Height.Ceil()
+		top := r.Min.Y - height - 2*labelPadding
+		if top < bounds.Min.Y {
+			// no room above the box, caption inside it instead
+			top = r.Min.Y
+		}
+		background := image.Rect(r.Min.X, top, r.Min.X+width+2*labelPadding, top+height+2*labelPadding).Intersect(bounds)
+		draw.Draw(dst, background, image.NewUniform(c), image.Point{}, draw.Src)
+		d := font.Drawer{
+			Dst:  dst,
+			Src:  image.White,
+			Face: face,
+			Dot:  fixed.P(r.Min.X+labelPadding, top+labelPadding+face.Metrics().Ascent.Ceil()),
+		}
+		d.DrawString(text)
+	}
+	return dst
+}
+
+func outline(dst *image.RGBA, r image.Rectangle, c color.RGBA) {
+	src := image.NewUniform(c)
+	edges := []image.Rectangle{
+		image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+lineWidth),
+		image.Rect(r.Min.X, r.Max.Y-lineWidth, r.Max.X, r.Max.Y),
+		image.Rect(r.Min.X, r.Min.Y, r.Min.X+lineWidth, r.Max.Y),
+		image.Rect(r.Max.X-lineWidth, r.Min.Y, r.Max.X, r.Max.Y),
+	}
+	for _, edge := range edges {
+		draw.Draw(dst, edge.Intersect(r), src, image.Point{}, draw.Src)
+	}
+}
@@ -0,0 +1,63 @@
+package annotate
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// the basic font is drawn this many pixels wide per unit of scale; wider
+// images get the text scaled up so that it stays readable on a phone
+const bannerColumnsPerScale = 320
+
+// bannerColor darkens the bottom of the image enough for white text.
+var bannerColor = color.RGBA{A: 0xa0}
+
+// Banner returns a copy of img with lines written on a semi-transparent band
+// across its bottom.
+func Banner(img image.Image, lines []string) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+	if len(lines) == 0 {
+		return dst
+	}
+	face := basicfont.Face7x13
+	scale := bounds.Dx() / bannerColumnsPerScale
+	if scale < 1 {
+		scale = 1
+	}
+	lineHeight := face.Metrics().Height.Ceil()
+	width := 0
+	for _, line := range lines {
+		if w := font.MeasureString(face, line).Ceil(); w > width {
+			width = w
+		}
+	}
+
+	// draw the text at its natural size first and scale the pixels up
+	text := image.NewAlpha(image.Rect(0, 0, width+2*labelPadding, len(lines)*lineHeight+2*labelPadding))
+	d := font.Drawer{Dst: text, Src: image.Opaque, Face: face}
+	for i, line := range lines {
+		d.Dot = fixed.P(labelPadding, labelPadding+i*lineHeight+face.Metrics().Ascent.Ceil())
+		d.DrawString(line)
+	}
+
+	band := image.Rect(bounds.Min.X, bounds.Max.Y-text.Bounds().Dy()*scale, bounds.Max.X, bounds.Max.Y).Intersect(bounds)
+	draw.Draw(dst, band, image.NewUniform(bannerColor), image.Point{}, draw.Over)
+	for y := 0; y < text.Bounds().Dy(); y++ {
+		for x := 0; x < text.Bounds().Dx(); x++ {
+			a := text.AlphaAt(x, y).A
+			if a == 0 {
+				continue
+			}
+			cell := image.Rect(band.Min.X+x*scale, band.Min.Y+y*scale, band.Min.X+(x+1)*scale, band.Min.Y+(y+1)*scale).Intersect(band)
+			draw.DrawMask(dst, cell, image.White, image.Point{}, image.NewUniform(color.Alpha{A: a}), image.Point{}, draw.Over)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,274 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/storage"
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cas"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/imageutil"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/taxonomy"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	moderationNone    = "none"
+	moderationBlurred = "blurred"
+	// pixel blocks are this fraction of the longer side of the image
+	moderationBlockFraction = 32
+)
+
+// archivedResult is one line of the results/ objects of ARCHIVE_BUCKET, in
+// the newline delimited JSON a BigQuery external table over
+// gs://ARCHIVE_BUCKET/results/* reads.
+type archivedResult struct {
+	ImageID    string    `json:"imageId"`
+	UserIDHash string    `json:"userIdHash"`
+	CreatedAt  time.Time `json:"createdAt"`
+	analysis.Result
+}
+
+func archiveResultName(userIDHash, imageID string) string {
+	return fmt.Sprintf("results/%s/%s.json", userIDHash, imageID)
+}
+
+// legacyArchiveName is where images were archived before the content
+// addressed layout.
+func legacyArchiveName(userIDHash, imageID string) string {
+	return fmt.Sprintf("archive/%s/%s.jpg", userIDHash, imageID)
+}
+
+// archiveStep stores the image in ARCHIVE_BUCKET, a no-op without it or the
+// user's consent, and the analysis result next to it. Images SafeSearch flags are pixelated
+// first and only that copy is kept; when the workflow has not run SafeSearch
+// yet, this step does. Images are stored once per content under cas.Name
+// and archiveIndex maps the message to it; a duplicate of an image already
+// archived reuses that blob. The index entry is written before the blob, see
+// writeBlob.
+func archiveStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	bucket := tenantEnv(ctx, "ARCHIVE_BUCKET")
+	if bucket == "" || !recordingAllowed(ctx) {
+		return nil
+	}
+	if err := ensureSafeSearch(ctx, state); err != nil {
+		return err
+	}
+
+	client, err := clients.Firestore(ctx, state.projectID)
+	if err != nil {
+		return err
+	}
+	index := cas.NewIndex(client)
+	entry := cas.Entry{
+		UserIDHash: state.procMsg.UserIDHash,
+		ImageID:    state.procMsg.ImageID,
+		Moderation: moderationNone,
+		Labels:     state.result.LabelNames(),
+		Categories: taxonomy.Categories(state.result.LabelNames()),
+	}
+	if state.duplicateOf != "" && !state.unsafe {
+		original, err := index.Get(ctx, state.procMsg.UserIDHash, state.duplicateOf)
+		if err != nil {
+			return err
+		}
+		if original != nil {
+			entry.Hash, entry.Moderation = original.Hash, original.Moderation
+		}
+	}
+	var image []byte
+	if entry.Hash == "" {
+		image = state.image
+		if state.unsafe {
+			blurred, err := moderateImage(image)
+			if err != nil {
+				return err
+			}
+			image = blurred
+			entry.Moderation = moderationBlurred
+		}
+		entry.Hash = cas.Hash(image)
+	}
+	if err := index.Put(ctx, entry); err != nil {
+		return err
+	}
+	stored, err := writeBlob(ctx, bucket, entry.Name(), image)
+	if image == nil && errors.Is(err, storage.ErrObjectNotExist) {
+		// the blob of the original was deleted meanwhile; keep this copy
+		image = state.image
+		entry.Hash, entry.Moderation = cas.Hash(image), moderationNone
+		if err := index.Put(ctx, entry); err != nil {
+			return err
+		}
+		stored, err = writeBlob(ctx, bucket, entry.Name(), image)
+	}
+	if err != nil {
+		return err
+	}
+	if !stored {
+		logging.Printf(ctx, "archive reuses gs://%s/%s", bucket, entry.Name())
+	}
+	state.archiveURL = fmt.Sprintf("https://storage.cloud.google.com/%s/%s", bucket, namespace.Object(entry.Name()))
+	logging.Printf(ctx, "archived gs://%s/%s; moderation: %s", bucket, entry.Name(), entry.Moderation)
+
+	b, err := json.Marshal(archivedResult{ImageID: state.procMsg.ImageID, UserIDHash: state.procMsg.UserIDHash, CreatedAt: time.Now(), Result: state.result})
+	if err != nil {
+		return fmt.Errorf("json.Marshal failed; %w", err)
+	}
+	return writeObject(ctx, bucket, archiveResultName(state.procMsg.UserIDHash, state.procMsg.ImageID), "application/json", append(b, '\n'), nil)
+}
+
+func moderateImage(b []byte) ([]byte, error) {
+	img, _, err := imageutil.Decode(b)
+	if err != nil {
+		return nil, err
+	}
+	size := img.Bounds().Dx()
+	if h := img.Bounds().Dy(); h > size {
+		size = h
+	}
+	block := size / moderationBlockFraction
+	if block < 1 {
+		block = 1
+	}
+	return imageutil.EncodeJPEG(imageutil.Pixelate(img, block))
+}
+
+// writeBlob stores b as name unless an object of that name exists, which
+// under the content addressed layout holds the same bytes, and reports
+// whether it wrote; nil b only reuses the object. A reused object has its
+// metadata touched, which changes its metageneration, so that a
+// forgetArchivedImages that found it orphaned before the index entry
+// referring to it again was written fails to delete it. That entry has to
+// be written first. storage.ErrObjectNotExist means there was nothing to
+// reuse.
+func writeBlob(ctx context.Context, bucket, name string, b []byte) (bool, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return false, fmt.Errorf("storage.NewClient failed; %w", err)
+	}
+	defer client.Close()
+	object := client.Bucket(bucket).Object(namespace.Object(name))
+	if b != nil {
+		w := object.If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+		w.ContentType = imageutil.ContentType(b)
+		if _, err := w.Write(b); err != nil {
+			w.Close()
+			return false, fmt.Errorf("storage.Writer.Write failed; %w", err)
+		}
+		err := w.Close()
+		if err == nil {
+			return true, nil
+		}
+		if !preconditionFailed(err) {
+			return false, fmt.Errorf("storage.Writer.Close failed; %w", err)
+		}
+	}
+	_, err = object.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: map[string]string{"referencedAt": time.Now().UTC().Format(time.RFC3339)}})
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, err
+	}
+	if err != nil {
+		return false, fmt.Errorf("storage.ObjectHandle.Update failed; %w", err)
+	}
+	return false, nil
+}
+
+func preconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
+
+// archivedImageName returns the object name the image of the message is
+// archived under, the legacy per message name for images archived before
+// the index existed.
+func archivedImageName(ctx context.Context, client *firestore.Client, userIDHash, imageID string) (string, error) {
+	entry, err := cas.NewIndex(client).Get(ctx, userIDHash, imageID)
+	if err != nil {
+		return "", err
+	}
+	if entry == nil {
+		return legacyArchiveName(userIDHash, imageID), nil
+	}
+	return entry.Name(), nil
+}
+
+// forgetArchivedImages drops the index entries and deletes the blobs no other
+// message refers to any more, returning how many blobs that was. A blob is
+// deleted only if it is unchanged since the index was checked again, see
+// writeBlob.
+func forgetArchivedImages(ctx context.Context, client *firestore.Client, bucket string, entries []cas.Entry) (int, error) {
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("storage.NewClient failed; %w", err)
+	}
+	defer storageClient.Close()
+	index := cas.NewIndex(client)
+	deleted := 0
+	for _, e := range entries {
+		orphan, err := index.Forget(ctx, e.UserIDHash, e.ImageID)
+		if err != nil {
+			return deleted, err
+		}
+		if orphan == "" || bucket == "" {
+			continue
+		}
+		object := storageClient.Bucket(bucket).Object(namespace.Object(cas.Name(orphan)))
+		attrs, err := object.Attrs(ctx)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			continue
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("storage.ObjectHandle.Attrs failed; %w", err)
+		}
+		referenced, err := index.Referenced(ctx, orphan)
+		if err != nil {
+			return deleted, err
+		}
+		if referenced {
+			continue
+		}
+		err = object.If(storage.Conditions{GenerationMatch: attrs.Generation, MetagenerationMatch: attrs.Metageneration}).Delete(ctx)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			continue
+		}
+		if preconditionFailed(err) {
+			logging.Printf(ctx, "keep gs://%s/%s; archived again", bucket, cas.Name(orphan))
+			continue
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("storage.ObjectHandle.Delete failed; %w", err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// writeObject stores b as name, within the NAMESPACE like every object
+// this deployment keeps.
+func writeObject(ctx context.Context, bucket, name, contentType string, b []byte, metadata map[string]string) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("storage.NewClient failed; %w", err)
+	}
+	defer client.Close()
+	w := client.Bucket(bucket).Object(namespace.Object(name)).NewWriter(ctx)
+	w.ContentType = contentType
+	w.Metadata = metadata
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return fmt.Errorf("storage.Writer.Write failed; %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("storage.Writer.Close failed; %w", err)
+	}
+	return nil
+}
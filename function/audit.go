@@ -0,0 +1,53 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/lineapi"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+)
+
+// recordReply writes the LINE answer to the audit log and onto the
+// interactions/{correlationId} document so that support can go from a user
+// report to the message IDs LINE delivered. Failures are only logged: the
+// reply token is spent, so failing the event would not help.
+func recordReply(ctx context.Context, result lineapi.ReplyResult, replyErr error) {
+	b, err := json.Marshal(result)
+	if err != nil {
+		logging.Errorf(ctx, "json.Marshal failed; %v", err)
+		return
+	}
+	logging.Printf(ctx, "reply audit: %s", b)
+
+	correlationID := logging.FromContext(ctx).CorrelationID
+	projectID := projectIDOf(ctx)
+	if correlationID == "" || projectID == "" || !recordingAllowed(ctx) {
+		return
+	}
+	fields := map[string]interface{}{
+		"replyRequestId": result.RequestID,
+		"replyStatus":    result.StatusCode,
+		"sentMessageIds": result.SentMessageIDs(),
+		"repliedAt":      time.Now(),
+	}
+	// lets /deletemydata find the rows of a user
+	if userIDHash := logging.FromContext(ctx).UserIDHash; userIDHash != "" {
+		fields["userIdHash"] = userIDHash
+	}
+	if replyErr != nil {
+		fields["replyError"] = replyErr.Error()
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		logging.Errorf(ctx, "clients.Firestore failed; %v", err)
+		return
+	}
+	if _, err := client.Collection(namespace.Collection("interactions")).Doc(correlationID).Set(ctx, fields, firestore.MergeAll); err != nil {
+		logging.Errorf(ctx, "firestore.DocumentRef.Set failed; %v", err)
+	}
+}
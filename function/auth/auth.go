@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"google.golang.org/api/idtoken"
+)
+
+var (
+	ErrMissingToken = errors.New("missing bearer token")
+	ErrForbidden    = errors.New("principal not allowed")
+	ErrNoPrincipals = errors.New("INTERNAL_PRINCIPALS is not set")
+)
+
+// Config says which Google signed identity tokens are accepted. An empty
+// Audience is not checked; Principals, when set, lists the verified emails
+// (service accounts or users) that may call. Validate accepts any principal
+// without them, Require none.
+type Config struct {
+	Audience   string
+	Principals []string
+}
+
+// ConfigFromEnv reads INTERNAL_AUDIENCE and the comma separated
+// INTERNAL_PRINCIPALS.
+func ConfigFromEnv() Config {
+	cfg := Config{Audience: os.Getenv("INTERNAL_AUDIENCE")}
+	for _, principal := range strings.Split(os.Getenv("INTERNAL_PRINCIPALS"), ",") {
+		if principal = strings.TrimSpace(principal); principal != "" {
+			cfg.Principals = append(cfg.Principals, principal)
+		}
+	}
+	return cfg
+}
+
+// Validate checks the bearer token of r and returns the email it was issued to.
+func Validate(ctx context.Context, r *http.Request, cfg Config) (string, error) {
+	authHeader := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+	if authHeader == "" || token == authHeader {
+		return "", ErrMissingToken
+	}
+	payload, err := idtoken.Validate(ctx, token, cfg.Audience)
+	if err != nil {
+		return "", fmt.Errorf("idtoken.Validate failed; %w", err)
+	}
+	email, _ := payload.Claims["email"].(string)
+	verified, _ := payload.Claims["email_verified"].(bool)
+	if len(cfg.Principals) == 0 {
+		return email, nil
+	}
+	if verified {
+		for _, principal := range cfg.Principals {
+			if email == principal {
+				return email, nil
+			}
+		}
+	}
+	return email, fmt.Errorf("%w; %s", ErrForbidden, email)
+}
+
+// Require wraps an internal endpoint so that only callers with a valid
+// identity token get through. Without a configured audience the token must
+// be issued for the URL of the service itself, which is what Cloud Scheduler
+// and gcloud use by default. Without Principals every request is refused,
+// since any service account can mint a token for that audience.
+func Require(cfg Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(cfg.Principals) == 0 {
+			logging.Errorf(r.Context(), "reject %s; %v", r.URL.Path, ErrNoPrincipals)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		reqCfg := cfg
+		if reqCfg.Audience == "" {
+			reqCfg.Audience = "https://" + r.Host
+		}
+		email, err := Validate(r.Context(), r, reqCfg)
+		if err != nil {
+			code := http.StatusUnauthorized
+			if errors.Is(err, ErrForbidden) {
+				code = http.StatusForbidden
+			}
+			logging.Warnf(r.Context(), "reject %s; %v", r.URL.Path, err)
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		logging.Printf(r.Context(), "caller: %s", email)
+		next(w, r)
+	}
+}
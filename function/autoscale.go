@@ -0,0 +1,152 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/autoscale"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+)
+
+const (
+	// an instance reports its in-flight peak at most this often
+	inFlightReportInterval = time.Minute
+	// messages waiting longer than this ask for more instances
+	defaultAutoscaleTarget = 30 * time.Second
+)
+
+// instanceID tells the in-flight series of the instances apart.
+var instanceID = newCorrelationID()
+
+var inFlight = struct {
+	sync.Mutex
+	gauges   map[string]*autoscale.Gauge
+	reported map[string]time.Time
+}{gauges: map[string]*autoscale.Gauge{}, reported: map[string]time.Time{}}
+
+func autoscaleMetricsEnabled(ctx context.Context) bool {
+	return dynconfig.Get(ctx, "AUTOSCALE_METRICS") == "true"
+}
+
+// trackInFlight counts a message of function in; the returned function
+// counts it out and, with AUTOSCALE_METRICS on, reports the peak of the
+// instance once a minute.
+func trackInFlight(ctx context.Context, function string) func() {
+	inFlight.Lock()
+	gauge, ok := inFlight.gauges[function]
+	if !ok {
+		gauge = &autoscale.Gauge{}
+		inFlight.gauges[function] = gauge
+	}
+	inFlight.Unlock()
+	done := gauge.Begin()
+	return func() {
+		done()
+		if !autoscaleMetricsEnabled(ctx) {
+			return
+		}
+		inFlight.Lock()
+		due := time.Since(inFlight.reported[function]) >= inFlightReportInterval
+		if due {
+			inFlight.reported[function] = time.Now()
+		}
+		inFlight.Unlock()
+		if due {
+			reportInFlight(ctx, function, gauge.TakePeak())
+		}
+	}
+}
+
+// reportInFlight is best effort; a lost point only blurs the advice.
+func reportInFlight(ctx context.Context, function string, peak int) {
+	metrics, err := autoscale.NewMetrics(ctx, os.Getenv("PROJECT_ID"))
+	if err != nil {
+		logging.Errorf(ctx, "autoscale.NewMetrics failed; %v", err)
+		return
+	}
+	defer metrics.Close()
+	labels := map[string]string{"function": function, "instance": instanceID}
+	if err := metrics.Write(ctx, autoscale.InFlightMetric, labels, float64(peak)); err != nil {
+		logging.Errorf(ctx, "report in-flight failed; %v", err)
+	}
+}
+
+// autoscaleLimits reads <FUNCTION>_MIN_INSTANCES, _MAX_INSTANCES and
+// _CONCURRENCY, the settings function is deployed with.
+func autoscaleLimits(function string) autoscale.Limits {
+	prefix := strings.ToUpper(function) + "_"
+	atoi := func(key string, fallback int) int {
+		if n, err := strconv.Atoi(os.Getenv(prefix + key)); err == nil && n >= 0 {
+			return n
+		}
+		return fallback
+	}
+	return autoscale.Limits{Min: atoi("MIN_INSTANCES", 0), Max: atoi("MAX_INSTANCES", 1), Concurrency: atoi("CONCURRENCY", 1)}
+}
+
+// autoscaleSignals runs on a schedule. For every function in
+// AUTOSCALE_FUNCTIONS it exports the backlog of <FUNCTION>_SUBSCRIPTION as
+// custom metrics next to the in-flight peaks the instances report, and logs
+// how the instance limits should change. It answers with the advice.
+func autoscaleSignals(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "autoscaleSignals"})
+	logging.Printf(ctx, "autoscaleSignals")
+
+	metrics, err := autoscale.NewMetrics(ctx, os.Getenv("PROJECT_ID"))
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	defer metrics.Close()
+
+	target := defaultAutoscaleTarget
+	if n, err := strconv.Atoi(dynconfig.Get(ctx, "AUTOSCALE_TARGET_SECONDS")); err == nil && n > 0 {
+		target = time.Duration(n) * time.Second
+	}
+	advice := []autoscale.Advice{}
+	for _, function := range strings.Split(os.Getenv("AUTOSCALE_FUNCTIONS"), ",") {
+		function = strings.TrimSpace(function)
+		subscription := os.Getenv(strings.ToUpper(function) + "_SUBSCRIPTION")
+		if function == "" || subscription == "" {
+			continue
+		}
+		signal := autoscale.Signal{Function: function}
+		if signal.Backlog, err = metrics.Backlog(ctx, subscription); err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		labels := map[string]string{"function": function}
+		if err := metrics.Write(ctx, autoscale.BacklogMetric, labels, float64(signal.Backlog.Messages)); err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := metrics.Write(ctx, autoscale.OldestAgeMetric, labels, signal.Backlog.OldestAge.Seconds()); err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		// instances that reported within two intervals count as running
+		if signal.InFlight, err = metrics.InFlight(ctx, function, 2*inFlightReportInterval); err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		limits := autoscaleLimits(function)
+		a := autoscale.Advise(signal, limits, target)
+		if a.Changed(limits) {
+			logging.Warnf(ctx, "autoscale %s: min %d -> %d, max %d -> %d; %s", function, limits.Min, a.Min, limits.Max, a.Max, a.Reason)
+		} else {
+			logging.Printf(ctx, "autoscale %s: %s", function, a.Reason)
+		}
+		advice = append(advice, a)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(advice); err != nil {
+		logging.Errorf(ctx, "json.Encoder.Encode failed; %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package autoscale
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Signal is what is known about the load of one function.
+type Signal struct {
+	Function string
+	Backlog  Backlog
+	// InFlight holds the peak each running instance reported.
+	InFlight []float64
+}
+
+// Limits are the instance settings a function is deployed with.
+type Limits struct {
+	Min         int
+	Max         int
+	Concurrency int
+}
+
+// Advice is the limits a function should run with and why. It only ever
+// goes to the logs; operators decide.
+type Advice struct {
+	Function string `json:"function"`
+	Min      int    `json:"min"`
+	Max      int    `json:"max"`
+	Reason   string `json:"reason"`
+}
+
+func (a Advice) Changed(l Limits) bool {
+	return a.Min != l.Min || a.Max != l.Max
+}
+
+// Advise compares the load of a function with its limits. Messages waiting
+// longer than target mean too few instances: max is raised to what would
+// hold the backlog and the work in flight at once, and min to one when they
+// waited although no instance was busy, i.e. on cold starts. A quiet
+// function whose max is more than twice what it used gets a lower max.
+func Advise(s Signal, l Limits, target time.Duration) Advice {
+	advice := Advice{Function: s.Function, Min: l.Min, Max: l.Max, Reason: "limits fit the load"}
+	concurrency := l.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	busy := 0.0
+	for _, n := range s.InFlight {
+		busy += n
+	}
+	needed := int(math.Ceil((busy + float64(s.Backlog.Messages)) / float64(concurrency)))
+	waiting := s.Backlog.OldestAge > target
+
+	switch {
+	case waiting && needed > l.Max:
+		advice.Max = needed
+		advice.Reason = fmt.Sprintf("oldest message waited %s; %d instances would hold %d waiting and %.0f in flight", s.Backlog.OldestAge, needed, s.Backlog.Messages, busy)
+	case waiting && len(s.InFlight) >= l.Max:
+		advice.Max = l.Max + 1
+		advice.Reason = fmt.Sprintf("oldest message waited %s with all %d instances running", s.Backlog.OldestAge, len(s.InFlight))
+	case s.Backlog.Messages == 0 && l.Max > 1 && needed*2 < l.Max:
+		advice.Max = needed * 2
+		if advice.Max < 1 {
+			advice.Max = 1
+		}
+		advice.Reason = fmt.Sprintf("nothing waits and at most %d of %d instances were needed", needed, l.Max)
+	}
+	if waiting && busy == 0 && l.Min == 0 {
+		advice.Min = 1
+		advice.Reason = fmt.Sprintf("oldest message waited %s while no instance was busy; keep one warm", s.Backlog.OldestAge)
+	}
+	if advice.Max < advice.Min {
+		advice.Max = advice.Min
+	}
+	return advice
+}
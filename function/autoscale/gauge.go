@@ -0,0 +1,39 @@
+package autoscale
+
+import "sync"
+
+// Gauge counts the messages an instance works on at once and keeps the peak
+// of the period since it was last taken.
+type Gauge struct {
+	mu      sync.Mutex
+	current int
+	peak    int
+}
+
+// Begin counts a message in; the returned function counts it out.
+func (g *Gauge) Begin() func() {
+	g.mu.Lock()
+	g.current++
+	if g.current > g.peak {
+		g.peak = g.current
+	}
+	g.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			g.current--
+			g.mu.Unlock()
+		})
+	}
+}
+
+// TakePeak returns the peak and starts the next period at the messages
+// still in flight.
+func (g *Gauge) TakePeak() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	peak := g.peak
+	g.peak = g.current
+	return peak
+}
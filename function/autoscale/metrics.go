@@ -0,0 +1,135 @@
+package autoscale
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/api/iterator"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	BacklogMetric   = "custom.googleapis.com/pipeline/backlog"
+	OldestAgeMetric = "custom.googleapis.com/pipeline/oldest_unacked_age"
+	InFlightMetric  = "custom.googleapis.com/pipeline/in_flight"
+
+	undeliveredMetric = "pubsub.googleapis.com/subscription/num_undelivered_messages"
+	oldestAckMetric   = "pubsub.googleapis.com/subscription/oldest_unacked_message_age"
+	// Pub/Sub metrics show up a few minutes late
+	pubsubMetricWindow = 5 * time.Minute
+)
+
+// Backlog is what waits in a subscription.
+type Backlog struct {
+	Messages  int64
+	OldestAge time.Duration
+}
+
+// Metrics reads the Pub/Sub metrics and reads and writes the custom metrics
+// of projectID.
+type Metrics struct {
+	client    *monitoring.MetricClient
+	projectID string
+}
+
+func NewMetrics(ctx context.Context, projectID string) (*Metrics, error) {
+	client, err := monitoring.NewMetricClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("monitoring.NewMetricClient failed; %w", err)
+	}
+	return &Metrics{client: client, projectID: projectID}, nil
+}
+
+func (m *Metrics) Close() error {
+	return m.client.Close()
+}
+
+// Backlog returns the newest backlog Pub/Sub reported for subscriptionID;
+// a subscription without points has none.
+func (m *Metrics) Backlog(ctx context.Context, subscriptionID string) (Backlog, error) {
+	filter := fmt.Sprintf(`resource.type = "pubsub_subscription" AND resource.labels.subscription_id = %q`, subscriptionID)
+	messages, err := m.newest(ctx, undeliveredMetric, filter, pubsubMetricWindow)
+	if err != nil {
+		return Backlog{}, err
+	}
+	age, err := m.newest(ctx, oldestAckMetric, filter, pubsubMetricWindow)
+	if err != nil {
+		return Backlog{}, err
+	}
+	return Backlog{Messages: int64(messages), OldestAge: time.Duration(age) * time.Second}, nil
+}
+
+func (m *Metrics) newest(ctx context.Context, metricType, filter string, window time.Duration) (float64, error) {
+	values, err := m.list(ctx, fmt.Sprintf(`metric.type = %q AND %s`, namespace.Metric(metricType), filter), window)
+	if err != nil || len(values) == 0 {
+		return 0, err
+	}
+	return values[0], nil
+}
+
+// list returns the newest point of every series matching filter.
+func (m *Metrics) list(ctx context.Context, filter string, window time.Duration) ([]float64, error) {
+	now := time.Now()
+	it := m.client.ListTimeSeries(ctx, &monitoringpb.ListTimeSeriesRequest{
+		Name:   "projects/" + m.projectID,
+		Filter: filter,
+		Interval: &monitoringpb.TimeInterval{
+			StartTime: timestamppb.New(now.Add(-window)),
+			EndTime:   timestamppb.New(now),
+		},
+		View: monitoringpb.ListTimeSeriesRequest_FULL,
+	})
+	values := []float64{}
+	for {
+		series, err := it.Next()
+		if err == iterator.Done {
+			return values, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("monitoring.TimeSeriesIterator.Next failed; %w", err)
+		}
+		// points come newest first
+		if points := series.GetPoints(); len(points) > 0 {
+			v := points[0].GetValue()
+			if _, ok := v.GetValue().(*monitoringpb.TypedValue_Int64Value); ok {
+				values = append(values, float64(v.GetInt64Value()))
+			} else {
+				values = append(values, v.GetDoubleValue())
+			}
+		}
+	}
+}
+
+// InFlight returns the peak every instance of function reported within
+// window, one value per instance.
+func (m *Metrics) InFlight(ctx context.Context, function string, window time.Duration) ([]float64, error) {
+	return m.list(ctx, fmt.Sprintf(`metric.type = %q AND metric.labels.function = %q`, namespace.Metric(InFlightMetric), function), window)
+}
+
+// Write adds a point to the custom gauge metricType. Points of one series
+// must be written at least five seconds apart.
+func (m *Metrics) Write(ctx context.Context, metricType string, labels map[string]string, value float64) error {
+	err := m.client.CreateTimeSeries(ctx, &monitoringpb.CreateTimeSeriesRequest{
+		Name: "projects/" + m.projectID,
+		TimeSeries: []*monitoringpb.TimeSeries{{
+			Metric:     &metricpb.Metric{Type: namespace.Metric(metricType), Labels: labels},
+			Resource:   &monitoredrespb.MonitoredResource{Type: "global", Labels: map[string]string{"project_id": m.projectID}},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: timestamppb.Now()},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+			}},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("monitoring.MetricClient.CreateTimeSeries failed; %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/backpressure"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	backpressureReject   = "reject"
+	backpressureOverflow = "overflow"
+
+	defaultPublishLatencyLimit = 2 * time.Second
+	defaultProcessLagLimit     = 20 * time.Second
+	// how long a raised flag holds once nobody raises it again
+	backpressureHold = time.Minute
+	// LINE is asked to redeliver after this long
+	retryAfterSeconds = 30
+)
+
+// backpressureMode is BACKPRESSURE: reject answers webhooks with 429 so that
+// LINE redelivers them later, overflow sends images to OVERFLOW_TOPIC, which
+// is worked off by its own function and answered by push once the reply
+// token has expired. Anything else turns backpressure off.
+func backpressureMode(ctx context.Context) string {
+	mode := dynconfig.Get(ctx, "BACKPRESSURE")
+	if mode == backpressureReject || mode == backpressureOverflow {
+		return mode
+	}
+	return ""
+}
+
+func durationSetting(ctx context.Context, key string, fallback time.Duration) time.Duration {
+	if n, err := strconv.Atoi(dynconfig.Get(ctx, key)); err == nil && n > 0 {
+		return time.Duration(n) * time.Millisecond
+	}
+	return fallback
+}
+
+// overloaded returns why the pipeline counts as overloaded, empty when it
+// does not. A failing check does not count.
+func overloaded(ctx context.Context) string {
+	latency := backpressure.Default.PublishLatency()
+	if latency > durationSetting(ctx, "PUBLISH_LATENCY_LIMIT_MS", defaultPublishLatencyLimit) {
+		return fmt.Sprintf("publish latency %dms", latency.Milliseconds())
+	}
+	c, err := cache.Open(ctx, cache.ConfigFromEnv())
+	if err != nil {
+		logging.Errorf(ctx, "cache.Open failed; %v", err)
+		return ""
+	}
+	defer c.Close()
+	reason, err := backpressure.Raised(ctx, c)
+	if err != nil {
+		logging.Errorf(ctx, "check backpressure failed; %v", err)
+		return ""
+	}
+	return reason
+}
+
+// raiseBackpressure is best effort; the caller goes on either way.
+func raiseBackpressure(ctx context.Context, reason string) {
+	c, err := cache.Open(ctx, cache.ConfigFromEnv())
+	if err != nil {
+		logging.Errorf(ctx, "cache.Open failed; %v", err)
+		return
+	}
+	defer c.Close()
+	if err := backpressure.Raise(ctx, c, reason, backpressureHold); err != nil {
+		logging.Errorf(ctx, "raise backpressure failed; %v", err)
+		return
+	}
+	logging.Warnf(ctx, "backpressure raised; %s", reason)
+}
+
+// checkProcessLag raises backpressure when an image waited in the queue
+// longer than PROCESS_LAG_LIMIT_MS.
+func checkProcessLag(ctx context.Context, receivedAt time.Time) {
+	if receivedAt.IsZero() || backpressureMode(ctx) == "" {
+		return
+	}
+	lag := time.Since(receivedAt)
+	if lag > durationSetting(ctx, "PROCESS_LAG_LIMIT_MS", defaultProcessLagLimit) {
+		raiseBackpressure(ctx, fmt.Sprintf("process lag %dms", lag.Milliseconds()))
+	}
+}
+
+// quotaExhausted looks for a RESOURCE_EXHAUSTED status anywhere in the chain
+// of err.
+func quotaExhausted(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if status.Code(err) == codes.ResourceExhausted {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package backpressure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+)
+
+const (
+	flagKey = "backpressure"
+	// weight of the newest sample in the moving average
+	smoothing = 0.2
+)
+
+// Monitor follows how long publishing takes on this instance, as an
+// exponentially weighted moving average.
+type Monitor struct {
+	mu      sync.Mutex
+	latency time.Duration
+}
+
+var Default = &Monitor{}
+
+func (m *Monitor) ObservePublish(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.latency == 0 {
+		m.latency = d
+		return
+	}
+	m.latency = time.Duration(smoothing*float64(d) + (1-smoothing)*float64(m.latency))
+}
+
+func (m *Monitor) PublishLatency() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.latency
+}
+
+// Raise tells every instance that the pipeline is overloaded for ttl. It is
+// raised by whoever notices: processors lagging behind, a spent budget.
+func Raise(ctx context.Context, c cache.Cache, reason string, ttl time.Duration) error {
+	if err := c.Set(ctx, flagKey, []byte(reason), ttl); err != nil {
+		return fmt.Errorf("cache.Cache.Set failed; %w", err)
+	}
+	return nil
+}
+
+// Raised returns the reason of a raised flag, empty when there is none.
+func Raised(ctx context.Context, c cache.Cache) (string, error) {
+	reason, err := c.Get(ctx, flagKey)
+	if errors.Is(err, cache.ErrMiss) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("cache.Cache.Get failed; %w", err)
+	}
+	return string(reason), nil
+}
@@ -0,0 +1,118 @@
+package function
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/hsmtkk/ubiquitous-couscous/function/beacon"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+	"github.com/hsmtkk/ubiquitous-couscous/function/decode"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/queue"
+	"github.com/hsmtkk/ubiquitous-couscous/function/redact"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+)
+
+// a user walking past the same beacon is greeted once per this period
+const defaultBeaconCooldown = time.Hour
+
+//go:embed beacons.json
+var defaultBeacons []byte
+
+type beaconMessage struct {
+	CorrelationID string
+	UserIDHash    string
+	ReplyToken    string
+	HWID          string
+	Type          string
+	Tenant        string `json:",omitempty"`
+}
+
+func (m beaconMessage) Validate() []decode.FieldError {
+	return append(decode.Required("ReplyToken", m.ReplyToken), decode.Required("HWID", m.HWID)...)
+}
+
+// loadBeacons reads the file named by BEACON_FILE, falling back to the
+// embedded beacons.json.
+func loadBeacons() (beacon.Config, error) {
+	b := defaultBeacons
+	if path := os.Getenv("BEACON_FILE"); path != "" {
+		var err error
+		b, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("os.ReadFile failed; %w", err)
+		}
+	}
+	return beacon.ParseConfig(b)
+}
+
+func handleBeacon(ctx context.Context, evt event.Event) error {
+	ctx = logging.With(ctx, logging.Fields{Function: "beacon"})
+	logging.Printf(ctx, "beacon")
+
+	var subMsg messagePublishedData
+	if err := evt.DataAs(&subMsg); err != nil {
+		return fmt.Errorf("event.Event.DataAs failed; %w", err)
+	}
+	logging.Debugf(ctx, "request: %s", redact.JSON(redact.ModeFromEnv(), subMsg.Message.Data))
+	return beaconData(queue.WithAttributes(ctx, subMsg.Message.Attributes), subMsg.Message.Data)
+}
+
+func beaconData(ctx context.Context, data []byte) (err error) {
+	defer func() { recordOutcome(ctx, "beacon", err) }()
+
+	var beaconMsg beaconMessage
+	if ok, err := decodePayload(ctx, "beacon", data, &beaconMsg); !ok {
+		return err
+	}
+	ctx = logging.With(ctx, logging.Fields{CorrelationID: beaconMsg.CorrelationID, UserIDHash: beaconMsg.UserIDHash})
+	if ctx, err = withTenant(ctx, beaconMsg.Tenant); err != nil {
+		// retrying cannot bring the tenant back
+		logging.Errorf(ctx, "drop message; %v", err)
+		return nil
+	}
+	projectID := projectIDOf(ctx)
+
+	beacons, err := loadBeacons()
+	if err != nil {
+		return err
+	}
+	spot, ok := beacons.Lookup(beaconMsg.HWID, beaconMsg.Type)
+	if !ok {
+		logging.Printf(ctx, "skip beacon %s %s", beaconMsg.HWID, beaconMsg.Type)
+		return nil
+	}
+
+	c, err := cache.Open(ctx, cache.ConfigFromEnv())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	key := "beacon:" + beaconMsg.UserIDHash + ":" + beaconMsg.HWID
+	_, err = c.Get(ctx, key)
+	if err == nil {
+		logging.Printf(ctx, "skip beacon %s; greeted recently", beaconMsg.HWID)
+		return nil
+	}
+	if !errors.Is(err, cache.ErrMiss) {
+		return err
+	}
+
+	lineClient, err := newLineClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	if err := sendReply(ctx, lineClient, beacon.Compose(reply.NewBuilder(beaconMsg.ReplyToken), spot)); err != nil {
+		return err
+	}
+	cooldown := defaultBeaconCooldown
+	if d, err := time.ParseDuration(os.Getenv("BEACON_COOLDOWN")); err == nil && d > 0 {
+		cooldown = d
+	}
+	return c.Set(ctx, key, []byte(beaconMsg.Type), cooldown)
+}
@@ -0,0 +1,79 @@
+package beacon
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+)
+
+// LINE beacon event types.
+const (
+	EventEnter  = "enter"
+	EventBanner = "banner"
+	EventStay   = "stay"
+)
+
+// Spot is the content sent to users near one beacon.
+type Spot struct {
+	Name      string  `json:"name"`
+	Text      string  `json:"text"`
+	ImageURL  string  `json:"imageUrl,omitempty"`
+	Address   string  `json:"address,omitempty"`
+	Latitude  float64 `json:"latitude,omitempty"`
+	Longitude float64 `json:"longitude,omitempty"`
+	// Events lists the beacon event types answered, enter and banner when
+	// empty.
+	Events []string `json:"events,omitempty"`
+}
+
+// Config maps beacon hardware IDs to their spots.
+type Config map[string]Spot
+
+func ParseConfig(b []byte) (Config, error) {
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	for hwid, spot := range cfg {
+		if spot.Text == "" {
+			return nil, fmt.Errorf("beacon %s has no text", hwid)
+		}
+	}
+	return cfg, nil
+}
+
+// Lookup returns the spot of the beacon if it answers eventType.
+func (c Config) Lookup(hwid, eventType string) (Spot, bool) {
+	spot, ok := c[hwid]
+	if !ok {
+		return Spot{}, false
+	}
+	events := spot.Events
+	if len(events) == 0 {
+		events = []string{EventEnter, EventBanner}
+	}
+	for _, event := range events {
+		if event == eventType {
+			return spot, true
+		}
+	}
+	return Spot{}, false
+}
+
+// Compose adds the messages for spot to builder: the text, then the image
+// and the location when the spot has them.
+func Compose(builder *reply.Builder, spot Spot) *reply.Builder {
+	builder.Text(spot.Text)
+	if spot.ImageURL != "" {
+		builder.Image(spot.ImageURL, spot.ImageURL)
+	}
+	if spot.Latitude != 0 || spot.Longitude != 0 {
+		title := spot.Name
+		if title == "" {
+			title = "Here"
+		}
+		builder.Location(title, spot.Address, spot.Latitude, spot.Longitude)
+	}
+	return builder
+}
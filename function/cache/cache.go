@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrMiss is returned by Get for absent or expired keys.
+var ErrMiss = errors.New("cache miss")
+
+// Cache is a key value store with expiry for short lived state such as
+// duplicate detection indexes and sessions.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores value for ttl; zero keeps it until deleted.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+	Close() error
+}
+
+// Config selects Redis (Memorystore) when RedisAddr is set and Firestore
+// otherwise.
+type Config struct {
+	ProjectID     string
+	RedisAddr     string
+	RedisPassword string
+	RedisTLS      bool
+	// RedisCACert is the path of the PEM server CA Memorystore issues for
+	// in-transit encryption. The system pool is used when empty.
+	RedisCACert string
+}
+
+func ConfigFromEnv() Config {
+	return Config{
+		ProjectID:     os.Getenv("PROJECT_ID"),
+		RedisAddr:     os.Getenv("REDIS_ADDR"),
+		RedisPassword: os.Getenv("REDIS_PASSWORD"),
+		RedisTLS:      os.Getenv("REDIS_TLS") == "true",
+		RedisCACert:   os.Getenv("REDIS_CA_CERT"),
+	}
+}
+
+func (cfg Config) Redis() bool {
+	return cfg.RedisAddr != ""
+}
+
+func Open(ctx context.Context, cfg Config) (Cache, error) {
+	if cfg.Redis() {
+		c, err := newRedis(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	c, err := newFirestore(ctx, cfg.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const collection = "cache"
+
+// entry documents expire through a Firestore TTL policy on expiresAt; Get
+// also checks it since the policy deletes lazily.
+type entry struct {
+	Value     []byte    `firestore:"value"`
+	ExpiresAt time.Time `firestore:"expiresAt,omitempty"`
+}
+
+type firestoreCache struct {
+	client *firestore.Client
+}
+
+func newFirestore(ctx context.Context, projectID string) (*firestoreCache, error) {
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return &firestoreCache{client: client}, nil
+}
+
+func (c *firestoreCache) doc(key string) *firestore.DocumentRef {
+	// document IDs cannot contain slashes
+	return c.client.Collection(namespace.Collection(collection)).Doc(url.PathEscape(key))
+}
+
+func (c *firestoreCache) Get(ctx context.Context, key string) ([]byte, error) {
+	snap, err := c.doc(key).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrMiss
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	var e entry
+	if err := snap.DataTo(&e); err != nil {
+		return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+	}
+	if !e.ExpiresAt.IsZero() && time.Now().After(e.ExpiresAt) {
+		return nil, ErrMiss
+	}
+	return e.Value, nil
+}
+
+func (c *firestoreCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	e := entry{Value: value}
+	if ttl > 0 {
+		e.ExpiresAt = time.Now().Add(ttl)
+	}
+	if _, err := c.doc(key).Set(ctx, e); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	return nil
+}
+
+func (c *firestoreCache) Delete(ctx context.Context, key string) error {
+	if _, err := c.doc(key).Delete(ctx); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Delete failed; %w", err)
+	}
+	return nil
+}
+
+// Close leaves the shared client open.
+func (c *firestoreCache) Close() error {
+	return nil
+}
@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/redis/go-redis/v9"
+)
+
+type redisCache struct {
+	client *redis.Client
+}
+
+func newRedis(cfg Config) (*redisCache, error) {
+	client, err := RedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &redisCache{client: client}, nil
+}
+
+// RedisClient connects to the configured Redis for callers that need more
+// than the Cache operations; they put their keys through namespace.Key.
+func RedisClient(cfg Config) (*redis.Client, error) {
+	opts := &redis.Options{
+		Addr:     cfg.RedisAddr,
+		Password: cfg.RedisPassword,
+	}
+	if cfg.RedisTLS {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if cfg.RedisCACert != "" {
+			pem, err := os.ReadFile(cfg.RedisCACert)
+			if err != nil {
+				return nil, fmt.Errorf("os.ReadFile failed; %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate in %s", cfg.RedisCACert)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		opts.TLSConfig = tlsConfig
+	}
+	return redis.NewClient(opts), nil
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := c.client.Get(ctx, namespace.Key(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrMiss
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis.Client.Get failed; %w", err)
+	}
+	return value, nil
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := c.client.Set(ctx, namespace.Key(key), value, ttl).Err(); err != nil {
+		return fmt.Errorf("redis.Client.Set failed; %w", err)
+	}
+	return nil
+}
+
+func (c *redisCache) Delete(ctx context.Context, key string) error {
+	if err := c.client.Del(ctx, namespace.Key(key)).Err(); err != nil {
+		return fmt.Errorf("redis.Client.Del failed; %w", err)
+	}
+	return nil
+}
+
+func (c *redisCache) Close() error {
+	return c.client.Close()
+}
@@ -0,0 +1,255 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/lineapi"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+	"github.com/hsmtkk/ubiquitous-couscous/function/taxonomy"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	campaignAudiencePending = "audiencePending"
+	campaignSending         = "sending"
+	campaignDone            = "done"
+	campaignFailed          = "failed"
+)
+
+// campaign is a narrowcast to the users whose images fell into a taxonomy
+// category, stored in campaigns/{id} while it moves through LINE's
+// asynchronous audience creation and delivery.
+type campaign struct {
+	ID              string    `firestore:"-" json:"id"`
+	Category        string    `firestore:"category" json:"category"`
+	Text            string    `firestore:"text" json:"text"`
+	Status          string    `firestore:"status" json:"status"`
+	AudienceGroupID int64     `firestore:"audienceGroupId" json:"audienceGroupId"`
+	Recipients      int       `firestore:"recipients" json:"recipients"`
+	RequestID       string    `firestore:"requestId" json:"requestId,omitempty"`
+	Phase           string    `firestore:"phase" json:"phase,omitempty"`
+	SuccessCount    int64     `firestore:"successCount" json:"successCount"`
+	FailureCount    int64     `firestore:"failureCount" json:"failureCount"`
+	Error           string    `firestore:"error" json:"error,omitempty"`
+	CreatedAt       time.Time `firestore:"createdAt" json:"createdAt"`
+	UpdatedAt       time.Time `firestore:"updatedAt" json:"updatedAt"`
+}
+
+type campaignRequest struct {
+	Category string `json:"category"`
+	Text     string `json:"text"`
+}
+
+// campaignsEnabled also decides whether receive keeps the raw LINE user IDs
+// audiences are built from.
+func campaignsEnabled(ctx context.Context) bool {
+	return dynconfig.Get(ctx, "CAMPAIGNS") == "true"
+}
+
+// rememberUser keeps the LINE user ID next to its hash, for users who
+// allowed recording. It is only read to build audiences and never logged.
+func rememberUser(ctx context.Context, projectID, userIDHash, userID string) error {
+	if !recordingAllowedFor(ctx, userIDHash) {
+		return nil
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	return savePreference(ctx, client, userIDHash, "lineUserId", userID)
+}
+
+// campaignHandler starts a campaign on POST and, on GET ?id=, moves it on
+// as far as LINE allows and reports where it stands; an operator or a
+// scheduler polls until the status is done or failed.
+func campaignHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "campaign"})
+	logging.Printf(ctx, "campaign")
+
+	ctx, err := requestTenant(ctx, r)
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	projectID := projectIDOf(ctx)
+
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	accessToken, err := channelAccessToken(ctx, projectID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	endpoints, err := lineEndpoints(ctx)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	narrowcaster := lineapi.NewNarrowcaster(accessToken, endpoints)
+
+	var c campaign
+	switch r.Method {
+	case http.MethodPost:
+		var req campaignRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			returnError(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Category == "" || req.Category == taxonomy.Other || req.Text == "" {
+			returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("category and text are required"))
+			return
+		}
+		c, err = startCampaign(ctx, client, narrowcaster, req)
+	case http.MethodGet:
+		c, err = advanceCampaign(ctx, client, narrowcaster, r.URL.Query().Get("id"))
+	default:
+		returnError(ctx, w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+func startCampaign(ctx context.Context, client *firestore.Client, narrowcaster lineapi.Narrowcaster, req campaignRequest) (campaign, error) {
+	userIDs, err := segmentUserIDs(ctx, client, req.Category)
+	if err != nil {
+		return campaign{}, err
+	}
+	logging.Printf(ctx, "segment %s: %d users", req.Category, len(userIDs))
+	if len(userIDs) > lineapi.MaxAudienceUpload {
+		logging.Warnf(ctx, "segment truncated to %d users", lineapi.MaxAudienceUpload)
+		userIDs = userIDs[:lineapi.MaxAudienceUpload]
+	}
+	now := time.Now()
+	c := campaign{Category: req.Category, Text: req.Text, Status: campaignAudiencePending, Recipients: len(userIDs), CreatedAt: now, UpdatedAt: now}
+	if len(userIDs) == 0 {
+		c.Status = campaignDone
+	} else {
+		c.AudienceGroupID, err = narrowcaster.CreateAudience(ctx, "category "+req.Category, userIDs)
+		if err != nil {
+			return campaign{}, err
+		}
+	}
+	ref, _, err := client.Collection(namespace.Collection("campaigns")).Add(ctx, c)
+	if err != nil {
+		return campaign{}, fmt.Errorf("firestore.CollectionRef.Add failed; %w", err)
+	}
+	c.ID = ref.ID
+	return c, nil
+}
+
+func advanceCampaign(ctx context.Context, client *firestore.Client, narrowcaster lineapi.Narrowcaster, id string) (campaign, error) {
+	if id == "" {
+		return campaign{}, fmt.Errorf("id is required")
+	}
+	ref := client.Collection(namespace.Collection("campaigns")).Doc(id)
+	snap, err := ref.Get(ctx)
+	if err != nil {
+		return campaign{}, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	var c campaign
+	if err := snap.DataTo(&c); err != nil {
+		return campaign{}, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+	}
+	c.ID = id
+
+	switch c.Status {
+	case campaignAudiencePending:
+		status, err := narrowcaster.AudienceStatus(ctx, c.AudienceGroupID)
+		if err != nil {
+			return campaign{}, err
+		}
+		switch status {
+		case lineapi.AudienceReady:
+			c.RequestID, err = narrowcaster.Narrowcast(ctx, c.AudienceGroupID, []reply.Message{reply.NewText(c.Text)})
+			if err != nil {
+				return campaign{}, err
+			}
+			c.Status = campaignSending
+		case lineapi.AudienceInProgress:
+		default:
+			c.Status = campaignFailed
+			c.Error = "audience " + status
+		}
+	case campaignSending:
+		progress, err := narrowcaster.NarrowcastProgress(ctx, c.RequestID)
+		if err != nil {
+			return campaign{}, err
+		}
+		c.Phase = progress.Phase
+		c.SuccessCount = progress.SuccessCount
+		c.FailureCount = progress.FailureCount
+		switch progress.Phase {
+		case "succeeded":
+			c.Status = campaignDone
+		case "failed":
+			c.Status = campaignFailed
+			c.Error = progress.FailedDescription
+		}
+	default:
+		return c, nil
+	}
+	c.UpdatedAt = time.Now()
+	if _, err := ref.Set(ctx, c); err != nil {
+		return campaign{}, fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	logging.Printf(ctx, "campaign %s: %s", id, c.Status)
+	return c, nil
+}
+
+// segmentUserIDs finds the users with an image record in category and
+// returns the LINE user IDs of those that receive has remembered.
+func segmentUserIDs(ctx context.Context, client *firestore.Client, category string) ([]string, error) {
+	iter := client.CollectionGroup(namespace.Collection("images")).Where("categories", "array-contains", category).Documents(ctx)
+	defer iter.Stop()
+	seen := map[string]bool{}
+	users := []*firestore.DocumentRef{}
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestore.DocumentIterator.Next failed; %w", err)
+		}
+		user := snap.Ref.Parent.Parent
+		if user == nil || seen[user.ID] {
+			continue
+		}
+		seen[user.ID] = true
+		users = append(users, user)
+	}
+	if len(users) == 0 {
+		return []string{}, nil
+	}
+	snaps, err := client.GetAll(ctx, users)
+	if err != nil {
+		return nil, fmt.Errorf("firestore.Client.GetAll failed; %w", err)
+	}
+	userIDs := []string{}
+	for _, snap := range snaps {
+		if !snap.Exists() {
+			continue
+		}
+		if userID, ok := snap.Data()["lineUserId"].(string); ok && userID != "" {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs, nil
+}
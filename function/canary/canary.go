@@ -0,0 +1,82 @@
+package canary
+
+import (
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config splits traffic between the primary analyzer and a candidate.
+// Percent of requests go to the candidate; in Shadow mode every request is
+// answered by the primary while the candidate runs alongside for comparison.
+type Config struct {
+	Percent int
+	Shadow  bool
+}
+
+// ConfigFromEnv reads CANARY_PERCENT (0-100) and CANARY_SHADOW=true.
+func ConfigFromEnv() Config {
+	return ConfigFrom(os.Getenv)
+}
+
+// ConfigFrom reads the settings of ConfigFromEnv through get.
+func ConfigFrom(get func(key string) string) Config {
+	percent, err := strconv.Atoi(get("CANARY_PERCENT"))
+	if err != nil || percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	return Config{Percent: percent, Shadow: get("CANARY_SHADOW") == "true"}
+}
+
+// Routed reports whether key falls into the candidate's share. The same key
+// always gets the same answer, so redeliveries of an event see one analyzer.
+func (cfg Config) Routed(key string) bool {
+	if cfg.Percent <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32()%100) < cfg.Percent
+}
+
+type Comparison struct {
+	Common        []string
+	OnlyPrimary   []string
+	OnlyCandidate []string
+	// Agreement is the Jaccard index of the two label sets, 1 when both are empty.
+	Agreement float64
+}
+
+// Compare matches labels case insensitively.
+func Compare(primary, candidate []string) Comparison {
+	candidates := map[string]bool{}
+	for _, label := range candidate {
+		candidates[strings.ToLower(label)] = true
+	}
+	var c Comparison
+	seen := map[string]bool{}
+	for _, label := range primary {
+		key := strings.ToLower(label)
+		seen[key] = true
+		if candidates[key] {
+			c.Common = append(c.Common, label)
+		} else {
+			c.OnlyPrimary = append(c.OnlyPrimary, label)
+		}
+	}
+	for _, label := range candidate {
+		if !seen[strings.ToLower(label)] {
+			c.OnlyCandidate = append(c.OnlyCandidate, label)
+		}
+	}
+	union := len(c.Common) + len(c.OnlyPrimary) + len(c.OnlyCandidate)
+	c.Agreement = 1
+	if union > 0 {
+		c.Agreement = float64(len(c.Common)) / float64(union)
+	}
+	return c
+}
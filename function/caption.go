@@ -0,0 +1,317 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/costguard"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/imageutil"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	defaultCaptionModel     = "gemini-1.5-flash"
+	defaultCaptionMaxTokens = 256
+	defaultCaptionSafety    = "BLOCK_MEDIUM_AND_ABOVE"
+	// Gemini bills an image as this many input tokens
+	captionImageTokens = 258
+)
+
+// captionPrompts are the prompt templates a workflow step picks with the
+// "prompt" param; they get the user's .Language.
+var captionPrompts = map[string]*template.Template{
+	"short":    template.Must(template.New("short").Parse(`Describe this photo in one friendly sentence. Answer in the language with the code "{{.Language}}".`)),
+	"detailed": template.Must(template.New("detailed").Parse(`Describe this photo in at most three sentences: what is in it, where it might be and what is happening. Answer in the language with the code "{{.Language}}".`)),
+	"alt":      template.Must(template.New("alt").Parse(`Write alt text for this photo for a screen reader user, at most 125 characters. Answer in the language with the code "{{.Language}}".`)),
+}
+
+// captionUserPrompt replaces the "short" and "detailed" prompts for users
+// who chose a caption length or style with "/caption".
+var captionUserPrompt = template.Must(template.New("user").Parse(`Describe this photo in {{.Length}}. {{.Style}} Answer in the language with the code "{{.Language}}".`))
+
+const (
+	defaultCaptionLength = "medium"
+	defaultCaptionStyle  = "factual"
+)
+
+type captionLength struct {
+	Prompt    string
+	MaxTokens int
+	// MaxRunes is enforced on the answer, models do not always keep to
+	// the prompt.
+	MaxRunes int
+}
+
+var captionLengths = map[string]captionLength{
+	"short":  {Prompt: "one short sentence", MaxTokens: 64, MaxRunes: 120},
+	"medium": {Prompt: "two or three sentences", MaxTokens: 160, MaxRunes: 400},
+	"long":   {Prompt: "one paragraph of at most six sentences", MaxTokens: 320, MaxRunes: 900},
+}
+
+var captionStyles = map[string]string{
+	"factual": "Keep to what can be seen, plainly and without guessing.",
+	"poetic":  "Write it evocatively, with imagery and rhythm, like a short prose poem.",
+}
+
+var captionHarmCategories = []string{
+	"HARM_CATEGORY_HATE_SPEECH",
+	"HARM_CATEGORY_DANGEROUS_CONTENT",
+	"HARM_CATEGORY_HARASSMENT",
+	"HARM_CATEGORY_SEXUALLY_EXPLICIT",
+}
+
+type generateRequest struct {
+	Contents         []generateContent `json:"contents"`
+	GenerationConfig generationConfig  `json:"generationConfig"`
+	SafetySettings   []safetySetting   `json:"safetySettings"`
+}
+
+type generateContent struct {
+	Role  string         `json:"role"`
+	Parts []generatePart `json:"parts"`
+}
+
+type generatePart struct {
+	Text       string      `json:"text,omitempty"`
+	InlineData *inlineData `json:"inlineData,omitempty"`
+}
+
+type inlineData struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type generationConfig struct {
+	MaxOutputTokens int     `json:"maxOutputTokens"`
+	Temperature     float64 `json:"temperature"`
+}
+
+type safetySetting struct {
+	Category  string `json:"category"`
+	Threshold string `json:"threshold"`
+}
+
+type generateResponse struct {
+	Candidates []struct {
+		Content      generateContent `json:"content"`
+		FinishReason string          `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata struct {
+		TotalTokenCount int64 `json:"totalTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+// captionStep asks a Vertex AI multimodal model for a caption, used as the
+// summary. Any failure, the daily token budget (CAPTION_DAILY_TOKENS)
+// included, is only logged; the workflow then falls back to labels with the
+// "captioned" condition.
+func captionStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	name := params["prompt"]
+	if name == "" {
+		name = "short"
+	}
+	prompt, ok := captionPrompts[name]
+	if !ok {
+		return fmt.Errorf("unknown caption prompt; %s", name)
+	}
+	maxTokens := defaultCaptionMaxTokens
+	if value := params["maxTokens"]; value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid maxTokens; %s", value)
+		}
+		maxTokens = n
+	}
+	lang, err := userLanguage(ctx, state.projectID, state.procMsg.UserIDHash)
+	if err != nil {
+		return err
+	}
+	data := struct{ Language, Length, Style string }{Language: lang}
+	maxRunes := 0
+	if (state.captionLength != "" || state.captionStyle != "") && (name == "short" || name == "detailed") {
+		length, ok := captionLengths[state.captionLength]
+		if !ok {
+			length = captionLengths[defaultCaptionLength]
+		}
+		style, ok := captionStyles[state.captionStyle]
+		if !ok {
+			style = captionStyles[defaultCaptionStyle]
+		}
+		prompt, data.Length, data.Style = captionUserPrompt, length.Prompt, style
+		maxTokens, maxRunes = length.MaxTokens, length.MaxRunes
+	}
+	var buf bytes.Buffer
+	if err := prompt.Execute(&buf, data); err != nil {
+		return fmt.Errorf("template.Execute failed; %w", err)
+	}
+
+	caption, err := generateCaption(ctx, state.projectID, state.image, buf.String(), maxTokens)
+	if err != nil {
+		logging.Warnf(ctx, "caption failed, falling back to labels; %v", err)
+		return nil
+	}
+	if maxRunes > 0 {
+		caption = fitCaption(caption, maxRunes)
+	}
+	state.summary = caption
+	state.captioned = true
+	return nil
+}
+
+func generateCaption(ctx context.Context, projectID string, image []byte, prompt string, maxTokens int) (string, error) {
+	var budget int64
+	if value := dynconfig.Get(ctx, "CAPTION_DAILY_TOKENS"); value != "" {
+		var err error
+		if budget, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return "", fmt.Errorf("invalid CAPTION_DAILY_TOKENS; %w", err)
+		}
+	}
+	// reserve the most the call can cost; a prompt token is about 4 bytes
+	estimate := int64(captionImageTokens + len(prompt)/4 + maxTokens)
+	if err := reserveTokens(ctx, projectID, budget, estimate); err != nil {
+		return "", err
+	}
+
+	threshold := dynconfig.Get(ctx, "CAPTION_SAFETY_THRESHOLD")
+	if threshold == "" {
+		threshold = defaultCaptionSafety
+	}
+	safety := make([]safetySetting, len(captionHarmCategories))
+	for i, category := range captionHarmCategories {
+		safety[i] = safetySetting{Category: category, Threshold: threshold}
+	}
+	body, err := json.Marshal(generateRequest{
+		Contents: []generateContent{{
+			Role: "user",
+			Parts: []generatePart{
+				{InlineData: &inlineData{MimeType: imageutil.ContentType(image), Data: base64.StdEncoding.EncodeToString(image)}},
+				{Text: prompt},
+			},
+		}},
+		GenerationConfig: generationConfig{MaxOutputTokens: maxTokens, Temperature: 0.4},
+		SafetySettings:   safety,
+	})
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal failed; %w", err)
+	}
+
+	model := dynconfig.Get(ctx, "CAPTION_MODEL")
+	if model == "" {
+		model = defaultCaptionModel
+	}
+	location := os.Getenv("VERTEX_LOCATION")
+	if location == "" {
+		location = "us-central1"
+	}
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return "", fmt.Errorf("google.DefaultClient failed; %w", err)
+	}
+	url := fmt.Sprintf("https://%s-aiplatform.googleapis.com/v1/projects/%s/locations/%s/publishers/google/models/%s:generateContent", location, projectID, location, model)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("http.Client.Do failed; %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vertex generateContent failed; %d %s", resp.StatusCode, respBody)
+	}
+	var genResp generateResponse
+	if err := json.Unmarshal(respBody, &genResp); err != nil {
+		return "", fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	logging.Printf(ctx, "caption tokens: %d", genResp.UsageMetadata.TotalTokenCount)
+	if len(genResp.Candidates) == 0 {
+		return "", errors.New("no caption candidates")
+	}
+	candidate := genResp.Candidates[0]
+	if candidate.FinishReason == "SAFETY" {
+		return "", errors.New("caption blocked by safety settings")
+	}
+	var texts []string
+	for _, part := range candidate.Content.Parts {
+		texts = append(texts, part.Text)
+	}
+	caption := strings.TrimSpace(strings.Join(texts, ""))
+	if caption == "" {
+		return "", errors.New("empty caption")
+	}
+	return caption, nil
+}
+
+// fitCaption cuts caption to at most maxRunes, at the end of a sentence when
+// one ends in the second half, with an ellipsis otherwise.
+func fitCaption(caption string, maxRunes int) string {
+	runes := []rune(caption)
+	if len(runes) <= maxRunes {
+		return caption
+	}
+	runes = runes[:maxRunes]
+	for i := len(runes) - 1; i >= maxRunes/2; i-- {
+		if strings.ContainsRune(".!?。！？", runes[i]) {
+			return string(runes[:i+1])
+		}
+	}
+	return strings.TrimSpace(string(runes[:maxRunes-1])) + "…"
+}
+
+// chooseCaption handles "/caption <length or style>" and returns the text
+// answering it; "/caption off" goes back to the prompt of the workflow.
+func chooseCaption(ctx context.Context, client *firestore.Client, userIDHash, choice string) (string, error) {
+	_, isLength := captionLengths[choice]
+	_, isStyle := captionStyles[choice]
+	switch {
+	case choice == "off":
+		for _, field := range []string{"captionLength", "captionStyle"} {
+			if err := savePreference(ctx, client, userIDHash, field, ""); err != nil {
+				return "", err
+			}
+		}
+		return "Captions are back to the default length and style.", nil
+	case isLength:
+		if err := savePreference(ctx, client, userIDHash, "captionLength", choice); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Captions are now %s.", choice), nil
+	case isStyle:
+		if err := savePreference(ctx, client, userIDHash, "captionStyle", choice); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Captions are now %s.", choice), nil
+	}
+	return "Choose with /caption and a length (short, medium, long), a style (factual, poetic) or off.", nil
+}
+
+func reserveTokens(ctx context.Context, projectID string, budget, tokens int64) error {
+	if budget <= 0 {
+		return nil
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	return costguard.NewFor(client, "captionUsage", budget).Reserve(ctx, tokens)
+}
@@ -0,0 +1,192 @@
+// Package cas names archived images by the SHA-256 of their bytes, so that an
+// image sent repeatedly is stored once, and keeps the index from messages to
+// those names.
+package cas
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Prefix is where the blobs live in the bucket.
+	Prefix     = "sha256/"
+	Collection = "archiveIndex"
+)
+
+// Hash is the hex SHA-256 of b.
+func Hash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Name is the object name of the blob with hash, fanned out by its first
+// two bytes: sha256/ab/cd/abcd...
+func Name(hash string) string {
+	if len(hash) < 4 {
+		return Prefix + hash
+	}
+	return fmt.Sprintf("%s%s/%s/%s", Prefix, hash[:2], hash[2:4], hash)
+}
+
+// Entry maps one message to the blob of its image.
+type Entry struct {
+	UserIDHash string   `firestore:"userIdHash"`
+	ImageID    string   `firestore:"imageId"`
+	Hash       string   `firestore:"hash"`
+	Moderation string   `firestore:"moderation"`
+	Labels     []string `firestore:"labels"`
+	Categories []string `firestore:"categories"`
+	// SearchLabels are Labels in lower case, for Search.
+	SearchLabels []string  `firestore:"searchLabels"`
+	CreatedAt    time.Time `firestore:"createdAt"`
+}
+
+// Name is the object name of the blob of the entry.
+func (e Entry) Name() string {
+	return Name(e.Hash)
+}
+
+// Index keeps an Entry per message on archiveIndex/{userIdHash}_{imageId}.
+type Index struct {
+	client *firestore.Client
+}
+
+func NewIndex(client *firestore.Client) *Index {
+	return &Index{client: client}
+}
+
+func (x *Index) collection() *firestore.CollectionRef {
+	return x.client.Collection(namespace.Collection(Collection))
+}
+
+func (x *Index) doc(userIDHash, imageID string) *firestore.DocumentRef {
+	return x.collection().Doc(userIDHash + "_" + imageID)
+}
+
+func (x *Index) Put(ctx context.Context, e Entry) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	e.SearchLabels = make([]string, len(e.Labels))
+	for i, label := range e.Labels {
+		e.SearchLabels[i] = strings.ToLower(label)
+	}
+	if _, err := x.doc(e.UserIDHash, e.ImageID).Set(ctx, e); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	return nil
+}
+
+// Get returns the entry of the message, nil when its image was archived
+// before the index existed or not at all.
+func (x *Index) Get(ctx context.Context, userIDHash, imageID string) (*Entry, error) {
+	snap, err := x.doc(userIDHash, imageID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	var e Entry
+	if err := snap.DataTo(&e); err != nil {
+		return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+	}
+	return &e, nil
+}
+
+// Forget removes the entry of the message and returns the hash of its blob
+// when no other entry refers to it any more, for the caller to delete; ""
+// otherwise.
+func (x *Index) Forget(ctx context.Context, userIDHash, imageID string) (string, error) {
+	orphan := ""
+	err := x.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		orphan = ""
+		ref := x.doc(userIDHash, imageID)
+		snap, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("firestore.Transaction.Get failed; %w", err)
+		}
+		var e Entry
+		if err := snap.DataTo(&e); err != nil {
+			return fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+		}
+		refs, err := tx.Documents(x.collection().Where("hash", "==", e.Hash).Limit(2)).GetAll()
+		if err != nil {
+			return fmt.Errorf("firestore.DocumentIterator.GetAll failed; %w", err)
+		}
+		shared := false
+		for _, s := range refs {
+			if s.Ref.ID != ref.ID {
+				shared = true
+			}
+		}
+		if !shared {
+			orphan = e.Hash
+		}
+		return tx.Delete(ref)
+	})
+	if err != nil {
+		return "", fmt.Errorf("firestore.Client.RunTransaction failed; %w", err)
+	}
+	return orphan, nil
+}
+
+// Referenced reports whether any entry refers to the blob with hash.
+func (x *Index) Referenced(ctx context.Context, hash string) (bool, error) {
+	snaps, err := x.collection().Where("hash", "==", hash).Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		return false, fmt.Errorf("firestore.DocumentIterator.GetAll failed; %w", err)
+	}
+	return len(snaps) > 0, nil
+}
+
+// Entries returns the entries of the user.
+func (x *Index) Entries(ctx context.Context, userIDHash string) ([]Entry, error) {
+	return x.all(ctx, x.collection().Where("userIdHash", "==", userIDHash))
+}
+
+// Search returns up to n entries of the user labeled label, or in the
+// category when category is set, newest first. It relies on the composite
+// indexes on userIdHash, searchLabels or categories, and createdAt.
+func (x *Index) Search(ctx context.Context, userIDHash, label string, category bool, n int) ([]Entry, error) {
+	field, value := "searchLabels", strings.ToLower(label)
+	if category {
+		field = "categories"
+	}
+	q := x.collection().Where("userIdHash", "==", userIDHash).Where(field, "array-contains", value).OrderBy("createdAt", firestore.Desc).Limit(n)
+	return x.all(ctx, q)
+}
+
+// Before returns up to n entries created before cutoff.
+func (x *Index) Before(ctx context.Context, cutoff time.Time, n int) ([]Entry, error) {
+	return x.all(ctx, x.collection().Where("createdAt", "<", cutoff).Limit(n))
+}
+
+func (x *Index) all(ctx context.Context, q firestore.Query) ([]Entry, error) {
+	snaps, err := q.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("firestore.DocumentIterator.GetAll failed; %w", err)
+	}
+	entries := make([]Entry, 0, len(snaps))
+	for _, snap := range snaps {
+		var e Entry
+		if err := snap.DataTo(&e); err != nil {
+			return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
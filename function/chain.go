@@ -0,0 +1,205 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cas"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+)
+
+const (
+	chainCache  = "cache"
+	chainVertex = "vertex"
+	chainVision = "vision"
+
+	defaultChainTimeout = 10 * time.Second
+	chainCacheTTL       = 24 * time.Hour
+)
+
+var errChainCacheMiss = errors.New("not cached")
+
+// chainStep is one analyzer of the chain and when to move on from it.
+type chainStep struct {
+	analyzer analyzer
+	timeout  time.Duration
+	// minConfidence is the top label score below which the next step is
+	// tried; zero accepts any labels.
+	minConfidence float32
+}
+
+// chainAnalyzer tries its steps in order until one answers confidently.
+// When none does, the most confident answer is used, and the error of the
+// last step only when no step answered at all.
+type chainAnalyzer struct {
+	steps []chainStep
+	cache *cacheAnalyzer
+}
+
+// parseAnalyzerChain reads ANALYZER_CHAIN, a comma separated list of
+// name[:timeout[:minConfidence]] with names cache, vertex and vision, e.g.
+// "cache,vertex:5s:0.7,vision:10s".
+func parseAnalyzerChain(spec string, minScore float32) (*chainAnalyzer, error) {
+	chain := &chainAnalyzer{}
+	for _, item := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		step := chainStep{timeout: defaultChainTimeout}
+		switch parts[0] {
+		case chainCache:
+			chain.cache = &cacheAnalyzer{minScore: minScore}
+			step.analyzer = chain.cache
+		case chainVertex:
+			candidate := candidateAnalyzer()
+			if candidate == nil {
+				return nil, fmt.Errorf("vertex in ANALYZER_CHAIN needs VERTEX_ENDPOINT")
+			}
+			step.analyzer = candidate
+		case chainVision:
+			step.analyzer = visionAnalyzer{minScore: minScore}
+		default:
+			return nil, fmt.Errorf("unknown analyzer in ANALYZER_CHAIN; %q", parts[0])
+		}
+		if len(parts) > 1 && parts[1] != "" {
+			d, err := time.ParseDuration(parts[1])
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid timeout in ANALYZER_CHAIN; %q", item)
+			}
+			step.timeout = d
+		}
+		if len(parts) > 2 {
+			v, err := strconv.ParseFloat(parts[2], 32)
+			if err != nil || v < 0 || v > 1 {
+				return nil, fmt.Errorf("invalid confidence in ANALYZER_CHAIN; %q", item)
+			}
+			step.minConfidence = float32(v)
+		}
+		chain.steps = append(chain.steps, step)
+	}
+	return chain, nil
+}
+
+// primaryAnalyzer is the chain of ANALYZER_CHAIN, or Vision alone without
+// one or when it does not parse.
+func primaryAnalyzer(ctx context.Context, minScore float32) analyzer {
+	spec := dynconfig.Get(ctx, "ANALYZER_CHAIN")
+	if spec == "" {
+		return visionAnalyzer{minScore: minScore}
+	}
+	chain, err := parseAnalyzerChain(spec, minScore)
+	if err != nil {
+		logging.Errorf(ctx, "analyzer chain ignored; %v", err)
+		return visionAnalyzer{minScore: minScore}
+	}
+	return chain
+}
+
+func (a *chainAnalyzer) Name() string {
+	return "chain"
+}
+
+func (a *chainAnalyzer) Labels(ctx context.Context, image []byte) ([]analysis.Label, error) {
+	var best []analysis.Label
+	var bestScore float32 = -1
+	var lastErr error
+	for i, step := range a.steps {
+		name := step.analyzer.Name()
+		start := time.Now()
+		stepCtx, cancel := context.WithTimeout(ctx, step.timeout)
+		labels, err := step.analyzer.Labels(stepCtx, image)
+		cancel()
+		elapsed := time.Since(start).Milliseconds()
+		if err != nil {
+			logging.Printf(ctx, "analyzer chain: %s failed in %dms; %v", name, elapsed, err)
+			lastErr = err
+			continue
+		}
+		score := topScore(labels)
+		if len(labels) == 0 || score < step.minConfidence {
+			logging.Printf(ctx, "analyzer chain: %s low confidence in %dms; %.2f < %.2f", name, elapsed, score, step.minConfidence)
+			if score > bestScore {
+				best, bestScore = labels, score
+			}
+			continue
+		}
+		logging.Printf(ctx, "analyzer chain: %s answered in %dms after %d step(s); confidence %.2f", name, elapsed, i+1, score)
+		if a.cache != nil && step.analyzer != a.cache {
+			a.cache.store(ctx, image, labels)
+		}
+		return labels, nil
+	}
+	if best != nil {
+		logging.Printf(ctx, "analyzer chain: no confident answer, using the best at %.2f", bestScore)
+		return best, nil
+	}
+	return nil, fmt.Errorf("analyzer chain exhausted; %w", lastErr)
+}
+
+func topScore(labels []analysis.Label) float32 {
+	var top float32
+	for _, label := range labels {
+		if label.Score > top {
+			top = label.Score
+		}
+	}
+	return top
+}
+
+// cacheAnalyzer answers with the labels an earlier step of the chain found
+// for the same bytes, within chainCacheTTL.
+type cacheAnalyzer struct {
+	minScore float32
+}
+
+func (a *cacheAnalyzer) key(image []byte) string {
+	return fmt.Sprintf("labels:%s:%.2f", cas.Hash(image), a.minScore)
+}
+
+func (a *cacheAnalyzer) Name() string {
+	return chainCache
+}
+
+func (a *cacheAnalyzer) Labels(ctx context.Context, image []byte) ([]analysis.Label, error) {
+	c, err := cache.Open(ctx, cache.ConfigFromEnv())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	value, err := c.Get(ctx, a.key(image))
+	if errors.Is(err, cache.ErrMiss) {
+		return nil, errChainCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	var labels []analysis.Label
+	if err := json.Unmarshal(value, &labels); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	return labels, nil
+}
+
+// store is only logged when it fails; the labels are answered anyway.
+func (a *cacheAnalyzer) store(ctx context.Context, image []byte, labels []analysis.Label) {
+	value, err := json.Marshal(labels)
+	if err != nil {
+		logging.Errorf(ctx, "json.Marshal failed; %v", err)
+		return
+	}
+	c, err := cache.Open(ctx, cache.ConfigFromEnv())
+	if err != nil {
+		logging.Errorf(ctx, "cache.Open failed; %v", err)
+		return
+	}
+	defer c.Close()
+	if err := c.Set(ctx, a.key(image), value, chainCacheTTL); err != nil {
+		logging.Errorf(ctx, "cache set failed; %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package function
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/channeltoken"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+)
+
+var (
+	tokenIssuersMu sync.Mutex
+	tokenIssuers   = map[string]*channeltoken.Issuer{}
+)
+
+// channelAccessToken is the token to call the Messaging API with. Channels
+// with LINE_CHANNEL_ID set get short-lived v2.1 tokens issued with the
+// channel-assertion-key secret, a JWK whose kid, or LINE_ASSERTION_KEY_ID,
+// is the key ID LINE returned when its public half was registered; others
+// use the long-lived channel-access-token secret.
+func channelAccessToken(ctx context.Context, projectID string) (string, error) {
+	channelID := tenantEnv(ctx, "LINE_CHANNEL_ID")
+	if channelID == "" {
+		return getSecret(ctx, projectID, "channel-access-token")
+	}
+	issuer, err := tokenIssuer(ctx, projectID, channelID)
+	if err != nil {
+		return "", err
+	}
+	return issuer.Token(ctx)
+}
+
+// tokenIssuer keeps an issuer per channel so that its token is only read
+// from Firestore again when it is about to expire.
+func tokenIssuer(ctx context.Context, projectID, channelID string) (*channeltoken.Issuer, error) {
+	key := projectID + "/" + channelID
+	tokenIssuersMu.Lock()
+	defer tokenIssuersMu.Unlock()
+	if issuer, ok := tokenIssuers[key]; ok {
+		return issuer, nil
+	}
+	jwk, err := getSecret(ctx, projectID, "channel-assertion-key")
+	if err != nil {
+		return nil, err
+	}
+	signingKey, err := channeltoken.ParseKey([]byte(jwk), tenantEnv(ctx, "LINE_ASSERTION_KEY_ID"))
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := lineEndpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	issuer := &channeltoken.Issuer{
+		ChannelID: channelID,
+		Key:       signingKey,
+		Endpoints: endpoints,
+		Store:     channeltoken.FirestoreStore{Client: client, ChannelID: channelID},
+	}
+	tokenIssuers[key] = issuer
+	return issuer, nil
+}
+
+// verifyChannelToken has LINE confirm the current token for the status page.
+func verifyChannelToken(ctx context.Context, projectID, channelID string) error {
+	issuer, err := tokenIssuer(ctx, projectID, channelID)
+	if err != nil {
+		return err
+	}
+	token, err := issuer.Token(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = issuer.Verify(ctx, token)
+	return err
+}
@@ -0,0 +1,226 @@
+// Package channeltoken issues channel access tokens v2.1: short-lived tokens
+// LINE hands out in exchange for a JWT signed with the channel's assertion
+// signing key, instead of a long-lived token kept as a secret.
+package channeltoken
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/lineapi"
+)
+
+const (
+	// DefaultLifetime is how long an issued token is valid; LINE allows up
+	// to 30 days.
+	DefaultLifetime = 24 * time.Hour
+	// DefaultRefreshBefore is how long before its expiry a token is replaced,
+	// longer than anyone holds on to a token it was handed.
+	DefaultRefreshBefore = time.Hour
+
+	// a JWT assertion may be valid for at most 30 minutes
+	assertionLifetime = 30 * time.Minute
+)
+
+// Token is an issued channel access token.
+type Token struct {
+	AccessToken string    `firestore:"accessToken"`
+	KeyID       string    `firestore:"keyId"`
+	ExpiresAt   time.Time `firestore:"expiresAt"`
+	IssuedAt    time.Time `firestore:"issuedAt"`
+}
+
+// Store shares the current token among instances, so that they do not each
+// issue their own; LINE limits the number of valid tokens per channel.
+type Store interface {
+	// Load returns the zero Token when none was saved.
+	Load(ctx context.Context) (Token, error)
+	Save(ctx context.Context, token Token) error
+}
+
+// Issuer hands out the current token of a channel and issues a new one when
+// it is about to expire.
+type Issuer struct {
+	ChannelID string
+	Key       Key
+	Endpoints lineapi.Endpoints
+	// Store may be nil to keep tokens in this instance only.
+	Store         Store
+	Lifetime      time.Duration
+	RefreshBefore time.Duration
+	HTTPClient    *http.Client
+
+	mu      sync.Mutex
+	current Token
+}
+
+// Token returns a token valid for at least RefreshBefore.
+func (i *Issuer) Token(ctx context.Context) (string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.fresh(i.current) {
+		return i.current.AccessToken, nil
+	}
+	if i.Store != nil {
+		token, err := i.Store.Load(ctx)
+		if err != nil {
+			return "", err
+		}
+		if i.fresh(token) {
+			i.current = token
+			return token.AccessToken, nil
+		}
+	}
+	token, err := i.Issue(ctx)
+	if err != nil {
+		return "", err
+	}
+	if i.Store != nil {
+		if err := i.Store.Save(ctx, token); err != nil {
+			return "", err
+		}
+	}
+	i.current = token
+	return token.AccessToken, nil
+}
+
+func (i *Issuer) fresh(token Token) bool {
+	return token.AccessToken != "" && time.Now().Add(i.refreshBefore()).Before(token.ExpiresAt)
+}
+
+func (i *Issuer) refreshBefore() time.Duration {
+	if i.RefreshBefore > 0 {
+		return i.RefreshBefore
+	}
+	return DefaultRefreshBefore
+}
+
+func (i *Issuer) httpClient() *http.Client {
+	if i.HTTPClient != nil {
+		return i.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Issue has LINE issue a new token, regardless of the current one.
+func (i *Issuer) Issue(ctx context.Context) (Token, error) {
+	lifetime := i.Lifetime
+	if lifetime <= 0 {
+		lifetime = DefaultLifetime
+	}
+	now := time.Now()
+	assertion, err := i.assertion(now, lifetime)
+	if err != nil {
+		return Token{}, err
+	}
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {assertion},
+	}
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		KeyID       string `json:"key_id"`
+	}
+	if err := i.call(ctx, http.MethodPost, i.Endpoints.API("oauth2", "v2.1", "token"), form, &resp); err != nil {
+		return Token{}, err
+	}
+	if resp.AccessToken == "" || resp.ExpiresIn <= 0 {
+		return Token{}, fmt.Errorf("no access token issued")
+	}
+	return Token{
+		AccessToken: resp.AccessToken,
+		KeyID:       resp.KeyID,
+		ExpiresAt:   now.Add(time.Duration(resp.ExpiresIn) * time.Second),
+		IssuedAt:    now,
+	}, nil
+}
+
+// Verify asks LINE whether accessToken is valid for this channel and how
+// long it remains so.
+func (i *Issuer) Verify(ctx context.Context, accessToken string) (time.Duration, error) {
+	u := i.Endpoints.API("oauth2", "v2.1", "verify")
+	u.RawQuery = url.Values{"access_token": {accessToken}}.Encode()
+	var resp struct {
+		ClientID  string `json:"client_id"`
+		ExpiresIn int64  `json:"expires_in"`
+	}
+	if err := i.call(ctx, http.MethodGet, u, nil, &resp); err != nil {
+		return 0, err
+	}
+	if resp.ClientID != i.ChannelID {
+		return 0, fmt.Errorf("token issued for channel %s", resp.ClientID)
+	}
+	if resp.ExpiresIn <= 0 {
+		return 0, fmt.Errorf("token expired")
+	}
+	return time.Duration(resp.ExpiresIn) * time.Second, nil
+}
+
+// assertion is the JWT LINE exchanges for a token valid for lifetime.
+func (i *Issuer) assertion(now time.Time, lifetime time.Duration) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": i.Key.ID})
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal failed; %w", err)
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":       i.ChannelID,
+		"sub":       i.ChannelID,
+		"aud":       "https://api.line.me/",
+		"exp":       now.Add(assertionLifetime).Unix(),
+		"token_exp": int64(lifetime / time.Second),
+	})
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal failed; %w", err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.Key.Private, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("rsa.SignPKCS1v15 failed; %w", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (i *Issuer) call(ctx context.Context, method string, u *url.URL, form url.Values, respBody interface{}) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := i.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("http.Client.Do failed; %w", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s failed; %d %s", method, u.Path, resp.StatusCode, b)
+	}
+	if err := json.Unmarshal(b, respBody); err != nil {
+		return fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package channeltoken
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// Key is the private half of the assertion signing key pair whose public
+// half is registered with the channel; ID is the kid LINE returned for it.
+type Key struct {
+	ID      string
+	Private *rsa.PrivateKey
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	D   string `json:"d"`
+	P   string `json:"p"`
+	Q   string `json:"q"`
+}
+
+// ParseKey reads an RSA private key in JWK form, as the LINE documentation
+// generates them. kid may be left out of the JWK and given as keyID instead.
+func ParseKey(b []byte, keyID string) (Key, error) {
+	var k jwk
+	if err := json.Unmarshal(b, &k); err != nil {
+		return Key{}, fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	if k.Kty != "RSA" || (k.Alg != "" && k.Alg != "RS256") {
+		return Key{}, fmt.Errorf("unsupported key; kty %s, alg %s", k.Kty, k.Alg)
+	}
+	if keyID == "" {
+		keyID = k.Kid
+	}
+	if keyID == "" {
+		return Key{}, fmt.Errorf("key ID is not set")
+	}
+	ints := map[string]*big.Int{}
+	for name, value := range map[string]string{"n": k.N, "e": k.E, "d": k.D, "p": k.P, "q": k.Q} {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(b) == 0 {
+			return Key{}, fmt.Errorf("invalid %s of the key", name)
+		}
+		ints[name] = new(big.Int).SetBytes(b)
+	}
+	if !ints["e"].IsInt64() {
+		return Key{}, fmt.Errorf("invalid e of the key")
+	}
+	private := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: ints["n"], E: int(ints["e"].Int64())},
+		D:         ints["d"],
+		Primes:    []*big.Int{ints["p"], ints["q"]},
+	}
+	if err := private.Validate(); err != nil {
+		return Key{}, fmt.Errorf("rsa.PrivateKey.Validate failed; %w", err)
+	}
+	private.Precompute()
+	return Key{ID: keyID, Private: private}, nil
+}
@@ -0,0 +1,45 @@
+package channeltoken
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const Collection = "channelTokens"
+
+// FirestoreStore keeps the token of a channel on channelTokens/{channelId}.
+type FirestoreStore struct {
+	Client    *firestore.Client
+	ChannelID string
+}
+
+func (s FirestoreStore) ref() *firestore.DocumentRef {
+	return s.Client.Collection(namespace.Collection(Collection)).Doc(s.ChannelID)
+}
+
+func (s FirestoreStore) Load(ctx context.Context) (Token, error) {
+	var token Token
+	snap, err := s.ref().Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return token, nil
+	}
+	if err != nil {
+		return token, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	if err := snap.DataTo(&token); err != nil {
+		return token, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+	}
+	return token, nil
+}
+
+func (s FirestoreStore) Save(ctx context.Context, token Token) error {
+	if _, err := s.ref().Set(ctx, token); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/storage"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cas"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/completion"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/slo"
+	"github.com/hsmtkk/ubiquitous-couscous/function/spam"
+	"github.com/hsmtkk/ubiquitous-couscous/function/visionresult"
+	"google.golang.org/api/iterator"
+)
+
+const cleanupBatchSize = 200
+
+// retention reads RETENTION_DAYS_<NAME>, falling back to days.
+func retention(name string, days int) time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("RETENTION_DAYS_" + strings.ToUpper(name))); err == nil && n > 0 {
+		days = n
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// cleanup is invoked by Cloud Scheduler and deletes what outlived its
+// retention: duplicate detection records, interaction records, conversation
+// logs, reply intents, finished game rounds, expired cache entries, spam
+// flags and the objects written to Cloud Storage.
+// Bucket lifecycle rules may delete objects earlier; this does not rely on them.
+// A tenant gets its own job with the tenant query parameter.
+func cleanup(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "cleanup"})
+	logging.Printf(ctx, "cleanup")
+
+	ctx, err := requestTenant(ctx, r)
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	projectID := projectIDOf(ctx)
+	now := time.Now()
+
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+
+	queries := []struct {
+		name  string
+		query firestore.Query
+	}{
+		{"images", client.CollectionGroup(namespace.Collection("images")).Where("createdAt", "<", now.Add(-retention("images", 90)))},
+		{"conversations", client.CollectionGroup(namespace.Collection("items")).Where("at", "<", now.Add(-retention("conversations", 30)))},
+		{"imagemaps", client.CollectionGroup(namespace.Collection("imagemaps")).Where("createdAt", "<", now.Add(-retention("objects", 7)))},
+		{"interactions", client.Collection(namespace.Collection("interactions")).Where("repliedAt", "<", now.Add(-retention("interactions", 30)))},
+		{"cache", client.Collection(namespace.Collection("cache")).Where("expiresAt", "<", now)},
+		{"replyIntents", client.Collection(namespace.Collection("replyIntents")).Where("createdAt", "<", now.Add(-retention("replyIntents", 30)))},
+		{"deadLetters", client.Collection(namespace.Collection("deadLetters")).Where("at", "<", now.Add(-retention("deadLetters", 30)))},
+		{"completions", client.Collection(namespace.Collection(completion.Collection)).Where("completedAt", "<", now.Add(-retention("completions", 7)))},
+		{"sloWindows", client.Collection(namespace.Collection(slo.Collection)).Where("start", "<", now.Add(-retention("slo", 30)))},
+		{"spamFlags", client.Collection(namespace.Collection(spam.FlagsCollection)).Where("lastFlaggedAt", "<", now.Add(-retention("spamFlags", defaultSpamFlagDays)))},
+		{"spamImages", client.Collection(namespace.Collection(spam.ImagesCollection)).Where("lastSentAt", "<", now.Add(-spam.SharedImageWindow))},
+	}
+	report := []string{}
+	for _, q := range queries {
+		deleted, err := deleteQuery(ctx, client, q.name, q.query)
+		if err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		report = append(report, fmt.Sprintf("%s %d", q.name, deleted))
+	}
+
+	rounds, err := clearGameRounds(ctx, client, now.Add(-retention("games", 7)))
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	report = append(report, fmt.Sprintf("rounds %d", rounds))
+
+	archived, err := expireArchivedImages(ctx, client, tenantEnv(ctx, "ARCHIVE_BUCKET"), now.Add(-retention("archive", 365)))
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	report = append(report, fmt.Sprintf("archived images %d", archived))
+
+	for _, p := range cleanupPrefixes(ctx) {
+		if p.bucket == "" {
+			continue
+		}
+		deleted, err := deleteObjects(ctx, p.bucket, p.prefix, now.Add(-p.retention))
+		if err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		report = append(report, fmt.Sprintf("gs://%s/%s %d", p.bucket, p.prefix, deleted))
+	}
+
+	logging.Printf(ctx, "cleanup: %s", strings.Join(report, ", "))
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "deleted %s", strings.Join(report, ", "))
+}
+
+type cleanupPrefix struct {
+	bucket, prefix string
+	retention      time.Duration
+}
+
+// cleanupPrefixes lists the objects cleanup expires, in the buckets of the
+// tenant ctx is served for.
+func cleanupPrefixes(ctx context.Context) []cleanupPrefix {
+	game, annotation := tenantEnv(ctx, "GAME_BUCKET"), tenantEnv(ctx, "ANNOTATION_BUCKET")
+	dryRun, archive := tenantEnv(ctx, "DRY_RUN_BUCKET"), tenantEnv(ctx, "ARCHIVE_BUCKET")
+	return []cleanupPrefix{
+		{game, "games/", retention("objects", 7)},
+		{annotation, "annotated/", retention("objects", 7)},
+		{annotation, "imagemap/", retention("objects", 7)},
+		{annotation, "echo/", retention("objects", 7)},
+		{dryRun, "dry-run/", retention("objects", 7)},
+		{archive, "archive/", retention("archive", 365)},
+		{archive, "results/", retention("archive", 365)},
+		{archive, webhookArchivePrefix, retention("webhooks", 30)},
+		{archive, visionresult.Prefix, retention("archive", 365)},
+	}
+}
+
+// deleteQuery deletes the matching documents batch by batch, logging progress
+// so that a run cut short by the timeout still shows how far it got.
+func deleteQuery(ctx context.Context, client *firestore.Client, name string, q firestore.Query) (int, error) {
+	total := 0
+	for {
+		snaps, err := q.Limit(cleanupBatchSize).Documents(ctx).GetAll()
+		if err != nil {
+			return total, fmt.Errorf("firestore.DocumentIterator.GetAll failed; %w", err)
+		}
+		if len(snaps) == 0 {
+			return total, nil
+		}
+		batch := client.Batch()
+		for _, snap := range snaps {
+			batch.Delete(snap.Ref)
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return total, fmt.Errorf("firestore.WriteBatch.Commit failed; %w", err)
+		}
+		total += len(snaps)
+		logging.Printf(ctx, "cleanup %s: %d deleted", name, total)
+	}
+}
+
+// expireArchivedImages forgets the archived images of messages older than
+// cutoff. Blobs are not expired by their own age: a blob written long ago
+// may back a recent message.
+func expireArchivedImages(ctx context.Context, client *firestore.Client, bucket string, cutoff time.Time) (int, error) {
+	index := cas.NewIndex(client)
+	total := 0
+	for {
+		entries, err := index.Before(ctx, cutoff, cleanupBatchSize)
+		if err != nil {
+			return total, err
+		}
+		if len(entries) == 0 {
+			return total, nil
+		}
+		if _, err := forgetArchivedImages(ctx, client, bucket, entries); err != nil {
+			return total, err
+		}
+		total += len(entries)
+		logging.Printf(ctx, "cleanup archived images: %d deleted", total)
+	}
+}
+
+// clearGameRounds drops rounds nobody finished; the group and its scores stay.
+func clearGameRounds(ctx context.Context, client *firestore.Client, cutoff time.Time) (int, error) {
+	q := client.Collection(namespace.Collection("groups")).Where("round.startedAt", "<", cutoff)
+	total := 0
+	for {
+		snaps, err := q.Limit(cleanupBatchSize).Documents(ctx).GetAll()
+		if err != nil {
+			return total, fmt.Errorf("firestore.DocumentIterator.GetAll failed; %w", err)
+		}
+		if len(snaps) == 0 {
+			return total, nil
+		}
+		batch := client.Batch()
+		for _, snap := range snaps {
+			batch.Update(snap.Ref, []firestore.Update{{Path: "round", Value: firestore.Delete}})
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return total, fmt.Errorf("firestore.WriteBatch.Commit failed; %w", err)
+		}
+		total += len(snaps)
+		logging.Printf(ctx, "cleanup rounds: %d cleared", total)
+	}
+}
+
+func deleteObjects(ctx context.Context, bucket, prefix string, cutoff time.Time) (int, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("storage.NewClient failed; %w", err)
+	}
+	defer client.Close()
+	total := 0
+	iter := client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: namespace.Object(prefix)})
+	for {
+		attrs, err := iter.Next()
+		if err == iterator.Done {
+			return total, nil
+		}
+		if err != nil {
+			return total, fmt.Errorf("storage.ObjectIterator.Next failed; %w", err)
+		}
+		if !attrs.Created.Before(cutoff) {
+			continue
+		}
+		if err := client.Bucket(bucket).Object(attrs.Name).Delete(ctx); err != nil {
+			return total, fmt.Errorf("storage.ObjectHandle.Delete failed; %w", err)
+		}
+		total++
+		if total%cleanupBatchSize == 0 {
+			logging.Printf(ctx, "cleanup gs://%s/%s: %d deleted", bucket, prefix, total)
+		}
+	}
+}
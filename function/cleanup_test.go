@@ -0,0 +1,47 @@
+package function
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/tenant"
+)
+
+func TestCleanupPrefixesTenant(t *testing.T) {
+	t.Setenv("ARCHIVE_BUCKET", "own-archive")
+	t.Setenv("ANNOTATION_BUCKET", "own-annotation")
+	t.Setenv("GAME_BUCKET", "own-game")
+	t.Setenv("DRY_RUN_BUCKET", "")
+
+	acme := tenant.Config{ID: "acme", Destination: "U1", ProjectID: "acme-project", Env: map[string]string{
+		"ARCHIVE_BUCKET":    "acme-archive",
+		"ANNOTATION_BUCKET": "acme-annotation",
+	}}
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want map[string]string
+	}{
+		{"own", context.Background(), map[string]string{
+			"games/": "own-game", "annotated/": "own-annotation", "echo/": "own-annotation",
+			"dry-run/": "", "archive/": "own-archive", webhookArchivePrefix: "own-archive",
+		}},
+		{"tenant", tenant.WithContext(context.Background(), acme), map[string]string{
+			"games/": "own-game", "annotated/": "acme-annotation", "echo/": "acme-annotation",
+			"dry-run/": "", "archive/": "acme-archive", webhookArchivePrefix: "acme-archive",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string]string{}
+			for _, p := range cleanupPrefixes(tt.ctx) {
+				got[p.prefix] = p.bucket
+			}
+			for prefix, bucket := range tt.want {
+				if got[prefix] != bucket {
+					t.Errorf("bucket of %s = %q, want %q", prefix, got[prefix], bucket)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package clients
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/pubsub"
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/storage"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errReset = errors.New("client reset before use")
+
+// Lazy creates a client on first use and shares it with every later caller
+// of the instance. Handlers never close what Get returns; Reset does, after
+// which the next Get creates the client again.
+type Lazy[T any] struct {
+	name   string
+	create func(ctx context.Context, opts ...option.ClientOption) (T, error)
+	close  func(T) error
+
+	mu    sync.Mutex
+	state *lazyState[T]
+}
+
+type lazyState[T any] struct {
+	once  sync.Once
+	value T
+	err   error
+	// unavailable is set once a call of the client fails with Unavailable.
+	unavailable atomic.Bool
+}
+
+// NewLazy hands create the options that watch the calls of a Google API
+// client, so that Recover resets only a client whose own call failed. A
+// client that makes no gRPC calls ignores them.
+func NewLazy[T any](name string, create func(ctx context.Context, opts ...option.ClientOption) (T, error), close func(T) error) *Lazy[T] {
+	return &Lazy[T]{name: name, create: create, close: close}
+}
+
+func (l *Lazy[T]) current() *lazyState[T] {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.state == nil {
+		l.state = &lazyState[T]{}
+	}
+	return l.state
+}
+
+// Get returns the shared client. A failed creation is not kept; the next
+// Get tries again.
+func (l *Lazy[T]) Get(ctx context.Context) (T, error) {
+	s := l.current()
+	s.once.Do(func() {
+		// the client outlives the request that happens to create it
+		s.value, s.err = l.create(context.Background(), watch(&s.unavailable)...)
+		if s.err == nil {
+			logging.Printf(ctx, "%s client created", l.name)
+		}
+	})
+	if s.err != nil {
+		l.mu.Lock()
+		if l.state == s {
+			l.state = nil
+		}
+		l.mu.Unlock()
+		return s.value, s.err
+	}
+	return s.value, nil
+}
+
+// Warm creates the client in the background so that the first request does
+// not wait for it.
+func (l *Lazy[T]) Warm() {
+	go func() {
+		if _, err := l.Get(context.Background()); err != nil {
+			logging.Warnf(context.Background(), "warm %s client failed; %v", l.name, err)
+		}
+	}()
+}
+
+// Reset closes the current client. Calls still in flight on it fail, as
+// they most likely would have anyway.
+func (l *Lazy[T]) Reset(ctx context.Context) {
+	l.mu.Lock()
+	s := l.state
+	l.state = nil
+	l.mu.Unlock()
+	l.closeState(ctx, s)
+}
+
+// recover resets the client when one of its calls failed with Unavailable,
+// leaving a client created since alone.
+func (l *Lazy[T]) recover(ctx context.Context) {
+	l.mu.Lock()
+	s := l.state
+	if s == nil || !s.unavailable.Load() {
+		l.mu.Unlock()
+		return
+	}
+	l.state = nil
+	l.mu.Unlock()
+	l.closeState(ctx, s)
+}
+
+func (l *Lazy[T]) closeState(ctx context.Context, s *lazyState[T]) {
+	if s == nil {
+		return
+	}
+	// waits for a creation in progress, or makes sure none starts
+	s.once.Do(func() { s.err = errReset })
+	if s.err != nil {
+		return
+	}
+	if l.close != nil {
+		if err := l.close(s.value); err != nil {
+			logging.Errorf(ctx, "%s client close failed; %v", l.name, err)
+		}
+	}
+	logging.Printf(ctx, "%s client reset", l.name)
+}
+
+// Keyed is a Lazy per key, e.g. per project.
+type Keyed[T any] struct {
+	name   string
+	create func(ctx context.Context, key string, opts ...option.ClientOption) (T, error)
+	close  func(T) error
+
+	mu     sync.Mutex
+	lazies map[string]*Lazy[T]
+}
+
+func NewKeyed[T any](name string, create func(ctx context.Context, key string, opts ...option.ClientOption) (T, error), close func(T) error) *Keyed[T] {
+	return &Keyed[T]{name: name, create: create, close: close, lazies: map[string]*Lazy[T]{}}
+}
+
+func (k *Keyed[T]) lazy(key string) *Lazy[T] {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	l, ok := k.lazies[key]
+	if !ok {
+		create := func(ctx context.Context, opts ...option.ClientOption) (T, error) {
+			return k.create(ctx, key, opts...)
+		}
+		l = NewLazy(k.name, create, k.close)
+		k.lazies[key] = l
+	}
+	return l
+}
+
+func (k *Keyed[T]) Get(ctx context.Context, key string) (T, error) {
+	return k.lazy(key).Get(ctx)
+}
+
+func (k *Keyed[T]) Warm(key string) {
+	k.lazy(key).Warm()
+}
+
+func (k *Keyed[T]) all() []*Lazy[T] {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	lazies := make([]*Lazy[T], 0, len(k.lazies))
+	for _, l := range k.lazies {
+		lazies = append(lazies, l)
+	}
+	return lazies
+}
+
+func (k *Keyed[T]) Reset(ctx context.Context) {
+	for _, l := range k.all() {
+		l.Reset(ctx)
+	}
+}
+
+func (k *Keyed[T]) recover(ctx context.Context) {
+	for _, l := range k.all() {
+		l.recover(ctx)
+	}
+}
+
+var (
+	firestoreClients = NewKeyed("firestore", func(ctx context.Context, projectID string, opts ...option.ClientOption) (*firestore.Client, error) {
+		client, err := firestore.NewClient(ctx, projectID, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("firestore.NewClient failed; %w", err)
+		}
+		return client, nil
+	}, (*firestore.Client).Close)
+
+	secretManagerClient = NewLazy("secretmanager", func(ctx context.Context, opts ...option.ClientOption) (*secretmanager.Client, error) {
+		client, err := secretmanager.NewClient(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("secretmanager.NewClient failed; %w", err)
+		}
+		return client, nil
+	}, (*secretmanager.Client).Close)
+
+	pubsubClients = NewKeyed("pubsub", func(ctx context.Context, projectID string, opts ...option.ClientOption) (*pubsub.Client, error) {
+		client, err := pubsub.NewClient(ctx, projectID, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("pubsub.NewClient failed; %w", err)
+		}
+		return client, nil
+	}, (*pubsub.Client).Close)
+
+	// the storage client speaks JSON over HTTP, which watch cannot see
+	storageClient = NewLazy("storage", func(ctx context.Context, _ ...option.ClientOption) (*storage.Client, error) {
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("storage.NewClient failed; %w", err)
+		}
+		return client, nil
+	}, (*storage.Client).Close)
+)
+
+// Firestore returns the shared client of projectID.
+func Firestore(ctx context.Context, projectID string) (*firestore.Client, error) {
+	return firestoreClients.Get(ctx, projectID)
+}
+
+// SecretManager returns the shared Secret Manager client.
+func SecretManager(ctx context.Context) (*secretmanager.Client, error) {
+	return secretManagerClient.Get(ctx)
+}
+
+// PubSub returns the shared admin client of projectID. Publishing goes
+// through the topics package, whose queue keeps its own client.
+func PubSub(ctx context.Context, projectID string) (*pubsub.Client, error) {
+	return pubsubClients.Get(ctx, projectID)
+}
+
+// Storage returns the shared Cloud Storage client.
+func Storage(ctx context.Context) (*storage.Client, error) {
+	return storageClient.Get(ctx)
+}
+
+// Warm creates the clients every function needs for projectID in the
+// background, at instance start rather than on the first request.
+func Warm(projectID string) {
+	firestoreClients.Warm(projectID)
+	secretManagerClient.Warm()
+}
+
+// Recover resets the shared clients of this package whose own calls failed
+// with Unavailable when err, as returned by a handler, says that a
+// connection is broken. They are created again on their next use; the
+// healthy ones keep their connections.
+func Recover(ctx context.Context, err error) {
+	if !Broken(err) {
+		return
+	}
+	logging.Warnf(ctx, "recover clients; %v", err)
+	firestoreClients.recover(ctx)
+	secretManagerClient.recover(ctx)
+	pubsubClients.recover(ctx)
+}
+
+// Broken tells whether err, wrapped or not, is a gRPC error of a connection
+// that cannot serve calls any more.
+func Broken(err error) bool {
+	var s interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &s) {
+		return false
+	}
+	return s.GRPCStatus().Code() == codes.Unavailable
+}
+
+// watch returns the options of a client that set unavailable when one of
+// its calls, unary or streaming, fails with Unavailable.
+func watch(unavailable *atomic.Bool) []option.ClientOption {
+	note := func(err error) {
+		if Broken(err) {
+			unavailable.Store(true)
+		}
+	}
+	unary := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		note(err)
+		return err
+	}
+	stream := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		note(err)
+		if err != nil {
+			return nil, err
+		}
+		return watchedStream{ClientStream: cs, note: note}, nil
+	}
+	return []option.ClientOption{
+		option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(unary)),
+		option.WithGRPCDialOption(grpc.WithChainStreamInterceptor(stream)),
+	}
+}
+
+type watchedStream struct {
+	grpc.ClientStream
+	note func(error)
+}
+
+func (s watchedStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != io.EOF {
+		s.note(err)
+	}
+	return err
+}
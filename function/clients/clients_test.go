@@ -0,0 +1,76 @@
+package clients
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// unavailableServer answers every call with Unavailable.
+func unavailableServer(t *testing.T) *bufconn.Listener {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(func(interface{}, grpc.ServerStream) error {
+		return status.Error(codes.Unavailable, "unavailable")
+	}))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis
+}
+
+func TestLazyRecover(t *testing.T) {
+	tests := []struct {
+		name    string
+		call    bool
+		created int
+	}{
+		{name: "unused client is kept", call: false, created: 1},
+		{name: "client reset after Unavailable", call: true, created: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lis := unavailableServer(t)
+			created := 0
+			l := NewLazy("test", func(ctx context.Context, opts ...option.ClientOption) (*secretmanager.Client, error) {
+				created++
+				return secretmanager.NewClient(ctx, append(opts,
+					option.WithEndpoint("bufnet"),
+					option.WithoutAuthentication(),
+					option.WithGRPCDialOption(grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() })),
+					option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+				)...)
+			}, (*secretmanager.Client).Close)
+			ctx := context.Background()
+			client, err := l.Get(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.call {
+				callCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+				_, err := client.GetSecret(callCtx, &secretmanagerpb.GetSecretRequest{Name: "projects/p/secrets/s"})
+				cancel()
+				if !Broken(err) {
+					t.Fatalf("GetSecret error = %v, want Unavailable", err)
+				}
+			}
+			l.recover(ctx)
+			if _, err := l.Get(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if created != tt.created {
+				t.Errorf("created = %d, want %d", created, tt.created)
+			}
+			l.Reset(ctx)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+// linesim posts signed LINE webhook requests to a receive endpoint, for
+// trying the bot without the LINE app and for simple load tests.
+//
+//	go run ./cmd/linesim -url http://localhost:8080 -type text -text "/game on"
+//
+// The channel secret comes from -secret or LINE_CHANNEL_SECRET and must be
+// the one the endpoint verifies signatures with.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/webhooksim"
+)
+
+func main() {
+	url := flag.String("url", "http://localhost:8080", "receive endpoint")
+	secret := flag.String("secret", os.Getenv("LINE_CHANNEL_SECRET"), "channel secret to sign with")
+	userID := flag.String("user", "U00000000000000000000000000000000", "source user ID")
+	groupID := flag.String("group", "", "source group ID, a user chat when empty")
+	eventType := flag.String("type", webhooksim.TypeImage, "image, text or follow")
+	text := flag.String("text", "hello", "text of text messages")
+	messageID := flag.String("message-id", "", "message ID of image messages, random when empty")
+	count := flag.Int("count", 1, "number of requests")
+	interval := flag.Duration("interval", 0, "wait between requests")
+	flag.Parse()
+
+	if *secret == "" {
+		log.Fatal("channel secret is not set; use -secret or LINE_CHANNEL_SECRET")
+	}
+	ctx := context.Background()
+	client := &http.Client{Timeout: 30 * time.Second}
+	failed := 0
+	for i := 0; i < *count; i++ {
+		if i > 0 && *interval > 0 {
+			time.Sleep(*interval)
+		}
+		evt, err := webhooksim.New(webhooksim.Options{Type: *eventType, UserID: *userID, GroupID: *groupID, Text: *text, MessageID: *messageID})
+		if err != nil {
+			log.Fatal(err)
+		}
+		start := time.Now()
+		status, body, err := webhooksim.Post(ctx, client, *url, *secret, evt)
+		if err != nil {
+			log.Printf("request %d failed; %v", i+1, err)
+			failed++
+			continue
+		}
+		if status != http.StatusOK {
+			failed++
+		}
+		log.Printf("request %d: %d %s (%dms)", i+1, status, bytes.TrimSpace(body), time.Since(start).Milliseconds())
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d requests failed", failed, *count)
+	}
+}
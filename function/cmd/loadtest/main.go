@@ -0,0 +1,166 @@
+// loadtest drives concurrent simulated webhooks through a deployed pipeline
+// and reports the end-to-end latency, from posting each webhook to the
+// repliedAt its interactions/{webhookEventId} audit record got.
+//
+//	go run ./cmd/loadtest -url https://REGION-PROJECT.cloudfunctions.net/receive-function -project PROJECT -n 200 -c 20
+//
+// Run it against a test channel or with DRY_RUN=true so that no real user is
+// answered. Image events only get past the download when -message-id names
+// content the channel can still fetch; text events default to /threshold,
+// which is answered without changing anything.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/webhooksim"
+)
+
+type sent struct {
+	id     string
+	postAt time.Time
+}
+
+func main() {
+	url := flag.String("url", "", "receive endpoint")
+	secret := flag.String("secret", os.Getenv("LINE_CHANNEL_SECRET"), "channel secret to sign with")
+	projectID := flag.String("project", os.Getenv("PROJECT_ID"), "project whose Firestore holds the audit records")
+	n := flag.Int("n", 100, "number of webhooks")
+	c := flag.Int("c", 10, "webhooks in flight at once")
+	users := flag.Int("users", 10, "distinct simulated users, to stay clear of per-user rate limits")
+	eventType := flag.String("type", webhooksim.TypeText, "image or text")
+	text := flag.String("text", "/threshold", "text of text messages")
+	messageID := flag.String("message-id", "", "message ID of image messages")
+	wait := flag.Duration("wait", 2*time.Minute, "how long to wait for the replies")
+	flag.Parse()
+
+	if *url == "" || *secret == "" || *projectID == "" {
+		log.Fatal("-url, -secret and -project are required")
+	}
+	ctx := context.Background()
+
+	posted, rejected := drive(ctx, *url, *secret, *n, *c, *users, webhooksim.Options{Type: *eventType, Text: *text, MessageID: *messageID})
+	log.Printf("posted %d webhooks, %d rejected", len(posted), rejected)
+
+	client, err := firestore.NewClient(ctx, *projectID)
+	if err != nil {
+		log.Fatalf("firestore.NewClient failed; %v", err)
+	}
+	defer client.Close()
+	latencies, err := collect(ctx, client, posted, *wait)
+	if err != nil {
+		log.Fatal(err)
+	}
+	report(len(posted), latencies)
+}
+
+// drive posts n webhooks from c workers, cycling through users user IDs.
+func drive(ctx context.Context, url, secret string, n, c, users int, opts webhooksim.Options) ([]sent, int) {
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	jobs := make(chan int)
+	var mu sync.Mutex
+	posted := []sent{}
+	rejected := 0
+	var wg sync.WaitGroup
+	for w := 0; w < c; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				o := opts
+				o.UserID = fmt.Sprintf("Uloadtest%023d", i%users)
+				evt, err := webhooksim.New(o)
+				if err != nil {
+					log.Fatal(err)
+				}
+				postAt := time.Now()
+				code, body, err := webhooksim.Post(ctx, httpClient, url, secret, evt)
+				mu.Lock()
+				if err != nil || code != http.StatusOK {
+					rejected++
+					log.Printf("webhook %s rejected; %d %s %v", evt.WebhookEventID, code, body, err)
+				} else {
+					posted = append(posted, sent{evt.WebhookEventID, postAt})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return posted, rejected
+}
+
+// collect polls the audit records until every posted webhook was answered
+// or wait has passed.
+func collect(ctx context.Context, client *firestore.Client, posted []sent, wait time.Duration) ([]time.Duration, error) {
+	pending := map[string]time.Time{}
+	for _, s := range posted {
+		pending[s.id] = s.postAt
+	}
+	latencies := []time.Duration{}
+	deadline := time.Now().Add(wait)
+	for len(pending) > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Second)
+		refs := []*firestore.DocumentRef{}
+		for id := range pending {
+			refs = append(refs, client.Collection(namespace.Collection("interactions")).Doc(id))
+		}
+		// GetAll accepts at most 500 documents per call
+		for start := 0; start < len(refs); start += 500 {
+			end := int(math.Min(float64(start+500), float64(len(refs))))
+			snaps, err := client.GetAll(ctx, refs[start:end])
+			if err != nil {
+				return nil, fmt.Errorf("firestore.Client.GetAll failed; %w", err)
+			}
+			for _, snap := range snaps {
+				if !snap.Exists() {
+					continue
+				}
+				repliedAt, ok := snap.Data()["repliedAt"].(time.Time)
+				if !ok {
+					continue
+				}
+				latencies = append(latencies, repliedAt.Sub(pending[snap.Ref.ID]))
+				delete(pending, snap.Ref.ID)
+			}
+		}
+		log.Printf("%d replied, %d pending", len(latencies), len(pending))
+	}
+	return latencies, nil
+}
+
+func report(posted int, latencies []time.Duration) {
+	fmt.Printf("posted:  %d\nreplied: %d\nmissing: %d\n", posted, len(latencies), posted-len(latencies))
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	for _, p := range []float64{50, 95, 99} {
+		fmt.Printf("p%.0f:     %dms\n", p, percentile(latencies, p).Milliseconds())
+	}
+	fmt.Printf("max:     %dms\n", latencies[len(latencies)-1].Milliseconds())
+}
+
+// percentile uses the nearest rank of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
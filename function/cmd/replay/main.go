@@ -0,0 +1,229 @@
+// replay sends the webhooks receive archived with WEBHOOK_ARCHIVE on through
+// the pipeline again, for disaster recovery and backfills. It lists
+// webhooks/ of the archive bucket for the UTC time range [-from, -to) and
+// posts each of them, signed again, to the receive endpoint.
+//
+//	go run ./cmd/replay -bucket ARCHIVE_BUCKET -from 2023-01-02T03:00:00Z -to 2023-01-02T05:00:00Z
+//	go run ./cmd/replay -bucket ARCHIVE_BUCKET -from ... -to ... -url https://REGION-PROJECT.cloudfunctions.net/receive-function -live
+//	go run ./cmd/replay -bucket ARCHIVE_BUCKET -from ... -to ... -url ... -dry-run
+//
+// Without -live or -dry-run the webhooks are only listed. Every event is
+// marked as a redelivery, so receive skips those already replied to and
+// pushes the replies of the others instead of using their expired reply
+// tokens. -dry-run posts them too, but receive publishes them with the dry
+// run attribute, so the pipeline runs through without answering anyone.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/webhooksim"
+	"google.golang.org/api/iterator"
+)
+
+// must match webhookArchivePrefix, webhookArchiveLayout and dryRunHeader
+// of receive
+const (
+	archivePrefix = "webhooks/"
+	archiveLayout = "2006/01/02/15/150405.000000"
+	dryRunHeader  = "X-Replay-Dry-Run"
+)
+
+type archived struct {
+	name string
+	at   time.Time
+}
+
+func main() {
+	bucket := flag.String("bucket", os.Getenv("ARCHIVE_BUCKET"), "archive bucket")
+	from := flag.String("from", "", "start of the range, RFC 3339")
+	to := flag.String("to", "", "end of the range, RFC 3339, exclusive")
+	url := flag.String("url", "", "receive endpoint")
+	secret := flag.String("secret", os.Getenv("LINE_CHANNEL_SECRET"), "channel secret to sign with")
+	destination := flag.String("destination", "", "only webhooks for this destination, the bot user ID of a channel")
+	types := flag.String("types", "message", "comma separated event types to replay; others are dropped")
+	rate := flag.Float64("rate", 5, "webhooks per second")
+	live := flag.Bool("live", false, "post the webhooks instead of only listing them")
+	dryRun := flag.Bool("dry-run", false, "post the webhooks as a dry run, without replying to anyone")
+	flag.Parse()
+
+	start, err := time.Parse(time.RFC3339, *from)
+	if err != nil {
+		log.Fatalf("invalid -from; %v", err)
+	}
+	end, err := time.Parse(time.RFC3339, *to)
+	if err != nil {
+		log.Fatalf("invalid -to; %v", err)
+	}
+	if *bucket == "" || !start.Before(end) {
+		log.Fatal("-bucket is required and -from must be before -to")
+	}
+	if *live && *dryRun {
+		log.Fatal("-live and -dry-run are exclusive")
+	}
+	post := *live || *dryRun
+	if post && (*url == "" || *secret == "") {
+		log.Fatal("-url and -secret are required with -live and -dry-run")
+	}
+	var header http.Header
+	if *dryRun {
+		header = http.Header{dryRunHeader: []string{"true"}}
+	}
+	if *rate <= 0 {
+		log.Fatal("-rate must be positive")
+	}
+	keep := map[string]bool{}
+	for _, t := range strings.Split(*types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			keep[t] = true
+		}
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("storage.NewClient failed; %v", err)
+	}
+	defer client.Close()
+	b := client.Bucket(*bucket)
+
+	webhooks, err := list(ctx, b, start.UTC(), end.UTC())
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%d webhooks between %s and %s", len(webhooks), start.Format(time.RFC3339), end.Format(time.RFC3339))
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer ticker.Stop()
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	posted, skipped, failed := 0, 0, 0
+	for i, webhook := range webhooks {
+		if i > 0 && i%50 == 0 {
+			log.Printf("progress %d/%d; posted %d, skipped %d, failed %d", i, len(webhooks), posted, skipped, failed)
+		}
+		body, err := read(ctx, b, webhook.name)
+		if err != nil {
+			log.Printf("%s: %v", webhook.name, err)
+			failed++
+			continue
+		}
+		body, events, err := prepare(body, *destination, keep)
+		if err != nil {
+			log.Printf("%s: %v", webhook.name, err)
+			failed++
+			continue
+		}
+		if events == 0 {
+			skipped++
+			continue
+		}
+		if !post {
+			fmt.Printf("%s %s %d events\n", webhook.at.Format(time.RFC3339Nano), webhook.name, events)
+			posted++
+			continue
+		}
+		<-ticker.C
+		code, respBody, err := webhooksim.PostBodyHeader(ctx, httpClient, *url, *secret, body, header)
+		if err == nil && code != http.StatusOK {
+			err = fmt.Errorf("status %d; %s", code, respBody)
+		}
+		if err != nil {
+			log.Printf("%s: %v", webhook.name, err)
+			failed++
+			continue
+		}
+		posted++
+	}
+	verb := "listed"
+	if post {
+		verb = "posted"
+	}
+	log.Printf("%s %d, skipped %d, failed %d", verb, posted, skipped, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// list returns the webhooks archived in [start, end), oldest first, looking
+// only at the hours the range covers.
+func list(ctx context.Context, b *storage.BucketHandle, start, end time.Time) ([]archived, error) {
+	webhooks := []archived{}
+	for hour := start.Truncate(time.Hour); hour.Before(end); hour = hour.Add(time.Hour) {
+		prefix := namespace.Object(archivePrefix) + hour.Format("2006/01/02/15/")
+		it := b.Objects(ctx, &storage.Query{Prefix: prefix})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("storage.ObjectIterator.Next failed; %w", err)
+			}
+			stamp, _, ok := strings.Cut(strings.TrimPrefix(attrs.Name, namespace.Object(archivePrefix)), "-")
+			if !ok {
+				continue
+			}
+			at, err := time.Parse(archiveLayout, stamp)
+			if err != nil || at.Before(start) || !at.Before(end) {
+				continue
+			}
+			webhooks = append(webhooks, archived{name: attrs.Name, at: at})
+		}
+	}
+	return webhooks, nil
+}
+
+// prepare drops the events of other types and marks the rest as
+// redeliveries. It returns how many events are left, 0 as well for a webhook
+// to another destination.
+func prepare(body []byte, destination string, keep map[string]bool) ([]byte, int, error) {
+	var webhook struct {
+		Destination string                       `json:"destination"`
+		Events      []map[string]json.RawMessage `json:"events"`
+	}
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, 0, fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	if destination != "" && webhook.Destination != destination {
+		return nil, 0, nil
+	}
+	events := []map[string]json.RawMessage{}
+	for _, evt := range webhook.Events {
+		var t string
+		if err := json.Unmarshal(evt["type"], &t); err != nil || !keep[t] {
+			continue
+		}
+		evt["deliveryContext"] = json.RawMessage(`{"isRedelivery":true}`)
+		events = append(events, evt)
+	}
+	webhook.Events = events
+	b, err := json.Marshal(webhook)
+	if err != nil {
+		return nil, 0, fmt.Errorf("json.Marshal failed; %w", err)
+	}
+	return b, len(events), nil
+}
+
+func read(ctx context.Context, b *storage.BucketHandle, name string) ([]byte, error) {
+	r, err := b.Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.ObjectHandle.NewReader failed; %w", err)
+	}
+	defer r.Close()
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	return body, nil
+}
@@ -0,0 +1,174 @@
+// visionbackfill derives the analysis results archived under results/ of
+// the archive bucket again from the raw Vision responses under vision/,
+// which process keeps with VISION_RAW_ARCHIVE on. Run it after changing how
+// results are derived, e.g. merging or new fields, instead of calling Vision
+// for every image again.
+//
+//	go run ./cmd/visionbackfill -bucket ARCHIVE_BUCKET -min-score 0.6 -dry-run
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/visionresult"
+	"google.golang.org/api/iterator"
+)
+
+// archivedResult is the line process writes to results/.
+type archivedResult struct {
+	ImageID    string    `json:"imageId"`
+	UserIDHash string    `json:"userIdHash"`
+	CreatedAt  time.Time `json:"createdAt"`
+	analysis.Result
+}
+
+type options struct {
+	features []string
+	minScore float32
+	max      int
+	dryRun   bool
+}
+
+func main() {
+	bucket := flag.String("bucket", os.Getenv("ARCHIVE_BUCKET"), "archive bucket")
+	user := flag.String("user", "", "only the images of this user ID hash")
+	features := flag.String("features", "", "comma separated features to derive labels from instead of those requested")
+	minScore := flag.Float64("min-score", 0.5, "lowest label score kept")
+	max := flag.Int("max", 10, "most labels kept")
+	dryRun := flag.Bool("dry-run", false, "print the results instead of writing them")
+	flag.Parse()
+
+	if *bucket == "" {
+		log.Fatal("-bucket is required")
+	}
+	opts := options{minScore: float32(*minScore), max: *max, dryRun: *dryRun}
+	for _, name := range strings.Split(*features, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := visionresult.Features[name]; !ok {
+			log.Fatalf("unknown feature %q", name)
+		}
+		opts.features = append(opts.features, name)
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("storage.NewClient failed; %v", err)
+	}
+	defer client.Close()
+
+	prefix := visionresult.Prefix
+	if *user != "" {
+		prefix += *user + "/"
+	}
+	done, failed := 0, 0
+	it := client.Bucket(*bucket).Objects(ctx, &storage.Query{Prefix: namespace.Object(prefix)})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Fatalf("storage.ObjectIterator.Next failed; %v", err)
+		}
+		if err := backfill(ctx, client.Bucket(*bucket), attrs.Name, opts); err != nil {
+			log.Printf("%s: %v", attrs.Name, err)
+			failed++
+			continue
+		}
+		done++
+	}
+	log.Printf("backfilled %d, failed %d", done, failed)
+}
+
+func backfill(ctx context.Context, bucket *storage.BucketHandle, name string, opts options) error {
+	b, err := read(ctx, bucket, name)
+	if err != nil {
+		return err
+	}
+	var record visionresult.Record
+	if err := json.Unmarshal(b, &record); err != nil {
+		return fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	resp, err := record.Decode()
+	if err != nil {
+		return err
+	}
+
+	resultName := namespace.Object(fmt.Sprintf("results/%s/%s.json", record.UserIDHash, record.ImageID))
+	result := archivedResult{ImageID: record.ImageID, UserIDHash: record.UserIDHash, CreatedAt: record.CreatedAt, Result: analysis.New()}
+	b, err = read(ctx, bucket, resultName)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &result); err != nil {
+			return fmt.Errorf("json.Unmarshal failed; %w", err)
+		}
+	}
+
+	features := opts.features
+	if len(features) == 0 {
+		features = record.Features
+	}
+	switch record.Kind {
+	case visionresult.KindLabels:
+		result.AddFeature(analysis.FeatureLabels)
+		result.Labels = []analysis.Label{}
+		for _, label := range visionresult.Labels(resp, features, opts.minScore, opts.max) {
+			result.Labels = append(result.Labels, analysis.Label{Name: label.Name, Score: label.Score})
+		}
+	case visionresult.KindObjects:
+		result.AddFeature(analysis.FeatureObjects)
+		result.Objects = visionresult.Objects(resp)
+	default:
+		return fmt.Errorf("unknown kind %q", record.Kind)
+	}
+	result.Version = analysis.Version
+
+	out, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("json.Marshal failed; %w", err)
+	}
+	if opts.dryRun {
+		fmt.Printf("%s\n", out)
+		return nil
+	}
+	w := bucket.Object(resultName).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(append(out, '\n')); err != nil {
+		w.Close()
+		return fmt.Errorf("storage.Writer.Write failed; %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("storage.Writer.Close failed; %w", err)
+	}
+	return nil
+}
+
+func read(ctx context.Context, bucket *storage.BucketHandle, name string) ([]byte, error) {
+	r, err := bucket.Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.ObjectHandle.NewReader failed; %w", err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,183 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/lineapi"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/messenger"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errWindowTaken = errors.New("reply window taken over")
+
+const (
+	// reply tokens expire after about a minute; the window has to leave
+	// time for the analysis before it
+	maxCoalesceWindow = 30 * time.Second
+	// a window whose leader did not close it this long after it ended is
+	// abandoned and the next image opens a new one
+	coalesceGrace   = time.Minute
+	coalesceLabels  = 3
+	coalesceSummary = "%d images:"
+)
+
+// coalesceWindow is COALESCE_WINDOW, e.g. 10s; zero, the default, replies
+// to every image on its own.
+func coalesceWindow(ctx context.Context) time.Duration {
+	d, err := time.ParseDuration(dynconfig.Get(ctx, "COALESCE_WINDOW"))
+	if err != nil || d <= 0 {
+		return 0
+	}
+	if d > maxCoalesceWindow {
+		return maxCoalesceWindow
+	}
+	return d
+}
+
+type coalescedImage struct {
+	ImageID    string    `firestore:"imageId"`
+	Labels     []string  `firestore:"labels"`
+	ReceivedAt time.Time `firestore:"receivedAt"`
+}
+
+// coalesceState lives on replyWindows/{userIdHash} while images of a burst
+// are collected. Leader is the correlation ID of the image that opened it,
+// whose send waits for the window to end, closes it and replies for all of
+// them. Images arriving once it is closed are answered on their own.
+type coalesceState struct {
+	Leader   string           `firestore:"leader"`
+	OpenedAt time.Time        `firestore:"openedAt"`
+	Closed   bool             `firestore:"closed"`
+	Images   []coalescedImage `firestore:"images"`
+}
+
+func replyWindowDoc(client *firestore.Client, userIDHash string) *firestore.DocumentRef {
+	return client.Collection(namespace.Collection("replyWindows")).Doc(userIDHash)
+}
+
+// coalesceReply adds the labels of the image to the reply window of the
+// user and reports whether the reply is taken care of. The image that opens
+// the window waits for it to end and, when others joined, replies with one
+// summary of all of them; alone, it gets the usual reply. Images joining an
+// open window get no reply of their own. Should the leader fail for good,
+// the images that joined its window go unanswered.
+func coalesceReply(ctx context.Context, projectID string, lineClient lineapi.LineClient, sendMsg sendMessage, labels []string) (bool, error) {
+	window := coalesceWindow(ctx)
+	if window == 0 || sendMsg.UserIDHash == "" {
+		return false, nil
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return false, err
+	}
+	ref := replyWindowDoc(client, sendMsg.UserIDHash)
+	image := coalescedImage{ImageID: sendMsg.ImageID, Labels: labels, ReceivedAt: sendMsg.ReceivedAt}
+	leader, joined := false, false
+	var openedAt time.Time
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		leader, joined = false, false
+		snap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		var state coalesceState
+		if err == nil {
+			if err := snap.DataTo(&state); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		switch {
+		case state.Leader == sendMsg.CorrelationID:
+			// a redelivery of the leader takes over its own window again
+			leader, openedAt = true, state.OpenedAt
+			return nil
+		case state.Leader == "" || now.After(state.OpenedAt.Add(window+coalesceGrace)):
+			state = coalesceState{Leader: sendMsg.CorrelationID, OpenedAt: now}
+			leader, openedAt = true, now
+		case state.Closed:
+			// the leader is replying already; this one is on its own
+			return nil
+		default:
+			joined = true
+		}
+		state.Images = append(state.Images, image)
+		return tx.Set(ref, state)
+	})
+	if err != nil {
+		return false, fmt.Errorf("firestore.Client.RunTransaction failed; %w", err)
+	}
+	if joined {
+		logging.Printf(ctx, "reply coalesced into the open window")
+		return true, nil
+	}
+	if !leader {
+		return false, nil
+	}
+
+	select {
+	case <-time.After(time.Until(openedAt.Add(window))):
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	var state coalesceState
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if err := snap.DataTo(&state); err != nil {
+			return err
+		}
+		if state.Leader != sendMsg.CorrelationID {
+			return errWindowTaken
+		}
+		return tx.Update(ref, []firestore.Update{{Path: "closed", Value: true}})
+	})
+	if errors.Is(err, errWindowTaken) || status.Code(err) == codes.NotFound {
+		// abandoned and reopened by a later image; this one is on its own
+		logging.Warnf(ctx, "reply window taken over")
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("firestore.Client.RunTransaction failed; %w", err)
+	}
+	if len(state.Images) > 1 {
+		logging.Printf(ctx, "coalesced reply for %d images", len(state.Images))
+		if err := sendLINE(ctx, lineClient, sendMsg, messenger.Message{Text: formatCoalesced(state.Images)}); err != nil {
+			return false, err
+		}
+	}
+	if _, err := ref.Delete(ctx); err != nil {
+		logging.Errorf(ctx, "firestore.DocumentRef.Delete failed; %v", err)
+	}
+	return len(state.Images) > 1, nil
+}
+
+// formatCoalesced lists the top labels of each image of the window, in the
+// order they were received.
+func formatCoalesced(images []coalescedImage) string {
+	lines := []string{fmt.Sprintf(coalesceSummary, len(images))}
+	for i, image := range images {
+		labels := image.Labels
+		if len(labels) > coalesceLabels {
+			labels = labels[:coalesceLabels]
+		}
+		text := strings.Join(labels, ", ")
+		if text == "" {
+			text = "no labels found"
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, text))
+	}
+	return strings.Join(lines, "\n")
+}
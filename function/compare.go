@@ -0,0 +1,83 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/canary"
+	"github.com/hsmtkk/ubiquitous-couscous/function/costguard"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+)
+
+// compareStep runs Vision and the candidate analyzer concurrently and
+// answers with both results side by side, for judging a provider on real
+// photos. The labels kept on the state are Vision's.
+func compareStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	candidate := candidateAnalyzer()
+	if candidate == nil {
+		return fmt.Errorf("compare mode needs VERTEX_ENDPOINT")
+	}
+	analyzers := []analyzer{visionAnalyzer{minScore: state.minScore}, candidate}
+
+	type outcome struct {
+		labels []analysis.Label
+		err    error
+	}
+	outcomes := make([]outcome, len(analyzers))
+	var wg sync.WaitGroup
+	for i, a := range analyzers {
+		wg.Add(1)
+		go func(i int, a analyzer) {
+			defer wg.Done()
+			labels, err := a.Labels(ctx, state.image)
+			outcomes[i] = outcome{labels, err}
+		}(i, a)
+	}
+	wg.Wait()
+
+	lines := []string{}
+	for i, a := range analyzers {
+		if outcomes[i].err != nil {
+			logging.Warnf(ctx, "compare %s failed; %v", a.Name(), outcomes[i].err)
+			lines = append(lines, fmt.Sprintf("%s: failed", a.Name()))
+		}
+	}
+	if errors.Is(outcomes[0].err, costguard.ErrBudgetExceeded) {
+		return budgetStop(state, outcomes[0].err)
+	}
+	if outcomes[0].err != nil && outcomes[1].err != nil {
+		return fmt.Errorf("both analyzers failed; %w", outcomes[0].err)
+	}
+	if len(lines) == 0 {
+		c := canary.Compare(analysis.Names(outcomes[0].labels), analysis.Names(outcomes[1].labels))
+		logging.Printf(ctx, "compare %s/%s: agreement=%.2f common=%v only-%s=%v only-%s=%v",
+			analyzers[0].Name(), analyzers[1].Name(), c.Agreement, c.Common, analyzers[0].Name(), c.OnlyPrimary, analyzers[1].Name(), c.OnlyCandidate)
+		lines = append(lines,
+			fmt.Sprintf("%s vs %s: %.0f%% agreement", analyzers[0].Name(), analyzers[1].Name(), c.Agreement*100),
+			"both: "+joinOrNone(c.Common),
+			fmt.Sprintf("only %s: %s", analyzers[0].Name(), joinOrNone(c.OnlyPrimary)),
+			fmt.Sprintf("only %s: %s", analyzers[1].Name(), joinOrNone(c.OnlyCandidate)),
+		)
+	} else {
+		for i, a := range analyzers {
+			if outcomes[i].err == nil {
+				lines = append(lines, fmt.Sprintf("%s: %s", a.Name(), joinOrNone(analysis.Names(outcomes[i].labels))))
+			}
+		}
+	}
+	state.result.AddFeature(analysis.FeatureLabels)
+	state.result.Labels = outcomes[0].labels
+	state.summary = strings.Join(lines, "\n")
+	return nil
+}
+
+func joinOrNone(labels []string) string {
+	if len(labels) == 0 {
+		return "(none)"
+	}
+	return strings.Join(labels, ", ")
+}
@@ -0,0 +1,50 @@
+package function
+
+import (
+	"context"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/completion"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+)
+
+// completionMarkers turns on completion markers for process and send, so
+// that a message Pub/Sub delivers again after it was handled, whether
+// through Eventarc or a pull subscription, is skipped.
+func completionMarkers(ctx context.Context) bool {
+	return dynconfig.Get(ctx, "COMPLETION_MARKERS") == "true"
+}
+
+// alreadyCompleted reports whether function finished the message with
+// correlationID before.
+func alreadyCompleted(ctx context.Context, projectID, function, correlationID string) (bool, error) {
+	if !completionMarkers(ctx) || correlationID == "" {
+		return false, nil
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return false, err
+	}
+	done, err := completion.New(client).Done(ctx, function, correlationID)
+	if err != nil {
+		return false, err
+	}
+	if done {
+		logging.Printf(ctx, "skip %s; completed before", function)
+	}
+	return done, nil
+}
+
+// markCompleted is the last step of a handler; its error fails the handler
+// so that the message is not acked without a marker.
+func markCompleted(ctx context.Context, projectID, function, correlationID string) error {
+	if !completionMarkers(ctx) || correlationID == "" {
+		return nil
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	return completion.New(client).Mark(ctx, function, correlationID)
+}
@@ -0,0 +1,53 @@
+package completion
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const Collection = "completions"
+
+type marker struct {
+	Function    string    `firestore:"function"`
+	CompletedAt time.Time `firestore:"completedAt"`
+}
+
+// Store keeps a durable marker per handled message. A handler checks Done
+// before doing any work and writes the marker with Mark as its last step,
+// before the message is acked, so a message delivered again after its ack
+// was lost is recognized instead of being handled twice.
+type Store struct {
+	client *firestore.Client
+}
+
+func New(client *firestore.Client) *Store {
+	return &Store{client: client}
+}
+
+func (s *Store) ref(function, id string) *firestore.DocumentRef {
+	return s.client.Collection(namespace.Collection(Collection)).Doc(function + ":" + id)
+}
+
+func (s *Store) Done(ctx context.Context, function, id string) (bool, error) {
+	_, err := s.ref(function, id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	return true, nil
+}
+
+func (s *Store) Mark(ctx context.Context, function, id string) error {
+	if _, err := s.ref(function, id).Set(ctx, marker{Function: function, CompletedAt: time.Now()}); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/postback"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+)
+
+const (
+	actionConsent = "consent"
+
+	consentAccepted = "accepted"
+	consentDeclined = "declined"
+
+	privacyCommand = "/privacy"
+)
+
+// consentRequired turns on the consent flow, CONSENT. Until a user accepted
+// the privacy notice, nothing about them is archived or recorded for
+// analytics; answering their photos does not depend on it.
+func consentRequired(ctx context.Context) bool {
+	return dynconfig.Get(ctx, "CONSENT") == "true"
+}
+
+type consentKey struct{}
+
+// withConsent carries the decision of the user ctx is handling, so that
+// recordingAllowed does not have to look it up again.
+func withConsent(ctx context.Context, consent string) context.Context {
+	return context.WithValue(ctx, consentKey{}, consent)
+}
+
+// recordingAllowed reports whether the user ctx is logging for may be
+// archived and recorded for analytics.
+func recordingAllowed(ctx context.Context) bool {
+	if !consentRequired(ctx) {
+		return true
+	}
+	if consent, ok := ctx.Value(consentKey{}).(string); ok {
+		return consent == consentAccepted
+	}
+	return recordingAllowedFor(ctx, logging.FromContext(ctx).UserIDHash)
+}
+
+// recordingAllowedFor looks the decision of userIDHash up. Records without
+// a user, such as those of groups, are not subject to consent.
+func recordingAllowedFor(ctx context.Context, userIDHash string) bool {
+	if !consentRequired(ctx) || userIDHash == "" {
+		return true
+	}
+	prefs, err := preferencesOf(ctx, projectIDOf(ctx), userIDHash)
+	if err != nil {
+		logging.Errorf(ctx, "load preferences failed; %v", err)
+		return false
+	}
+	return prefs.Consent == consentAccepted
+}
+
+// askConsent reports whether the reply to the user should carry the privacy
+// notice: once, to users who have not decided yet.
+func askConsent(ctx context.Context, userIDHash string, prefs userPreferences) bool {
+	return consentRequired(ctx) && userIDHash != "" && prefs.Consent == "" && prefs.ConsentAskedAt.IsZero()
+}
+
+func consentQuickReplies(codec *postback.Codec) ([]reply.QuickReplyItem, error) {
+	accept, err := codec.Encode(actionConsent, map[string]string{"choice": consentAccepted})
+	if err != nil {
+		return nil, err
+	}
+	decline, err := codec.Encode(actionConsent, map[string]string{"choice": consentDeclined})
+	if err != nil {
+		return nil, err
+	}
+	return []reply.QuickReplyItem{
+		{Label: "Accept", Data: accept, DisplayText: "I accept"},
+		{Label: "Decline", Data: decline, DisplayText: "I decline"},
+	}, nil
+}
+
+func privacyNotice(ctx context.Context) string {
+	return replyTemplate(ctx, "CONSENT_NOTICE", "May we keep your photos and their analysis to improve this service? "+
+		"Declining does not change how your photos are answered. You can change your mind any time with /privacy.")
+}
+
+// addConsentNotice appends the privacy notice with Accept and Decline to
+// the reply and remembers that the user was asked.
+func addConsentNotice(ctx context.Context, projectID, userIDHash string, codec *postback.Codec, builder *reply.Builder) error {
+	if builder.Len() >= reply.MaxMessages {
+		return nil
+	}
+	items, err := consentQuickReplies(codec)
+	if err != nil {
+		return err
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	if err := savePreference(ctx, client, userIDHash, "consentAskedAt", time.Now()); err != nil {
+		return err
+	}
+	builder.Text(privacyNotice(ctx)).QuickReply(items...)
+	return nil
+}
+
+// privacy answers "/privacy" with the user's decision and the quick
+// replies to change it.
+func privacy(ctx context.Context, client *firestore.Client, userIDHash string, codec *postback.Codec) (string, []reply.QuickReplyItem, error) {
+	prefs, err := loadPreferences(ctx, client, userIDHash)
+	if err != nil {
+		return "", nil, err
+	}
+	var decision string
+	switch prefs.Consent {
+	case consentAccepted:
+		decision = "You accepted that your photos and their analysis are kept."
+	case consentDeclined:
+		decision = "You declined that your photos and their analysis are kept."
+	default:
+		decision = "You have not decided yet; nothing about you is kept until you accept."
+	}
+	items, err := consentQuickReplies(codec)
+	if err != nil {
+		return "", nil, err
+	}
+	return decision + "\n\n" + privacyNotice(ctx), items, nil
+}
+
+// consentAction records the choice of the privacy notice.
+func consentAction(ctx context.Context, evt postback.Event, payload postback.Payload) error {
+	choice := payload.Param("choice")
+	if choice != consentAccepted && choice != consentDeclined {
+		return fmt.Errorf("invalid consent choice; %s", choice)
+	}
+	projectID := projectIDOf(ctx)
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	decision := map[string]interface{}{"consent": choice, "consentAt": time.Now()}
+	if _, err := client.Collection(namespace.Collection("users")).Doc(evt.UserIDHash).Set(ctx, decision, firestore.MergeAll); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	logging.Printf(ctx, "consent %s", choice)
+
+	text := "Thank you. Your photos and their analysis are kept from now on."
+	if choice == consentDeclined {
+		text = "Understood. Your photos are still answered, but nothing about them is kept."
+	}
+	lineClient, err := newLineClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	return sendReply(ctx, lineClient, reply.NewBuilder(evt.ReplyToken).Text(text))
+}
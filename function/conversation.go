@@ -0,0 +1,90 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/conversation"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+)
+
+const (
+	defaultHistoryItems = 5
+	maxHistoryItems     = 20
+)
+
+func conversationLogEnabled(ctx context.Context) bool {
+	return dynconfig.Get(ctx, "CONVERSATION_LOG") == "true"
+}
+
+// logConversation appends item to the conversation of the user ctx is
+// logging for when CONVERSATION_LOG is on. The log is a record, not part of
+// the pipeline, so failures are only logged.
+func logConversation(ctx context.Context, item conversation.Item) {
+	fields := logging.FromContext(ctx)
+	if fields.UserIDHash == "" || !conversationLogEnabled(ctx) || !recordingAllowed(ctx) {
+		return
+	}
+	item.CorrelationID = fields.CorrelationID
+	item.Function = fields.Function
+	client, err := clients.Firestore(ctx, projectIDOf(ctx))
+	if err != nil {
+		logging.Errorf(ctx, "clients.Firestore failed; %v", err)
+		return
+	}
+	if err := conversation.New(client).Append(ctx, fields.UserIDHash, item); err != nil {
+		logging.Errorf(ctx, "log conversation failed; %v", err)
+	}
+}
+
+// replyText is the text messages of req as the user read them.
+func replyText(req reply.Request) string {
+	texts := []string{}
+	for _, msg := range req.Messages {
+		if m, ok := msg.(reply.TextMessage); ok {
+			texts = append(texts, m.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// history answers "/history [n]" with the user's last n analyses from the
+// conversation log.
+func history(ctx context.Context, client *firestore.Client, userIDHash, arg string) (string, error) {
+	if userIDHash == "" {
+		return "History is not available.", nil
+	}
+	n := defaultHistoryItems
+	if arg != "" {
+		var err error
+		n, err = strconv.Atoi(arg)
+		if err != nil || n < 1 || n > maxHistoryItems {
+			return fmt.Sprintf("Usage: /history [1-%d]", maxHistoryItems), nil
+		}
+	}
+	items, err := conversation.New(client).Recent(ctx, userIDHash, conversation.KindAnalysis, n)
+	if err != nil {
+		return "", err
+	}
+	if len(items) == 0 {
+		return "There is no history yet.", nil
+	}
+	lines := make([]string, 0, len(items))
+	for _, item := range items {
+		found := strings.Join(item.Labels, ", ")
+		if found == "" {
+			found = item.Text
+		}
+		if found == "" {
+			found = "(nothing found)"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s", item.At.Format("01-02 15:04"), found))
+	}
+	return "Your latest analyses:\n" + strings.Join(lines, "\n"), nil
+}
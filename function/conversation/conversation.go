@@ -0,0 +1,120 @@
+package conversation
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/api/iterator"
+)
+
+const Collection = "conversations"
+
+// Kinds of Item.
+const (
+	KindInbound  = "inbound"
+	KindAnalysis = "analysis"
+	KindReply    = "reply"
+	KindError    = "error"
+)
+
+// Item is one step of an interaction with a user.
+type Item struct {
+	Kind          string    `firestore:"kind" json:"kind"`
+	CorrelationID string    `firestore:"correlationId" json:"correlationId"`
+	Function      string    `firestore:"function" json:"function"`
+	ImageID       string    `firestore:"imageId,omitempty" json:"imageId,omitempty"`
+	Text          string    `firestore:"text,omitempty" json:"text,omitempty"`
+	Labels        []string  `firestore:"labels,omitempty" json:"labels,omitempty"`
+	At            time.Time `firestore:"at" json:"at"`
+}
+
+// Log keeps the items of each user under
+// conversations/{userIdHash}/days/{yyyy-mm-dd}/items, so that a day reads
+// back as one conversation in the order it happened.
+type Log struct {
+	client *firestore.Client
+}
+
+func New(client *firestore.Client) *Log {
+	return &Log{client: client}
+}
+
+func (l *Log) days(userIDHash string) *firestore.CollectionRef {
+	return l.client.Collection(namespace.Collection(Collection)).Doc(userIDHash).Collection(namespace.Collection("days"))
+}
+
+func day(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// Append stores item, stamping it with the current time when it has none.
+// The day document is written too; days without one cannot be listed.
+func (l *Log) Append(ctx context.Context, userIDHash string, item Item) error {
+	if item.At.IsZero() {
+		item.At = time.Now()
+	}
+	dayRef := l.days(userIDHash).Doc(day(item.At))
+	// the ID sorts by time and keeps items of the same instant apart
+	id := fmt.Sprintf("%019d-%s-%s", item.At.UnixNano(), item.Kind, item.CorrelationID)
+	batch := l.client.Batch()
+	batch.Set(dayRef, map[string]interface{}{"updatedAt": item.At}, firestore.MergeAll)
+	batch.Set(dayRef.Collection(namespace.Collection("items")).Doc(id), item)
+	if _, err := batch.Commit(ctx); err != nil {
+		return fmt.Errorf("firestore.WriteBatch.Commit failed; %w", err)
+	}
+	return nil
+}
+
+// Day returns the items of the user on the UTC day of t, oldest first.
+func (l *Log) Day(ctx context.Context, userIDHash string, t time.Time) ([]Item, error) {
+	return readItems(l.days(userIDHash).Doc(day(t)).Collection(namespace.Collection("items")).OrderBy("at", firestore.Asc).Documents(ctx))
+}
+
+// Recent returns up to n items of kind, newest first, walking back day by
+// day.
+func (l *Log) Recent(ctx context.Context, userIDHash, kind string, n int) ([]Item, error) {
+	iter := l.days(userIDHash).OrderBy(firestore.DocumentID, firestore.Desc).Documents(ctx)
+	defer iter.Stop()
+	results := []Item{}
+	for len(results) < n {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestore.DocumentIterator.Next failed; %w", err)
+		}
+		items, err := readItems(snap.Ref.Collection(namespace.Collection("items")).OrderBy("at", firestore.Desc).Documents(ctx))
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			if item.Kind == kind && len(results) < n {
+				results = append(results, item)
+			}
+		}
+	}
+	return results, nil
+}
+
+func readItems(iter *firestore.DocumentIterator) ([]Item, error) {
+	defer iter.Stop()
+	items := []Item{}
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return items, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestore.DocumentIterator.Next failed; %w", err)
+		}
+		var item Item
+		if err := snap.DataTo(&item); err != nil {
+			return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+		}
+		items = append(items, item)
+	}
+}
@@ -0,0 +1,90 @@
+package costguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	visionCollection = "visionUsage"
+	// share of the budget at which a warning is logged
+	warnRatio = 0.8
+)
+
+var ErrBudgetExceeded = errors.New("daily budget exceeded")
+
+type usage struct {
+	Units     int64     `firestore:"units"`
+	UpdatedAt time.Time `firestore:"updatedAt"`
+}
+
+// Guard counts API units per UTC day in Firestore and refuses to reserve
+// more once the daily budget is used up.
+type Guard struct {
+	client     *firestore.Client
+	collection string
+	budget     int64
+}
+
+// New returns a Guard allowing budget Vision units per day; a budget of 0 or
+// less disables the limit.
+func New(client *firestore.Client, budget int64) *Guard {
+	return NewFor(client, visionCollection, budget)
+}
+
+// NewFor counts in collection instead, for APIs with a budget of their own.
+func NewFor(client *firestore.Client, collection string, budget int64) *Guard {
+	return &Guard{client: client, collection: collection, budget: budget}
+}
+
+// Reserve records units as consumed today, or returns ErrBudgetExceeded
+// without recording anything when they do not fit in the remaining budget.
+func (g *Guard) Reserve(ctx context.Context, units int64) error {
+	if g.budget <= 0 {
+		return nil
+	}
+	day := time.Now().UTC().Format("2006-01-02")
+	ref := g.client.Collection(namespace.Collection(g.collection)).Doc(day)
+	var before, after int64
+	err := g.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var current usage
+		snap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return fmt.Errorf("firestore.Transaction.Get failed; %w", err)
+		}
+		if err == nil {
+			if err := snap.DataTo(&current); err != nil {
+				return fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+			}
+		}
+		before = current.Units
+		after = before + units
+		if after > g.budget {
+			return ErrBudgetExceeded
+		}
+		if err := tx.Set(ref, usage{Units: after, UpdatedAt: time.Now()}); err != nil {
+			return fmt.Errorf("firestore.Transaction.Set failed; %w", err)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrBudgetExceeded) {
+		logging.Warnf(ctx, "%s budget exhausted; %d/%d units used on %s", g.collection, before, g.budget, day)
+		return ErrBudgetExceeded
+	}
+	if err != nil {
+		return fmt.Errorf("firestore.Client.RunTransaction failed; %w", err)
+	}
+	threshold := int64(float64(g.budget) * warnRatio)
+	if before < threshold && after >= threshold {
+		logging.Warnf(ctx, "%s budget at %d%%; %d/%d units used on %s", g.collection, after*100/g.budget, after, g.budget, day)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/storage"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/conversation"
+	"github.com/hsmtkk/ubiquitous-couscous/function/health"
+	"github.com/hsmtkk/ubiquitous-couscous/function/imageutil"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/tenant"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	dashboardRows      = 20
+	dashboardThumbSize = 96
+	// thumbnails are cached briefly so that a deleted image drops out soon
+	dashboardThumbTTL = 15 * time.Minute
+)
+
+type dashboardPage struct {
+	// Tenant is carried in the links and the form, empty for the
+	// deployment's own channel.
+	Tenant       string
+	GeneratedAt  time.Time
+	Label        string
+	Results      []dashboardResult
+	NextPage     string
+	Interactions []interactionRow
+	RecentErrors []health.ErrorEntry
+	// User and Day select the conversation shown, which is only read when a
+	// user is given.
+	User         string
+	Day          string
+	Conversation []conversation.Item
+}
+
+type dashboardResult struct {
+	result
+	// Thumbnail is the URL serveThumbnail answers on, empty when images are
+	// not archived.
+	Thumbnail template.URL
+}
+
+type interactionRow struct {
+	CorrelationID string    `firestore:"-"`
+	ReplyStatus   int64     `firestore:"replyStatus"`
+	ReplyError    string    `firestore:"replyError"`
+	RepliedAt     time.Time `firestore:"repliedAt"`
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>ubiquitous-couscous dashboard</title>
+<style>body{font-family:sans-serif;margin:1em}td,th{padding:2px 8px;text-align:left;vertical-align:top}img{max-width:96px}.ng{color:#c00}</style>
+</head>
+<body>
+<h1>Dashboard</h1>
+<p>{{.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}</p>
+<form>{{if .Tenant}}<input type="hidden" name="tenant" value="{{.Tenant}}">{{end}}<input name="label" value="{{.Label}}" placeholder="label"><button>filter</button></form>
+<h2>Results</h2>
+<table>
+<tr><th></th><th>time</th><th>user</th><th>labels</th></tr>
+{{range .Results}}<tr><td>{{if .Thumbnail}}<img src="{{.Thumbnail}}" alt="{{.ImageID}}">{{end}}</td><td>{{.CreatedAt.Format "01-02 15:04:05"}}</td><td>{{printf "%.8s" .UserIDHash}}</td><td>{{range .Labels}}{{.}}<br>{{end}}</td></tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+{{if .NextPage}}<p><a href="?{{if .Tenant}}tenant={{.Tenant}}&amp;{{end}}label={{.Label}}&amp;pageToken={{.NextPage}}">older</a></p>{{end}}
+{{if .User}}<h2>Conversation of {{printf "%.8s" .User}} on {{.Day}}</h2>
+<table>
+{{range .Conversation}}<tr><td>{{.At.Format "15:04:05"}}</td><td>{{.Function}}</td>{{if eq .Kind "error"}}<td class="ng">{{.Kind}}</td>{{else}}<td>{{.Kind}}</td>{{end}}<td>{{.ImageID}}</td><td>{{range .Labels}}{{.}}<br>{{end}}{{.Text}}</td></tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Recent interactions</h2>
+<table>
+{{range .Interactions}}<tr><td>{{.RepliedAt.Format "01-02 15:04:05"}}</td><td>{{.CorrelationID}}</td>{{if .ReplyError}}<td class="ng">{{.ReplyStatus}} {{.ReplyError}}</td>{{else}}<td>{{.ReplyStatus}}</td>{{end}}</tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+<h2>Recent errors</h2>
+<table>
+{{range .RecentErrors}}<tr><td>{{.At.Format "01-02 15:04:05"}}</td><td>{{.Function}}</td><td>{{.CorrelationID}}</td><td>{{.Message}}</td></tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// dashboard renders recent results, interactions and errors for operators,
+// plus the conversation of the user given as user on day, today by default.
+// It sits behind requireOperator; INTERNAL_PRINCIPALS lists the operators.
+func dashboard(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "dashboard"})
+	logging.Printf(ctx, "dashboard")
+
+	ctx, err := requestTenant(ctx, r)
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	projectID := projectIDOf(ctx)
+
+	if imageID := r.URL.Query().Get("thumbnail"); imageID != "" {
+		client, err := clients.Firestore(ctx, projectID)
+		if err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		serveThumbnail(ctx, w, client, r.URL.Query().Get("user"), imageID)
+		return
+	}
+
+	q, err := parseResultsQuery(r)
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	q.Limit = dashboardRows
+
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+
+	results, err := listResults(ctx, client, q)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	page := dashboardPage{GeneratedAt: time.Now(), Label: q.Label, NextPage: results.NextPageToken}
+	if t, ok := tenant.FromContext(ctx); ok {
+		page.Tenant = t.ID
+	}
+	for _, res := range results.Data {
+		page.Results = append(page.Results, dashboardResult{result: res, Thumbnail: thumbnailURL(ctx, res)})
+	}
+	if page.Interactions, err = recentInteractions(ctx, client, dashboardRows); err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	if page.RecentErrors, err = health.NewRecorder(client).RecentErrors(ctx, dashboardRows); err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	if q.UserIDHash != "" {
+		day := time.Now()
+		if value := r.URL.Query().Get("day"); value != "" {
+			if day, err = time.Parse("2006-01-02", value); err != nil {
+				returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("invalid day; %s", value))
+				return
+			}
+		}
+		page.User = q.UserIDHash
+		page.Day = day.UTC().Format("2006-01-02")
+		if page.Conversation, err = conversation.New(client).Day(ctx, q.UserIDHash, day); err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, page); err != nil {
+		logging.Errorf(ctx, "template.Execute failed; %v", err)
+	}
+}
+
+func recentInteractions(ctx context.Context, client *firestore.Client, n int) ([]interactionRow, error) {
+	iter := client.Collection(namespace.Collection("interactions")).OrderBy("repliedAt", firestore.Desc).Limit(n).Documents(ctx)
+	defer iter.Stop()
+	rows := []interactionRow{}
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestore.DocumentIterator.Next failed; %w", err)
+		}
+		var row interactionRow
+		if err := snap.DataTo(&row); err != nil {
+			return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+		}
+		row.CorrelationID = snap.Ref.ID
+		rows = append(rows, row)
+	}
+}
+
+// thumbnailURL links the thumbnail of res, which the dashboard serves
+// itself for the tenant ctx is served for; empty when images are not
+// archived.
+func thumbnailURL(ctx context.Context, res result) template.URL {
+	if tenantEnv(ctx, "ARCHIVE_BUCKET") == "" {
+		return ""
+	}
+	query := url.Values{"thumbnail": {res.ImageID}, "user": {res.UserIDHash}}
+	if t, ok := tenant.FromContext(ctx); ok {
+		query.Set("tenant", t.ID)
+	}
+	return template.URL("?" + query.Encode())
+}
+
+// serveThumbnail answers with the archived copy of the image shrunk, which
+// is already pixelated when SafeSearch flagged it. Shrunk copies are kept in
+// the cache, briefly so that a deleted image drops out soon, and by the
+// browser, so that reloading the page does not download every image again.
+func serveThumbnail(ctx context.Context, w http.ResponseWriter, fsClient *firestore.Client, userIDHash, imageID string) {
+	bucket := tenantEnv(ctx, "ARCHIVE_BUCKET")
+	if bucket == "" || userIDHash == "" {
+		http.NotFound(w, nil)
+		return
+	}
+	name, err := archivedImageName(ctx, fsClient, userIDHash, imageID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	var c cache.Cache
+	if opened, err := cache.Open(ctx, cache.ConfigFromEnv()); err != nil {
+		logging.Errorf(ctx, "cache.Open failed; %v", err)
+	} else {
+		c = opened
+		defer c.Close()
+	}
+	key := "thumbnail:" + bucket + "/" + name
+	var thumb []byte
+	if c != nil {
+		if thumb, err = c.Get(ctx, key); err != nil && !errors.Is(err, cache.ErrMiss) {
+			logging.Errorf(ctx, "cache get failed; %v", err)
+		}
+	}
+	if thumb == nil {
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, fmt.Errorf("storage.NewClient failed; %w", err))
+			return
+		}
+		defer client.Close()
+		if thumb, err = thumbnail(ctx, client.Bucket(bucket), name); err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		if thumb == nil {
+			http.NotFound(w, nil)
+			return
+		}
+		if c != nil {
+			if err := c.Set(ctx, key, thumb, dashboardThumbTTL); err != nil {
+				logging.Errorf(ctx, "cache set failed; %v", err)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(dashboardThumbTTL.Seconds())))
+	if _, err := w.Write(thumb); err != nil {
+		logging.Errorf(ctx, "http.ResponseWriter.Write failed; %v", err)
+	}
+}
+
+// thumbnail returns the object name shrunk to a JPEG, nil when it is gone.
+func thumbnail(ctx context.Context, bucket *storage.BucketHandle, name string) ([]byte, error) {
+	reader, err := bucket.Object(namespace.Object(name)).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("storage.ObjectHandle.NewReader failed; %w", err)
+	}
+	defer reader.Close()
+	b, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	img, _, err := imageutil.Decode(b)
+	if err != nil {
+		return nil, err
+	}
+	return imageutil.EncodeJPEG(imageutil.Resize(img, dashboardThumbSize))
+}
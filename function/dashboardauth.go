@@ -0,0 +1,151 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/auth"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/postback"
+	"google.golang.org/api/idtoken"
+)
+
+const (
+	googleAuthorizeURL = "https://accounts.google.com/o/oauth2/v2/auth"
+	googleTokenURL     = "https://oauth2.googleapis.com/token"
+
+	dashboardCookie        = "dashboard_session"
+	dashboardSessionTTL    = 8 * time.Hour
+	dashboardSessionAction = "dashboard-session"
+	dashboardStateTTL      = 10 * time.Minute
+	dashboardStateAction   = "dashboard-login"
+)
+
+// requireOperator signs operators in with their Google account, since a
+// browser cannot send the bearer token auth.Require wants. A visitor without
+// a session is sent to Google with a signed state and comes back with a
+// code, which is exchanged for an identity token; an operator listed in
+// INTERNAL_PRINCIPALS then gets a session cookie signed with the client
+// secret of the OAuth client DASHBOARD_OAUTH_CLIENT_ID.
+func requireOperator(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := logging.With(r.Context(), logging.Fields{Function: "dashboard"})
+		clientID := os.Getenv("DASHBOARD_OAUTH_CLIENT_ID")
+		if clientID == "" {
+			returnError(ctx, w, http.StatusInternalServerError, fmt.Errorf("DASHBOARD_OAUTH_CLIENT_ID is not set"))
+			return
+		}
+		clientSecret, err := getSecret(ctx, os.Getenv("PROJECT_ID"), "dashboard-oauth-client-secret")
+		if err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		codec := postback.NewCodec([]byte(clientSecret), 0)
+		now := time.Now()
+
+		if cookie, err := r.Cookie(dashboardCookie); err == nil {
+			session, err := codec.DecodeAction(cookie.Value, dashboardSessionAction, dashboardSessionTTL, now)
+			if err == nil && operatorAllowed(session.Param("email")) {
+				logging.Printf(ctx, "operator: %s", session.Param("email"))
+				next(w, r)
+				return
+			}
+		}
+
+		redirectURI := "https://" + r.Host + r.URL.Path
+		query := r.URL.Query()
+		code := query.Get("code")
+		if code == "" {
+			state, err := codec.Encode(dashboardStateAction, nil)
+			if err != nil {
+				returnError(ctx, w, http.StatusInternalServerError, err)
+				return
+			}
+			authorize := url.Values{"client_id": {clientID}, "redirect_uri": {redirectURI}, "response_type": {"code"}, "scope": {"openid email"}, "state": {state}}
+			http.Redirect(w, r, googleAuthorizeURL+"?"+authorize.Encode(), http.StatusFound)
+			return
+		}
+		if _, err := codec.DecodeAction(query.Get("state"), dashboardStateAction, dashboardStateTTL, now); err != nil {
+			returnError(ctx, w, http.StatusForbidden, fmt.Errorf("invalid state; %w", err))
+			return
+		}
+		email, err := googleSignIn(ctx, clientID, clientSecret, redirectURI, code)
+		if err != nil {
+			returnError(ctx, w, http.StatusUnauthorized, err)
+			return
+		}
+		if !operatorAllowed(email) {
+			logging.Warnf(ctx, "reject %s; %v", r.URL.Path, fmt.Errorf("%w; %s", auth.ErrForbidden, email))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		session, err := codec.Encode(dashboardSessionAction, map[string]string{"email": email})
+		if err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     dashboardCookie,
+			Value:    session,
+			Path:     r.URL.Path,
+			MaxAge:   int(dashboardSessionTTL.Seconds()),
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		logging.Printf(ctx, "operator %s signed in", email)
+		// drops the code from the address bar
+		http.Redirect(w, r, redirectURI, http.StatusFound)
+	}
+}
+
+// operatorAllowed tells whether INTERNAL_PRINCIPALS lists email; nobody is
+// without it.
+func operatorAllowed(email string) bool {
+	for _, principal := range auth.ConfigFromEnv().Principals {
+		if email != "" && email == principal {
+			return true
+		}
+	}
+	return false
+}
+
+// googleSignIn exchanges the code Google sent back for an identity token
+// and returns its verified email.
+func googleSignIn(ctx context.Context, clientID, clientSecret, redirectURI, code string) (string, error) {
+	form := url.Values{"client_id": {clientID}, "client_secret": {clientSecret}, "code": {code}, "grant_type": {"authorization_code"}, "redirect_uri": {redirectURI}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, googleTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("http.Client.Do failed; %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token exchange failed; %d", resp.StatusCode)
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("json.Decoder.Decode failed; %w", err)
+	}
+	payload, err := idtoken.Validate(ctx, token.IDToken, clientID)
+	if err != nil {
+		return "", fmt.Errorf("idtoken.Validate failed; %w", err)
+	}
+	email, _ := payload.Claims["email"].(string)
+	if verified, _ := payload.Claims["email_verified"].(bool); !verified {
+		return "", fmt.Errorf("email not verified; %s", email)
+	}
+	return email, nil
+}
@@ -0,0 +1,88 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/conversation"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/lineapi"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+)
+
+// a reply token is only valid for about a minute; leave room for the call
+const defaultReplyWindow = 50 * time.Second
+
+func replyWindow(ctx context.Context) time.Duration {
+	if n, err := strconv.Atoi(dynconfig.Get(ctx, "REPLY_WINDOW_SECONDS")); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return defaultReplyWindow
+}
+
+// errUserUnreachable means the reply window passed and the LINE user ID of
+// the user is unknown, so there is no way left to reach them.
+var errUserUnreachable = errors.New("LINE user ID unknown; reply cannot be pushed")
+
+// deliver sends builder as the reply to the event received at receivedAt.
+// Once the reply window has passed the reply token is not tried at all and
+// the messages are pushed to the user instead. A reply that cannot be pushed
+// is logged, counted against the reply SLO and recorded as a lost intent;
+// it is not returned, since retrying cannot reach the user either.
+func deliver(ctx context.Context, lineClient lineapi.LineClient, userIDHash string, receivedAt time.Time, builder *reply.Builder) error {
+	err := deliverReply(ctx, lineClient, userIDHash, receivedAt, builder)
+	trackReply(ctx, receivedAt, err)
+	if errors.Is(err, errUserUnreachable) {
+		logging.Errorf(ctx, "reply lost; %v", err)
+		recordLostReply(ctx, err)
+		return nil
+	}
+	return err
+}
+
+func deliverReply(ctx context.Context, lineClient lineapi.LineClient, userIDHash string, receivedAt time.Time, builder *reply.Builder) error {
+	if receivedAt.IsZero() {
+		return sendReply(ctx, lineClient, builder)
+	}
+	latency := time.Since(receivedAt)
+	logging.Printf(ctx, "end-to-end latency: %dms", latency.Milliseconds())
+	if latency <= replyWindow(ctx) {
+		return sendReply(ctx, lineClient, builder)
+	}
+	logging.Warnf(ctx, "reply window passed after %dms, pushing instead", latency.Milliseconds())
+	return pushReply(ctx, lineClient, userIDHash, builder)
+}
+
+// pushReply sends the messages of builder as a push message. It fails with
+// errUserUnreachable when the LINE user ID of the user is unknown.
+func pushReply(ctx context.Context, lineClient lineapi.LineClient, userIDHash string, builder *reply.Builder) error {
+	req, err := builder.Build()
+	if err != nil {
+		return err
+	}
+	req.ReplyToken = ""
+	if dryRunEnabled(ctx) {
+		return dryRunReply(ctx, req)
+	}
+	client, err := clients.Firestore(ctx, projectIDOf(ctx))
+	if err != nil {
+		return err
+	}
+	userID, err := lineUserID(ctx, client, userIDHash)
+	if err != nil {
+		return err
+	}
+	if userID == "" {
+		return errUserUnreachable
+	}
+	if err := lineClient.Push(ctx, userID, req); err != nil {
+		return err
+	}
+	logging.Printf(ctx, "send push")
+	logConversation(ctx, conversation.Item{Kind: conversation.KindReply, Text: replyText(req)})
+	return nil
+}
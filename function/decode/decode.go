@@ -0,0 +1,88 @@
+package decode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/jsoncodec"
+)
+
+// ErrInvalid is matched by every error about the payload itself, as opposed
+// to the caller.
+var ErrInvalid = errors.New("invalid payload")
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) String() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+// Error lists what is wrong with a payload, field by field.
+type Error struct {
+	Fields []FieldError
+}
+
+func (e *Error) Error() string {
+	problems := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		problems[i] = f.String()
+	}
+	return fmt.Sprintf("%v; %s", ErrInvalid, strings.Join(problems, "; "))
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrInvalid
+}
+
+// Defaulter is implemented by payloads that fill in optional fields.
+type Defaulter interface {
+	Defaults()
+}
+
+// Validator is implemented by payloads with required fields.
+type Validator interface {
+	Validate() []FieldError
+}
+
+// Required reports field when value is empty.
+func Required(field, value string) []FieldError {
+	if value == "" {
+		return []FieldError{{Field: field, Message: "required"}}
+	}
+	return nil
+}
+
+// JSON decodes data into v, then applies its defaults and validation. A
+// panic in either is reported as an invalid payload rather than taking the
+// instance down.
+func JSON(data []byte, v interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &Error{Fields: []FieldError{{Message: fmt.Sprintf("panic: %v", r)}}}
+		}
+	}()
+	if err := jsoncodec.Unmarshal(data, v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return &Error{Fields: []FieldError{{Field: typeErr.Field, Message: fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value)}}}
+		}
+		return &Error{Fields: []FieldError{{Message: err.Error()}}}
+	}
+	if d, ok := v.(Defaulter); ok {
+		d.Defaults()
+	}
+	if val, ok := v.(Validator); ok {
+		if fields := val.Validate(); len(fields) > 0 {
+			return &Error{Fields: fields}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cas"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/conversation"
+	"github.com/hsmtkk/ubiquitous-couscous/function/eventlog"
+	"github.com/hsmtkk/ubiquitous-couscous/function/lineapi"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/postback"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+	"github.com/hsmtkk/ubiquitous-couscous/function/spam"
+	"github.com/hsmtkk/ubiquitous-couscous/function/visionresult"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	deleteDataCommand = "/deletemydata"
+	actionDeleteData  = "deleteData"
+
+	deletionsCollection = "deletions"
+
+	deletionByUser  = "user"
+	deletionByAdmin = "admin"
+)
+
+// deletionRecord on deletions/{id} is the audit trail of a purge: who asked
+// for it, when it finished and how much it deleted, nothing of the data.
+type deletionRecord struct {
+	UserIDHash  string         `firestore:"userIdHash" json:"userIdHash"`
+	RequestedBy string         `firestore:"requestedBy" json:"requestedBy"`
+	RequestedAt time.Time      `firestore:"requestedAt" json:"requestedAt"`
+	CompletedAt time.Time      `firestore:"completedAt,omitempty" json:"completedAt,omitempty"`
+	Deleted     map[string]int `firestore:"deleted" json:"deleted"`
+	Error       string         `firestore:"error,omitempty" json:"error,omitempty"`
+}
+
+// deleteDataPrompt answers "/deletemydata" with a quick reply to confirm;
+// nothing is deleted before the user taps it.
+func deleteDataPrompt(codec *postback.Codec) (string, []reply.QuickReplyItem, error) {
+	data, err := codec.Encode(actionDeleteData, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	text := "This deletes your photos, their analysis, your settings and our records of your messages. It cannot be undone."
+	return text, []reply.QuickReplyItem{{Label: "Delete everything", Data: data, DisplayText: "Delete my data"}}, nil
+}
+
+// deleteDataAction purges the user who confirmed "/deletemydata".
+func deleteDataAction(ctx context.Context, evt postback.Event, payload postback.Payload) error {
+	if evt.UserIDHash == "" {
+		return fmt.Errorf("delete data postback without user")
+	}
+	projectID := projectIDOf(ctx)
+	record, userID, err := forgetUser(ctx, projectID, evt.UserIDHash, deletionByUser)
+	if err != nil {
+		return err
+	}
+	lineClient, err := newLineClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	return confirmDeletion(ctx, lineClient, userID, evt.ReplyToken, record)
+}
+
+// deleteUserData purges a user on behalf of an operator: POST
+// {"userIdHash": "..."} or {"lineUserId": "U..."}. The user is sent the
+// confirmation when their LINE user ID is known.
+func deleteUserData(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "deleteUserData"})
+	logging.Printf(ctx, "delete user data")
+
+	if r.Method != http.MethodPost {
+		returnError(ctx, w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed; %s", r.Method))
+		return
+	}
+	var req struct {
+		UserIDHash string `json:"userIdHash"`
+		LineUserID string `json:"lineUserId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	if req.LineUserID != "" {
+		req.UserIDHash = logging.HashUserID(req.LineUserID)
+	}
+	if req.UserIDHash == "" {
+		returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("userIdHash or lineUserId is required"))
+		return
+	}
+	ctx = logging.With(ctx, logging.Fields{UserIDHash: req.UserIDHash})
+
+	ctx, err := requestTenant(ctx, r)
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	projectID := projectIDOf(ctx)
+	record, userID, err := forgetUser(ctx, projectID, req.UserIDHash, deletionByAdmin)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	if userID == "" {
+		userID = req.LineUserID
+	}
+	if userID != "" {
+		lineClient, err := newLineClient(ctx, projectID)
+		if err == nil {
+			err = confirmDeletion(ctx, lineClient, userID, "", record)
+		}
+		if err != nil {
+			// the data is gone either way
+			logging.Errorf(ctx, "confirm deletion failed; %v", err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(record); err != nil {
+		logging.Errorf(ctx, "json.Encoder.Encode failed; %v", err)
+	}
+}
+
+// forgetUser purges userIDHash and keeps the audit trail of it. It returns
+// the LINE user ID the user doc knew, read before it was deleted, so that
+// the user can still be told.
+func forgetUser(ctx context.Context, projectID, userIDHash, requestedBy string) (deletionRecord, string, error) {
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return deletionRecord{}, "", err
+	}
+	userID, err := lineUserID(ctx, client, userIDHash)
+	if err != nil {
+		return deletionRecord{}, "", err
+	}
+	record := deletionRecord{UserIDHash: userIDHash, RequestedBy: requestedBy, RequestedAt: time.Now(), Deleted: map[string]int{}}
+	ref := client.Collection(namespace.Collection(deletionsCollection)).NewDoc()
+	if _, err := ref.Set(ctx, record); err != nil {
+		return record, "", fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	purgeErr := purgeUser(ctx, client, userIDHash, record.Deleted)
+	if purgeErr != nil {
+		record.Error = purgeErr.Error()
+	} else {
+		record.CompletedAt = time.Now()
+	}
+	if _, err := ref.Set(ctx, record); err != nil {
+		return record, "", fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	if purgeErr != nil {
+		return record, "", purgeErr
+	}
+	logging.Printf(ctx, "user data deleted; %v", record.Deleted)
+	return record, userID, nil
+}
+
+// purgeUser deletes everything kept about userIDHash and counts it in
+// deleted, exports the user made included. Archived blobs other users also
+// sent are kept. The BigQuery
+// table over results/ loses the user's rows with the objects; those of the
+// pipeline event export are deleted. Archived webhooks are not searched;
+// they expire on their own.
+func purgeUser(ctx context.Context, client *firestore.Client, userIDHash string, deleted map[string]int) error {
+	docs := []struct {
+		name string
+		ref  *firestore.DocumentRef
+	}{
+		{"users", client.Collection(namespace.Collection("users")).Doc(userIDHash)},
+		{"conversations", client.Collection(namespace.Collection(conversation.Collection)).Doc(userIDHash)},
+		{"replyWindows", replyWindowDoc(client, userIDHash)},
+		{spam.FlagsCollection, client.Collection(namespace.Collection(spam.FlagsCollection)).Doc(userIDHash)},
+	}
+	for _, d := range docs {
+		n, err := deleteDocument(ctx, client, d.ref)
+		if err != nil {
+			return err
+		}
+		deleted[d.name] = n
+	}
+
+	queries := []struct {
+		name  string
+		query firestore.Query
+	}{
+		{"interactions", client.Collection(namespace.Collection("interactions")).Where("userIdHash", "==", userIDHash)},
+		{"replyIntents", client.Collection(namespace.Collection("replyIntents")).Where("userIdHash", "==", userIDHash)},
+		{"deadLetters", client.Collection(namespace.Collection("deadLetters")).Where("userIdHash", "==", userIDHash)},
+		{"sheetRows", client.Collection(namespace.Collection("sheetRows")).Where("userIdHash", "==", userIDHash)},
+		{"pipelineEvents", client.Collection(namespace.Collection(eventlog.Collection)).Where("userIdHash", "==", userIDHash)},
+	}
+	for _, q := range queries {
+		n, err := deleteQuery(ctx, client, q.name, q.query)
+		if err != nil {
+			return err
+		}
+		deleted[q.name] = n
+	}
+
+	shared, err := spam.New(client, spam.Config{}).ForgetSender(ctx, userIDHash)
+	if err != nil {
+		return err
+	}
+	deleted[spam.ImagesCollection] = shared
+
+	exported, err := purgeEventExport(ctx, projectIDOf(ctx), userIDHash)
+	if err != nil {
+		return err
+	}
+	deleted["bigquery:pipelineEvents"] = int(exported)
+
+	entries, err := cas.NewIndex(client).Entries(ctx, userIDHash)
+	if err != nil {
+		return err
+	}
+	blobs, err := forgetArchivedImages(ctx, client, tenantEnv(ctx, "ARCHIVE_BUCKET"), entries)
+	if err != nil {
+		return err
+	}
+	deleted[cas.Collection] = len(entries)
+	deleted[cas.Prefix] = blobs
+
+	c, err := cache.Open(ctx, cache.ConfigFromEnv())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for _, key := range userCacheKeys(userIDHash) {
+		if err := c.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	for _, p := range userPrefixes(ctx, userIDHash) {
+		if p.bucket == "" {
+			continue
+		}
+		n, err := deleteObjects(ctx, p.bucket, p.prefix, now)
+		if err != nil {
+			return err
+		}
+		deleted["gs://"+p.bucket+"/"+p.prefix] = n
+	}
+	return nil
+}
+
+// userCacheKeys are the cache entries kept per user. The export cooldown,
+// which names the export, lives in either backend; the others only in Redis
+// and deleting them elsewhere is a no-op.
+func userCacheKeys(userIDHash string) []string {
+	return []string{exportKey(userIDHash), imageIndexKey(userIDHash), compareFlagKey(userIDHash)}
+}
+
+// userPrefixes are the Cloud Storage prefixes holding objects of the user,
+// in the buckets of the tenant ctx is served for.
+func userPrefixes(ctx context.Context, userIDHash string) []struct{ bucket, prefix string } {
+	archive, annotation := tenantEnv(ctx, "ARCHIVE_BUCKET"), tenantEnv(ctx, "ANNOTATION_BUCKET")
+	return []struct{ bucket, prefix string }{
+		{archive, "archive/" + userIDHash + "/"},
+		{archive, "results/" + userIDHash + "/"},
+		{archive, visionresult.Prefix + userIDHash + "/"},
+		{annotation, "annotated/" + userIDHash + "/"},
+		{annotation, "imagemap/" + userIDHash + "/"},
+		{annotation, "echo/" + userIDHash + "/"},
+		{tenantEnv(ctx, "EXPORT_BUCKET"), "exports/" + userIDHash + "/"},
+	}
+}
+
+// deleteDocument deletes ref with all its subcollections and returns how
+// many documents that was. Documents that only hold subcollections are
+// found through DocumentRefs.
+func deleteDocument(ctx context.Context, client *firestore.Client, ref *firestore.DocumentRef) (int, error) {
+	total := 0
+	collections := ref.Collections(ctx)
+	for {
+		collection, err := collections.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return total, fmt.Errorf("firestore.CollectionIterator.Next failed; %w", err)
+		}
+		refs := collection.DocumentRefs(ctx)
+		for {
+			child, err := refs.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return total, fmt.Errorf("firestore.DocumentRefIterator.Next failed; %w", err)
+			}
+			n, err := deleteDocument(ctx, client, child)
+			if err != nil {
+				return total, err
+			}
+			total += n
+		}
+	}
+	if _, err := ref.Delete(ctx); err != nil {
+		return total, fmt.Errorf("firestore.DocumentRef.Delete failed; %w", err)
+	}
+	return total + 1, nil
+}
+
+// confirmDeletion pushes the confirmation when the LINE user ID is known and
+// uses replyToken otherwise.
+func confirmDeletion(ctx context.Context, lineClient lineapi.LineClient, userID, replyToken string, record deletionRecord) error {
+	text := fmt.Sprintf("Your data has been deleted (%s).", record.CompletedAt.UTC().Format("2006-01-02 15:04 MST"))
+	if userID == "" {
+		if replyToken == "" {
+			return nil
+		}
+		return sendReply(ctx, lineClient, reply.NewBuilder(replyToken).Text(text))
+	}
+	req := reply.Request{Messages: []reply.Message{reply.NewText(text)}}
+	if dryRunEnabled(ctx) {
+		return dryRunReply(ctx, req)
+	}
+	if err := lineClient.Push(ctx, userID, req); err != nil {
+		return err
+	}
+	logging.Printf(ctx, "send push")
+	return nil
+}
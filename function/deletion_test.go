@@ -0,0 +1,42 @@
+package function
+
+import (
+	"context"
+	"testing"
+)
+
+func TestUserPrefixesExport(t *testing.T) {
+	t.Setenv("ARCHIVE_BUCKET", "archive")
+	t.Setenv("ANNOTATION_BUCKET", "annotation")
+	t.Setenv("EXPORT_BUCKET", "export")
+
+	got := map[string]string{}
+	for _, p := range userPrefixes(context.Background(), "u1") {
+		got[p.prefix] = p.bucket
+	}
+	want := map[string]string{
+		"archive/u1/":   "archive",
+		"results/u1/":   "archive",
+		"annotated/u1/": "annotation",
+		"echo/u1/":      "annotation",
+		"exports/u1/":   "export",
+	}
+	for prefix, bucket := range want {
+		if got[prefix] != bucket {
+			t.Errorf("bucket of %s = %q, want %q", prefix, got[prefix], bucket)
+		}
+	}
+}
+
+func TestUserCacheKeysExport(t *testing.T) {
+	keys := userCacheKeys("u1")
+	for _, want := range []string{exportKey("u1"), imageIndexKey("u1"), compareFlagKey("u1")} {
+		found := false
+		for _, key := range keys {
+			found = found || key == want
+		}
+		if !found {
+			t.Errorf("userCacheKeys = %v, missing %s", keys, want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	vision "cloud.google.com/go/vision/apiv1"
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/costguard"
+	"github.com/hsmtkk/ubiquitous-couscous/function/langdetect"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/summary"
+	"github.com/hsmtkk/ubiquitous-couscous/function/visionclient"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	modeLabels   = "labels"
+	modeDescribe = "describe"
+)
+
+// label detection, OCR and image properties are billed separately
+const describeUnits = 3
+
+type description struct {
+	Summary string
+	// Text is the OCR result and Language its detected base language.
+	Text       string
+	Language   string
+	TextBlocks []analysis.TextBlock
+	Colors     []analysis.Color
+}
+
+// describeImage runs label detection, OCR and image properties concurrently
+// and composes them into one sentence style summary. OCR reads sideways
+// text again upright, see detectText.
+func describeImage(ctx context.Context, projectID string, imageBytes []byte) (description, error) {
+	budget, err := visionDailyBudget(ctx)
+	if err != nil {
+		return description{}, err
+	}
+	fsClient, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return description{}, err
+	}
+	if err := costguard.New(fsClient, budget).Reserve(ctx, describeUnits); err != nil {
+		return description{}, err
+	}
+
+	client, err := visionclient.Default.Get(ctx)
+	if err != nil {
+		return description{}, err
+	}
+	image, err := vision.NewImageFromReader(bytes.NewReader(imageBytes))
+	if err != nil {
+		return description{}, fmt.Errorf("vision.NewImageFromReader failed; %w", err)
+	}
+
+	var input summary.Input
+	var locale string
+	var colors []analysis.Color
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		release, err := acquireVision(egCtx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		labels, err := client.DetectLabels(egCtx, image, nil, 10)
+		if err != nil {
+			return fmt.Errorf("vision.ImageAnnotatorClient.DetectLabels failed; %w", err)
+		}
+		for _, label := range labels {
+			input.Labels = append(input.Labels, label.Description)
+		}
+		return nil
+	})
+	eg.Go(func() error {
+		release, err := acquireVision(egCtx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		ocr, err := detectText(egCtx, projectID, client, imageBytes)
+		if err != nil {
+			return err
+		}
+		input.Text = ocr.Text
+		locale = ocr.Locale
+		return nil
+	})
+	eg.Go(func() error {
+		release, err := acquireVision(egCtx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		props, err := client.DetectImageProperties(egCtx, image, nil)
+		if err != nil {
+			return fmt.Errorf("vision.ImageAnnotatorClient.DetectImageProperties failed; %w", err)
+		}
+		for _, c := range props.GetDominantColors().GetColors() {
+			input.Colors = append(input.Colors, summary.Color{
+				R:        uint8(c.GetColor().GetRed()),
+				G:        uint8(c.GetColor().GetGreen()),
+				B:        uint8(c.GetColor().GetBlue()),
+				Fraction: float64(c.GetPixelFraction()),
+			})
+			colors = append(colors, analysis.Color{
+				Hex:           fmt.Sprintf("#%02x%02x%02x", uint8(c.GetColor().GetRed()), uint8(c.GetColor().GetGreen()), uint8(c.GetColor().GetBlue())),
+				Score:         c.GetScore(),
+				PixelFraction: c.GetPixelFraction(),
+			})
+		}
+		return nil
+	})
+	if err := eg.Wait(); err != nil {
+		return description{}, err
+	}
+
+	text, err := summary.Compose(input)
+	if err != nil {
+		return description{}, err
+	}
+	logging.Printf(ctx, "summary: %s", text)
+	desc := description{Summary: text, Text: input.Text, Language: langdetect.Detect(input.Text, locale), Colors: colors}
+	if desc.Language == "" && input.Text != "" {
+		if desc.Language, err = detectLanguage(ctx, input.Text); err != nil {
+			// only the translate offer depends on it
+			logging.Errorf(ctx, "detect language failed; %v", err)
+		}
+	}
+	if input.Text != "" {
+		desc.TextBlocks = []analysis.TextBlock{{Text: input.Text, Locale: locale}}
+	}
+	return desc, nil
+}
@@ -0,0 +1,245 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/imagediff"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/phash"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	modeDiff       = "diff"
+	compareCommand = "/compare"
+	// a comparison the second picture never came for is forgotten
+	compareSessionTTL = 30 * time.Minute
+	// a finished comparison is kept this long, so that a redelivered second
+	// picture gets the comparison again rather than a plain answer
+	compareTombstoneTTL = 10 * time.Minute
+)
+
+// compareSession lives on users/{userIdHash}/context/compare from /compare
+// until the second picture arrived, and as a tombstone for a while after.
+// The first picture fills in the labels and the hash, the second the rest.
+type compareSession struct {
+	StartedAt     time.Time `firestore:"startedAt"`
+	FirstImageID  string    `firestore:"firstImageId"`
+	Labels        []string  `firestore:"labels"`
+	Hash          string    `firestore:"hash"`
+	SecondImageID string    `firestore:"secondImageId,omitempty"`
+	Summary       string    `firestore:"summary,omitempty"`
+	FinishedAt    time.Time `firestore:"finishedAt,omitempty"`
+}
+
+func (s *compareSession) finished() bool {
+	return !s.FinishedAt.IsZero()
+}
+
+// expiresAt is when the session, or its tombstone, is forgotten.
+func (s *compareSession) expiresAt() time.Time {
+	if s.finished() {
+		return s.FinishedAt.Add(compareTombstoneTTL)
+	}
+	return s.StartedAt.Add(compareSessionTTL)
+}
+
+// wants tells whether the picture imageID belongs to the comparison: any
+// picture while it waits, only the second once it finished.
+func (s *compareSession) wants(imageID string) bool {
+	return !s.finished() || s.SecondImageID == imageID
+}
+
+func compareSessionDoc(client *firestore.Client, userIDHash string) *firestore.DocumentRef {
+	return client.Collection(namespace.Collection("users")).Doc(userIDHash).Collection(namespace.Collection("context")).Doc("compare")
+}
+
+// loadCompareSession returns nil when the user is not comparing.
+func loadCompareSession(ctx context.Context, client *firestore.Client, userIDHash string) (*compareSession, error) {
+	snap, err := compareSessionDoc(client, userIDHash).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	return compareSessionOf(snap)
+}
+
+// compareSessionOf returns nil for an expired session.
+func compareSessionOf(snap *firestore.DocumentSnapshot) (*compareSession, error) {
+	var session compareSession
+	if err := snap.DataTo(&session); err != nil {
+		return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+	}
+	if time.Now().After(session.expiresAt()) {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+func compareFlagKey(userIDHash string) string {
+	return "compare:" + userIDHash
+}
+
+// comparing tells process to run the picture imageID of the user through
+// the diff mode. It is asked for every picture, so with Redis the answer is
+// cached until the session would expire: "1" while it waits, "0" without
+// one and "=" with the second image ID once it finished. Starting,
+// cancelling and finishing a comparison drop it.
+func comparing(ctx context.Context, projectID, userIDHash, imageID string) (bool, error) {
+	if userIDHash == "" {
+		return false, nil
+	}
+	var c cache.Cache
+	if cfg := cache.ConfigFromEnv(); cfg.Redis() {
+		opened, err := cache.Open(ctx, cfg)
+		if err != nil {
+			logging.Errorf(ctx, "cache.Open failed; %v", err)
+		} else {
+			c = opened
+			defer c.Close()
+			if value, err := c.Get(ctx, compareFlagKey(userIDHash)); err == nil {
+				return string(value) == "1" || string(value) == "="+imageID, nil
+			}
+		}
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return false, err
+	}
+	session, err := loadCompareSession(ctx, client, userIDHash)
+	if err != nil {
+		return false, err
+	}
+	if c != nil {
+		value, ttl := "0", compareSessionTTL
+		if session != nil {
+			value, ttl = "1", time.Until(session.expiresAt())
+			if session.finished() {
+				value = "=" + session.SecondImageID
+			}
+		}
+		if err := c.Set(ctx, compareFlagKey(userIDHash), []byte(value), ttl); err != nil {
+			logging.Errorf(ctx, "cache set failed; %v", err)
+		}
+	}
+	return session != nil && session.wants(imageID), nil
+}
+
+// forgetComparing drops the cached answer of comparing.
+func forgetComparing(ctx context.Context, userIDHash string) error {
+	cfg := cache.ConfigFromEnv()
+	if !cfg.Redis() {
+		return nil
+	}
+	c, err := cache.Open(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Delete(ctx, compareFlagKey(userIDHash))
+}
+
+// startComparison answers "/compare" and "/compare cancel".
+func startComparison(ctx context.Context, client *firestore.Client, userIDHash, args string) (string, error) {
+	if args == "cancel" {
+		if _, err := compareSessionDoc(client, userIDHash).Delete(ctx); err != nil {
+			return "", fmt.Errorf("firestore.DocumentRef.Delete failed; %w", err)
+		}
+		if err := forgetComparing(ctx, userIDHash); err != nil {
+			return "", err
+		}
+		return "Comparison cancelled.", nil
+	}
+	if _, err := compareSessionDoc(client, userIDHash).Set(ctx, compareSession{StartedAt: time.Now()}); err != nil {
+		return "", fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	if err := forgetComparing(ctx, userIDHash); err != nil {
+		return "", err
+	}
+	return "Send the first picture, then the one to compare it with.", nil
+}
+
+// diffStep keeps the labels and perceptual hash of the first picture of a
+// comparison and answers the second with what changed between the two. The
+// session is read and written in one transaction, so that two pictures sent
+// together cannot both be taken for the first. A redelivered picture gets
+// the answer it got the first time.
+func diffStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	client, err := clients.Firestore(ctx, state.projectID)
+	if err != nil {
+		return err
+	}
+	hash, err := phash.FromBytes(state.image)
+	if err != nil {
+		return err
+	}
+	imageID := state.procMsg.ImageID
+	ref := compareSessionDoc(client, state.procMsg.UserIDHash)
+
+	var summary string
+	var finished bool
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		summary, finished = "", false
+		snap, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		session, err := compareSessionOf(snap)
+		if err != nil || session == nil {
+			return err
+		}
+		switch {
+		case session.finished():
+			if session.SecondImageID == imageID {
+				summary = session.Summary
+			}
+			return nil
+		case session.FirstImageID == "" || session.FirstImageID == imageID:
+			session.FirstImageID = imageID
+			session.Labels = state.result.LabelNames()
+			session.Hash = hash.String()
+			summary = "Got the first picture. Now send the one to compare it with."
+			return tx.Set(ref, session)
+		}
+
+		firstHash, err := phash.Parse(session.Hash)
+		if err != nil {
+			return err
+		}
+		d := imagediff.Compare(imagediff.Snapshot{Labels: session.Labels, Hash: firstHash}, imagediff.Snapshot{Labels: state.result.LabelNames(), Hash: hash})
+		logging.Printf(ctx, "compare with %s: similarity %.2f, visual %.2f, labels %.2f", session.FirstImageID, d.Similarity(), d.Visual, d.Labels)
+		session.SecondImageID = imageID
+		session.Summary = fmt.Sprintf("Similarity: %.0f%%\nAdded: %s\nRemoved: %s\nUnchanged: %s",
+			d.Similarity()*100, joinOrNone(d.Added), joinOrNone(d.Removed), joinOrNone(d.Kept))
+		session.FinishedAt = time.Now()
+		summary, finished = session.Summary, true
+		return tx.Set(ref, session)
+	})
+	if err != nil {
+		return fmt.Errorf("firestore.Client.RunTransaction failed; %w", err)
+	}
+	if summary == "" {
+		return nil
+	}
+	if finished {
+		if err := forgetComparing(ctx, state.procMsg.UserIDHash); err != nil {
+			logging.Errorf(ctx, "forget comparison failed; %v", err)
+		}
+	}
+	// the comparison is the answer, also for a picture sent before
+	state.previouslySentAt = time.Time{}
+	state.summary = summary
+	return nil
+}
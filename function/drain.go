@@ -0,0 +1,75 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/backpressure"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/outbox"
+	"github.com/hsmtkk/ubiquitous-couscous/function/queue"
+	"github.com/hsmtkk/ubiquitous-couscous/function/topics"
+)
+
+const drainBatchSize = 100
+
+// publishOrBuffer publishes data with attrs, falling back to the Firestore
+// outbox when the queue is unavailable (q is nil) or the publish fails, so
+// that LINE still gets a 200 and the event is not lost.
+func publishOrBuffer(ctx context.Context, q queue.Queue, projectID, topic string, data []byte, attrs map[string]string) error {
+	cause := fmt.Errorf("queue unavailable")
+	if q != nil {
+		start := time.Now()
+		id, err := queue.PublishAttributes(ctx, q, topic, data, attrs)
+		backpressure.Default.ObservePublish(time.Since(start))
+		if err == nil {
+			logging.Printf(ctx, "publish: %s", id)
+			return nil
+		}
+		cause = err
+	}
+	logging.Errorf(ctx, "publish failed, buffering in outbox; %v", cause)
+
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	id, err := outbox.New(client).Put(ctx, topic, data, attrs, cause)
+	if err != nil {
+		return err
+	}
+	logging.Printf(ctx, "outbox: %s", id)
+	return nil
+}
+
+// drainOutbox is invoked by Cloud Scheduler and republishes buffered events.
+func drainOutbox(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "drainOutbox"})
+	logging.Printf(ctx, "drainOutbox")
+
+	projectID := os.Getenv("PROJECT_ID")
+
+	q, err := topics.Queue(ctx)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+
+	sent, failed, err := outbox.New(client).Drain(ctx, q, drainBatchSize)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	logging.Printf(ctx, "drain: %d sent, %d failed", sent, failed)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "sent %d, failed %d", sent, failed)
+}
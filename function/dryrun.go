@@ -0,0 +1,83 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/lineapi"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/queue"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+	"github.com/hsmtkk/ubiquitous-couscous/function/topics"
+)
+
+// dryRunHeader marks a webhook cmd/replay posts as a dry run; it must match
+// dryRunHeader of cmd/replay.
+const dryRunHeader = "X-Replay-Dry-Run"
+
+// dryRunEnabled is controlled by DRY_RUN=true, or per message by the dry run
+// attribute of a replayed webhook. The pipeline runs as usual but replies
+// are only logged and, with DRY_RUN_BUCKET set, stored in Cloud Storage
+// instead of being sent to LINE.
+func dryRunEnabled(ctx context.Context) bool {
+	return dynconfig.Get(ctx, "DRY_RUN") == "true" || queue.AttributesFrom(ctx)[topics.AttrDryRun] == "true"
+}
+
+// envelope is topics.Envelope, keeping the dry run attribute of the message
+// being handled.
+func envelope(ctx context.Context, correlationID string) map[string]string {
+	attrs := topics.Envelope(correlationID)
+	if queue.AttributesFrom(ctx)[topics.AttrDryRun] == "true" {
+		attrs[topics.AttrDryRun] = "true"
+	}
+	return attrs
+}
+
+func dryRunReply(ctx context.Context, req reply.Request) error {
+	body, err := lineapi.ReplyBody(req)
+	if err != nil {
+		return err
+	}
+	logging.Printf(ctx, "dry run reply: %s", body)
+	recordDryRun(ctx)
+
+	bucket := tenantEnv(ctx, "DRY_RUN_BUCKET")
+	if bucket == "" {
+		return nil
+	}
+	id := logging.FromContext(ctx).CorrelationID
+	if id == "" {
+		id = newCorrelationID()
+	}
+	now := time.Now().UTC()
+	name := fmt.Sprintf("dry-run/%s/%s-%s.json", now.Format("2006-01-02"), now.Format("150405"), id)
+	if err := writeObject(ctx, bucket, name, "application/json", body, nil); err != nil {
+		return err
+	}
+	logging.Printf(ctx, "dry run reply stored: gs://%s/%s", bucket, name)
+	return nil
+}
+
+// recordDryRun writes the interactions record a sent reply would get, marked
+// as a dry run, so that redelivery checks and cmd/loadtest work the same.
+func recordDryRun(ctx context.Context) {
+	correlationID := logging.FromContext(ctx).CorrelationID
+	projectID := projectIDOf(ctx)
+	if correlationID == "" || projectID == "" {
+		return
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		logging.Errorf(ctx, "clients.Firestore failed; %v", err)
+		return
+	}
+	fields := map[string]interface{}{"repliedAt": time.Now(), "dryRun": true}
+	if _, err := client.Collection(namespace.Collection("interactions")).Doc(correlationID).Set(ctx, fields, firestore.MergeAll); err != nil {
+		logging.Errorf(ctx, "firestore.DocumentRef.Set failed; %v", err)
+	}
+}
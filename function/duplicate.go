@@ -0,0 +1,225 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/phash"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// images whose hashes differ in at most this many bits are treated as the same picture
+	duplicateDistance = 6
+	recentImageLimit  = 100
+	// how long a cached index of a user's images lives after the last upload
+	imageIndexTTL = 30 * 24 * time.Hour
+)
+
+type imageRecord struct {
+	ImageID string   `firestore:"imageId"`
+	Hash    string   `firestore:"hash"`
+	Labels  []string `firestore:"labels"`
+	// Categories are the taxonomy categories of Labels, for analytics queries.
+	Categories []string `firestore:"categories"`
+	// Result keeps the label scores; records written before it existed only
+	// have Labels.
+	Result    *analysis.Result `firestore:"result,omitempty"`
+	CreatedAt time.Time        `firestore:"createdAt"`
+}
+
+// labels returns the scored labels of the record, unscored for old records.
+func (r imageRecord) labels() []analysis.Label {
+	return r.analysisResult().Labels
+}
+
+func (r imageRecord) analysisResult() analysis.Result {
+	if r.Result != nil {
+		return *r.Result
+	}
+	result := analysis.New()
+	result.AddFeature(analysis.FeatureLabels)
+	result.Labels = analysis.Unscored(r.Labels)
+	return result
+}
+
+// imageStore keeps the recent images of each user for duplicate detection.
+type imageStore interface {
+	// recentImages returns at most recentImageLimit records, newest first.
+	recentImages(ctx context.Context, userIDHash string) ([]imageRecord, error)
+	saveImage(ctx context.Context, userIDHash string, record imageRecord) error
+	deleteImage(ctx context.Context, userIDHash, imageID string) error
+}
+
+// openImageStore keeps the records on the Firestore subcollection, read
+// through a Redis index when Redis is configured. The returned function
+// releases the store.
+func openImageStore(ctx context.Context, client *firestore.Client) (imageStore, func(), error) {
+	cfg := cache.ConfigFromEnv()
+	if !cfg.Redis() {
+		return firestoreImages{client: client}, func() {}, nil
+	}
+	c, err := cache.Open(ctx, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cachedImages{firestoreImages: firestoreImages{client: client}, cache: c}, func() { c.Close() }, nil
+}
+
+func findDuplicate(ctx context.Context, store imageStore, userIDHash string, hash phash.Hash) (*imageRecord, error) {
+	records, err := store.recentImages(ctx, userIDHash)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		recordHash, err := phash.Parse(record.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if phash.Distance(hash, recordHash) <= duplicateDistance {
+			return &record, nil
+		}
+	}
+	return nil, nil
+}
+
+type firestoreImages struct {
+	client *firestore.Client
+}
+
+func userImages(client *firestore.Client, userIDHash string) *firestore.CollectionRef {
+	return client.Collection(namespace.Collection("users")).Doc(userIDHash).Collection(namespace.Collection("images"))
+}
+
+func (s firestoreImages) recentImages(ctx context.Context, userIDHash string) ([]imageRecord, error) {
+	iter := userImages(s.client, userIDHash).OrderBy("createdAt", firestore.Desc).Limit(recentImageLimit).Documents(ctx)
+	defer iter.Stop()
+	records := []imageRecord{}
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestore.DocumentIterator.Next failed; %w", err)
+		}
+		var record imageRecord
+		if err := snap.DataTo(&record); err != nil {
+			return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+		}
+		records = append(records, record)
+	}
+}
+
+func (s firestoreImages) saveImage(ctx context.Context, userIDHash string, record imageRecord) error {
+	if _, err := userImages(s.client, userIDHash).Doc(record.ImageID).Set(ctx, record); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	return nil
+}
+
+func (s firestoreImages) deleteImage(ctx context.Context, userIDHash, imageID string) error {
+	if _, err := userImages(s.client, userIDHash).Doc(imageID).Delete(ctx); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Delete failed; %w", err)
+	}
+	return nil
+}
+
+// cachedImages writes through to Firestore, which everything querying the
+// images collection reads, and keeps each user's recent records in Redis as
+// one JSON list so that duplicate detection reads them in one round trip.
+// A cache that fails is logged and dropped; Firestore stays the truth.
+type cachedImages struct {
+	firestoreImages
+	cache cache.Cache
+}
+
+func imageIndexKey(userIDHash string) string {
+	return "images:" + userIDHash
+}
+
+func (s cachedImages) recentImages(ctx context.Context, userIDHash string) ([]imageRecord, error) {
+	records, err := s.cachedRecords(ctx, userIDHash)
+	if err == nil {
+		return records, nil
+	}
+	if !errors.Is(err, cache.ErrMiss) {
+		logging.Errorf(ctx, "image index read failed; %v", err)
+	}
+	records, err = s.firestoreImages.recentImages(ctx, userIDHash)
+	if err != nil {
+		return nil, err
+	}
+	s.cacheRecords(ctx, userIDHash, records)
+	return records, nil
+}
+
+func (s cachedImages) cachedRecords(ctx context.Context, userIDHash string) ([]imageRecord, error) {
+	value, err := s.cache.Get(ctx, imageIndexKey(userIDHash))
+	if err != nil {
+		return nil, err
+	}
+	var records []imageRecord
+	if err := json.Unmarshal(value, &records); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	return records, nil
+}
+
+func (s cachedImages) cacheRecords(ctx context.Context, userIDHash string, records []imageRecord) {
+	value, err := json.Marshal(records)
+	if err == nil {
+		err = s.cache.Set(ctx, imageIndexKey(userIDHash), value, imageIndexTTL)
+	}
+	if err != nil {
+		logging.Errorf(ctx, "image index write failed; %v", err)
+		s.invalidate(ctx, userIDHash)
+	}
+}
+
+// invalidate has the next read load the index from Firestore again.
+func (s cachedImages) invalidate(ctx context.Context, userIDHash string) {
+	if err := s.cache.Delete(ctx, imageIndexKey(userIDHash)); err != nil {
+		logging.Errorf(ctx, "image index delete failed; %v", err)
+	}
+}
+
+// saveImage updates a cached index in place, a read-modify-write; of two
+// concurrent uploads by the same user one may be missing from the index
+// until it expires, which only costs a missed duplicate.
+func (s cachedImages) saveImage(ctx context.Context, userIDHash string, record imageRecord) error {
+	if err := s.firestoreImages.saveImage(ctx, userIDHash, record); err != nil {
+		return err
+	}
+	records, err := s.cachedRecords(ctx, userIDHash)
+	if errors.Is(err, cache.ErrMiss) {
+		return nil
+	}
+	if err != nil {
+		logging.Errorf(ctx, "image index read failed; %v", err)
+		s.invalidate(ctx, userIDHash)
+		return nil
+	}
+	records = append([]imageRecord{record}, records...)
+	if len(records) > recentImageLimit {
+		records = records[:recentImageLimit]
+	}
+	s.cacheRecords(ctx, userIDHash, records)
+	return nil
+}
+
+func (s cachedImages) deleteImage(ctx context.Context, userIDHash, imageID string) error {
+	if err := s.firestoreImages.deleteImage(ctx, userIDHash, imageID); err != nil {
+		return err
+	}
+	s.invalidate(ctx, userIDHash)
+	return nil
+}
@@ -0,0 +1,124 @@
+package dynconfig
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultTTL   = 30 * time.Second
+	fetchTimeout = 10 * time.Second
+)
+
+// Store serves settings from the config/runtime Firestore document, falling
+// back to the environment variable of the same name. The document is read at
+// most once per TTL per instance, so an edit takes effect within that time
+// without a redeploy.
+type Store struct {
+	projectID string
+	ttl       time.Duration
+	reloads   singleflight.Group
+
+	mu        sync.Mutex
+	values    map[string]string
+	fetchedAt time.Time
+}
+
+func New(projectID string, ttl time.Duration) *Store {
+	return &Store{projectID: projectID, ttl: ttl}
+}
+
+// Default is configured by PROJECT_ID and CONFIG_TTL (a Go duration).
+var Default = New(os.Getenv("PROJECT_ID"), ttlFromEnv())
+
+func ttlFromEnv() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("CONFIG_TTL"))
+	if err != nil || ttl <= 0 {
+		return defaultTTL
+	}
+	return ttl
+}
+
+// Get returns the value of Default for key.
+func Get(ctx context.Context, key string) string {
+	return Default.Get(ctx, key)
+}
+
+func (s *Store) Get(ctx context.Context, key string) string {
+	if value, ok := s.lookup(ctx, key); ok {
+		return value
+	}
+	return os.Getenv(key)
+}
+
+func (s *Store) lookup(ctx context.Context, key string) (string, bool) {
+	if s.projectID == "" {
+		return "", false
+	}
+	s.mu.Lock()
+	stale := time.Since(s.fetchedAt) >= s.ttl
+	loaded := s.values != nil
+	s.mu.Unlock()
+	if stale {
+		done := s.reload(ctx)
+		// only the first load is waited for; later ones serve the old values
+		if !loaded {
+			<-done
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// reload fetches the document once for every caller that finds it stale at
+// the same time, without holding the lock, so that a slow Firestore does not
+// hold up the readers of the values already fetched. The fetch outlives the
+// request of the caller that started it.
+func (s *Store) reload(ctx context.Context) <-chan singleflight.Result {
+	return s.reloads.DoChan("runtime", func() (interface{}, error) {
+		fetchCtx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+		defer cancel()
+		values, err := s.fetch(fetchCtx)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err != nil {
+			// keep serving what we had; retry after another TTL
+			logging.Errorf(ctx, "config reload failed; %v", err)
+		} else {
+			s.values = values
+		}
+		s.fetchedAt = time.Now()
+		return nil, nil
+	})
+}
+
+func (s *Store) fetch(ctx context.Context) (map[string]string, error) {
+	client, err := clients.Firestore(ctx, s.projectID)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := client.Collection(namespace.Collection("config")).Doc("runtime").Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	values := map[string]string{}
+	for key, value := range snap.Data() {
+		values[key] = fmt.Sprint(value)
+	}
+	return values, nil
+}
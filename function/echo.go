@@ -0,0 +1,70 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/annotate"
+	"github.com/hsmtkk/ubiquitous-couscous/function/imageutil"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+)
+
+const (
+	defaultEchoLabels = 3
+	// LINE shows previews of at most 1MB; this keeps the echo well below
+	echoMaxSize = 1024
+)
+
+func echoObjectName(userIDHash, imageID string) string {
+	return fmt.Sprintf("echo/%s/%s.jpg", userIDHash, imageID)
+}
+
+// echoStep replies with the image itself, its top params["labels"] labels
+// written on a banner across its bottom, for users who turned "/echo" on.
+// The copy goes to ANNOTATION_BUCKET, see uploadImage; of an image
+// SafeSearch flags only a pixelated copy is echoed.
+func echoStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	bucket := tenantEnv(ctx, "ANNOTATION_BUCKET")
+	labels := state.result.Labels
+	if bucket == "" || len(labels) == 0 || state.procMsg.UserIDHash == "" || state.annotatedImageURL != "" {
+		return nil
+	}
+	n := defaultEchoLabels
+	if v, err := strconv.Atoi(params["labels"]); err == nil && v > 0 {
+		n = v
+	}
+	if len(labels) > n {
+		labels = labels[:n]
+	}
+	lines := make([]string, len(labels))
+	for i, label := range labels {
+		lines[i] = fmt.Sprintf("%s %.0f%%", label.Name, label.Score*100)
+	}
+	if err := ensureSafeSearch(ctx, state); err != nil {
+		return err
+	}
+	image := state.image
+	if state.unsafe {
+		pixelated, err := moderateImage(image)
+		if err != nil {
+			return err
+		}
+		image = pixelated
+	}
+	img, _, err := imageutil.Decode(image)
+	if err != nil {
+		return err
+	}
+	b, err := imageutil.EncodeJPEG(annotate.Banner(imageutil.Resize(img, echoMaxSize), lines))
+	if err != nil {
+		return err
+	}
+	url, err := uploadImage(ctx, bucket, echoObjectName(state.procMsg.UserIDHash, state.procMsg.ImageID), b)
+	if err != nil {
+		return err
+	}
+	state.annotatedImageURL = url
+	logging.Printf(ctx, "echo with %d labels", len(labels))
+	return nil
+}
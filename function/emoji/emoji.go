@@ -0,0 +1,70 @@
+package emoji
+
+import (
+	_ "embed"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+//go:embed emoji.json
+var emojiJSON []byte
+
+var byKeyword = mustLoad()
+
+// keywords are tried longest first so that a longer keyword wins over its
+// parts.
+var keywords = sortedKeywords()
+
+func mustLoad() map[string]string {
+	var m map[string]string
+	if err := json.Unmarshal(emojiJSON, &m); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func sortedKeywords() []string {
+	ks := make([]string, 0, len(byKeyword))
+	for k := range byKeyword {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		if len(ks[i]) != len(ks[j]) {
+			return len(ks[i]) > len(ks[j])
+		}
+		return ks[i] < ks[j]
+	})
+	return ks
+}
+
+// For returns the emoji of the first keyword that is the label or a run of
+// its words, matched the way taxonomy categories are, or "" if none is.
+func For(label string) string {
+	words := " " + strings.ToLower(strings.Join(strings.Fields(label), " ")) + " "
+	for _, keyword := range keywords {
+		if strings.Contains(words, " "+keyword+" ") {
+			return byKeyword[keyword]
+		}
+	}
+	return ""
+}
+
+// ForLabels maps labels in order, skipping those without an emoji and
+// repeated emojis, and stops at max.
+func ForLabels(labels []string, max int) []string {
+	results := []string{}
+	seen := map[string]bool{}
+	for _, label := range labels {
+		if len(results) == max {
+			break
+		}
+		e := For(label)
+		if e == "" || seen[e] {
+			continue
+		}
+		seen[e] = true
+		results = append(results, e)
+	}
+	return results
+}
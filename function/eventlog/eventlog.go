@@ -0,0 +1,170 @@
+// Package eventlog keeps the state transitions of each message as append-only
+// events, so that what happened to a message can be read back exactly.
+package eventlog
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	Collection       = "pipelineEvents"
+	countsCollection = "pipelineEventCounts"
+	// a day's counts are spread over this many documents, each taking a
+	// share of the increments
+	countShards = 16
+)
+
+// States a message passes through, in order; Failed may follow any of them
+// and be followed by a retry.
+const (
+	Received  = "received"
+	Queued    = "queued"
+	Analyzing = "analyzing"
+	Analyzed  = "analyzed"
+	Replying  = "replying"
+	Replied   = "replied"
+	Failed    = "failed"
+)
+
+// States lists the states in pipeline order.
+var States = []string{Received, Queued, Analyzing, Analyzed, Replying, Replied, Failed}
+
+// Event is one state transition of a message.
+type Event struct {
+	CorrelationID string    `firestore:"correlationId" json:"correlationId"`
+	State         string    `firestore:"state" json:"state"`
+	Function      string    `firestore:"function" json:"function"`
+	UserIDHash    string    `firestore:"userIdHash,omitempty" json:"userIdHash,omitempty"`
+	ImageID       string    `firestore:"imageId,omitempty" json:"imageId,omitempty"`
+	Attempt       int       `firestore:"attempt" json:"attempt"`
+	Error         string    `firestore:"error,omitempty" json:"error,omitempty"`
+	At            time.Time `firestore:"at" json:"at"`
+}
+
+// Store keeps the events on pipelineEvents and counts them per day and
+// state on the shards pipelineEventCounts/{yyyy-mm-dd}-{n}.
+type Store struct {
+	client *firestore.Client
+}
+
+func New(client *firestore.Client) *Store {
+	return &Store{client: client}
+}
+
+func day(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// Append stores e, stamping it with the current time when it has none, and
+// returns it as stored. Events are created, never updated, so an event
+// already stored is an error.
+func (s *Store) Append(ctx context.Context, e Event) (Event, error) {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	// the ID sorts by time and keeps the events of one message together
+	id := fmt.Sprintf("%s-%019d-%s-%d", e.CorrelationID, e.At.UnixNano(), e.State, e.Attempt)
+	if _, err := s.client.Collection(namespace.Collection(Collection)).Doc(id).Create(ctx, e); err != nil {
+		return e, fmt.Errorf("firestore.DocumentRef.Create failed; %w", err)
+	}
+	return e, nil
+}
+
+// Count adds e to the counts of its day on a random shard. It is kept apart
+// from Append so that a contended counter never loses the event itself.
+func (s *Store) Count(ctx context.Context, e Event) error {
+	ref := s.client.Collection(namespace.Collection(countsCollection)).Doc(fmt.Sprintf("%s-%02d", day(e.At), rand.Intn(countShards)))
+	data := map[string]interface{}{"day": day(e.At), e.State: firestore.Increment(1)}
+	if _, err := ref.Set(ctx, data, firestore.MergeAll); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	return nil
+}
+
+// History returns the events of a message, oldest first.
+func (s *Store) History(ctx context.Context, correlationID string) ([]Event, error) {
+	iter := s.client.Collection(namespace.Collection(Collection)).Where("correlationId", "==", correlationID).Documents(ctx)
+	defer iter.Stop()
+	events := []Event{}
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestore.DocumentIterator.Next failed; %w", err)
+		}
+		var e Event
+		if err := snap.DataTo(&e); err != nil {
+			return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+		}
+		events = append(events, e)
+	}
+	// sorted here rather than in the query, which would need a composite index
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.Before(events[j].At) })
+	return events, nil
+}
+
+// Counts returns how many events of each state were recorded on the UTC day
+// of t, summing its shards.
+func (s *Store) Counts(ctx context.Context, t time.Time) (map[string]int64, error) {
+	iter := s.client.Collection(namespace.Collection(countsCollection)).Where("day", "==", day(t)).Documents(ctx)
+	defer iter.Stop()
+	counts := map[string]int64{}
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return counts, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestore.DocumentIterator.Next failed; %w", err)
+		}
+		for state, v := range snap.Data() {
+			if n, ok := v.(int64); ok {
+				counts[state] += n
+			}
+		}
+	}
+}
+
+// Timeline is what the events of a message add up to.
+type Timeline struct {
+	CorrelationID string `json:"correlationId"`
+	// State is the state of the last event.
+	State    string `json:"state"`
+	Attempts int    `json:"attempts"`
+	// Since holds the milliseconds from the first Received event to the
+	// first event of each later state.
+	Since  map[string]int64 `json:"since"`
+	Events []Event          `json:"events"`
+}
+
+// Replay reconstructs the timeline of a message from its events, oldest
+// first.
+func Replay(correlationID string, events []Event) Timeline {
+	t := Timeline{CorrelationID: correlationID, Since: map[string]int64{}, Events: events}
+	var received time.Time
+	for _, e := range events {
+		t.State = e.State
+		if e.Attempt+1 > t.Attempts {
+			t.Attempts = e.Attempt + 1
+		}
+		if e.State == Received && received.IsZero() {
+			received = e.At
+			continue
+		}
+		if _, ok := t.Since[e.State]; ok || received.IsZero() {
+			continue
+		}
+		t.Since[e.State] = e.At.Sub(received).Milliseconds()
+	}
+	return t
+}
@@ -0,0 +1,211 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/eventlog"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/queue"
+	"github.com/hsmtkk/ubiquitous-couscous/function/slo"
+	bigquery "google.golang.org/api/bigquery/v2"
+)
+
+// how long a BigQuery request waits for its job before polling again
+const bigQueryTimeout = time.Minute
+
+// pipelineEventsEnabled turns on recording state transitions,
+// PIPELINE_EVENTS.
+func pipelineEventsEnabled(ctx context.Context) bool {
+	return dynconfig.Get(ctx, "PIPELINE_EVENTS") == "true"
+}
+
+// recordEvent appends a state transition of the message in ctx at, or now
+// when at is zero. Every event is logged as "pipeline event: <state>" too,
+// without the user, which the log sink exports to BigQuery. The event names
+// the user and the image only when recordingAllowed; the counts do not
+// need them. Messages ending up replied or failed feed the pipeline SLO.
+// Failing to record is only logged.
+func recordEvent(ctx context.Context, state string, at time.Time, cause error) {
+	switch state {
+	case eventlog.Replied, eventlog.Failed:
+		trackSLO(ctx, slo.Event{Objective: sloPipeline, Good: state == eventlog.Replied})
+	}
+	fields := logging.FromContext(ctx)
+	if !pipelineEventsEnabled(ctx) || fields.CorrelationID == "" {
+		return
+	}
+	e := eventlog.Event{
+		CorrelationID: fields.CorrelationID,
+		State:         state,
+		Function:      fields.Function,
+		Attempt:       queue.RetryFrom(ctx).Count,
+		At:            at,
+	}
+	if recordingAllowed(ctx) {
+		e.UserIDHash, e.ImageID = fields.UserIDHash, fields.ImageID
+	}
+	if cause != nil {
+		e.Error = cause.Error()
+	}
+	logging.Printf(logging.WithoutUser(ctx), "pipeline event: %s", state)
+	client, err := clients.Firestore(ctx, projectIDOf(ctx))
+	if err != nil {
+		logging.Errorf(ctx, "clients.Firestore failed; %v", err)
+		return
+	}
+	store := eventlog.New(client)
+	e, err = store.Append(ctx, e)
+	if err != nil {
+		logging.Errorf(ctx, "record pipeline event failed; %v", err)
+		return
+	}
+	if err := store.Count(ctx, e); err != nil {
+		logging.Errorf(ctx, "count pipeline event failed; %v", err)
+	}
+}
+
+// trackStage records state once the handler gets to work on a message, and
+// returns the func to defer that records done or Failed by its outcome.
+func trackStage(ctx context.Context, state, done string) func(error) {
+	recordEvent(ctx, state, time.Time{}, nil)
+	return func(err error) {
+		if err != nil {
+			recordEvent(ctx, eventlog.Failed, time.Time{}, err)
+			return
+		}
+		if done != "" {
+			recordEvent(ctx, done, time.Time{}, nil)
+		}
+	}
+}
+
+// messageEvents returns the events of the message given by correlationId
+// and the timeline they reconstruct.
+func messageEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "messageEvents"})
+	logging.Printf(ctx, "message events")
+
+	correlationID := r.URL.Query().Get("correlationId")
+	if correlationID == "" {
+		returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("correlationId is required"))
+		return
+	}
+	ctx, err := requestTenant(ctx, r)
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	client, err := clients.Firestore(ctx, projectIDOf(ctx))
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	events, err := eventlog.New(client).History(ctx, correlationID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(events) == 0 {
+		returnError(ctx, w, http.StatusNotFound, fmt.Errorf("no events; %s", correlationID))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(eventlog.Replay(correlationID, events)); err != nil {
+		logging.Errorf(ctx, "json.Encoder.Encode failed; %v", err)
+	}
+}
+
+// purgeEventExport deletes the rows of userIDHash from the tables the log
+// sink exports pipeline events to, PIPELINE_EVENTS_DATASET, and returns how
+// many there were. Events are logged without the user now, so only rows
+// exported before carry one; the tables expire on their own as well.
+func purgeEventExport(ctx context.Context, projectID, userIDHash string) (int64, error) {
+	datasetID := os.Getenv("PIPELINE_EVENTS_DATASET")
+	if datasetID == "" {
+		return 0, nil
+	}
+	svc, err := bigquery.NewService(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("bigquery.NewService failed; %w", err)
+	}
+	dataset, err := svc.Datasets.Get(projectID, datasetID).Context(ctx).Do()
+	if err != nil {
+		return 0, fmt.Errorf("bigquery.DatasetsService.Get failed; %w", err)
+	}
+	var deleted int64
+	err = svc.Tables.List(projectID, datasetID).Pages(ctx, func(page *bigquery.TableList) error {
+		for _, t := range page.Tables {
+			n, err := purgeEventTable(ctx, svc, dataset.Location, t.TableReference, userIDHash)
+			if err != nil {
+				return err
+			}
+			deleted += n
+		}
+		return nil
+	})
+	if err != nil {
+		return deleted, fmt.Errorf("bigquery.TablesListCall.Pages failed; %w", err)
+	}
+	return deleted, nil
+}
+
+func purgeEventTable(ctx context.Context, svc *bigquery.Service, location string, ref *bigquery.TableReference, userIDHash string) (int64, error) {
+	table, err := svc.Tables.Get(ref.ProjectId, ref.DatasetId, ref.TableId).Context(ctx).Do()
+	if err != nil {
+		return 0, fmt.Errorf("bigquery.TablesService.Get failed; %w", err)
+	}
+	// a table that never got an entry with the user has no column for it
+	if !hasUserColumn(table.Schema) {
+		return 0, nil
+	}
+	useLegacySQL := false
+	resp, err := svc.Jobs.Query(ref.ProjectId, &bigquery.QueryRequest{
+		Query:         fmt.Sprintf("DELETE FROM `%s.%s.%s` WHERE jsonPayload.userIdHash = @user", ref.ProjectId, ref.DatasetId, ref.TableId),
+		UseLegacySql:  &useLegacySQL,
+		ParameterMode: "NAMED",
+		QueryParameters: []*bigquery.QueryParameter{{
+			Name:           "user",
+			ParameterType:  &bigquery.QueryParameterType{Type: "STRING"},
+			ParameterValue: &bigquery.QueryParameterValue{Value: userIDHash},
+		}},
+		Location:  location,
+		TimeoutMs: bigQueryTimeout.Milliseconds(),
+	}).Context(ctx).Do()
+	if err != nil {
+		return 0, fmt.Errorf("bigquery.JobsService.Query failed; %w", err)
+	}
+	complete, affected := resp.JobComplete, resp.NumDmlAffectedRows
+	for !complete {
+		res, err := svc.Jobs.GetQueryResults(ref.ProjectId, resp.JobReference.JobId).Location(location).TimeoutMs(bigQueryTimeout.Milliseconds()).Context(ctx).Do()
+		if err != nil {
+			return 0, fmt.Errorf("bigquery.JobsService.GetQueryResults failed; %w", err)
+		}
+		complete, affected = res.JobComplete, res.NumDmlAffectedRows
+	}
+	return affected, nil
+}
+
+func hasUserColumn(schema *bigquery.TableSchema) bool {
+	if schema == nil {
+		return false
+	}
+	for _, f := range schema.Fields {
+		if !strings.EqualFold(f.Name, "jsonPayload") {
+			continue
+		}
+		for _, sub := range f.Fields {
+			if strings.EqualFold(sub.Name, "userIdHash") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/exif"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/postback"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+)
+
+const actionExifLocation = "exifLocation"
+
+func exifEnabled(ctx context.Context) bool {
+	return dynconfig.Get(ctx, "EXIF_REPLY") == "true"
+}
+
+// extractExif returns nil when the image carries no usable metadata.
+func extractExif(ctx context.Context, image []byte) *exif.Metadata {
+	if !exifEnabled(ctx) {
+		return nil
+	}
+	meta, err := exif.Extract(image)
+	if err != nil {
+		logging.Printf(ctx, "no exif; %v", err)
+		return nil
+	}
+	return &meta
+}
+
+// addExif appends the metadata section to the reply and, for photos with GPS
+// data, either the location itself when the user opted in or a quick reply
+// to opt in.
+func addExif(ctx context.Context, projectID string, sendMsg sendMessage, codec *postback.Codec, builder *reply.Builder) error {
+	meta := sendMsg.Exif
+	if meta == nil {
+		return nil
+	}
+	if text := meta.Format(); text != "" {
+		builder.Text(text)
+	}
+	if !meta.HasGPS || sendMsg.UserIDHash == "" {
+		return nil
+	}
+
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	prefs, err := loadPreferences(ctx, client, sendMsg.UserIDHash)
+	if err != nil {
+		return err
+	}
+	if prefs.ExifLocation {
+		builder.Location("Photo location", formatCoordinates(meta.Latitude, meta.Longitude), meta.Latitude, meta.Longitude)
+		return nil
+	}
+	data, err := codec.Encode(actionExifLocation, map[string]string{
+		"lat": strconv.FormatFloat(meta.Latitude, 'f', 6, 64),
+		"lng": strconv.FormatFloat(meta.Longitude, 'f', 6, 64),
+	})
+	if err != nil {
+		return err
+	}
+	builder.QuickReply(reply.QuickReplyItem{Label: "Show location", Data: data, DisplayText: "Show photo locations"})
+	return nil
+}
+
+// exifLocationAction records the opt in and answers with the location of the
+// photo the quick reply was attached to.
+func exifLocationAction(ctx context.Context, evt postback.Event, payload postback.Payload) error {
+	projectID := projectIDOf(ctx)
+	lat, err := strconv.ParseFloat(payload.Param("lat"), 64)
+	if err != nil {
+		return fmt.Errorf("invalid lat; %w", err)
+	}
+	lng, err := strconv.ParseFloat(payload.Param("lng"), 64)
+	if err != nil {
+		return fmt.Errorf("invalid lng; %w", err)
+	}
+
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	if err := savePreference(ctx, client, evt.UserIDHash, "exifLocation", true); err != nil {
+		return err
+	}
+
+	lineClient, err := newLineClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	builder := reply.NewBuilder(evt.ReplyToken).
+		Location("Photo location", formatCoordinates(lat, lng), lat, lng).
+		Text("From now on the location of photos with GPS data is shown.")
+	return sendReply(ctx, lineClient, builder)
+}
+
+func formatCoordinates(lat, lng float64) string {
+	return fmt.Sprintf("%.5f, %.5f", lat, lng)
+}
@@ -0,0 +1,253 @@
+package exif
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrNoExif = errors.New("no exif data")
+
+const (
+	tagMake            = 0x010f
+	tagModel           = 0x0110
+	tagDateTime        = 0x0132
+	tagExifIFD         = 0x8769
+	tagGPSIFD          = 0x8825
+	tagDateTimeOrig    = 0x9003
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+
+	typeASCII    = 2
+	typeShort    = 3
+	typeLong     = 4
+	typeRational = 5
+
+	dateTimeLayout = "2006:01:02 15:04:05"
+)
+
+type Metadata struct {
+	CaptureTime time.Time
+	Make        string
+	Model       string
+	HasGPS      bool
+	Latitude    float64
+	Longitude   float64
+}
+
+func (m Metadata) Camera() string {
+	if m.Model == "" || strings.HasPrefix(m.Model, m.Make) {
+		return m.Model
+	}
+	return strings.TrimSpace(m.Make + " " + m.Model)
+}
+
+// Format renders the metadata as a few lines for a reply; it is empty when
+// nothing was found.
+func (m Metadata) Format() string {
+	lines := []string{}
+	if !m.CaptureTime.IsZero() {
+		lines = append(lines, "Taken: "+m.CaptureTime.Format("2006-01-02 15:04"))
+	}
+	if camera := m.Camera(); camera != "" {
+		lines = append(lines, "Camera: "+camera)
+	}
+	if m.HasGPS {
+		lines = append(lines, fmt.Sprintf("Location: %.5f, %.5f", m.Latitude, m.Longitude))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Extract reads the Exif APP1 segment of a JPEG image. Capture times carry
+// no zone in Exif and are returned in UTC as written by the camera.
+func Extract(jpeg []byte) (Metadata, error) {
+	tiff, err := findExif(jpeg)
+	if err != nil {
+		return Metadata{}, err
+	}
+	r, err := newReader(tiff)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	var m Metadata
+	ifd0, err := r.readIFD(r.order.Uint32(tiff[4:8]))
+	if err != nil {
+		return Metadata{}, err
+	}
+	m.Make = r.ascii(ifd0[tagMake])
+	m.Model = r.ascii(ifd0[tagModel])
+	m.CaptureTime = parseTime(r.ascii(ifd0[tagDateTime]))
+
+	if e, ok := ifd0[tagExifIFD]; ok {
+		exifIFD, err := r.readIFD(r.long(e))
+		if err != nil {
+			return Metadata{}, err
+		}
+		if t := parseTime(r.ascii(exifIFD[tagDateTimeOrig])); !t.IsZero() {
+			m.CaptureTime = t
+		}
+	}
+
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		gps, err := r.readIFD(r.long(e))
+		if err != nil {
+			return Metadata{}, err
+		}
+		lat, latOK := r.degrees(gps[tagGPSLatitude])
+		lon, lonOK := r.degrees(gps[tagGPSLongitude])
+		if latOK && lonOK {
+			if r.ascii(gps[tagGPSLatitudeRef]) == "S" {
+				lat = -lat
+			}
+			if r.ascii(gps[tagGPSLongitudeRef]) == "W" {
+				lon = -lon
+			}
+			m.HasGPS = true
+			m.Latitude = lat
+			m.Longitude = lon
+		}
+	}
+	return m, nil
+}
+
+func findExif(jpeg []byte) ([]byte, error) {
+	if len(jpeg) < 4 || jpeg[0] != 0xff || jpeg[1] != 0xd8 {
+		return nil, fmt.Errorf("not a jpeg")
+	}
+	pos := 2
+	for pos+4 <= len(jpeg) {
+		if jpeg[pos] != 0xff {
+			return nil, ErrNoExif
+		}
+		marker := jpeg[pos+1]
+		// start of scan; no metadata follows
+		if marker == 0xda {
+			return nil, ErrNoExif
+		}
+		length := int(binary.BigEndian.Uint16(jpeg[pos+2 : pos+4]))
+		if length < 2 || pos+2+length > len(jpeg) {
+			return nil, fmt.Errorf("truncated jpeg segment")
+		}
+		segment := jpeg[pos+4 : pos+2+length]
+		if marker == 0xe1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return segment[6:], nil
+		}
+		pos += 2 + length
+	}
+	return nil, ErrNoExif
+}
+
+type entry struct {
+	typ    uint16
+	count  uint32
+	offset []byte // the 4 byte value/offset field
+}
+
+type reader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newReader(tiff []byte) (*reader, error) {
+	if len(tiff) < 8 {
+		return nil, fmt.Errorf("truncated tiff header")
+	}
+	switch string(tiff[:2]) {
+	case "II":
+		return &reader{data: tiff, order: binary.LittleEndian}, nil
+	case "MM":
+		return &reader{data: tiff, order: binary.BigEndian}, nil
+	default:
+		return nil, fmt.Errorf("invalid tiff byte order")
+	}
+}
+
+func (r *reader) readIFD(offset uint32) (map[uint16]entry, error) {
+	start := int(offset)
+	if start+2 > len(r.data) {
+		return nil, fmt.Errorf("ifd offset out of range")
+	}
+	n := int(r.order.Uint16(r.data[start : start+2]))
+	entries := map[uint16]entry{}
+	for i := 0; i < n; i++ {
+		p := start + 2 + i*12
+		if p+12 > len(r.data) {
+			return nil, fmt.Errorf("truncated ifd")
+		}
+		tag := r.order.Uint16(r.data[p : p+2])
+		entries[tag] = entry{
+			typ:    r.order.Uint16(r.data[p+2 : p+4]),
+			count:  r.order.Uint32(r.data[p+4 : p+8]),
+			offset: r.data[p+8 : p+12],
+		}
+	}
+	return entries, nil
+}
+
+// value returns the bytes of an entry, which are inline when they fit in
+// four bytes and elsewhere in the TIFF data otherwise.
+func (r *reader) value(e entry, size int) []byte {
+	total := size * int(e.count)
+	if e.offset == nil || total <= 0 {
+		return nil
+	}
+	if total <= 4 {
+		return e.offset[:total]
+	}
+	start := int(r.order.Uint32(e.offset))
+	if start+total > len(r.data) || start < 0 {
+		return nil
+	}
+	return r.data[start : start+total]
+}
+
+func (r *reader) ascii(e entry) string {
+	if e.typ != typeASCII {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(r.value(e, 1)), "\x00"))
+}
+
+func (r *reader) long(e entry) uint32 {
+	if e.offset == nil {
+		return 0
+	}
+	if e.typ == typeShort {
+		return uint32(r.order.Uint16(e.offset))
+	}
+	return r.order.Uint32(e.offset)
+}
+
+// degrees converts a degrees, minutes, seconds rational triple.
+func (r *reader) degrees(e entry) (float64, bool) {
+	if e.typ != typeRational || e.count != 3 {
+		return 0, false
+	}
+	b := r.value(e, 8)
+	if b == nil {
+		return 0, false
+	}
+	var parts [3]float64
+	for i := range parts {
+		num := r.order.Uint32(b[i*8 : i*8+4])
+		den := r.order.Uint32(b[i*8+4 : i*8+8])
+		if den == 0 {
+			return 0, false
+		}
+		parts[i] = float64(num) / float64(den)
+	}
+	return parts[0] + parts[1]/60 + parts[2]/3600, true
+}
+
+func parseTime(s string) time.Time {
+	t, err := time.Parse(dateTimeLayout, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
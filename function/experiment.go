@@ -0,0 +1,109 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/experiment"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/taxonomy"
+)
+
+const (
+	variantText = "text"
+	variantFlex = "flex"
+	// LINE shows at most 12 bubbles in a carousel
+	maxCarouselBubbles = 12
+)
+
+// replyFormat compares plain text label replies with a Flex carousel of one
+// bubble per category. It runs while EXPERIMENT_REPLY_FORMAT is true;
+// engagement is a tap on the Describe quick reply of a reply a variant
+// shaped, which carries the variant.
+var replyFormat = experiment.Experiment{Name: "replyFormat", Variants: []string{variantText, variantFlex}}
+
+// replyFormatVariant returns the user's variant, empty when the experiment
+// is off.
+func replyFormatVariant(ctx context.Context, userIDHash string) string {
+	if dynconfig.Get(ctx, "EXPERIMENT_REPLY_FORMAT") != "true" || userIDHash == "" {
+		return ""
+	}
+	return replyFormat.Assign(userIDHash)
+}
+
+// recordExperiment counts an exposure or an engagement and notes the
+// variant on the interactions/{correlationId} document. It is best effort.
+func recordExperiment(ctx context.Context, variant string, engaged bool) {
+	if !recordingAllowed(ctx) {
+		return
+	}
+	client, err := clients.Firestore(ctx, projectIDOf(ctx))
+	if err != nil {
+		logging.Errorf(ctx, "clients.Firestore failed; %v", err)
+		return
+	}
+	recorder := experiment.NewRecorder(client)
+	if engaged {
+		err = recorder.Engaged(ctx, replyFormat.Name, variant)
+	} else {
+		err = recorder.Exposed(ctx, replyFormat.Name, variant)
+	}
+	if err != nil {
+		logging.Errorf(ctx, "record experiment failed; %v", err)
+	}
+	correlationID := logging.FromContext(ctx).CorrelationID
+	if engaged || correlationID == "" {
+		return
+	}
+	fields := map[string]interface{}{"experiments": map[string]interface{}{replyFormat.Name: variant}}
+	if _, err := client.Collection(namespace.Collection("interactions")).Doc(correlationID).Set(ctx, fields, firestore.MergeAll); err != nil {
+		logging.Errorf(ctx, "firestore.DocumentRef.Set failed; %v", err)
+	}
+}
+
+type flexBubble struct {
+	Type string  `json:"type"`
+	Body flexBox `json:"body"`
+}
+
+type flexBox struct {
+	Type     string        `json:"type"`
+	Layout   string        `json:"layout"`
+	Spacing  string        `json:"spacing,omitempty"`
+	Contents []interface{} `json:"contents"`
+}
+
+type flexText struct {
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Weight string `json:"weight,omitempty"`
+	Size   string `json:"size,omitempty"`
+	Wrap   bool   `json:"wrap,omitempty"`
+}
+
+// labelsCarousel lays the labels out as one bubble per taxonomy category.
+func labelsCarousel(labels []string) (json.RawMessage, error) {
+	bubbles := []flexBubble{}
+	for _, group := range taxonomy.GroupLabels(labels) {
+		if len(bubbles) == maxCarouselBubbles {
+			break
+		}
+		heading := strings.ToUpper(group.Category[:1]) + group.Category[1:]
+		contents := []interface{}{flexText{Type: "text", Text: heading, Weight: "bold", Size: "lg"}}
+		for _, label := range group.Labels {
+			contents = append(contents, flexText{Type: "text", Text: label, Wrap: true})
+		}
+		bubbles = append(bubbles, flexBubble{Type: "bubble", Body: flexBox{Type: "box", Layout: "vertical", Spacing: "sm", Contents: contents}})
+	}
+	b, err := json.Marshal(map[string]interface{}{"type": "carousel", "contents": bubbles})
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal failed; %w", err)
+	}
+	return b, nil
+}
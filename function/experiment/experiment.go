@@ -0,0 +1,85 @@
+package experiment
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const collection = "experiments"
+
+// Experiment splits users between variants by a hash of their ID, so that
+// a user keeps seeing the same variant.
+type Experiment struct {
+	Name     string
+	Variants []string
+}
+
+func (e Experiment) Assign(userIDHash string) string {
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + ":" + userIDHash))
+	return e.Variants[int(h.Sum32()%uint32(len(e.Variants)))]
+}
+
+type Counts struct {
+	Exposures   int64 `firestore:"exposures"`
+	Engagements int64 `firestore:"engagements"`
+}
+
+// EngagementRate is engagements per exposure.
+func (c Counts) EngagementRate() float64 {
+	if c.Exposures == 0 {
+		return 0
+	}
+	return float64(c.Engagements) / float64(c.Exposures)
+}
+
+// Recorder keeps per variant counters on experiments/{name}.
+type Recorder struct {
+	client *firestore.Client
+}
+
+func NewRecorder(client *firestore.Client) *Recorder {
+	return &Recorder{client: client}
+}
+
+// Exposed counts a reply shown in variant.
+func (r *Recorder) Exposed(ctx context.Context, name, variant string) error {
+	return r.increment(ctx, name, variant, "exposures")
+}
+
+// Engaged counts a follow-up of a user in variant.
+func (r *Recorder) Engaged(ctx context.Context, name, variant string) error {
+	return r.increment(ctx, name, variant, "engagements")
+}
+
+func (r *Recorder) increment(ctx context.Context, name, variant, field string) error {
+	counter := map[string]interface{}{
+		variant: map[string]interface{}{field: firestore.Increment(1)},
+	}
+	if _, err := r.client.Collection(namespace.Collection(collection)).Doc(name).Set(ctx, counter, firestore.MergeAll); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	return nil
+}
+
+// Counts returns the counters of the experiment keyed by variant.
+func (r *Recorder) Counts(ctx context.Context, name string) (map[string]Counts, error) {
+	counts := map[string]Counts{}
+	snap, err := r.client.Collection(namespace.Collection(collection)).Doc(name).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return counts, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	if err := snap.DataTo(&counts); err != nil {
+		return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+	}
+	return counts, nil
+}
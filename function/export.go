@@ -0,0 +1,161 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/storage"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+)
+
+const (
+	defaultExportMaxRows  = 1000
+	defaultExportCooldown = time.Hour
+	exportLinkTTL         = 24 * time.Hour
+)
+
+// exportResults answers "/export [csv|json]": the user's past analyses are
+// written to EXPORT_BUCKET and a signed link valid for a day is returned.
+// Exports are capped at EXPORT_MAX_ROWS rows and allowed once per
+// EXPORT_COOLDOWN per user.
+func exportResults(ctx context.Context, client *firestore.Client, userIDHash, format string) (string, error) {
+	bucket := tenantEnv(ctx, "EXPORT_BUCKET")
+	if bucket == "" || userIDHash == "" {
+		return "Export is not available.", nil
+	}
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		return "Usage: /export [csv|json]", nil
+	}
+
+	c, err := cache.Open(ctx, cache.ConfigFromEnv())
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	key := exportKey(userIDHash)
+	_, err = c.Get(ctx, key)
+	if err == nil {
+		return "You exported recently. Please try again later.", nil
+	}
+	if !errors.Is(err, cache.ErrMiss) {
+		return "", err
+	}
+
+	maxRows := defaultExportMaxRows
+	if n, err := strconv.Atoi(os.Getenv("EXPORT_MAX_ROWS")); err == nil && n > 0 {
+		maxRows = n
+	}
+	results, truncated, err := userResults(ctx, client, userIDHash, maxRows)
+	if err != nil {
+		return "", err
+	}
+	if len(results) == 0 {
+		return "There is nothing to export yet.", nil
+	}
+	b, contentType, err := encodeExport(results, format)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("exports/%s/%s.%s", userIDHash, time.Now().UTC().Format("20060102T150405Z"), format)
+	if err := writeObject(ctx, bucket, name, contentType, b, nil); err != nil {
+		return "", err
+	}
+	url, err := signedURL(ctx, bucket, name, exportLinkTTL)
+	if err != nil {
+		return "", err
+	}
+
+	cooldown := defaultExportCooldown
+	if d, err := time.ParseDuration(os.Getenv("EXPORT_COOLDOWN")); err == nil && d > 0 {
+		cooldown = d
+	}
+	if err := c.Set(ctx, key, []byte(name), cooldown); err != nil {
+		logging.Errorf(ctx, "cache.Cache.Set failed; %v", err)
+	}
+	logging.Printf(ctx, "exported %d results to gs://%s/%s", len(results), bucket, name)
+
+	text := fmt.Sprintf("Your %d analyses are ready for 24 hours:\n%s", len(results), url)
+	if truncated {
+		text = fmt.Sprintf("Your latest %d analyses are ready for 24 hours:\n%s", len(results), url)
+	}
+	return text, nil
+}
+
+func exportKey(userIDHash string) string {
+	return "export:" + userIDHash
+}
+
+// userResults pages through the user's results, newest first, stopping at
+// maxRows; the flag tells whether there were more.
+func userResults(ctx context.Context, client *firestore.Client, userIDHash string, maxRows int) ([]result, bool, error) {
+	results := []result{}
+	q := resultsQuery{UserIDHash: userIDHash, Limit: maxResultsLimit}
+	for {
+		page, err := listResults(ctx, client, q)
+		if err != nil {
+			return nil, false, err
+		}
+		results = append(results, page.Data...)
+		if len(results) >= maxRows {
+			return results[:maxRows], len(results) > maxRows || page.NextPageToken != "", nil
+		}
+		if page.NextPageToken == "" {
+			return results, false, nil
+		}
+		q.PageToken = page.NextPageToken
+	}
+}
+
+func encodeExport(results []result, format string) ([]byte, string, error) {
+	if format == "json" {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return nil, "", fmt.Errorf("json.MarshalIndent failed; %w", err)
+		}
+		return b, "application/json", nil
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"createdAt", "imageId", "labels", "categories"})
+	for _, r := range results {
+		w.Write([]string{r.CreatedAt.UTC().Format(time.RFC3339), r.ImageID, strings.Join(r.Labels, ";"), strings.Join(r.Categories, ";")})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, "", fmt.Errorf("csv.Writer.Flush failed; %w", err)
+	}
+	return buf.Bytes(), "text/csv", nil
+}
+
+// signedURL signs with the function's service account through the IAM
+// signBlob API, which needs roles/iam.serviceAccountTokenCreator on itself.
+func signedURL(ctx context.Context, bucket, name string, ttl time.Duration) (string, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return "", fmt.Errorf("storage.NewClient failed; %w", err)
+	}
+	defer client.Close()
+	url, err := client.Bucket(bucket).SignedURL(namespace.Object(name), &storage.SignedURLOptions{
+		Scheme:  storage.SigningSchemeV4,
+		Method:  "GET",
+		Expires: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", fmt.Errorf("storage.BucketHandle.SignedURL failed; %w", err)
+	}
+	return url, nil
+}
@@ -0,0 +1,100 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+)
+
+const (
+	defaultOnboardingGreeting = "Thanks for adding me as a friend!"
+	defaultOnboardingUsage    = "Send me a picture and I will tell you what is in it. Try /persona to change how I talk and /history to see what we talked about."
+)
+
+// onboardingEnabled turns on the messages a user gets on following the bot;
+// the follow state is tracked either way.
+func onboardingEnabled(ctx context.Context) bool {
+	return dynconfig.Get(ctx, "ONBOARDING") == "true"
+}
+
+// onboarding is the sequence a new friend is greeted with: the greeting, the
+// usage and, when ONBOARDING_MENU_TEXT is set, a pointer to the rich menu.
+// Setting a template to "-" leaves its message out.
+func onboarding(ctx context.Context, replyToken string) *reply.Builder {
+	builder := reply.NewBuilder(replyToken)
+	for _, text := range []string{
+		replyTemplate(ctx, "ONBOARDING_GREETING", defaultOnboardingGreeting),
+		replyTemplate(ctx, "ONBOARDING_USAGE", defaultOnboardingUsage),
+		dynconfig.Get(ctx, "ONBOARDING_MENU_TEXT"),
+	} {
+		if text != "" && text != "-" {
+			builder.Text(text)
+		}
+	}
+	return builder
+}
+
+// welcome marks the user as following and, with onboarding on, links the
+// ONBOARDING_RICH_MENU_ID rich menu and replies with the onboarding
+// sequence.
+func welcome(ctx context.Context, projectID, userIDHash, userID, replyToken string) error {
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	state := map[string]interface{}{"following": true, "followedAt": time.Now()}
+	if campaignsEnabled(ctx) {
+		state["lineUserId"] = userID
+	}
+	if _, err := client.Collection(namespace.Collection("users")).Doc(userIDHash).Set(ctx, state, firestore.MergeAll); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	logging.Printf(ctx, "followed")
+	if !onboardingEnabled(ctx) {
+		return nil
+	}
+
+	lineClient, err := newLineClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	if richMenuID := dynconfig.Get(ctx, "ONBOARDING_RICH_MENU_ID"); richMenuID != "" && !dryRunEnabled(ctx) {
+		// the greeting is worth more than the menu; go on without it
+		if err := lineClient.LinkRichMenu(ctx, userID, richMenuID); err != nil {
+			logging.Errorf(ctx, "link rich menu failed; %v", err)
+		}
+	}
+	builder := onboarding(ctx, replyToken)
+	if builder.Len() == 0 {
+		return nil
+	}
+	return sendReply(ctx, lineClient, builder)
+}
+
+// farewell marks the user as no longer following and drops what only served
+// replying to them: the remembered LINE user ID and the imagemaps that can no
+// longer be tapped. Preferences stay for when the user comes back.
+func farewell(ctx context.Context, projectID, userIDHash string) error {
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	user := client.Collection(namespace.Collection("users")).Doc(userIDHash)
+	state := map[string]interface{}{"following": false, "unfollowedAt": time.Now(), "lineUserId": firestore.Delete}
+	if _, err := user.Set(ctx, state, firestore.MergeAll); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	n, err := deleteQuery(ctx, client, "imagemaps", user.Collection(namespace.Collection("imagemaps")).Query)
+	if err != nil {
+		return err
+	}
+	logging.Printf(ctx, "unfollowed; %d imagemaps deleted", n)
+	return nil
+}
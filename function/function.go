@@ -3,51 +3,202 @@ package function
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
-	"net/http/httputil"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
-	"cloud.google.com/go/pubsub"
 	vision "cloud.google.com/go/vision/apiv1"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
 	"github.com/cloudevents/sdk-go/v2/event"
-
-	secretmanager "cloud.google.com/go/secretmanager/apiv1"
-	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/auth"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/conversation"
+	"github.com/hsmtkk/ubiquitous-couscous/function/decode"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/emoji"
+	"github.com/hsmtkk/ubiquitous-couscous/function/eventlog"
+	"github.com/hsmtkk/ubiquitous-couscous/function/exif"
+	"github.com/hsmtkk/ubiquitous-couscous/function/knowledge"
+	"github.com/hsmtkk/ubiquitous-couscous/function/lineapi"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/messenger"
+	"github.com/hsmtkk/ubiquitous-couscous/function/persona"
+	"github.com/hsmtkk/ubiquitous-couscous/function/queue"
+	"github.com/hsmtkk/ubiquitous-couscous/function/redact"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+	"github.com/hsmtkk/ubiquitous-couscous/function/secrets"
+	"github.com/hsmtkk/ubiquitous-couscous/function/slo"
+	"github.com/hsmtkk/ubiquitous-couscous/function/topics"
+	"github.com/hsmtkk/ubiquitous-couscous/function/visionclient"
+	"github.com/hsmtkk/ubiquitous-couscous/function/visionresult"
+	"github.com/hsmtkk/ubiquitous-couscous/function/workflow"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+	visionpb "google.golang.org/genproto/googleapis/cloud/vision/v1"
 )
 
 func init() {
-	functions.HTTP("receive", receive)
+	functions.HTTP("receive", withRecentEvents(apiSpec.Middleware("/receive-function", receive)))
+	functions.HTTP("telegram", telegramWebhook)
+	functions.HTTP("slack", slackEvents)
+	functions.HTTP("slackInstall", slackInstall)
+	functions.HTTP("liff", liff)
+	functions.HTTP("imagemap", serveImagemap)
 	functions.CloudEvent("process", process)
 	functions.CloudEvent("send", send)
+	functions.CloudEvent("postback", handlePostback)
+	functions.CloudEvent("guess", handleGuess)
+	functions.CloudEvent("beacon", handleBeacon)
+	functions.CloudEvent("deadLetters", deadLetters)
+	functions.HTTP("processPush", withRecentEvents(processPush))
+	functions.HTTP("sendPush", withRecentEvents(sendPush))
+	functions.HTTP("status", apiSpec.Middleware("/status-function", statusPage))
+	functions.HTTP("selftest", selftest)
+	functions.HTTP("upload", apiSpec.Middleware("/upload-function", upload))
+	functions.HTTP("results", apiSpec.Middleware("/results-function", results))
+	functions.HTTP("drainOutbox", auth.Require(auth.ConfigFromEnv(), drainOutbox))
+	functions.HTTP("cleanup", auth.Require(auth.ConfigFromEnv(), cleanup))
+	functions.HTTP("campaign", auth.Require(auth.ConfigFromEnv(), campaignHandler))
+	functions.HTTP("multicast", auth.Require(auth.ConfigFromEnv(), multicastHandler))
+	functions.HTTP("dashboard", requireOperator(dashboard))
+	functions.HTTP("reconcileReplies", auth.Require(auth.ConfigFromEnv(), reconcileReplies))
+	functions.HTTP("flushSheet", auth.Require(auth.ConfigFromEnv(), flushSheet))
+	functions.HTTP("autoscaleSignals", auth.Require(auth.ConfigFromEnv(), autoscaleSignals))
+	functions.HTTP("sloCheck", auth.Require(auth.ConfigFromEnv(), sloCheck))
+	functions.HTTP("deleteUserData", auth.Require(auth.ConfigFromEnv(), deleteUserData))
+	functions.HTTP("spamFlags", auth.Require(auth.ConfigFromEnv(), spamFlags))
+	functions.HTTP("messageEvents", auth.Require(auth.ConfigFromEnv(), messageEvents))
+	functions.HTTP("analyze", auth.Require(auth.ConfigFromEnv(), analyzeAPI))
+
+	topics.ShutdownOnSignal()
+	applyTuning(context.Background())
+	checkPubSubAtStartup()
+	// dialing takes a while; start before the first request needs them
+	clients.Warm(os.Getenv("PROJECT_ID"))
+	topics.Warm()
+	visionclient.Default.Warm()
+	if err := subscribePipeline(context.Background(), queue.ConfigFromEnv()); err != nil {
+		logging.Errorf(context.Background(), "subscribe pipeline failed; %v", err)
+	}
 }
 
-type lineWebHook struct {
-	Events []lineEvent `json:"events"`
+// subscribePipeline wires process and send to their topics when the queue
+// backend delivers in process, e.g. when self hosting with NATS.
+func subscribePipeline(ctx context.Context, cfg queue.Config) error {
+	if cfg.Backend == queue.BackendPubSub && os.Getenv("PUBSUB_PULL") != "true" {
+		return nil
+	}
+	q, err := topics.Queue(ctx)
+	if err != nil {
+		return err
+	}
+	subscriber, ok := q.(queue.Subscriber)
+	if !ok {
+		return fmt.Errorf("queue backend %s cannot subscribe", cfg.Backend)
+	}
+	if err := subscriber.Subscribe(ctx, processTopic.Name(), processWithRetries); err != nil {
+		return err
+	}
+	if err := subscriber.Subscribe(ctx, sendTopic.Name(), sendWithRetries); err != nil {
+		return err
+	}
+	if err := subscriber.Subscribe(ctx, os.Getenv("WAIT_POSTBACK_TOPIC"), postbackData); err != nil {
+		return err
+	}
+	if err := subscriber.Subscribe(ctx, os.Getenv("WAIT_GUESS_TOPIC"), guessData); err != nil {
+		return err
+	}
+	return subscriber.Subscribe(ctx, os.Getenv("WAIT_BEACON_TOPIC"), beaconData)
 }
 
-type lineEvent struct {
-	ReplyToken       string           `json:"replyToken"`
-	LineEventMessage lineEventMessage `json:"message"`
+var (
+	processTopic = topics.New[processMessage]("WAIT_PROCESS_TOPIC")
+	sendTopic    = topics.New[sendMessage]("WAIT_SEND_TOPIC")
+)
+
+type processMessage struct {
+	CorrelationID string
+	UserIDHash    string
+	GroupIDHash   string
+	ImageID       string
+	ReplyToken    string
+	Mode          string
+	ReceivedAt    time.Time
+	// MediaType is mediaImage or mediaVideo; empty means an image.
+	MediaType string
+	// Overflow is set for images sent to OVERFLOW_TOPIC under backpressure.
+	Overflow bool
+	// Tenant is the ID of the tenant the webhook came for, empty for the
+	// deployment's own channel.
+	Tenant string `json:",omitempty"`
+	// Destination is set for images from platforms other than LINE, which
+	// have no reply token.
+	Destination *messenger.Destination `json:",omitempty"`
 }
 
-type lineEventMessage struct {
-	ID string `json:"id"`
+func (m *processMessage) Defaults() {
+	if m.Mode == "" {
+		m.Mode = modeLabels
+	}
 }
 
-type processMessage struct {
-	ImageID    string
-	ReplyToken string
+func (m processMessage) Validate() []decode.FieldError {
+	if m.Destination != nil {
+		return append(decode.Required("Destination.ChatID", m.Destination.ChatID), decode.Required("ImageID", m.ImageID)...)
+	}
+	return append(decode.Required("ReplyToken", m.ReplyToken), decode.Required("ImageID", m.ImageID)...)
 }
 
 type sendMessage struct {
-	ReplyToken string
-	Labels     []string
+	CorrelationID    string
+	UserIDHash       string
+	ImageID          string
+	ReplyToken       string
+	Result           analysis.Result
+	Summary          string
+	Exif             *exif.Metadata
+	PreviouslySentAt time.Time
+	BudgetExceeded   bool
+	GameImageURL     string
+	// TranslateTo is the language to offer translating the OCR text to.
+	TranslateTo string
+	PublishedAt time.Time
+	Persona     string
+	MediaType   string
+	// ReceivedAt is when the webhook carrying the event arrived.
+	ReceivedAt        time.Time
+	AnnotatedImageURL string
+	Imagemap          *objectImagemap `json:",omitempty"`
+	Emoji             bool
+	Knowledge         *knowledge.Entity
+	FunFact           string `json:",omitempty"`
+	Tenant            string `json:",omitempty"`
+	// MulticastID switches send to pushing the multicast job of that ID.
+	MulticastID string `json:",omitempty"`
+	// Consent is the user's answer to the privacy notice; AskConsent adds
+	// the notice to the reply.
+	Consent     string                 `json:",omitempty"`
+	AskConsent  bool                   `json:",omitempty"`
+	Destination *messenger.Destination `json:",omitempty"`
+}
+
+// maxEmojis caps the emoji-only reply of users in emoji mode.
+const maxEmojis = 5
+
+func (m sendMessage) Validate() []decode.FieldError {
+	if m.MulticastID != "" {
+		return nil
+	}
+	if m.Destination != nil {
+		return append(decode.Required("Destination.ChatID", m.Destination.ChatID), decode.Required("ImageID", m.ImageID)...)
+	}
+	return append(decode.Required("ReplyToken", m.ReplyToken), decode.Required("ImageID", m.ImageID)...)
 }
 
 type messagePublishedData struct {
@@ -55,254 +206,679 @@ type messagePublishedData struct {
 }
 
 type pubSubMessage struct {
-	Data []byte `json:"data"`
+	Data       []byte            `json:"data"`
+	MessageID  string            `json:"messageId"`
+	Attributes map[string]string `json:"attributes"`
 }
 
 func receive(w http.ResponseWriter, r *http.Request) {
-	log.Printf("receive")
-	reqBytes, err := httputil.DumpRequest(r, true)
+	ctx := logging.With(r.Context(), logging.Fields{Function: "receive"})
+	logging.Printf(ctx, "receive")
+	if logging.DebugEnabled() {
+		reqBytes, err := redact.Request(redact.ModeFromEnv(), r)
+		if err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		logging.Debugf(ctx, "request: %s", string(reqBytes))
+	}
+
+	body, err := readWebhook(r)
 	if err != nil {
-		returnError(w, http.StatusInternalServerError, err)
+		returnError(ctx, w, webhookErrorStatus(err), err)
 		return
 	}
-	log.Printf("request: %s", string(reqBytes))
-
-	ctx := r.Context()
-	projectID := os.Getenv("PROJECT_ID")
-	waitProcessTopic := os.Getenv("WAIT_PROCESS_TOPIC")
+	ctx, err = receiveTenant(ctx, body)
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	if r.Header.Get(dryRunHeader) == "true" {
+		// the header is not signed, but all it can do is hold replies back
+		ctx = queue.WithAttributes(ctx, map[string]string{topics.AttrDryRun: "true"})
+		logging.Printf(ctx, "replayed as a dry run")
+	}
+	projectID := projectIDOf(ctx)
+	waitProcessTopic := processTopic.NameFor(ctx)
+	waitPostbackTopic := tenantEnv(ctx, "WAIT_POSTBACK_TOPIC")
+	waitGuessTopic := tenantEnv(ctx, "WAIT_GUESS_TOPIC")
+	waitBeaconTopic := tenantEnv(ctx, "WAIT_BEACON_TOPIC")
+	analysisMode := dynconfig.Get(ctx, "ANALYSIS_MODE")
+	if analysisMode == "" {
+		analysisMode = modeLabels
+	}
 
-	reqBody, err := io.ReadAll(r.Body)
+	channelSecret, err := getSecret(ctx, projectID, "channel-secret")
 	if err != nil {
-		returnError(w, http.StatusInternalServerError, err)
+		returnError(ctx, w, http.StatusInternalServerError, err)
 		return
 	}
-	var lineWebHook lineWebHook
-	if err := json.Unmarshal(reqBody, &lineWebHook); err != nil {
-		returnError(w, http.StatusInternalServerError, err)
+	events, err := lineapi.ParseRequest(channelSecret, r)
+	if errors.Is(err, linebot.ErrInvalidSignature) {
+		returnError(ctx, w, http.StatusBadRequest, err)
 		return
 	}
-	client, err := pubsub.NewClient(ctx, projectID)
 	if err != nil {
-		returnError(w, http.StatusInternalServerError, err)
+		returnError(ctx, w, http.StatusInternalServerError, err)
 		return
 	}
-	defer client.Close()
-	topic := client.Topic(waitProcessTopic)
-	for _, evt := range lineWebHook.Events {
-		msg := processMessage{ImageID: evt.LineEventMessage.ID, ReplyToken: evt.ReplyToken}
-		msgBytes, err := json.Marshal(msg)
-		if err != nil {
-			returnError(w, http.StatusInternalServerError, err)
-			return
+	archiveWebhook(ctx, body, events)
+	mode := backpressureMode(ctx)
+	pressure := ""
+	if mode != "" {
+		pressure = overloaded(ctx)
+	}
+	if pressure != "" && mode == backpressureReject {
+		logging.Warnf(ctx, "reject webhook; %s", pressure)
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	if pressure != "" && tenantEnv(ctx, "OVERFLOW_TOPIC") != "" {
+		logging.Warnf(ctx, "images overflow; %s", pressure)
+		waitProcessTopic = tenantEnv(ctx, "OVERFLOW_TOPIC")
+	}
+	q, err := topics.Queue(ctx)
+	if err != nil {
+		// keep going; every event is buffered in the outbox below
+		logging.Errorf(ctx, "topics.Queue failed; %v", err)
+	}
+	limiter, err := openRateLimiter(ctx)
+	if err != nil {
+		logging.Errorf(ctx, "open rate limiter failed; %v", err)
+	}
+	if limiter != nil {
+		defer limiter.Close()
+	}
+	for _, evt := range events {
+		correlationID := evt.WebhookEventID
+		if correlationID == "" {
+			correlationID = newCorrelationID()
+		}
+		var userIDHash, groupIDHash string
+		if evt.Source != nil {
+			userIDHash = logging.HashUserID(evt.Source.UserID)
+			if evt.Source.Type == linebot.EventSourceTypeGroup {
+				groupIDHash = redact.Hash(evt.Source.GroupID)
+			}
+		}
+		evtCtx := logging.With(ctx, logging.Fields{CorrelationID: correlationID, UserIDHash: userIDHash})
+		if evt.DeliveryContext.IsRedelivery {
+			handled, err := alreadyHandled(evtCtx, projectID, correlationID)
+			if err != nil {
+				logging.Errorf(evtCtx, "check redelivery failed; %v", err)
+			}
+			if handled {
+				logging.Printf(evtCtx, "skip redelivery; already replied")
+				continue
+			}
+		}
+
+		var topic string
+		var msg interface{}
+		switch evt.Type {
+		case linebot.EventTypeMessage:
+			switch message := evt.Message.(type) {
+			case *linebot.ImageMessage, *linebot.VideoMessage:
+				mediaID, mediaType := mediaOf(message)
+				evtCtx = logging.With(evtCtx, logging.Fields{ImageID: mediaID})
+				if !allowImage(evtCtx, limiter, userIDHash) {
+					logging.Warnf(evtCtx, "rate limited")
+					if err := replySlowDown(evtCtx, projectID, evt.ReplyToken); err != nil {
+						logging.Errorf(evtCtx, "reply slow down failed; %v", err)
+					}
+					continue
+				}
+				if campaignsEnabled(evtCtx) && userIDHash != "" {
+					if err := rememberUser(evtCtx, projectID, userIDHash, evt.Source.UserID); err != nil {
+						logging.Errorf(evtCtx, "remember user failed; %v", err)
+					}
+				}
+				topic = waitProcessTopic
+				msg = processMessage{
+					CorrelationID: correlationID,
+					UserIDHash:    userIDHash,
+					GroupIDHash:   groupIDHash,
+					ImageID:       mediaID,
+					MediaType:     mediaType,
+					ReplyToken:    evt.ReplyToken,
+					Mode:          analysisMode,
+					ReceivedAt:    receivedAt(evt),
+					Overflow:      waitProcessTopic != processTopic.NameFor(ctx),
+					Tenant:        tenantID(ctx),
+				}
+			case *linebot.TextMessage:
+				// texts only matter as commands and as guesses in group games
+				if groupIDHash == "" && !strings.HasPrefix(message.Text, "/") {
+					logging.Printf(evtCtx, "skip text message outside group")
+					continue
+				}
+				topic = waitGuessTopic
+				msg = guessMessage{
+					CorrelationID: correlationID,
+					GroupIDHash:   groupIDHash,
+					UserIDHash:    userIDHash,
+					ReplyToken:    evt.ReplyToken,
+					Text:          message.Text,
+					Tenant:        tenantID(ctx),
+				}
+			default:
+				logging.Printf(evtCtx, "skip message; %s", evt.Message.Type())
+				continue
+			}
+		case linebot.EventTypePostback:
+			topic = waitPostbackTopic
+			msg = postbackMessage{
+				CorrelationID: correlationID,
+				UserIDHash:    userIDHash,
+				GroupIDHash:   groupIDHash,
+				ReplyToken:    evt.ReplyToken,
+				Data:          evt.Postback.Data,
+				Tenant:        tenantID(ctx),
+			}
+		case linebot.EventTypeBeacon:
+			topic = waitBeaconTopic
+			msg = beaconMessage{
+				CorrelationID: correlationID,
+				UserIDHash:    userIDHash,
+				ReplyToken:    evt.ReplyToken,
+				HWID:          evt.Beacon.Hwid,
+				Type:          string(evt.Beacon.Type),
+				Tenant:        tenantID(ctx),
+			}
+		case linebot.EventTypeFollow:
+			if userIDHash == "" {
+				continue
+			}
+			if err := welcome(evtCtx, projectID, userIDHash, evt.Source.UserID, evt.ReplyToken); err != nil {
+				logging.Errorf(evtCtx, "welcome failed; %v", err)
+			}
+			continue
+		case linebot.EventTypeUnfollow:
+			if userIDHash == "" {
+				continue
+			}
+			if err := farewell(evtCtx, projectID, userIDHash); err != nil {
+				logging.Errorf(evtCtx, "farewell failed; %v", err)
+			}
+			continue
+		case linebot.EventTypeUnsend:
+			if err := forgetMessage(evtCtx, projectID, userIDHash, groupIDHash, evt.Unsend.MessageID); err != nil {
+				// retention cleanup removes the rest eventually
+				logging.Errorf(evtCtx, "forget unsent message failed; %v", err)
+			}
+			continue
+		default:
+			logging.Printf(evtCtx, "skip event; %s", evt.Type)
+			continue
+		}
+		procMsg, processing := msg.(processMessage)
+		if processing {
+			recordEvent(evtCtx, eventlog.Received, procMsg.ReceivedAt, nil)
+		}
+		err = publishReceived(evtCtx, q, topic, correlationID, msg)
+		recordRecent(logging.FromContext(evtCtx), "receive", err)
+		if processing {
+			if err != nil {
+				recordEvent(evtCtx, eventlog.Failed, time.Time{}, err)
+			} else {
+				recordEvent(evtCtx, eventlog.Queued, time.Time{}, nil)
+			}
 		}
-		result := topic.Publish(ctx, &pubsub.Message{Data: msgBytes})
-		id, err := result.Get(ctx)
 		if err != nil {
-			returnError(w, http.StatusInternalServerError, err)
+			returnError(evtCtx, w, http.StatusInternalServerError, err)
 			return
 		}
-		log.Printf("publish: %s", id)
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("receive"))
 }
 
 func process(ctx context.Context, evt event.Event) error {
-	log.Printf("process")
-	log.Printf("request: %v", evt)
-
-	projectID := os.Getenv("PROJECT_ID")
-	waitSendTopic := os.Getenv("WAIT_SEND_TOPIC")
+	ctx = logging.With(ctx, logging.Fields{Function: "process"})
+	logging.Printf(ctx, "process")
 
 	var subMsg messagePublishedData
 	if err := evt.DataAs(&subMsg); err != nil {
 		return fmt.Errorf("event.Event.DataAs failed; %w", err)
 	}
-	var procMsg processMessage
-	if err := json.Unmarshal(subMsg.Message.Data, &procMsg); err != nil {
-		return fmt.Errorf("json.Unmarshal failed; %w", err)
-	}
+	logging.Debugf(ctx, "request: %s", redact.JSON(redact.ModeFromEnv(), subMsg.Message.Data))
+	ctx = queue.WithAttributes(ctx, subMsg.Message.Attributes)
+	return processWithRetries(ctx, subMsg.Message.Data)
+}
 
-	log.Printf("image ID: %s", procMsg.ImageID)
-	log.Printf("reply token: %s", procMsg.ReplyToken)
+func processData(ctx context.Context, data []byte) (err error) {
+	defer func() { recordOutcome(ctx, "process", err) }()
+	defer trackInFlight(ctx, "process")()
 
-	channelAccessToken, err := getSecret(ctx, projectID, "channel-access-token")
-	if err != nil {
+	var procMsg processMessage
+	if ok, err := decodePayload(ctx, "process", data, &procMsg); !ok {
 		return err
 	}
-	log.Print("get secret")
-
-	image, err := downloadImage(channelAccessToken, procMsg.ImageID)
-	if err != nil {
+	ctx = logging.With(ctx, logging.Fields{CorrelationID: procMsg.CorrelationID, UserIDHash: procMsg.UserIDHash, ImageID: procMsg.ImageID})
+	ctx = withVisionSubject(ctx, procMsg.UserIDHash, procMsg.ImageID)
+	if ctx, err = withTenant(ctx, procMsg.Tenant); err != nil {
+		// retrying cannot bring the tenant back
+		logging.Errorf(ctx, "drop message; %v", err)
+		return nil
+	}
+	projectID := projectIDOf(ctx)
+	if done, err := alreadyCompleted(ctx, projectID, "process", procMsg.CorrelationID); err != nil || done {
 		return err
 	}
-	log.Print("download image")
+	finish := trackStage(ctx, eventlog.Analyzing, "")
+	defer func() { finish(err) }()
+
+	logging.Printf(ctx, "image ID: %s", procMsg.ImageID)
+	logConversation(ctx, conversation.Item{Kind: conversation.KindInbound, ImageID: procMsg.ImageID})
+	logging.Printf(ctx, "reply token: %s", redact.Secret(redact.ModeFromEnv(), procMsg.ReplyToken))
 
-	labels, err := analyzeImage(ctx, image)
+	pipeline := newPipeline()
+	workflows, err := loadWorkflows(pipeline)
 	if err != nil {
 		return err
 	}
-	log.Printf("labels: %v\n", labels)
-
-	msg := sendMessage{ReplyToken: procMsg.ReplyToken, Labels: labels}
-	msgBytes, err := json.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("json.Marshal failed; %w", err)
+	mode := procMsg.Mode
+	if mode == modeLabels && procMsg.GroupIDHash != "" {
+		playing, err := gameEnabled(ctx, projectID, procMsg.GroupIDHash)
+		if err != nil {
+			return err
+		}
+		if playing {
+			mode = modeGame
+		}
 	}
-
-	client, err := pubsub.NewClient(ctx, projectID)
+	if mode == modeLabels {
+		diffing, err := comparing(ctx, projectID, procMsg.UserIDHash, procMsg.ImageID)
+		if err != nil {
+			return err
+		}
+		if diffing {
+			mode = modeDiff
+		}
+	}
+	state := &pipelineState{projectID: projectID, procMsg: procMsg, result: analysis.New()}
+	startedAt := time.Now()
+	if !procMsg.Overflow {
+		// overflow is expected to lag, that is what it is for
+		checkProcessLag(ctx, procMsg.ReceivedAt)
+	}
+	prefs, err := preferencesOf(ctx, projectID, procMsg.UserIDHash)
 	if err != nil {
-		return fmt.Errorf("pubsub.NewClient failed; %w", err)
+		// preferences only shape the reply, the image is analyzed anyway
+		logging.Errorf(ctx, "load preferences failed; %v", err)
+	}
+	ctx = withConsent(ctx, prefs.Consent)
+	state.minScore = labelMinScore(ctx, prefs)
+	state.echo = prefs.Echo
+	state.funFact = prefs.FunFact
+	state.captionLength, state.captionStyle = prefs.CaptionLength, prefs.CaptionStyle
+	if prefs.DebugTiming {
+		state.result.Timings = []analysis.Timing{}
+		if !procMsg.ReceivedAt.IsZero() {
+			state.result.Timings = append(state.result.Timings, newStageTiming("queue wait", startedAt.Sub(procMsg.ReceivedAt)))
+		}
+	}
+	stepEvents := []slo.Event{}
+	pipeline.AfterStep = func(ctx context.Context, step workflow.Step, elapsed time.Duration, err error) {
+		if prefs.DebugTiming {
+			state.result.Timings = append(state.result.Timings, newStageTiming(step.Name, elapsed))
+		}
+		stepEvents = append(stepEvents, slo.Event{Objective: sloStepObjective(step.Name), Good: err == nil})
 	}
-	defer client.Close()
-	topic := client.Topic(waitSendTopic)
-	result := topic.Publish(ctx, &pubsub.Message{Data: msgBytes})
-	id, err := result.Get(ctx)
+	err = pipeline.Run(ctx, workflows, mode, state)
+	trackSLO(ctx, stepEvents...)
 	if err != nil {
-		return fmt.Errorf("pubsub.PublishResult.Get failed; %w", err)
+		if quotaExhausted(err) && backpressureMode(ctx) != "" {
+			raiseBackpressure(ctx, "vision quota exhausted")
+		}
+		return err
+	}
+	recordEvent(ctx, eventlog.Analyzed, time.Time{}, nil)
+	if state.spam {
+		// spam is dropped without a reply
+		return markCompleted(ctx, projectID, "process", procMsg.CorrelationID)
+	}
+	logConversation(ctx, conversation.Item{Kind: conversation.KindAnalysis, ImageID: procMsg.ImageID, Labels: state.result.LabelNames(), Text: state.summary})
+
+	msg := sendMessage{
+		CorrelationID:     procMsg.CorrelationID,
+		UserIDHash:        procMsg.UserIDHash,
+		ImageID:           procMsg.ImageID,
+		ReplyToken:        procMsg.ReplyToken,
+		Result:            state.result,
+		Summary:           state.summary,
+		Exif:              state.exif,
+		PreviouslySentAt:  state.previouslySentAt,
+		BudgetExceeded:    state.budgetExceeded,
+		GameImageURL:      state.gameImageURL,
+		TranslateTo:       state.translateTo,
+		Persona:           prefs.Persona,
+		MediaType:         procMsg.MediaType,
+		PublishedAt:       time.Now(),
+		ReceivedAt:        procMsg.ReceivedAt,
+		AnnotatedImageURL: state.annotatedImageURL,
+		Imagemap:          state.imagemap,
+		Emoji:             prefs.Emoji,
+		Knowledge:         state.knowledge,
+		FunFact:           state.funFactText,
+		Tenant:            procMsg.Tenant,
+		Consent:           prefs.Consent,
+		AskConsent:        askConsent(ctx, procMsg.UserIDHash, prefs),
+		Destination:       procMsg.Destination,
+	}
+	if _, err := publishSendMessage(ctx, msg); err != nil {
+		return err
 	}
-	log.Printf("publish: %s", id)
 
-	return nil
+	return markCompleted(ctx, projectID, "process", procMsg.CorrelationID)
 }
 
 func send(ctx context.Context, evt event.Event) error {
-	log.Printf("send")
-	log.Printf("request: %v", evt)
-
-	projectID := os.Getenv("PROJECT_ID")
+	ctx = logging.With(ctx, logging.Fields{Function: "send"})
+	logging.Printf(ctx, "send")
 
 	var subMsg messagePublishedData
 	if err := evt.DataAs(&subMsg); err != nil {
 		return fmt.Errorf("event.Event.DataAs failed; %w", err)
 	}
+	logging.Debugf(ctx, "request: %s", redact.JSON(redact.ModeFromEnv(), subMsg.Message.Data))
+	ctx = queue.WithAttributes(ctx, subMsg.Message.Attributes)
+	return sendWithRetries(ctx, subMsg.Message.Data)
+}
+
+func sendData(ctx context.Context, data []byte) (err error) {
+	defer func() { recordOutcome(ctx, "send", err) }()
+	defer trackInFlight(ctx, "send")()
+
 	var sendMsg sendMessage
-	if err := json.Unmarshal(subMsg.Message.Data, &sendMsg); err != nil {
-		return fmt.Errorf("json.Unmarshal failed; %w", err)
+	if ok, err := decodePayload(ctx, "send", data, &sendMsg); !ok {
+		return err
+	}
+	ctx = logging.With(ctx, logging.Fields{CorrelationID: sendMsg.CorrelationID, UserIDHash: sendMsg.UserIDHash, ImageID: sendMsg.ImageID})
+	if ctx, err = withTenant(ctx, sendMsg.Tenant); err != nil {
+		// retrying cannot bring the tenant back
+		logging.Errorf(ctx, "drop message; %v", err)
+		return nil
+	}
+	projectID := projectIDOf(ctx)
+	if done, err := alreadyCompleted(ctx, projectID, "send", sendMsg.CorrelationID); err != nil || done {
+		return err
+	}
+	finish := trackStage(ctx, eventlog.Replying, eventlog.Replied)
+	defer func() { finish(err) }()
+	if sendMsg.MulticastID != "" {
+		if err := sendMulticast(ctx, projectID, sendMsg.MulticastID); err != nil {
+			return err
+		}
+		return markCompleted(ctx, projectID, "send", sendMsg.CorrelationID)
 	}
 
-	log.Printf("reply token: %s", sendMsg.ReplyToken)
-	log.Printf("labels: %v", sendMsg.Labels)
+	logging.Printf(ctx, "reply token: %s", redact.Secret(redact.ModeFromEnv(), sendMsg.ReplyToken))
+	ctx = withConsent(ctx, sendMsg.Consent)
+	labels := sendMsg.Result.LabelNames()
+	logging.Printf(ctx, "labels: %v", labels)
 
-	text := strings.Join(sendMsg.Labels, "\n")
+	tone, _ := persona.Lookup(sendMsg.Persona)
+	text := formatLabels(labels)
+	if text != "" && sendMsg.MediaType == mediaVideo {
+		text = "Your video appears to show:\n" + text
+	}
+	if sendMsg.Summary != "" {
+		text = sendMsg.Summary
+	}
+	if text != "" {
+		text = tone.Frame(text)
+	}
+	if text == "" {
+		text = tone.Text(persona.KeyNoLabels, replyTemplate(ctx, "REPLY_NO_LABELS", "no labels found"), nil)
+	}
+	if sendMsg.BudgetExceeded {
+		text = tone.Text(persona.KeyBudgetExceeded, replyTemplate(ctx, "REPLY_BUDGET_EXCEEDED", "The daily analysis limit has been reached. Please try again tomorrow."), nil)
+	}
+	if !sendMsg.PreviouslySentAt.IsZero() {
+		date := sendMsg.PreviouslySentAt.Format("2006-01-02")
+		joined := strings.Join(labels, ", ")
+		text = tone.Text(persona.KeyDuplicate, fmt.Sprintf("you sent this before on %s, labels were: %s", date, joined), map[string]string{"Date": date, "Labels": joined})
+	}
+	if sendMsg.Destination != nil {
+		if err := sendElsewhere(ctx, projectID, sendMsg, text); err != nil {
+			return err
+		}
+		return markCompleted(ctx, projectID, "send", sendMsg.CorrelationID)
+	}
 
-	channelAccessToken, err := getSecret(ctx, projectID, "channel-access-token")
+	lineClient, err := newLineClient(ctx, projectID)
 	if err != nil {
 		return err
 	}
-	log.Print("get secret")
 
-	if err := sendReply(channelAccessToken, sendMsg.ReplyToken, text); err != nil {
+	codec, err := newPostbackCodec(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	if sendMsg.GameImageURL != "" {
+		builder, err := gameReply(sendMsg, codec)
+		if err != nil {
+			return err
+		}
+		if err := sendLINE(ctx, lineClient, sendMsg, messenger.Message{LINE: builder}); err != nil {
+			return err
+		}
+		return markCompleted(ctx, projectID, "send", sendMsg.CorrelationID)
+	}
+	builder := reply.NewBuilder(sendMsg.ReplyToken)
+	if sendMsg.Imagemap != nil {
+		addImagemap(builder, sendMsg.ImageID, sendMsg.Imagemap)
+	} else if sendMsg.AnnotatedImageURL != "" {
+		builder.Image(sendMsg.AnnotatedImageURL, sendMsg.AnnotatedImageURL)
+	}
+	plainLabels := len(labels) > 0 && sendMsg.Summary == "" && !sendMsg.BudgetExceeded && sendMsg.PreviouslySentAt.IsZero()
+	if plainLabels && sendMsg.MediaType != mediaVideo {
+		handled, err := coalesceReply(ctx, projectID, lineClient, sendMsg, labels)
+		if err != nil {
+			return err
+		}
+		if handled {
+			return markCompleted(ctx, projectID, "send", sendMsg.CorrelationID)
+		}
+	}
+	variant := ""
+	if plainLabels {
+		variant = replyFormatVariant(ctx, sendMsg.UserIDHash)
+	}
+	emojiOnly := false
+	if plainLabels && sendMsg.Emoji {
+		// labels without an emoji keep the text reply
+		if emojis := emoji.ForLabels(labels, maxEmojis); len(emojis) > 0 {
+			text = strings.Join(emojis, " ")
+			variant = ""
+			emojiOnly = true
+		}
+	}
+	if variant == variantFlex {
+		contents, err := labelsCarousel(labels)
+		if err != nil {
+			return err
+		}
+		builder.Flex(text, contents)
+	} else {
+		builder.Text(text)
+	}
+	if sendMsg.Summary == "" && !sendMsg.BudgetExceeded {
+		params := map[string]string{"imageId": sendMsg.ImageID}
+		if variant != "" {
+			// only a tap on the reply the variant shaped counts as engagement
+			params["variant"] = variant
+		}
+		data, err := codec.Encode(actionDescribe, params)
+		if err != nil {
+			return err
+		}
+		builder.QuickReply(reply.QuickReplyItem{Label: "Describe", Data: data, DisplayText: "Describe this image"})
+	}
+	if uri := liffURL(ctx, sendMsg.ImageID); uri != "" && !sendMsg.BudgetExceeded {
+		builder.QuickReply(reply.QuickReplyItem{Label: "View details", URI: uri})
+	}
+	if sendMsg.TranslateTo != "" {
+		item, err := translateQuickReply(sendMsg, codec)
+		if err != nil {
+			return err
+		}
+		builder.QuickReply(item)
+	}
+	if err := addExif(ctx, projectID, sendMsg, codec, builder); err != nil {
+		return err
+	}
+	if plainLabels && !emojiOnly && sendMsg.Knowledge != nil && builder.Len() < reply.MaxMessages {
+		builder.Text(sendMsg.Knowledge.Format())
+	}
+	if plainLabels && !emojiOnly && sendMsg.FunFact != "" && builder.Len() < reply.MaxMessages {
+		builder.Text("Fun fact: " + sendMsg.FunFact)
+	}
+	if sendMsg.Result.Timings != nil && builder.Len() < reply.MaxMessages {
+		timings := append(sendMsg.Result.Timings, newStageTiming("send queue wait", time.Since(sendMsg.PublishedAt)))
+		builder.Text(formatTimings(timings))
+	}
+	if sendMsg.AskConsent {
+		if err := addConsentNotice(ctx, projectID, sendMsg.UserIDHash, codec, builder); err != nil {
+			return err
+		}
+	}
+	if err := sendLINE(ctx, lineClient, sendMsg, messenger.Message{LINE: builder}); err != nil {
 		return err
 	}
-	log.Print("send reply")
+	if variant != "" {
+		recordExperiment(ctx, variant, false)
+	}
 
-	return nil
+	return markCompleted(ctx, projectID, "send", sendMsg.CorrelationID)
 }
 
-func returnError(w http.ResponseWriter, code int, err error) {
-	log.Printf("error: %v", err.Error())
+func returnError(ctx context.Context, w http.ResponseWriter, code int, err error) {
+	logging.Errorf(ctx, "error: %v", err.Error())
 	w.WriteHeader(code)
 	if _, err := w.Write([]byte(err.Error())); err != nil {
-		log.Printf("http.ResponseWriter.Write failed; %v", err.Error())
+		logging.Errorf(ctx, "http.ResponseWriter.Write failed; %v", err.Error())
 	}
 }
 
-func getSecret(ctx context.Context, projectID, secretName string) (string, error) {
-	clt, err := secretmanager.NewClient(ctx)
-	if err != nil {
-		return "", fmt.Errorf("secretmanager.NewClient failed; %w", err)
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
 	}
-	defer clt.Close()
-	req := &secretmanagerpb.AccessSecretVersionRequest{
-		Name: fmt.Sprintf("projects/%s/secrets/%s/versions/latest", projectID, secretName),
-	}
-	resp, err := clt.AccessSecretVersion(ctx, req)
-	if err != nil {
-		return "", fmt.Errorf("secretmanager.Client.AccessSecretVersion failed; %w", err)
-	}
-	return string(resp.Payload.Data), nil
+	return hex.EncodeToString(b)
 }
 
-func downloadImage(channelAccessToken, imageID string) ([]byte, error) {
-	url := fmt.Sprintf("https://api-data.line.me/v2/bot/message/%s/content", imageID)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// getSecret reads secretName from the backend SECRET_BACKEND selects.
+func getSecret(ctx context.Context, projectID, secretName string) (string, error) {
+	provider, err := secrets.FromEnv(projectID)
 	if err != nil {
-		return nil, fmt.Errorf("http.NewRequest failed; %w", err)
+		return "", err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", channelAccessToken))
-	resp, err := http.DefaultClient.Do(req)
+	return provider.Get(ctx, tenantSecretName(ctx, secretName))
+}
+
+// putSecret stores value with the provider of SECRET_BACKEND, as secretName
+// of the tenant.
+func putSecret(ctx context.Context, projectID, secretName, value string) error {
+	provider, err := secrets.FromEnv(projectID)
 	if err != nil {
-		return nil, fmt.Errorf("http.DefaultClient.Get failed; %w", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("non 200 HTTP status code; %d; %s", resp.StatusCode, resp.Status)
+		return err
 	}
-	respBytes, err := io.ReadAll(resp.Body)
+	return secrets.Put(ctx, provider, tenantSecretName(ctx, secretName), value)
+}
+
+func newLineClient(ctx context.Context, projectID string) (lineapi.LineClient, error) {
+	return cachedLineClientFor(ctx, projectID, func() (lineapi.LineClient, error) {
+		channelSecret, err := getSecret(ctx, projectID, "channel-secret")
+		if err != nil {
+			return nil, err
+		}
+		accessToken, err := channelAccessToken(ctx, projectID)
+		if err != nil {
+			return nil, err
+		}
+		logging.Printf(ctx, "get secret")
+		endpoints, err := lineEndpoints(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return lineapi.New(channelSecret, accessToken, endpoints)
+	})
+}
+
+// lineEndpoints are LINE's own unless LINE_API_BASE or LINE_DATA_API_BASE
+// point the tenant at another server, e.g. a sandbox.
+func lineEndpoints(ctx context.Context) (lineapi.Endpoints, error) {
+	return lineapi.ParseEndpoints(tenantEnv(ctx, "LINE_API_BASE"), tenantEnv(ctx, "LINE_DATA_API_BASE"))
+}
+
+func downloadImage(ctx context.Context, lineClient lineapi.LineClient, imageID string) ([]byte, error) {
+	image, err := lineClient.GetMessageContent(ctx, imageID)
 	if err != nil {
-		return nil, fmt.Errorf("io.ReadAll failed; %w", err)
+		return nil, err
 	}
-	return respBytes, nil
+	logging.Printf(ctx, "download image; %d bytes", len(image))
+	return image, nil
 }
 
-func analyzeImage(ctx context.Context, imageBytes []byte) ([]string, error) {
-	client, err := vision.NewImageAnnotatorClient(ctx)
+// analyzeImage requests the Vision features VISION_FEATURES names and merges
+// what they found into one list of labels, leaving out those scoring below
+// minScore.
+func analyzeImage(ctx context.Context, imageBytes []byte, minScore float32) ([]analysis.Label, error) {
+	client, err := visionclient.Default.Get(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("vision.NewImageAnnotatorClient failed; %w", err)
+		return nil, err
 	}
-	defer client.Close()
 	image, err := vision.NewImageFromReader(bytes.NewReader(imageBytes))
 	if err != nil {
 		return nil, fmt.Errorf("vision.NewImageFromReader failed; %w", err)
 	}
-	labels, err := client.DetectLabels(ctx, image, nil, 10)
+	features := labelFeatures(ctx)
+	req := &visionpb.AnnotateImageRequest{Image: image}
+	for _, name := range features {
+		req.Features = append(req.Features, &visionpb.Feature{Type: visionresult.Features[name].Type, MaxResults: maxLabels})
+	}
+	release, err := acquireVision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	batch, err := client.BatchAnnotateImages(ctx, &visionpb.BatchAnnotateImagesRequest{Requests: []*visionpb.AnnotateImageRequest{req}})
+	release()
 	if err != nil {
-		return nil, fmt.Errorf("vision.ImageAnnotatorClient.DetectLabels failed; %w", err)
+		return nil, fmt.Errorf("vision.ImageAnnotatorClient.BatchAnnotateImages failed; %w", err)
 	}
-	results := []string{}
-	for _, label := range labels {
-		results = append(results, label.Description)
+	if n := len(batch.GetResponses()); n != 1 {
+		return nil, fmt.Errorf("vision annotate failed; %d responses", n)
 	}
+	resp := batch.GetResponses()[0]
+	if resp.GetError() != nil {
+		return nil, fmt.Errorf("vision annotate failed; %s", resp.GetError().GetMessage())
+	}
+	archiveVisionResponse(ctx, visionresult.KindLabels, features, resp)
+	results := mergedLabels(visionresult.Labels(resp, features, minScore, maxLabels))
+	logging.Printf(ctx, "labels: %v", analysis.Names(results))
 	return results, nil
 }
 
-type replyFormat struct {
-	ReplyToken string               `json:"replyToken"`
-	Messages   []replyFormatMessage `json:"messages"`
-}
-
-type replyFormatMessage struct {
-	Type string `json:"type"`
-	Text string `json:"text"`
-}
-
-func sendReply(channelAccessToken, replyToken, text string) error {
-	url := "https://api.line.me/v2/bot/message/reply"
-	reply := replyFormat{
-		ReplyToken: replyToken,
-		Messages: []replyFormatMessage{{
-			Type: "text",
-			Text: text,
-		}},
-	}
-	replyBytes, err := json.Marshal(reply)
+func sendReply(ctx context.Context, lineClient lineapi.LineClient, builder *reply.Builder) error {
+	replyReq, err := builder.Build()
 	if err != nil {
-		return fmt.Errorf("json.Marshal failed; %w", err)
+		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(replyBytes))
-	if err != nil {
-		return fmt.Errorf("http.NewRequest failed; %w", err)
+	if dryRunEnabled(ctx) {
+		return dryRunReply(ctx, replyReq)
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", channelAccessToken))
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
+	complete := beginReplyIntent(ctx)
+	result, err := lineClient.Reply(ctx, replyReq)
+	complete(err)
+	recordReply(ctx, result, err)
 	if err != nil {
-		return fmt.Errorf("http.DefaultClient.Get failed; %w", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("non 200 HTTP status code; %d; %s", resp.StatusCode, resp.Status)
+		return err
 	}
+	logging.Printf(ctx, "send reply")
+	logConversation(ctx, conversation.Item{Kind: conversation.KindReply, Text: replyText(replyReq)})
 	return nil
 }
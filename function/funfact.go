@@ -0,0 +1,59 @@
+package function
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/funfact"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+)
+
+// a fun fact rides along with the labels, so it stays short
+const defaultFunFactMaxLength = 150
+
+func funFactsEnabled(ctx context.Context) bool {
+	return dynconfig.Get(ctx, "FUN_FACTS") == "true"
+}
+
+func funFactMaxLength(ctx context.Context) int {
+	if n, err := strconv.Atoi(dynconfig.Get(ctx, "FUN_FACT_MAX_LENGTH")); err == nil && n > 0 {
+		return n
+	}
+	return defaultFunFactMaxLength
+}
+
+// funFactStep picks a fun fact about the top label for users who turned
+// "/funfact" on, a no-op unless FUN_FACTS=true. Labels the embedded dataset
+// does not know fall back to the Knowledge Graph, whose lookups are cached;
+// failures only cost the fact, never the reply.
+func funFactStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	if !funFactsEnabled(ctx) || !state.funFact || len(state.result.Labels) == 0 {
+		return nil
+	}
+	label := state.result.Labels[0].Name
+	fact := funfact.For(label)
+	if fact == "" && knowledgeEnabled(ctx) {
+		entity := state.knowledge
+		if entity == nil {
+			language, err := userLanguage(ctx, state.projectID, state.procMsg.UserIDHash)
+			if err != nil {
+				logging.Errorf(ctx, "fun fact skipped; %v", err)
+				return nil
+			}
+			if entity, err = lookupEntity(ctx, state.projectID, label, language); err != nil {
+				logging.Errorf(ctx, "fun fact skipped; %v", err)
+				return nil
+			}
+		}
+		if entity != nil {
+			fact = entity.Detail
+		}
+	}
+	if fact == "" {
+		return nil
+	}
+	state.funFactText = funfact.Truncate(fact, funFactMaxLength(ctx))
+	logging.Printf(ctx, "fun fact about %s", label)
+	return nil
+}
@@ -0,0 +1,105 @@
+// Package funfact picks a fun fact about a label from an embedded dataset.
+package funfact
+
+import (
+	_ "embed"
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//go:embed facts.json
+var factsJSON []byte
+
+// Fact is one fact of the dataset; facts with a higher weight come up more
+// often.
+type Fact struct {
+	Text   string `json:"text"`
+	Weight int    `json:"weight"`
+}
+
+var byKeyword = mustLoad()
+
+// keywords are tried longest first, the way emojis are.
+var keywords = sortedKeywords()
+
+var (
+	mu  sync.Mutex
+	rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func mustLoad() map[string][]Fact {
+	var m map[string][]Fact
+	if err := json.Unmarshal(factsJSON, &m); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func sortedKeywords() []string {
+	ks := make([]string, 0, len(byKeyword))
+	for k := range byKeyword {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		if len(ks[i]) != len(ks[j]) {
+			return len(ks[i]) > len(ks[j])
+		}
+		return ks[i] < ks[j]
+	})
+	return ks
+}
+
+// For returns a random fact about the first keyword that is the label or a
+// run of its words, or "" if none is.
+func For(label string) string {
+	words := " " + strings.ToLower(strings.Join(strings.Fields(label), " ")) + " "
+	for _, keyword := range keywords {
+		if strings.Contains(words, " "+keyword+" ") {
+			return pick(byKeyword[keyword])
+		}
+	}
+	return ""
+}
+
+// pick draws a fact with a probability proportional to its weight; a
+// weight below 1 counts as 1.
+func pick(facts []Fact) string {
+	total := 0
+	for _, f := range facts {
+		total += weight(f)
+	}
+	if total == 0 {
+		return ""
+	}
+	mu.Lock()
+	n := rnd.Intn(total)
+	mu.Unlock()
+	for _, f := range facts {
+		if n < weight(f) {
+			return f.Text
+		}
+		n -= weight(f)
+	}
+	return ""
+}
+
+func weight(f Fact) int {
+	if f.Weight < 1 {
+		return 1
+	}
+	return f.Weight
+}
+
+// Truncate shortens s to at most n runes, ending it with an ellipsis.
+func Truncate(s string, n int) string {
+	s = strings.TrimSpace(s)
+	if n <= 0 || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
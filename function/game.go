@@ -0,0 +1,420 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/conversation"
+	"github.com/hsmtkk/ubiquitous-couscous/function/decode"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/game"
+	"github.com/hsmtkk/ubiquitous-couscous/function/imageutil"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/postback"
+	"github.com/hsmtkk/ubiquitous-couscous/function/queue"
+	"github.com/hsmtkk/ubiquitous-couscous/function/redact"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	modeGame         = "game"
+	actionGameReveal = "gameReveal"
+
+	gameImageSize = 512
+	// the posted picture shows this part of the original, blurred
+	gameCropFraction = 0.6
+	gameBlurRadius   = 8
+
+	// V4 signed URLs are valid for at most 7 days
+	maxImageURLTTL = 7 * 24 * time.Hour
+)
+
+type gameRound struct {
+	ImageID   string    `firestore:"imageId"`
+	Labels    []string  `firestore:"labels"`
+	StartedAt time.Time `firestore:"startedAt"`
+	Solved    bool      `firestore:"solved"`
+}
+
+// groupState lives on the groups/{groupIdHash} document.
+type groupState struct {
+	Game   bool             `firestore:"game"`
+	Round  *gameRound       `firestore:"round"`
+	Scores map[string]int64 `firestore:"scores"`
+}
+
+type guessMessage struct {
+	CorrelationID string
+	GroupIDHash   string
+	UserIDHash    string
+	ReplyToken    string
+	Text          string
+	Tenant        string `json:",omitempty"`
+}
+
+func (m guessMessage) Validate() []decode.FieldError {
+	return append(decode.Required("ReplyToken", m.ReplyToken), decode.Required("Text", m.Text)...)
+}
+
+func groupDoc(client *firestore.Client, groupIDHash string) *firestore.DocumentRef {
+	return client.Collection(namespace.Collection("groups")).Doc(groupIDHash)
+}
+
+func loadGroup(ctx context.Context, client *firestore.Client, groupIDHash string) (groupState, error) {
+	var group groupState
+	snap, err := groupDoc(client, groupIDHash).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return group, nil
+	}
+	if err != nil {
+		return group, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	if err := snap.DataTo(&group); err != nil {
+		return group, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+	}
+	return group, nil
+}
+
+func gameEnabled(ctx context.Context, projectID, groupIDHash string) (bool, error) {
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return false, err
+	}
+	group, err := loadGroup(ctx, client, groupIDHash)
+	if err != nil {
+		return false, err
+	}
+	return group.Game, nil
+}
+
+// gameStep posts an obscured version of the image instead of its labels and
+// starts a new round for the group with the labels as answers.
+func gameStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	bucket := tenantEnv(ctx, "GAME_BUCKET")
+	if bucket == "" {
+		return fmt.Errorf("GAME_BUCKET is not set")
+	}
+	if err := ensureSafeSearch(ctx, state); err != nil {
+		return err
+	}
+	image := state.image
+	if state.unsafe {
+		// the blur alone may still show what SafeSearch flagged
+		pixelated, err := moderateImage(image)
+		if err != nil {
+			return err
+		}
+		image = pixelated
+	}
+	img, _, err := imageutil.Decode(image)
+	if err != nil {
+		return err
+	}
+	obscured := imageutil.Blur(imageutil.CropCenter(imageutil.Resize(img, gameImageSize), gameCropFraction), gameBlurRadius)
+	b, err := imageutil.EncodeJPEG(obscured)
+	if err != nil {
+		return err
+	}
+	url, err := uploadImage(ctx, bucket, fmt.Sprintf("games/%s/%s.jpg", state.procMsg.GroupIDHash, state.procMsg.ImageID), b)
+	if err != nil {
+		return err
+	}
+
+	client, err := clients.Firestore(ctx, state.projectID)
+	if err != nil {
+		return err
+	}
+	round := gameRound{ImageID: state.procMsg.ImageID, Labels: state.result.LabelNames(), StartedAt: time.Now()}
+	if _, err := groupDoc(client, state.procMsg.GroupIDHash).Set(ctx, map[string]interface{}{"round": round}, firestore.MergeAll); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	logging.Printf(ctx, "game round started")
+
+	// the answers must not reach the group
+	state.result.Labels = []analysis.Label{}
+	state.previouslySentAt = time.Time{}
+	state.gameImageURL = url
+	return nil
+}
+
+// imageURLTTL is how long the link to an uploaded image can be opened,
+// IMAGE_URL_TTL_HOURS, 7 days at most and by default.
+func imageURLTTL(ctx context.Context) time.Duration {
+	if n, err := strconv.Atoi(dynconfig.Get(ctx, "IMAGE_URL_TTL_HOURS")); err == nil && n > 0 && time.Duration(n)*time.Hour < maxImageURLTTL {
+		return time.Duration(n) * time.Hour
+	}
+	return maxImageURLTTL
+}
+
+// uploadImage stores a JPEG in bucket and returns a signed URL to it, so
+// that the bucket itself need not be readable.
+func uploadImage(ctx context.Context, bucket, name string, b []byte) (string, error) {
+	if err := writeObject(ctx, bucket, name, "image/jpeg", b, nil); err != nil {
+		return "", err
+	}
+	return signedURL(ctx, bucket, name, imageURLTTL(ctx))
+}
+
+func gameReply(sendMsg sendMessage, codec *postback.Codec) (*reply.Builder, error) {
+	data, err := codec.Encode(actionGameReveal, nil)
+	if err != nil {
+		return nil, err
+	}
+	return reply.NewBuilder(sendMsg.ReplyToken).
+		Image(sendMsg.GameImageURL, sendMsg.GameImageURL).
+		Text("What is in this picture? Send your guess as a message.").
+		QuickReply(reply.QuickReplyItem{Label: "Reveal", Data: data, DisplayText: "Reveal the answer"}), nil
+}
+
+func handleGuess(ctx context.Context, evt event.Event) error {
+	ctx = logging.With(ctx, logging.Fields{Function: "guess"})
+	logging.Printf(ctx, "guess")
+
+	var subMsg messagePublishedData
+	if err := evt.DataAs(&subMsg); err != nil {
+		return fmt.Errorf("event.Event.DataAs failed; %w", err)
+	}
+	logging.Debugf(ctx, "request: %s", redact.JSON(redact.ModeFromEnv(), subMsg.Message.Data))
+	return guessData(queue.WithAttributes(ctx, subMsg.Message.Attributes), subMsg.Message.Data)
+}
+
+// guessData handles the "/debug", "/emoji", "/echo", "/funfact", "/caption", "/privacy", "/deletemydata", "/persona", "/threshold", "/export",
+// "/history", "/search", "/object", "/compare", admin and "/game" commands and scores every other text of a playing group
+// against the current round.
+func guessData(ctx context.Context, data []byte) (err error) {
+	defer func() { recordOutcome(ctx, "guess", err) }()
+
+	var guessMsg guessMessage
+	if ok, err := decodePayload(ctx, "guess", data, &guessMsg); !ok {
+		return err
+	}
+	ctx = logging.With(ctx, logging.Fields{CorrelationID: guessMsg.CorrelationID, UserIDHash: guessMsg.UserIDHash})
+	if ctx, err = withTenant(ctx, guessMsg.Tenant); err != nil {
+		// retrying cannot bring the tenant back
+		logging.Errorf(ctx, "drop message; %v", err)
+		return nil
+	}
+	projectID := projectIDOf(ctx)
+	logConversation(ctx, conversation.Item{Kind: conversation.KindInbound, Text: guessMsg.Text})
+
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return err
+	}
+
+	var text string
+	var quickReplies []reply.QuickReplyItem
+	var images []string
+	command := strings.TrimSpace(strings.ToLower(guessMsg.Text))
+	switch {
+	case command == "/debug on" || command == "/debug off":
+		on := command == "/debug on"
+		if err := savePreference(ctx, client, guessMsg.UserIDHash, "debugTiming", on); err != nil {
+			return err
+		}
+		text = "Timing breakdown turned off."
+		if on {
+			text = "Timing breakdown turned on. Replies now show how long each stage took."
+		}
+	case command == "/emoji on" || command == "/emoji off":
+		on := command == "/emoji on"
+		if err := savePreference(ctx, client, guessMsg.UserIDHash, "emoji", on); err != nil {
+			return err
+		}
+		text = "Emoji replies turned off."
+		if on {
+			text = "Emoji replies turned on. Photos are now answered with emojis only."
+		}
+	case command == "/echo on" || command == "/echo off":
+		on := command == "/echo on"
+		if err := savePreference(ctx, client, guessMsg.UserIDHash, "echo", on); err != nil {
+			return err
+		}
+		text = "Image echo turned off."
+		if on {
+			text = "Image echo turned on. Photos are now sent back with their top labels on them."
+		}
+	case command == "/funfact on" || command == "/funfact off":
+		on := command == "/funfact on"
+		if err := savePreference(ctx, client, guessMsg.UserIDHash, "funFact", on); err != nil {
+			return err
+		}
+		text = "Fun facts turned off."
+		if on {
+			text = "Fun facts turned on. Replies now end with a fun fact about the photo when there is one."
+		}
+	case command == privacyCommand && guessMsg.UserIDHash != "":
+		codec, err := newPostbackCodec(ctx, projectID)
+		if err != nil {
+			return err
+		}
+		text, quickReplies, err = privacy(ctx, client, guessMsg.UserIDHash, codec)
+		if err != nil {
+			return err
+		}
+	case command == deleteDataCommand && guessMsg.UserIDHash != "":
+		codec, err := newPostbackCodec(ctx, projectID)
+		if err != nil {
+			return err
+		}
+		text, quickReplies, err = deleteDataPrompt(codec)
+		if err != nil {
+			return err
+		}
+	case command == "/persona" || strings.HasPrefix(command, "/persona "):
+		text, err = choosePersona(ctx, client, guessMsg.UserIDHash, strings.TrimSpace(strings.TrimPrefix(command, "/persona")))
+		if err != nil {
+			return err
+		}
+	case command == "/caption" || strings.HasPrefix(command, "/caption "):
+		text, err = chooseCaption(ctx, client, guessMsg.UserIDHash, strings.TrimSpace(strings.TrimPrefix(command, "/caption")))
+		if err != nil {
+			return err
+		}
+	case command == "/threshold" || strings.HasPrefix(command, "/threshold "):
+		text, err = chooseThreshold(ctx, client, guessMsg.UserIDHash, strings.TrimSpace(strings.TrimPrefix(command, "/threshold")))
+		if err != nil {
+			return err
+		}
+	case command == "/export" || strings.HasPrefix(command, "/export "):
+		text, err = exportResults(ctx, client, guessMsg.UserIDHash, strings.TrimSpace(strings.TrimPrefix(command, "/export")))
+		if err != nil {
+			return err
+		}
+	case command == "/history" || strings.HasPrefix(command, "/history "):
+		text, err = history(ctx, client, guessMsg.UserIDHash, strings.TrimSpace(strings.TrimPrefix(command, "/history")))
+		if err != nil {
+			return err
+		}
+	case command == searchCommand || strings.HasPrefix(command, searchCommand+" "):
+		text, images, err = searchArchive(ctx, client, guessMsg.UserIDHash, strings.TrimSpace(strings.TrimPrefix(command, searchCommand)))
+		if err != nil {
+			return err
+		}
+	case strings.HasPrefix(command, objectCommand+" "):
+		text, err = objectDetails(ctx, client, guessMsg.UserIDHash, strings.TrimPrefix(command, objectCommand))
+		if err != nil {
+			return err
+		}
+	case command == compareCommand || strings.HasPrefix(command, compareCommand+" "):
+		text, err = startComparison(ctx, client, guessMsg.UserIDHash, strings.TrimSpace(strings.TrimPrefix(command, compareCommand)))
+		if err != nil {
+			return err
+		}
+	case isAdminCommand(command):
+		text, err = adminCommand(ctx, client, guessMsg.UserIDHash, guessMsg.CorrelationID, guessMsg.Text)
+		if err != nil {
+			return err
+		}
+	case guessMsg.GroupIDHash == "":
+		logging.Printf(ctx, "skip unknown command")
+	case command == "/game on":
+		if _, err := groupDoc(client, guessMsg.GroupIDHash).Set(ctx, map[string]interface{}{"game": true}, firestore.MergeAll); err != nil {
+			return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+		}
+		text = "Game on! Send a photo and let the others guess what is in it."
+	case command == "/game off":
+		if _, err := groupDoc(client, guessMsg.GroupIDHash).Set(ctx, map[string]interface{}{"game": false}, firestore.MergeAll); err != nil {
+			return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+		}
+		text = "Game over. Photos are labeled again."
+	default:
+		text, err = scoreGuess(ctx, client, guessMsg)
+		if err != nil {
+			return err
+		}
+	}
+	// wrong guesses are not answered to keep the group quiet
+	if text == "" {
+		return nil
+	}
+
+	lineClient, err := newLineClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	builder := reply.NewBuilder(guessMsg.ReplyToken).Text(text)
+	for _, url := range images {
+		builder.Image(url, url)
+	}
+	return sendReply(ctx, lineClient, builder.QuickReply(quickReplies...))
+}
+
+// scoreGuess closes the round on the first correct guess and returns the
+// text announcing it, empty for anything else.
+func scoreGuess(ctx context.Context, client *firestore.Client, guessMsg guessMessage) (string, error) {
+	ref := groupDoc(client, guessMsg.GroupIDHash)
+	var text string
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		text = ""
+		snap, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var group groupState
+		if err := snap.DataTo(&group); err != nil {
+			return err
+		}
+		if !group.Game || group.Round == nil || group.Round.Solved {
+			return nil
+		}
+		label, ok := game.Match(group.Round.Labels, guessMsg.Text)
+		if !ok {
+			return nil
+		}
+		points := group.Scores[guessMsg.UserIDHash] + 1
+		text = fmt.Sprintf("Correct! It was %s. You have %d points.", label, points)
+		return tx.Update(ref, []firestore.Update{
+			{Path: "round.solved", Value: true},
+			{FieldPath: firestore.FieldPath{"scores", guessMsg.UserIDHash}, Value: points},
+		})
+	})
+	if err != nil {
+		return "", fmt.Errorf("firestore.Client.RunTransaction failed; %w", err)
+	}
+	return text, nil
+}
+
+// gameRevealAction closes the current round of the group the postback came
+// from and tells the answers.
+func gameRevealAction(ctx context.Context, evt postback.Event, payload postback.Payload) error {
+	projectID := projectIDOf(ctx)
+	if evt.GroupIDHash == "" {
+		return fmt.Errorf("game reveal postback outside group")
+	}
+
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	group, err := loadGroup(ctx, client, evt.GroupIDHash)
+	if err != nil {
+		return err
+	}
+	text := "There is no round to reveal."
+	if group.Round != nil && !group.Round.Solved {
+		if _, err := groupDoc(client, evt.GroupIDHash).Update(ctx, []firestore.Update{{Path: "round.solved", Value: true}}); err != nil {
+			return fmt.Errorf("firestore.DocumentRef.Update failed; %w", err)
+		}
+		text = "The answer was: " + strings.Join(group.Round.Labels, ", ")
+	}
+
+	lineClient, err := newLineClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	return sendReply(ctx, lineClient, reply.NewBuilder(evt.ReplyToken).Text(text))
+}
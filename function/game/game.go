@@ -0,0 +1,43 @@
+package game
+
+import (
+	"strings"
+	"unicode"
+)
+
+// minWordLength keeps guesses like "a" or "of" from matching multi word labels.
+const minWordLength = 3
+
+// Normalize lower cases s and drops everything but letters, digits and
+// single spaces.
+func Normalize(s string) string {
+	fields := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(fields, " ")
+}
+
+// Match returns the label a guess hits. A guess hits a label when it equals
+// the whole label or one of its words, so "retriever" scores for
+// "Golden retriever".
+func Match(labels []string, guess string) (string, bool) {
+	guess = Normalize(guess)
+	if guess == "" {
+		return "", false
+	}
+	for _, label := range labels {
+		normalized := Normalize(label)
+		if guess == normalized {
+			return label, true
+		}
+		if len(guess) < minWordLength {
+			continue
+		}
+		for _, word := range strings.Fields(normalized) {
+			if guess == word {
+				return label, true
+			}
+		}
+	}
+	return "", false
+}
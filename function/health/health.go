@@ -0,0 +1,110 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	errorsCollection = "pipelineErrors"
+	statsCollection  = "pipelineStats"
+)
+
+type ErrorEntry struct {
+	Function      string    `firestore:"function" json:"function"`
+	CorrelationID string    `firestore:"correlationId" json:"correlationId"`
+	Message       string    `firestore:"message" json:"message"`
+	At            time.Time `firestore:"at" json:"at"`
+}
+
+type Counts struct {
+	Success int64 `firestore:"success" json:"success"`
+	Failure int64 `firestore:"failure" json:"failure"`
+}
+
+func (c Counts) SuccessRate() float64 {
+	total := c.Success + c.Failure
+	if total == 0 {
+		return 1
+	}
+	return float64(c.Success) / float64(total)
+}
+
+// Recorder keeps per day success/failure counters for each pipeline
+// function plus the most recent errors in Firestore.
+type Recorder struct {
+	client *firestore.Client
+}
+
+func NewRecorder(client *firestore.Client) *Recorder {
+	return &Recorder{client: client}
+}
+
+func (r *Recorder) Record(ctx context.Context, function, correlationID string, outcome error) error {
+	now := time.Now()
+	field := "success"
+	if outcome != nil {
+		field = "failure"
+	}
+	counter := map[string]interface{}{
+		function: map[string]interface{}{field: firestore.Increment(1)},
+	}
+	if _, err := r.client.Collection(namespace.Collection(statsCollection)).Doc(day(now)).Set(ctx, counter, firestore.MergeAll); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	if outcome == nil {
+		return nil
+	}
+	entry := ErrorEntry{Function: function, CorrelationID: correlationID, Message: outcome.Error(), At: now}
+	if _, _, err := r.client.Collection(namespace.Collection(errorsCollection)).Add(ctx, entry); err != nil {
+		return fmt.Errorf("firestore.CollectionRef.Add failed; %w", err)
+	}
+	return nil
+}
+
+func (r *Recorder) RecentErrors(ctx context.Context, n int) ([]ErrorEntry, error) {
+	iter := r.client.Collection(namespace.Collection(errorsCollection)).OrderBy("at", firestore.Desc).Limit(n).Documents(ctx)
+	defer iter.Stop()
+	entries := []ErrorEntry{}
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestore.DocumentIterator.Next failed; %w", err)
+		}
+		var entry ErrorEntry
+		if err := snap.DataTo(&entry); err != nil {
+			return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// Counts returns today's counters keyed by function name.
+func (r *Recorder) Counts(ctx context.Context) (map[string]Counts, error) {
+	counts := map[string]Counts{}
+	snap, err := r.client.Collection(namespace.Collection(statsCollection)).Doc(day(time.Now())).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return counts, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	if err := snap.DataTo(&counts); err != nil {
+		return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+	}
+	return counts, nil
+}
+
+func day(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
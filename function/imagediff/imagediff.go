@@ -0,0 +1,43 @@
+package imagediff
+
+import (
+	"github.com/hsmtkk/ubiquitous-couscous/function/canary"
+	"github.com/hsmtkk/ubiquitous-couscous/function/phash"
+)
+
+// Snapshot is what a comparison needs of an image.
+type Snapshot struct {
+	Labels []string
+	Hash   phash.Hash
+}
+
+// Diff tells what changed from the first image to the second.
+type Diff struct {
+	Added   []string
+	Removed []string
+	Kept    []string
+	// Visual compares the perceptual hashes, Labels the label sets; both
+	// run from 0 to 1.
+	Visual float64
+	Labels float64
+}
+
+// Similarity weighs the look and the content of the images equally; when
+// neither has labels only the look counts.
+func (d Diff) Similarity() float64 {
+	if len(d.Added)+len(d.Removed)+len(d.Kept) == 0 {
+		return d.Visual
+	}
+	return (d.Visual + d.Labels) / 2
+}
+
+func Compare(first, second Snapshot) Diff {
+	c := canary.Compare(first.Labels, second.Labels)
+	return Diff{
+		Added:   c.OnlyCandidate,
+		Removed: c.OnlyPrimary,
+		Kept:    c.Common,
+		Visual:  1 - float64(phash.Distance(first.Hash, second.Hash))/64,
+		Labels:  c.Agreement,
+	}
+}
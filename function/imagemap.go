@@ -0,0 +1,294 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/storage"
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/annotate"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/imageutil"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+	"github.com/hsmtkk/ubiquitous-couscous/function/tenant"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// LINE fetches an imagemap image in these widths; the first is the base
+// size the tappable areas are given in.
+var imagemapWidths = []int{1040, 700, 460, 300, 240}
+
+// objectCommand is what tapping an object of an imagemap sends, followed by
+// the image ID and the index of the object. Imagemaps cannot carry
+// postbacks, so the tap comes back as a text message.
+const objectCommand = "/object"
+
+// actionImagemapImage signs the part of an imagemap's base URL that names
+// the image, see serveImagemap.
+const actionImagemapImage = "imagemapImage"
+
+// objectImagemap is the imagemap reply of the objects mode.
+type objectImagemap struct {
+	BaseURL string
+	// Height is the height of the base image, 1040 pixels wide.
+	Height  int
+	Objects []analysis.Object
+}
+
+// imagemapRecord lives on users/{userIdHash}/imagemaps/{imageId} so that a
+// tap can be answered with the details of the object.
+type imagemapRecord struct {
+	Objects   []analysis.Object `firestore:"objects"`
+	CreatedAt time.Time         `firestore:"createdAt"`
+}
+
+func imagemapDoc(client *firestore.Client, userIDHash, imageID string) *firestore.DocumentRef {
+	return client.Collection(namespace.Collection("users")).Doc(userIDHash).Collection(namespace.Collection("imagemaps")).Doc(imageID)
+}
+
+func imagemapObjectName(userIDHash, imageID string, width int) string {
+	return fmt.Sprintf("imagemap/%s/%s/%d", userIDHash, imageID, width)
+}
+
+// imagemapStep uploads the image with the objects the objects step found
+// outlined on it to ANNOTATION_BUCKET, in every width an imagemap needs, and
+// replies with it as an imagemap whose boxes can be tapped. The bucket is
+// not readable; LINE fetches the image from the imagemap function at
+// IMAGEMAP_URL. Images SafeSearch flags get no imagemap.
+func imagemapStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	bucket := tenantEnv(ctx, "ANNOTATION_BUCKET")
+	base := tenantEnv(ctx, "IMAGEMAP_URL")
+	objects := state.result.Objects
+	if bucket == "" || base == "" || len(objects) == 0 || state.procMsg.UserIDHash == "" {
+		return nil
+	}
+	if err := ensureSafeSearch(ctx, state); err != nil {
+		return err
+	}
+	if state.unsafe {
+		logging.Printf(ctx, "no imagemap of an unsafe image")
+		return nil
+	}
+	codec, err := newPostbackCodec(ctx, state.projectID)
+	if err != nil {
+		return err
+	}
+	token, err := codec.Encode(actionImagemapImage, map[string]string{"u": state.procMsg.UserIDHash, "i": state.procMsg.ImageID})
+	if err != nil {
+		return err
+	}
+	img, _, err := imageutil.Decode(state.image)
+	if err != nil {
+		return err
+	}
+	boxes := make([]annotate.Box, len(objects))
+	for i, o := range objects {
+		boxes[i] = annotate.Box{Name: o.Name, Score: o.Score, MinX: o.MinX, MinY: o.MinY, MaxX: o.MaxX, MaxY: o.MaxY}
+	}
+	drawn := annotate.Draw(img, boxes)
+	height := 0
+	for _, width := range imagemapWidths {
+		scaled := imageutil.ScaleWidth(drawn, width)
+		if width == imagemapWidths[0] {
+			height = scaled.Bounds().Dy()
+		}
+		b, err := imageutil.EncodeJPEG(scaled)
+		if err != nil {
+			return err
+		}
+		if err := writeObject(ctx, bucket, imagemapObjectName(state.procMsg.UserIDHash, state.procMsg.ImageID, width), "image/jpeg", b, nil); err != nil {
+			return err
+		}
+	}
+
+	client, err := clients.Firestore(ctx, state.projectID)
+	if err != nil {
+		return err
+	}
+	record := imagemapRecord{Objects: objects, CreatedAt: time.Now()}
+	if _, err := imagemapDoc(client, state.procMsg.UserIDHash, state.procMsg.ImageID).Set(ctx, record); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	state.imagemap = &objectImagemap{
+		BaseURL: imagemapBaseURL(ctx, base, token),
+		Height:  height,
+		Objects: objects,
+	}
+	logging.Printf(ctx, "imagemap with %d objects", len(objects))
+	return nil
+}
+
+// imagemapBaseURL is base followed by the tenant, when there is one, and
+// token; LINE appends the width it wants to it.
+func imagemapBaseURL(ctx context.Context, base, token string) string {
+	segments := []string{strings.TrimSuffix(base, "/")}
+	if t, ok := tenant.FromContext(ctx); ok {
+		segments = append(segments, url.PathEscape(t.ID))
+	}
+	return strings.Join(append(segments, token), "/")
+}
+
+// serveImagemap answers LINE fetching an imagemap image, GET
+// /[tenant/]<token>/<width> with the token imagemapStep signed. A token
+// is good for as long as imageURLTTL.
+func serveImagemap(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "imagemap"})
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		returnError(ctx, w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed; %s", r.Method))
+		return
+	}
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) == 3 {
+		var err error
+		if ctx, err = withTenant(ctx, segments[0]); err != nil {
+			returnError(ctx, w, http.StatusNotFound, err)
+			return
+		}
+		segments = segments[1:]
+	}
+	if len(segments) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	width, err := strconv.Atoi(segments[1])
+	if err != nil || !validImagemapWidth(width) {
+		http.NotFound(w, r)
+		return
+	}
+	codec, err := newPostbackCodec(ctx, projectIDOf(ctx))
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	payload, err := codec.DecodeAction(segments[0], actionImagemapImage, imageURLTTL(ctx), time.Now())
+	if err != nil {
+		returnError(ctx, w, http.StatusNotFound, err)
+		return
+	}
+	bucket := tenantEnv(ctx, "ANNOTATION_BUCKET")
+	if bucket == "" {
+		http.NotFound(w, r)
+		return
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, fmt.Errorf("storage.NewClient failed; %w", err))
+		return
+	}
+	defer client.Close()
+	reader, err := client.Bucket(bucket).Object(namespace.Object(imagemapObjectName(payload.Param("u"), payload.Param("i"), width))).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, fmt.Errorf("storage.ObjectHandle.NewReader failed; %w", err))
+		return
+	}
+	defer reader.Close()
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, reader); err != nil {
+		logging.Errorf(ctx, "io.Copy failed; %v", err)
+	}
+}
+
+func validImagemapWidth(width int) bool {
+	for _, w := range imagemapWidths {
+		if w == width {
+			return true
+		}
+	}
+	return false
+}
+
+// addImagemap puts the imagemap in front of the text reply, one tappable
+// area per object.
+func addImagemap(builder *reply.Builder, imageID string, imagemap *objectImagemap) {
+	width := imagemapWidths[0]
+	actions := []reply.ImagemapAction{}
+	for i, o := range imagemap.Objects {
+		x, y := int(o.MinX*float64(width)), int(o.MinY*float64(imagemap.Height))
+		w, h := int(o.MaxX*float64(width))-x, int(o.MaxY*float64(imagemap.Height))-y
+		if w <= 0 || h <= 0 {
+			continue
+		}
+		actions = append(actions, reply.ImagemapAction{
+			Label:  o.Name,
+			Text:   fmt.Sprintf("%s %s %d", objectCommand, imageID, i+1),
+			X:      x,
+			Y:      y,
+			Width:  w,
+			Height: h,
+		})
+	}
+	if len(actions) == 0 {
+		return
+	}
+	builder.Imagemap(imagemap.BaseURL, "Tap an object to learn more", reply.ImagemapSize{Width: width, Height: imagemap.Height}, actions...)
+}
+
+// objectDetails answers the text an imagemap tap sent, "/object <imageId>
+// <n>", with what is known about the n-th object of the image.
+func objectDetails(ctx context.Context, client *firestore.Client, userIDHash, args string) (string, error) {
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		return "Tap an object in the picture to learn more about it.", nil
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 1 {
+		return "Tap an object in the picture to learn more about it.", nil
+	}
+	snap, err := imagemapDoc(client, userIDHash, fields[0]).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return "This picture is no longer available.", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	var record imagemapRecord
+	if err := snap.DataTo(&record); err != nil {
+		return "", fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+	}
+	if n > len(record.Objects) {
+		return "This picture is no longer available.", nil
+	}
+	o := record.Objects[n-1]
+	area := (o.MaxX - o.MinX) * (o.MaxY - o.MinY)
+	return fmt.Sprintf("%s\nConfidence: %.0f%%\nPosition: %s\nSize: %.0f%% of the picture",
+		o.Name, o.Score*100, objectPosition(o), area*100), nil
+}
+
+// objectPosition names the part of the picture the center of o is in.
+func objectPosition(o analysis.Object) string {
+	third := func(v float64, names [3]string) string {
+		switch {
+		case v < 1.0/3:
+			return names[0]
+		case v < 2.0/3:
+			return names[1]
+		}
+		return names[2]
+	}
+	vertical := third((o.MinY+o.MaxY)/2, [3]string{"top", "middle", "bottom"})
+	horizontal := third((o.MinX+o.MaxX)/2, [3]string{"left", "center", "right"})
+	if vertical == "middle" && horizontal == "center" {
+		return "center"
+	}
+	return vertical + " " + horizontal
+}
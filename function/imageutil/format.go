@@ -0,0 +1,102 @@
+package imageutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	FormatJPEG    = "jpeg"
+	FormatPNG     = "png"
+	FormatGIF     = "gif"
+	FormatWebP    = "webp"
+	FormatHEIC    = "heic"
+	FormatUnknown = "unknown"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+// heicBrands are the ftyp brands of HEIF images with HEVC content. The
+// generic mif1 and msf1 are left out, AVIF images carry them too.
+var heicBrands = map[string]bool{"heic": true, "heix": true, "hevc": true, "hevx": true, "heim": true, "heis": true}
+
+var contentTypes = map[string]string{
+	FormatJPEG: "image/jpeg",
+	FormatPNG:  "image/png",
+	FormatGIF:  "image/gif",
+	FormatWebP: "image/webp",
+	FormatHEIC: "image/heic",
+}
+
+// Sniff tells the format of an image from its leading bytes.
+func Sniff(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xFF, 0xD8, 0xFF}):
+		return FormatJPEG
+	case bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")):
+		return FormatPNG
+	case bytes.HasPrefix(b, []byte("GIF87a")), bytes.HasPrefix(b, []byte("GIF89a")):
+		return FormatGIF
+	case len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "WEBP":
+		return FormatWebP
+	case len(b) >= 12 && string(b[4:8]) == "ftyp":
+		for _, brand := range ftypBrands(b) {
+			if heicBrands[brand] {
+				return FormatHEIC
+			}
+		}
+	}
+	return FormatUnknown
+}
+
+// ftypBrands returns the major brand of the leading ftyp box and its
+// compatible brands, which follow the minor version.
+func ftypBrands(b []byte) []string {
+	size := int(binary.BigEndian.Uint32(b[:4]))
+	if size > len(b) {
+		size = len(b)
+	}
+	brands := []string{string(b[8:12])}
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, string(b[i:i+4]))
+	}
+	return brands
+}
+
+// ContentType is the MIME type of the image, application/octet-stream when
+// Sniff cannot tell its format.
+func ContentType(b []byte) string {
+	if t, ok := contentTypes[Sniff(b)]; ok {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// Normalize converts WebP and HEIC images to JPEG, which Vision and the
+// rest of the pipeline handle, and passes JPEG, PNG and GIF through. It
+// returns the original format along with the bytes.
+func Normalize(b []byte) ([]byte, string, error) {
+	format := Sniff(b)
+	switch format {
+	case FormatJPEG, FormatPNG, FormatGIF:
+		return b, format, nil
+	case FormatWebP:
+		img, _, err := Decode(b)
+		if err != nil {
+			return nil, format, err
+		}
+		out, err := EncodeJPEG(img)
+		return out, format, err
+	case FormatHEIC:
+		img, err := decodeHEIC(b)
+		if err != nil {
+			return nil, format, err
+		}
+		out, err := EncodeJPEG(img)
+		return out, format, err
+	}
+	return nil, format, ErrUnsupportedFormat
+}
@@ -0,0 +1,173 @@
+package imageutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func sample() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 32), uint8(y * 32), 128, 255})
+		}
+	}
+	return img
+}
+
+func encoded(t *testing.T, format string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case FormatJPEG:
+		err = jpeg.Encode(&buf, sample(), nil)
+	case FormatPNG:
+		err = png.Encode(&buf, sample())
+	case FormatGIF:
+		err = gif.Encode(&buf, sample(), nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// ftyp is the leading box of an ISO media file with the given brands.
+func ftyp(major string, compatible ...string) []byte {
+	b := make([]byte, 16, 16+4*len(compatible))
+	binary.BigEndian.PutUint32(b, uint32(16+4*len(compatible)))
+	copy(b[4:], "ftyp")
+	copy(b[8:], major)
+	for _, brand := range compatible {
+		b = append(b, brand...)
+	}
+	// the next box
+	return append(b, 0, 0, 0, 8, 'm', 'e', 't', 'a')
+}
+
+// webpHeader is the start of a WebP file without a valid image after it.
+var webpHeader = []byte("RIFF\x24\x00\x00\x00WEBPVP8 \x18\x00\x00\x00")
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"jpeg", encoded(t, FormatJPEG), FormatJPEG},
+		{"png", encoded(t, FormatPNG), FormatPNG},
+		{"gif", encoded(t, FormatGIF), FormatGIF},
+		{"gif87a", []byte("GIF87a\x01\x00\x01\x00"), FormatGIF},
+		{"webp", webpHeader, FormatWebP},
+		{"heic", ftyp("heic", "mif1", "heic"), FormatHEIC},
+		{"heix", ftyp("heix", "mif1"), FormatHEIC},
+		{"heic sequence", ftyp("hevc", "msf1"), FormatHEIC},
+		{"mif1 major brand with heic", ftyp("mif1", "heic"), FormatHEIC},
+		{"avif", ftyp("avif", "mif1", "miaf"), FormatUnknown},
+		{"mif1 major brand with avif", ftyp("mif1", "avif", "miaf"), FormatUnknown},
+		{"mp4", ftyp("isom", "iso2", "mp41"), FormatUnknown},
+		{"empty", nil, FormatUnknown},
+		{"text", []byte("<html></html>"), FormatUnknown},
+		{"short jpeg", []byte{0xFF, 0xD8}, FormatUnknown},
+		{"short riff", []byte("RIFF\x00\x00"), FormatUnknown},
+		{"riff wave", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), FormatUnknown},
+		{"short ftyp", []byte("\x00\x00\x00\x0cftyp"), FormatUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sniff(tt.b); got != tt.want {
+				t.Errorf("Sniff() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentType(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		want string
+	}{
+		{encoded(t, FormatJPEG), "image/jpeg"},
+		{encoded(t, FormatPNG), "image/png"},
+		{encoded(t, FormatGIF), "image/gif"},
+		{webpHeader, "image/webp"},
+		{ftyp("heic"), "image/heic"},
+		{[]byte("not an image"), "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := ContentType(tt.b); got != tt.want {
+			t.Errorf("ContentType(%.12q) = %q, want %q", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		format  string
+		passed  bool
+		wantErr error
+	}{
+		{"jpeg", encoded(t, FormatJPEG), FormatJPEG, true, nil},
+		{"png", encoded(t, FormatPNG), FormatPNG, true, nil},
+		{"gif", encoded(t, FormatGIF), FormatGIF, true, nil},
+		{"unknown", []byte("not an image"), FormatUnknown, false, ErrUnsupportedFormat},
+		{"avif", ftyp("avif", "mif1"), FormatUnknown, false, ErrUnsupportedFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, format, err := Normalize(tt.b)
+			if format != tt.format {
+				t.Errorf("format %q, want %q", format, tt.format)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error %v, want %v", err, tt.wantErr)
+			}
+			if tt.passed && !bytes.Equal(got, tt.b) {
+				t.Errorf("bytes changed")
+			}
+		})
+	}
+}
+
+func TestNormalizeCorrupted(t *testing.T) {
+	tests := []struct {
+		name   string
+		b      []byte
+		format string
+	}{
+		{"webp", webpHeader, FormatWebP},
+		{"truncated webp", webpHeader[:16], FormatWebP},
+		{"heic", ftyp("heic", "mif1"), FormatHEIC},
+		{"truncated heic", ftyp("heic")[:12], FormatHEIC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, format, err := Normalize(tt.b)
+			if format != tt.format {
+				t.Errorf("format %q, want %q", format, tt.format)
+			}
+			if err == nil || got != nil {
+				t.Errorf("Normalize() = %d bytes, %v; want an error", len(got), err)
+			}
+		})
+	}
+}
+
+func TestDecodeCorrupted(t *testing.T) {
+	for _, format := range []string{FormatJPEG, FormatPNG, FormatGIF} {
+		b := encoded(t, format)
+		if _, _, err := Decode(b[:len(b)/2]); err == nil {
+			t.Errorf("Decode of a truncated %s succeeded", format)
+		}
+	}
+}
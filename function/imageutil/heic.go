@@ -0,0 +1,19 @@
+//go:build cgo
+
+package imageutil
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+
+	"github.com/jdeng/goheif"
+)
+
+func decodeHEIC(b []byte) (image.Image, error) {
+	img, err := goheif.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("goheif.Decode failed; %w", err)
+	}
+	return img, nil
+}
@@ -0,0 +1,10 @@
+//go:build !cgo
+
+package imageutil
+
+import "image"
+
+// the HEVC decoder behind goheif needs cgo
+func decodeHEIC(b []byte) (image.Image, error) {
+	return nil, ErrUnsupportedFormat
+}
@@ -0,0 +1,200 @@
+package imageutil
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+)
+
+const jpegQuality = 85
+
+func Decode(b []byte) (image.Image, string, error) {
+	img, format, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, "", fmt.Errorf("image.Decode failed; %w", err)
+	}
+	return img, format, nil
+}
+
+func EncodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, fmt.Errorf("jpeg.Encode failed; %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Resize scales img down so that neither side exceeds maxSize, averaging the
+// source pixels that fall into each destination pixel. Smaller images are
+// returned as is.
+func Resize(img image.Image, maxSize int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= maxSize && h <= maxSize {
+		return img
+	}
+	dw, dh := maxSize, h*maxSize/w
+	if h > w {
+		dw, dh = w*maxSize/h, maxSize
+	}
+	return scale(img, dw, dh)
+}
+
+// ScaleWidth scales img up or down to width pixels wide, keeping its aspect
+// ratio.
+func ScaleWidth(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	return scale(img, width, bounds.Dy()*width/bounds.Dx())
+}
+
+func scale(img image.Image, dw, dh int) *image.RGBA {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0 := bounds.Min.Y + y*h/dh
+		y1 := bounds.Min.Y + (y+1)*h/dh
+		if y1 <= y0 {
+			// scaling up, one source pixel covers several
+			y1 = y0 + 1
+		}
+		for x := 0; x < dw; x++ {
+			x0 := bounds.Min.X + x*w/dw
+			x1 := bounds.Min.X + (x+1)*w/dw
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			dst.Set(x, y, average(img, x0, y0, x1, y1))
+		}
+	}
+	return dst
+}
+
+func average(img image.Image, x0, y0, x1, y1 int) color.RGBA {
+	var r, g, b, a, n uint64
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			cr, cg, cb, ca := img.At(x, y).RGBA()
+			r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+			n++
+		}
+	}
+	if n == 0 {
+		return color.RGBA{}
+	}
+	return color.RGBA{R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(b / n >> 8), A: uint8(a / n >> 8)}
+}
+
+// CropCenter keeps the middle fraction of img in both directions.
+func CropCenter(img image.Image, fraction float64) image.Image {
+	bounds := img.Bounds()
+	w := int(float64(bounds.Dx()) * fraction)
+	h := int(float64(bounds.Dy()) * fraction)
+	x0 := bounds.Min.X + (bounds.Dx()-w)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-h)/2
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dst.Set(x, y, img.At(x0+x, y0+y))
+		}
+	}
+	return dst
+}
+
+// Blur applies a box blur of the given radius, horizontally then vertically.
+func Blur(img image.Image, radius int) image.Image {
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			src.Set(x, y, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return boxBlur(boxBlur(src, radius, 1, 0), radius, 0, 1)
+}
+
+func boxBlur(src *image.RGBA, radius, dx, dy int) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			var r, g, b, a, n int
+			for i := -radius; i <= radius; i++ {
+				sx, sy := x+i*dx, y+i*dy
+				if sx < 0 || sy < 0 || sx >= bounds.Dx() || sy >= bounds.Dy() {
+					continue
+				}
+				c := src.RGBAAt(sx, sy)
+				r, g, b, a = r+int(c.R), g+int(c.G), b+int(c.B), a+int(c.A)
+				n++
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// Pixelate replaces every block x block square with its average color.
+func Pixelate(img image.Image, block int) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y += block {
+		for x := 0; x < bounds.Dx(); x += block {
+			x1, y1 := x+block, y+block
+			if x1 > bounds.Dx() {
+				x1 = bounds.Dx()
+			}
+			if y1 > bounds.Dy() {
+				y1 = bounds.Dy()
+			}
+			c := average(img, bounds.Min.X+x, bounds.Min.Y+y, bounds.Min.X+x1, bounds.Min.Y+y1)
+			for py := y; py < y1; py++ {
+				for px := x; px < x1; px++ {
+					dst.SetRGBA(px, py, c)
+				}
+			}
+		}
+	}
+	return dst
+}
+
+// Rotate turns img clockwise by degrees, a multiple of 90; other angles
+// return img as is.
+func Rotate(img image.Image, degrees int) image.Image {
+	degrees = ((degrees % 360) + 360) % 360
+	if degrees == 0 || degrees%90 != 0 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if degrees != 180 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch degrees {
+			case 90:
+				sx, sy = y, h-1-x
+			case 180:
+				sx, sy = w-1-x, h-1-y
+			case 270:
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, img.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return dst
+}
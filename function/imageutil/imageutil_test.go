@@ -0,0 +1,94 @@
+package imageutil
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"testing"
+)
+
+var (
+	red   = color.RGBA{255, 0, 0, 255}
+	green = color.RGBA{0, 255, 0, 255}
+	blue  = color.RGBA{0, 0, 255, 255}
+	white = color.RGBA{255, 255, 255, 255}
+)
+
+// corners reads testdata/corners.png: 6x4 black with a red top left, green
+// top right, blue bottom left and white bottom right pixel.
+func corners(t *testing.T) image.Image {
+	t.Helper()
+	b, err := os.ReadFile("testdata/corners.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, format, err := Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != FormatPNG {
+		t.Fatalf("format %q, want %q", format, FormatPNG)
+	}
+	return img
+}
+
+func rgba(c color.Color) color.RGBA {
+	r, g, b, a := c.RGBA()
+	return color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+}
+
+func TestRotate(t *testing.T) {
+	tests := []struct {
+		degrees       int
+		width, height int
+		// clockwise from the top left
+		corners [4]color.RGBA
+	}{
+		{0, 6, 4, [4]color.RGBA{red, green, white, blue}},
+		{90, 4, 6, [4]color.RGBA{blue, red, green, white}},
+		{180, 6, 4, [4]color.RGBA{white, blue, red, green}},
+		{270, 4, 6, [4]color.RGBA{green, white, blue, red}},
+		{-90, 4, 6, [4]color.RGBA{green, white, blue, red}},
+		{360, 6, 4, [4]color.RGBA{red, green, white, blue}},
+		{450, 4, 6, [4]color.RGBA{blue, red, green, white}},
+		{45, 6, 4, [4]color.RGBA{red, green, white, blue}},
+	}
+	img := corners(t)
+	for _, tt := range tests {
+		got := Rotate(img, tt.degrees)
+		b := got.Bounds()
+		if b.Dx() != tt.width || b.Dy() != tt.height {
+			t.Errorf("Rotate(%d) is %dx%d, want %dx%d", tt.degrees, b.Dx(), b.Dy(), tt.width, tt.height)
+			continue
+		}
+		points := []image.Point{
+			{b.Min.X, b.Min.Y},
+			{b.Max.X - 1, b.Min.Y},
+			{b.Max.X - 1, b.Max.Y - 1},
+			{b.Min.X, b.Max.Y - 1},
+		}
+		for i, p := range points {
+			if c := rgba(got.At(p.X, p.Y)); c != tt.corners[i] {
+				t.Errorf("Rotate(%d) at %v = %v, want %v", tt.degrees, p, c, tt.corners[i])
+			}
+		}
+	}
+}
+
+func TestRotateRoundTrip(t *testing.T) {
+	img := corners(t)
+	for _, degrees := range []int{90, 180, 270} {
+		got := Rotate(Rotate(img, degrees), 360-degrees)
+		b := img.Bounds()
+		if got.Bounds().Dx() != b.Dx() || got.Bounds().Dy() != b.Dy() {
+			t.Fatalf("Rotate(%d) and back is %v, want %v", degrees, got.Bounds(), b)
+		}
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				if rgba(got.At(x, y)) != rgba(img.At(b.Min.X+x, b.Min.Y+y)) {
+					t.Fatalf("Rotate(%d) and back differs at %d,%d", degrees, x, y)
+				}
+			}
+		}
+	}
+}
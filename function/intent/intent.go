@@ -0,0 +1,108 @@
+package intent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const collection = "replyIntents"
+
+const (
+	StatePending = "pending"
+	StateDone    = "done"
+	// StateFallback means the reply was lost and a push message sent instead.
+	StateFallback = "fallback"
+	// StateLost means neither the reply nor a fallback reached the user.
+	StateLost = "lost"
+)
+
+// Intent records that a reply is about to be sent, keyed by correlation ID.
+type Intent struct {
+	UserIDHash  string    `firestore:"userIdHash"`
+	State       string    `firestore:"state"`
+	CreatedAt   time.Time `firestore:"createdAt"`
+	CompletedAt time.Time `firestore:"completedAt,omitempty"`
+	LastError   string    `firestore:"lastError,omitempty"`
+}
+
+type Store struct {
+	client *firestore.Client
+}
+
+func New(client *firestore.Client) *Store {
+	return &Store{client: client}
+}
+
+// Begin records the intent unless a delivery of the same message began it
+// already; that one is left as it is, so a redelivery cannot reopen an
+// intent the reconciler resolved.
+func (s *Store) Begin(ctx context.Context, id, userIDHash string) error {
+	intent := Intent{UserIDHash: userIDHash, State: StatePending, CreatedAt: time.Now()}
+	_, err := s.client.Collection(namespace.Collection(collection)).Doc(id).Create(ctx, intent)
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Create failed; %w", err)
+	}
+	return nil
+}
+
+// Complete marks the reply as delivered. A failed reply stays pending with
+// its error so that the reconciler picks it up.
+func (s *Store) Complete(ctx context.Context, id string, replyErr error) error {
+	update := []firestore.Update{{Path: "state", Value: StateDone}, {Path: "completedAt", Value: time.Now()}}
+	if replyErr != nil {
+		update = []firestore.Update{{Path: "lastError", Value: replyErr.Error()}}
+	}
+	if _, err := s.client.Collection(namespace.Collection(collection)).Doc(id).Update(ctx, update); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Update failed; %w", err)
+	}
+	return nil
+}
+
+// Resolve closes a stale intent with state, StateFallback or StateLost.
+func (s *Store) Resolve(ctx context.Context, id, state string, cause error) error {
+	update := []firestore.Update{{Path: "state", Value: state}, {Path: "completedAt", Value: time.Now()}}
+	if cause != nil {
+		update = append(update, firestore.Update{Path: "lastError", Value: cause.Error()})
+	}
+	if _, err := s.client.Collection(namespace.Collection(collection)).Doc(id).Update(ctx, update); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Update failed; %w", err)
+	}
+	return nil
+}
+
+// Stale returns up to limit intents still pending that were begun before
+// the given time, keyed by correlation ID.
+func (s *Store) Stale(ctx context.Context, before time.Time, limit int) (map[string]Intent, error) {
+	iter := s.client.Collection(namespace.Collection(collection)).
+		Where("state", "==", StatePending).
+		Where("createdAt", "<", before).
+		OrderBy("createdAt", firestore.Asc).
+		Limit(limit).
+		Documents(ctx)
+	defer iter.Stop()
+	intents := map[string]Intent{}
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return intents, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestore.DocumentIterator.Next failed; %w", err)
+		}
+		var intent Intent
+		if err := snap.DataTo(&intent); err != nil {
+			return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+		}
+		intents[snap.Ref.ID] = intent
+	}
+}
@@ -0,0 +1,16 @@
+//go:build fastjson
+
+package jsoncodec
+
+import "github.com/segmentio/encoding/json"
+
+// Name tells the implementation in use apart in logs and benchmarks.
+const Name = "segmentio/encoding"
+
+func Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,10 @@
+// Package jsoncodec is the JSON implementation of the hot paths: webhook and
+// pipeline payload decoding, publishing and log output. encoding/json is the
+// default; building with -tags fastjson switches to segmentio/encoding, a
+// drop-in replacement that spends less CPU and allocates less; compare them
+// with the benchmarks here and BenchmarkParseRequest of lineapi, run with and
+// without the tag.
+//
+// Both return the error types of encoding/json, so errors.As against
+// *json.UnmarshalTypeError and friends works either way.
+package jsoncodec
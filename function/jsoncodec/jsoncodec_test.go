@@ -0,0 +1,93 @@
+package jsoncodec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type payload struct {
+	CorrelationID string             `json:"correlationId"`
+	UserIDHash    string             `json:"userIdHash"`
+	ImageID       string             `json:"imageId"`
+	Labels        []string           `json:"labels"`
+	Scores        map[string]float64 `json:"scores"`
+}
+
+func testPayload() payload {
+	p := payload{CorrelationID: "0123456789abcdef", UserIDHash: strings.Repeat("ab", 32), ImageID: "468789577898262530", Scores: map[string]float64{}}
+	for i := 0; i < 20; i++ {
+		label := fmt.Sprintf("label %d", i)
+		p.Labels = append(p.Labels, label)
+		p.Scores[label] = float64(i) / 20
+	}
+	return p
+}
+
+func TestRoundTrip(t *testing.T) {
+	want := testPayload()
+	b, err := Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got payload
+	if err := Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.CorrelationID != want.CorrelationID || len(got.Labels) != len(want.Labels) || got.Scores["label 10"] != want.Scores["label 10"] {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		check func(error) bool
+	}{
+		{"type", `{"labels":"x"}`, func(err error) bool {
+			var typeErr *json.UnmarshalTypeError
+			return errors.As(err, &typeErr)
+		}},
+		{"syntax", `{"labels":`, func(err error) bool {
+			var syntaxErr *json.SyntaxError
+			return errors.As(err, &syntaxErr)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p payload
+			err := Unmarshal([]byte(tt.data), &p)
+			if err == nil || !tt.check(err) {
+				t.Errorf("%s: Unmarshal error = %T %v", Name, err, err)
+			}
+		})
+	}
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	p := testPayload()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	data, err := Marshal(testPayload())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		var p payload
+		if err := Unmarshal(data, &p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
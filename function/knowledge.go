@@ -0,0 +1,95 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/knowledge"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+)
+
+// entities hardly change; misses are cached too so that common labels with
+// no entity do not cost a call every time
+const defaultKnowledgeCacheTTL = 7 * 24 * time.Hour
+
+func knowledgeEnabled(ctx context.Context) bool {
+	return dynconfig.Get(ctx, "KNOWLEDGE_GRAPH") == "true"
+}
+
+func knowledgeCacheTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("KNOWLEDGE_CACHE_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultKnowledgeCacheTTL
+}
+
+// knowledgeStep looks up the top label in the Knowledge Graph, a no-op
+// unless KNOWLEDGE_GRAPH=true. Web detection puts landmarks and well known
+// people at the top, which is where an entity is most useful. Failures only
+// cost the enrichment, never the reply.
+func knowledgeStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	if !knowledgeEnabled(ctx) || len(state.result.Labels) == 0 {
+		return nil
+	}
+	language, err := userLanguage(ctx, state.projectID, state.procMsg.UserIDHash)
+	if err != nil {
+		logging.Errorf(ctx, "knowledge graph skipped; %v", err)
+		return nil
+	}
+	entity, err := lookupEntity(ctx, state.projectID, state.result.Labels[0].Name, language)
+	if err != nil {
+		logging.Errorf(ctx, "knowledge graph skipped; %v", err)
+		return nil
+	}
+	if entity != nil {
+		logging.Printf(ctx, "knowledge graph: %s", entity.Name)
+	}
+	state.knowledge = entity
+	return nil
+}
+
+// lookupEntity searches the Knowledge Graph through the cache.
+func lookupEntity(ctx context.Context, projectID, query, language string) (*knowledge.Entity, error) {
+	c, err := cache.Open(ctx, cache.ConfigFromEnv())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	key := "kg:" + language + ":" + strings.ToLower(query)
+	b, err := c.Get(ctx, key)
+	if err == nil {
+		var entity *knowledge.Entity
+		if err := json.Unmarshal(b, &entity); err != nil {
+			return nil, err
+		}
+		return entity, nil
+	}
+	if !errors.Is(err, cache.ErrMiss) {
+		return nil, err
+	}
+
+	apiKey, err := getSecret(ctx, projectID, "kg-api-key")
+	if err != nil {
+		return nil, err
+	}
+	entity, err := knowledge.Search(ctx, http.DefaultClient, apiKey, query, language)
+	if err != nil {
+		return nil, err
+	}
+	// a nil entity is stored as null and remembered as a miss
+	b, err = json.Marshal(entity)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Set(ctx, key, b, knowledgeCacheTTL()); err != nil {
+		logging.Errorf(ctx, "cache knowledge graph entity failed; %v", err)
+	}
+	return entity, nil
+}
@@ -0,0 +1,108 @@
+package knowledge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Endpoint is the Knowledge Graph Search API.
+var Endpoint = "https://kgsearch.googleapis.com/v1/entities:search"
+
+// maxDetail keeps the article body to a couple of sentences
+const maxDetail = 200
+
+// Entity is the top Knowledge Graph match of a query.
+type Entity struct {
+	Name string `json:"name"`
+	// Description is a short phrase such as "Tower in Tokyo, Japan".
+	Description string `json:"description,omitempty"`
+	// Detail is the start of the Wikipedia style article body.
+	Detail string `json:"detail,omitempty"`
+	URL    string `json:"url,omitempty"`
+}
+
+type searchResponse struct {
+	ItemListElement []struct {
+		Result struct {
+			Name                string `json:"name"`
+			Description         string `json:"description"`
+			URL                 string `json:"url"`
+			DetailedDescription struct {
+				ArticleBody string `json:"articleBody"`
+				URL         string `json:"url"`
+			} `json:"detailedDescription"`
+		} `json:"result"`
+		ResultScore float64 `json:"resultScore"`
+	} `json:"itemListElement"`
+}
+
+// Search returns the best match for query in language, nil when nothing
+// matches.
+func Search(ctx context.Context, client *http.Client, apiKey, query, language string) (*Entity, error) {
+	values := url.Values{}
+	values.Set("query", query)
+	values.Set("key", apiKey)
+	values.Set("limit", "1")
+	if language != "" {
+		values.Set("languages", language)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, Endpoint+"?"+values.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// the error carries the URL and with it the API key
+		return nil, fmt.Errorf("knowledge graph search failed; %s", strings.ReplaceAll(err.Error(), apiKey, "REDACTED"))
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("knowledge graph search failed; %d %s", resp.StatusCode, body)
+	}
+	var searchResp searchResponse
+	if err := json.Unmarshal(body, &searchResp); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	if len(searchResp.ItemListElement) == 0 {
+		return nil, nil
+	}
+	r := searchResp.ItemListElement[0].Result
+	entity := &Entity{Name: r.Name, Description: r.Description, Detail: truncate(r.DetailedDescription.ArticleBody, maxDetail), URL: r.DetailedDescription.URL}
+	if entity.URL == "" {
+		entity.URL = r.URL
+	}
+	return entity, nil
+}
+
+// Format renders e as a few lines to append to a reply.
+func (e Entity) Format() string {
+	lines := []string{e.Name}
+	if e.Description != "" {
+		lines[0] += " - " + e.Description
+	}
+	if e.Detail != "" {
+		lines = append(lines, e.Detail)
+	}
+	if e.URL != "" {
+		lines = append(lines, e.URL)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func truncate(s string, n int) string {
+	s = strings.TrimSpace(s)
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
@@ -0,0 +1,151 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/costguard"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/labelmerge"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/phash"
+	"github.com/hsmtkk/ubiquitous-couscous/function/taxonomy"
+	"github.com/hsmtkk/ubiquitous-couscous/function/visionresult"
+)
+
+// maxLabels caps how many merged labels analyzeImage returns.
+const maxLabels = 10
+
+// labelFeatures returns the comma separated VISION_FEATURES, defaulting to
+// labels only. Unknown names are skipped.
+func labelFeatures(ctx context.Context) []string {
+	features := []string{}
+	for _, name := range strings.Split(dynconfig.Get(ctx, "VISION_FEATURES"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := visionresult.Features[name]; !ok {
+			logging.Printf(ctx, "unknown vision feature %q", name)
+			continue
+		}
+		features = append(features, name)
+	}
+	if len(features) == 0 {
+		return []string{"labels"}
+	}
+	return features
+}
+
+// labelDetectionUnits is what one analyzeImage call is billed: one unit per
+// requested feature.
+func labelDetectionUnits(ctx context.Context) int64 {
+	return int64(len(labelFeatures(ctx)))
+}
+
+// reserveLabelDetection reserves one analyzeImage call on the daily Vision
+// budget, costguard.ErrBudgetExceeded once it is spent.
+func reserveLabelDetection(ctx context.Context) error {
+	budget, err := visionDailyBudget(ctx)
+	if err != nil {
+		return err
+	}
+	client, err := clients.Firestore(ctx, projectIDOf(ctx))
+	if err != nil {
+		return err
+	}
+	return costguard.New(client, budget).Reserve(ctx, labelDetectionUnits(ctx))
+}
+
+// labelImage returns the labels for image, reusing the labels of an earlier
+// near-duplicate from the same user instead of calling Vision again, and
+// returns the record of that duplicate, nil otherwise. Once
+// the daily Vision budget is spent only duplicates are answered and
+// costguard.ErrBudgetExceeded is returned for everything else Vision would
+// have labeled.
+func labelImage(ctx context.Context, projectID, userIDHash, imageID string, image []byte, minScore float32) ([]analysis.Label, *imageRecord, error) {
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, closeStore, err := openImageStore(ctx, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer closeStore()
+
+	hash, err := phash.FromBytes(image)
+	canDedup := err == nil && userIDHash != ""
+	if err != nil {
+		logging.Printf(ctx, "skip duplicate detection; %v", err)
+	}
+	if canDedup {
+		duplicate, err := findDuplicate(ctx, store, userIDHash, hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if duplicate != nil {
+			logging.Printf(ctx, "duplicate of %s", duplicate.ImageID)
+			return duplicate.labels(), duplicate, nil
+		}
+	}
+
+	labels, err := analyzeWithCanary(ctx, imageID, image, minScore)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the record outlives the reply, so it needs the user's consent
+	if canDedup && recordingAllowedFor(ctx, userIDHash) {
+		result := analysis.New()
+		result.AddFeature(analysis.FeatureLabels)
+		result.Labels = labels
+		names := analysis.Names(labels)
+		record := imageRecord{ImageID: imageID, Hash: hash.String(), Labels: names, Categories: taxonomy.Categories(names), Result: &result, CreatedAt: time.Now()}
+		if err := store.saveImage(ctx, userIDHash, record); err != nil {
+			return nil, nil, err
+		}
+	}
+	return labels, nil, nil
+}
+
+// mergedLabels converts the labelmerge output into the labels of an
+// analysis.Result.
+func mergedLabels(merged []labelmerge.Label) []analysis.Label {
+	labels := make([]analysis.Label, len(merged))
+	for i, label := range merged {
+		labels[i] = analysis.Label{Name: label.Name, Score: label.Score}
+	}
+	return labels
+}
+
+// formatLabels lists labels under their category headings. Labels that all
+// fall outside the taxonomy are listed plainly.
+func formatLabels(labels []string) string {
+	groups := taxonomy.GroupLabels(labels)
+	if len(groups) == 1 && groups[0].Category == taxonomy.Other {
+		return strings.Join(labels, "\n")
+	}
+	sections := make([]string, 0, len(groups))
+	for _, group := range groups {
+		heading := strings.ToUpper(group.Category[:1]) + group.Category[1:]
+		sections = append(sections, "["+heading+"]\n"+strings.Join(group.Labels, "\n"))
+	}
+	return strings.Join(sections, "\n\n")
+}
+
+func visionDailyBudget(ctx context.Context) (int64, error) {
+	value := dynconfig.Get(ctx, "VISION_DAILY_BUDGET")
+	if value == "" {
+		return 0, nil
+	}
+	budget, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid VISION_DAILY_BUDGET; %w", err)
+	}
+	return budget, nil
+}
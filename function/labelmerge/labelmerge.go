@@ -0,0 +1,78 @@
+package labelmerge
+
+import (
+	"sort"
+	"strings"
+)
+
+// Label is a concept found by one Vision feature, with its score in [0, 1]
+// after the feature's weight is applied.
+type Label struct {
+	Name  string
+	Score float32
+}
+
+// Merge joins the labels of several features. Names are compared case
+// insensitively; of duplicates the highest scored one is kept with its
+// spelling. The result is sorted by score, then name, so equal input always
+// gives equal output.
+func Merge(groups ...[]Label) []Label {
+	best := map[string]Label{}
+	for _, group := range groups {
+		for _, label := range group {
+			name := strings.TrimSpace(label.Name)
+			if name == "" {
+				continue
+			}
+			key := strings.ToLower(name)
+			if current, ok := best[key]; ok && current.Score >= label.Score {
+				continue
+			}
+			best[key] = Label{Name: name, Score: label.Score}
+		}
+	}
+	merged := make([]Label, 0, len(best))
+	for _, label := range best {
+		merged = append(merged, label)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].Score != merged[j].Score {
+			return merged[i].Score > merged[j].Score
+		}
+		return strings.ToLower(merged[i].Name) < strings.ToLower(merged[j].Name)
+	})
+	return merged
+}
+
+// Weighted scales the scores of one feature by weight, capping them at 1.
+func Weighted(labels []Label, weight float32) []Label {
+	results := make([]Label, len(labels))
+	for i, label := range labels {
+		score := label.Score * weight
+		if score > 1 {
+			score = 1
+		}
+		results[i] = Label{Name: label.Name, Score: score}
+	}
+	return results
+}
+
+// Names returns the names of labels in order.
+func Names(labels []Label) []string {
+	names := make([]string, len(labels))
+	for i, label := range labels {
+		names[i] = label.Name
+	}
+	return names
+}
+
+// Above keeps the labels scoring at least min.
+func Above(labels []Label, min float32) []Label {
+	results := []Label{}
+	for _, label := range labels {
+		if label.Score >= min {
+			results = append(results, label)
+		}
+	}
+	return results
+}
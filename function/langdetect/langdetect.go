@@ -0,0 +1,86 @@
+package langdetect
+
+import (
+	"strings"
+	"unicode"
+)
+
+// minLetters is the least number of letters a text needs for a guess.
+const minLetters = 3
+
+// scripts maps a Unicode script to the language it most likely means.
+// Han is resolved separately since Japanese mixes it with kana.
+var scripts = []struct {
+	table    *unicode.RangeTable
+	language string
+}{
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Hangul, "ko"},
+	{unicode.Thai, "th"},
+	{unicode.Cyrillic, "ru"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Greek, "el"},
+	{unicode.Devanagari, "hi"},
+}
+
+// Detect guesses the language of text from the scripts of its letters and
+// returns a BCP 47 base language, or "" when there is too little to go by.
+// Latin script is shared by too many languages to tell from, so mostly
+// Latin text is "" too and left to a real detector; hint, typically the
+// locale Vision returns with OCR results, wins when it is set.
+func Detect(text, hint string) string {
+	if hint != "" {
+		return Base(hint)
+	}
+	counts := map[string]int{}
+	han, latin, letters := 0, 0, 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.Is(unicode.Han, r):
+			han++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		default:
+			for _, s := range scripts {
+				if unicode.Is(s.table, r) {
+					counts[s.language]++
+					break
+				}
+			}
+		}
+	}
+	if letters < minLetters {
+		return ""
+	}
+	if counts["ja"] > 0 && counts["ja"]+han >= latin {
+		return "ja"
+	}
+	best, bestCount := "", 0
+	for language, count := range counts {
+		if count > bestCount {
+			best, bestCount = language, count
+		}
+	}
+	switch {
+	case han > bestCount && han >= latin:
+		return "zh"
+	case latin > bestCount:
+		return ""
+	}
+	return best
+}
+
+// Base strips the region and script from a language tag, "en-US" -> "en".
+func Base(tag string) string {
+	tag = strings.ToLower(tag)
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	return tag
+}
@@ -0,0 +1,230 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/lineapi"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the archived image a LIFF view shows is linked for this long
+const liffImageTTL = 15 * time.Minute
+
+// liffURL opens the details of imageID in the LIFF app LIFF_ID names,
+// empty without one.
+func liffURL(ctx context.Context, imageID string) string {
+	liffID := tenantEnv(ctx, "LIFF_ID")
+	if liffID == "" {
+		return ""
+	}
+	return "https://liff.line.me/" + liffID + "?" + url.Values{"imageId": {imageID}}.Encode()
+}
+
+type liffResult struct {
+	ImageID   string          `json:"imageId"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Result    analysis.Result `json:"result"`
+	// ImageURL links the archived image, empty when it was not kept.
+	ImageURL string `json:"imageUrl,omitempty"`
+}
+
+var liffPage = template.Must(template.New("liff").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Details</title>
+<style>body{font-family:sans-serif;margin:1em}td{padding:2px 8px}#view{position:relative;max-width:100%}#view img{max-width:100%;display:block}.box{position:absolute;border:2px solid #f33}.box span{background:#f33;color:#fff;font-size:12px}pre{white-space:pre-wrap}</style>
+<script charset="utf-8" src="https://static.line-scdn.net/liff/edge/2/sdk.js"></script>
+</head>
+<body>
+<div id="content">Loading…</div>
+<script>
+const base = location.pathname.replace(/\/$/, '');
+const tenant = new URLSearchParams(location.search).get('tenant');
+const tenantQuery = tenant ? 'tenant=' + encodeURIComponent(tenant) : '';
+const esc = s => String(s).replace(/[&<>"']/g, c => '&#' + c.charCodeAt(0) + ';');
+async function api(path) {
+  const url = new URL(base + path, location.origin);
+  if (tenant) url.searchParams.set('tenant', tenant);
+  const res = await fetch(url, {headers: {Authorization: 'Bearer ' + liff.getIDToken()}});
+  if (!res.ok) throw new Error(await res.text());
+  return res.json();
+}
+function detail(r) {
+  let html = '<h1>' + new Date(r.createdAt).toLocaleString() + '</h1>';
+  if (r.imageUrl) {
+    html += '<div id="view"><img src="' + esc(r.imageUrl) + '" onerror="this.remove()">';
+    for (const o of r.result.objects || []) {
+      html += '<div class="box" style="left:' + o.minX * 100 + '%;top:' + o.minY * 100 + '%;width:' + (o.maxX - o.minX) * 100 + '%;height:' + (o.maxY - o.minY) * 100 + '%"><span>' + esc(o.name) + '</span></div>';
+    }
+    html += '</div>';
+  }
+  html += '<h2>Labels</h2><table>';
+  for (const l of r.result.labels || []) html += '<tr><td>' + esc(l.name) + '</td><td>' + (l.score * 100).toFixed(0) + '%</td></tr>';
+  html += '</table>';
+  if ((r.result.objects || []).length) {
+    html += '<h2>Objects</h2><table>';
+    for (const o of r.result.objects) html += '<tr><td>' + esc(o.name) + '</td><td>' + (o.score * 100).toFixed(0) + '%</td></tr>';
+    html += '</table>';
+  }
+  if ((r.result.textBlocks || []).length) {
+    html += '<h2>Text</h2>';
+    for (const t of r.result.textBlocks) html += '<pre>' + esc(t.text) + '</pre>';
+  }
+  return html + '<p><a href="?' + tenantQuery + '">History</a></p>';
+}
+function history(page) {
+  let html = '<h1>History</h1><table>';
+  for (const r of page.data) html += '<tr><td><a href="?imageId=' + encodeURIComponent(r.imageId) + (tenant ? '&' + tenantQuery : '') + '">' + new Date(r.createdAt).toLocaleString() + '</a></td><td>' + esc((r.labels || []).slice(0, 3).join(', ')) + '</td></tr>';
+  return html + '</table>';
+}
+liff.init({liffId: {{.}}}).then(async () => {
+  if (!liff.isLoggedIn()) { liff.login(); return; }
+  const imageId = new URLSearchParams(location.search).get('imageId');
+  const content = document.getElementById('content');
+  try {
+    content.innerHTML = imageId ? detail(await api('/api/result?imageId=' + encodeURIComponent(imageId))) : history(await api('/api/history'));
+  } catch (e) {
+    content.textContent = 'Not available: ' + e.message;
+  }
+});
+</script>
+</body>
+</html>
+`))
+
+// liff serves the LIFF app the "View details" quick reply opens, and the
+// JSON APIs behind it: /api/result?imageId= with everything the analysis
+// found and /api/history with the user's past images. The APIs take the
+// LIFF ID token as a bearer token and only answer for its user. The tenant
+// query parameter, kept by the page, serves a tenant's LIFF app.
+func liff(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "liff"})
+	logging.Printf(ctx, "liff")
+
+	if r.Method != http.MethodGet {
+		returnError(ctx, w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed; %s", r.Method))
+		return
+	}
+	ctx, err := requestTenant(ctx, r)
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/api/result"), strings.HasSuffix(r.URL.Path, "/api/history"):
+	default:
+		liffID := tenantEnv(ctx, "LIFF_ID")
+		if liffID == "" {
+			returnError(ctx, w, http.StatusNotFound, fmt.Errorf("LIFF_ID is not set"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := liffPage.Execute(w, liffID); err != nil {
+			logging.Errorf(ctx, "template.Template.Execute failed; %v", err)
+		}
+		return
+	}
+
+	userIDHash, err := liffUser(ctx, r)
+	if errors.Is(err, lineapi.ErrInvalidIDToken) {
+		returnError(ctx, w, http.StatusUnauthorized, err)
+		return
+	}
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	ctx = logging.With(ctx, logging.Fields{UserIDHash: userIDHash})
+	projectID := projectIDOf(ctx)
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var resp interface{}
+	if strings.HasSuffix(r.URL.Path, "/api/history") {
+		q := resultsQuery{UserIDHash: userIDHash, Limit: defaultResultsLimit, PageToken: r.URL.Query().Get("pageToken")}
+		if value := r.URL.Query().Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 || n > maxResultsLimit {
+				returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("invalid limit; %s", value))
+				return
+			}
+			q.Limit = n
+		}
+		if resp, err = listResults(ctx, client, q); err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		imageID := r.URL.Query().Get("imageId")
+		if imageID == "" {
+			returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("missing imageId"))
+			return
+		}
+		snap, err := userImages(client, userIDHash).Doc(imageID).Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			returnError(ctx, w, http.StatusNotFound, fmt.Errorf("no result for %s", imageID))
+			return
+		}
+		if err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err))
+			return
+		}
+		var record imageRecord
+		if err := snap.DataTo(&record); err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err))
+			return
+		}
+		detail := liffResult{ImageID: imageID, CreatedAt: record.CreatedAt, Result: record.analysisResult()}
+		if bucket := tenantEnv(ctx, "ARCHIVE_BUCKET"); bucket != "" {
+			name, err := archivedImageName(ctx, client, userIDHash, imageID)
+			if err == nil {
+				detail.ImageURL, err = signedURL(ctx, bucket, name, liffImageTTL)
+			}
+			if err != nil {
+				// the labels are worth showing without the image
+				logging.Errorf(ctx, "sign archived image failed; %v", err)
+			}
+		}
+		resp = detail
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logging.Errorf(ctx, "json.Encoder.Encode failed; %v", err)
+	}
+}
+
+// liffUser verifies the bearer ID token against the LINE Login channel
+// LIFF_CHANNEL_ID and returns the hash of its user.
+func liffUser(ctx context.Context, r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", fmt.Errorf("%w; missing bearer token", lineapi.ErrInvalidIDToken)
+	}
+	endpoints, err := lineEndpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+	token, err := lineapi.VerifyIDToken(ctx, endpoints, tenantEnv(ctx, "LIFF_CHANNEL_ID"), strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		return "", err
+	}
+	return logging.HashUserID(token.Subject), nil
+}
@@ -0,0 +1,90 @@
+package lineapi
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	DefaultAPIBase  = "https://api.line.me"
+	DefaultDataBase = "https://api-data.line.me"
+)
+
+// Endpoints are the base URLs the Messaging API is called at: API for
+// everything but content, which is served from Data. Tests and sandbox or
+// regional deployments point them elsewhere.
+type Endpoints struct {
+	api  *url.URL
+	data *url.URL
+}
+
+// DefaultEndpoints are LINE's production endpoints.
+func DefaultEndpoints() Endpoints {
+	e, _ := ParseEndpoints("", "")
+	return e
+}
+
+// ParseEndpoints takes absolute http or https base URLs, which may carry a
+// path prefix; an empty one means LINE's own.
+func ParseEndpoints(api, data string) (Endpoints, error) {
+	var e Endpoints
+	var err error
+	if e.api, err = parseBase(api, DefaultAPIBase); err != nil {
+		return Endpoints{}, err
+	}
+	if e.data, err = parseBase(data, DefaultDataBase); err != nil {
+		return Endpoints{}, err
+	}
+	return e, nil
+}
+
+func parseBase(base, fallback string) (*url.URL, error) {
+	if base == "" {
+		base = fallback
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse failed; %w", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint base; %s", base)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("endpoint base must not carry user info, query or fragment; %s", base)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = strings.TrimSuffix(u.RawPath, "/")
+	return u, nil
+}
+
+// API returns the URL of the path segments under the API base. Segments
+// are escaped one by one, so that an ID can never add to or leave the path.
+func (e Endpoints) API(segments ...string) *url.URL {
+	return join(e.api, segments)
+}
+
+// Data is API for the content endpoints.
+func (e Endpoints) Data(segments ...string) *url.URL {
+	return join(e.data, segments)
+}
+
+// APIBase and DataBase are the bases as the SDK takes them.
+func (e Endpoints) APIBase() string {
+	return e.api.String()
+}
+
+func (e Endpoints) DataBase() string {
+	return e.data.String()
+}
+
+func join(base *url.URL, segments []string) *url.URL {
+	u := *base
+	escaped := make([]string, len(segments))
+	for i, s := range segments {
+		escaped[i] = url.PathEscape(s)
+	}
+	u.RawPath = base.EscapedPath() + "/" + strings.Join(escaped, "/")
+	u.Path = base.Path + "/" + strings.Join(segments, "/")
+	return &u
+}
@@ -0,0 +1,64 @@
+package lineapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrInvalidIDToken = errors.New("invalid ID token")
+
+// IDToken is what LINE vouches for of a LINE Login or LIFF ID token.
+type IDToken struct {
+	// Subject is the LINE user ID.
+	Subject   string
+	Name      string
+	ExpiresAt time.Time
+}
+
+// VerifyIDToken has LINE check idToken, which LIFF hands the page with
+// liff.getIDToken, and that it was issued for the login channel channelID.
+func VerifyIDToken(ctx context.Context, endpoints Endpoints, channelID, idToken string) (IDToken, error) {
+	form := url.Values{"id_token": {idToken}, "client_id": {channelID}}
+	u := endpoints.API("oauth2", "v2.1", "verify")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return IDToken{}, fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return IDToken{}, fmt.Errorf("http.Client.Do failed; %w", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return IDToken{}, fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	// LINE answers 400 for expired, forged or foreign tokens
+	if resp.StatusCode == http.StatusBadRequest {
+		return IDToken{}, fmt.Errorf("%w; %s", ErrInvalidIDToken, b)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return IDToken{}, fmt.Errorf("POST %s failed; %d %s", u.Path, resp.StatusCode, b)
+	}
+	var claims struct {
+		Sub  string `json:"sub"`
+		Aud  string `json:"aud"`
+		Exp  int64  `json:"exp"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return IDToken{}, fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	if claims.Aud != channelID || claims.Sub == "" {
+		return IDToken{}, fmt.Errorf("%w; issued for %s", ErrInvalidIDToken, claims.Aud)
+	}
+	return IDToken{Subject: claims.Sub, Name: claims.Name, ExpiresAt: time.Unix(claims.Exp, 0)}, nil
+}
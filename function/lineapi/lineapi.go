@@ -0,0 +1,282 @@
+package lineapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/jsoncodec"
+	"github.com/hsmtkk/ubiquitous-couscous/function/linetext"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+	"github.com/hsmtkk/ubiquitous-couscous/function/tuning"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// LineClient is the part of the LINE Messaging API the functions use. Handlers
+// depend on it rather than on *linebot.Client so they can be exercised with a
+// fake.
+type LineClient interface {
+	GetMessageContent(ctx context.Context, messageID string) ([]byte, error)
+	// GetMessagePreview returns the preview image LINE generates for videos.
+	GetMessagePreview(ctx context.Context, messageID string) ([]byte, error)
+	// Reply returns what LINE answered, also when it rejected the request.
+	Reply(ctx context.Context, req reply.Request) (ReplyResult, error)
+	// Push sends the messages of req, whose reply token is ignored, to a user.
+	Push(ctx context.Context, to string, req reply.Request) error
+	// Broadcast sends the messages of req to every friend of the channel.
+	Broadcast(ctx context.Context, req reply.Request) error
+	// LinkRichMenu shows the rich menu richMenuID to the user instead of the
+	// channel's default one.
+	LinkRichMenu(ctx context.Context, userID, richMenuID string) error
+}
+
+type sdkClient struct {
+	bot                *linebot.Client
+	httpClient         *http.Client
+	endpoints          Endpoints
+	channelAccessToken string
+}
+
+func New(channelSecret, channelAccessToken string, endpoints Endpoints, options ...linebot.ClientOption) (LineClient, error) {
+	httpClient := &http.Client{Transport: recordingTransport{base: http.DefaultTransport}}
+	options = append([]linebot.ClientOption{
+		linebot.WithHTTPClient(httpClient),
+		linebot.WithEndpointBase(endpoints.APIBase()),
+		linebot.WithEndpointBaseData(endpoints.DataBase()),
+	}, options...)
+	bot, err := linebot.New(channelSecret, channelAccessToken, options...)
+	if err != nil {
+		return nil, fmt.Errorf("linebot.New failed; %w", err)
+	}
+	return &sdkClient{bot: bot, httpClient: httpClient, endpoints: endpoints, channelAccessToken: channelAccessToken}, nil
+}
+
+// ParseRequest validates the X-Line-Signature header against the channel
+// secret and decodes the webhook events. It does what linebot.ParseRequest
+// does, decoding with jsoncodec; the events decode their own fields with
+// encoding/json still.
+func ParseRequest(channelSecret string, r *http.Request) ([]*linebot.Event, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	if !validSignature(channelSecret, r.Header.Get("X-Line-Signature"), body) {
+		return nil, linebot.ErrInvalidSignature
+	}
+	var webhook struct {
+		Events []*linebot.Event `json:"events"`
+	}
+	if err := jsoncodec.Unmarshal(body, &webhook); err != nil {
+		return nil, fmt.Errorf("jsoncodec.Unmarshal failed; %w", err)
+	}
+	return webhook.Events, nil
+}
+
+func validSignature(channelSecret, signature string, body []byte) bool {
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(channelSecret))
+	mac.Write(body)
+	return hmac.Equal(decoded, mac.Sum(nil))
+}
+
+// GetMessageContent calls the endpoint directly so that the 202 LINE answers
+// while large media is still being prepared can be told from a failure; see
+// getContent.
+func (c *sdkClient) GetMessageContent(ctx context.Context, messageID string) ([]byte, error) {
+	return c.getContent(ctx, messageID, c.endpoints.Data("v2", "bot", "message", messageID, "content"))
+}
+
+// GetMessagePreview calls the endpoint directly; the SDK version in use does
+// not cover it.
+func (c *sdkClient) GetMessagePreview(ctx context.Context, messageID string) ([]byte, error) {
+	return c.getContent(ctx, messageID, c.endpoints.Data("v2", "bot", "message", messageID, "content", "preview"))
+}
+
+// getContent downloads u and, when LINE is still preparing the content,
+// waits for it to be ready and downloads it again.
+func (c *sdkClient) getContent(ctx context.Context, messageID string, u *url.URL) ([]byte, error) {
+	content, ready, err := c.download(ctx, u)
+	if err != nil || ready {
+		return content, err
+	}
+	if err := c.waitForContent(ctx, messageID); err != nil {
+		return nil, err
+	}
+	content, ready, err = c.download(ctx, u)
+	if err == nil && !ready {
+		err = fmt.Errorf("get message content failed; still being prepared")
+	}
+	return content, err
+}
+
+func (c *sdkClient) download(ctx context.Context, u *url.URL) ([]byte, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.channelAccessToken)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("http.Client.Do failed; %w", err)
+	}
+	defer resp.Body.Close()
+	content, err := tuning.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("tuning.ReadAll failed; %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return content, true, nil
+	case http.StatusAccepted:
+		return nil, false, nil
+	}
+	return nil, false, fmt.Errorf("get message content failed; %d %s", resp.StatusCode, content)
+}
+
+func (c *sdkClient) Reply(ctx context.Context, req reply.Request) (ReplyResult, error) {
+	messages, err := replyMessages(req)
+	if err != nil {
+		return ReplyResult{}, err
+	}
+	ctx, rec := withRecorder(ctx)
+	if _, err := c.bot.ReplyMessage(req.ReplyToken, messages...).WithContext(ctx).Do(); err != nil {
+		return rec.result(), fmt.Errorf("linebot.ReplyMessageCall.Do failed; %w", err)
+	}
+	return rec.result(), nil
+}
+
+func (c *sdkClient) Push(ctx context.Context, to string, req reply.Request) error {
+	messages, err := replyMessages(req)
+	if err != nil {
+		return err
+	}
+	call := c.bot.PushMessage(to, messages...)
+	if req.RetryKey != "" {
+		call = call.WithRetryKey(req.RetryKey)
+	}
+	_, err = call.WithContext(ctx).Do()
+	var apiErr *linebot.APIError
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict && req.RetryKey != "" {
+		// accepted before under the same retry key
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("linebot.PushMessageCall.Do failed; %w", err)
+	}
+	return nil
+}
+
+func (c *sdkClient) Broadcast(ctx context.Context, req reply.Request) error {
+	messages, err := replyMessages(req)
+	if err != nil {
+		return err
+	}
+	call := c.bot.BroadcastMessage(messages...)
+	if req.RetryKey != "" {
+		call = call.WithRetryKey(req.RetryKey)
+	}
+	_, err = call.WithContext(ctx).Do()
+	var apiErr *linebot.APIError
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict && req.RetryKey != "" {
+		// accepted before under the same retry key
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("linebot.BroadcastMessageCall.Do failed; %w", err)
+	}
+	return nil
+}
+
+func (c *sdkClient) LinkRichMenu(ctx context.Context, userID, richMenuID string) error {
+	if _, err := c.bot.LinkUserRichMenu(userID, richMenuID).WithContext(ctx).Do(); err != nil {
+		return fmt.Errorf("linebot.LinkUserRichMenuCall.Do failed; %w", err)
+	}
+	return nil
+}
+
+// ReplyBody returns the JSON body Reply would POST to the reply endpoint.
+func ReplyBody(req reply.Request) ([]byte, error) {
+	messages, err := replyMessages(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := jsoncodec.Marshal(struct {
+		ReplyToken string                   `json:"replyToken"`
+		Messages   []linebot.SendingMessage `json:"messages"`
+	}{req.ReplyToken, messages})
+	if err != nil {
+		return nil, fmt.Errorf("jsoncodec.Marshal failed; %w", err)
+	}
+	return body, nil
+}
+
+// replyMessages attaches the quick reply to the last message, where LINE
+// expects it.
+func replyMessages(req reply.Request) ([]linebot.SendingMessage, error) {
+	messages, err := SendingMessages(req.Messages)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.QuickReply) > 0 && len(messages) > 0 {
+		last := len(messages) - 1
+		messages[last] = messages[last].WithQuickReplies(QuickReplyItems(req.QuickReply))
+	}
+	return messages, nil
+}
+
+// SendingMessages converts validated reply messages to their SDK builders,
+// sanitizing the texts of those not built with reply.Builder.
+func SendingMessages(messages []reply.Message) ([]linebot.SendingMessage, error) {
+	results := make([]linebot.SendingMessage, 0, len(messages))
+	for _, msg := range messages {
+		switch m := msg.(type) {
+		case reply.TextMessage:
+			results = append(results, linebot.NewTextMessage(linetext.Sanitize(m.Text)))
+		case reply.ImageMessage:
+			results = append(results, linebot.NewImageMessage(m.OriginalContentURL, m.PreviewImageURL))
+		case reply.StickerMessage:
+			results = append(results, linebot.NewStickerMessage(m.PackageID, m.StickerID))
+		case reply.FlexMessage:
+			m = reply.NewFlex(m.AltText, m.Contents)
+			contents, err := linebot.UnmarshalFlexMessageJSON(m.Contents)
+			if err != nil {
+				return nil, fmt.Errorf("linebot.UnmarshalFlexMessageJSON failed; %w", err)
+			}
+			results = append(results, linebot.NewFlexMessage(m.AltText, contents))
+		case reply.LocationMessage:
+			results = append(results, linebot.NewLocationMessage(m.Title, m.Address, m.Latitude, m.Longitude))
+		case reply.ImagemapMessage:
+			actions := make([]linebot.ImagemapAction, 0, len(m.Actions))
+			for _, a := range m.Actions {
+				area := linebot.ImagemapArea{X: a.X, Y: a.Y, Width: a.Width, Height: a.Height}
+				actions = append(actions, linebot.NewMessageImagemapAction(a.Label, a.Text, area))
+			}
+			baseSize := linebot.ImagemapBaseSize{Width: m.BaseSize.Width, Height: m.BaseSize.Height}
+			results = append(results, linebot.NewImagemapMessage(m.BaseURL, m.AltText, baseSize, actions...))
+		default:
+			return nil, fmt.Errorf("unsupported message type; %T", msg)
+		}
+	}
+	return results, nil
+}
+
+func QuickReplyItems(items []reply.QuickReplyItem) *linebot.QuickReplyItems {
+	buttons := make([]*linebot.QuickReplyButton, 0, len(items))
+	for _, item := range items {
+		var action linebot.QuickReplyAction = &linebot.PostbackAction{Label: item.Label, Data: item.Data, DisplayText: item.DisplayText}
+		if item.URI != "" {
+			action = &linebot.URIAction{Label: item.Label, URI: item.URI}
+		}
+		buttons = append(buttons, linebot.NewQuickReplyButton("", action))
+	}
+	return linebot.NewQuickReplyItems(buttons...)
+}
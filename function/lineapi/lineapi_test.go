@@ -0,0 +1,98 @@
+package lineapi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+const testSecret = "channel-secret"
+
+func sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func webhookBody(t testing.TB, events int) []byte {
+	list := []map[string]interface{}{}
+	for i := 0; i < events; i++ {
+		list = append(list, map[string]interface{}{
+			"type":            "message",
+			"mode":            "active",
+			"timestamp":       1672628400000 + i,
+			"source":          map[string]string{"type": "user", "userId": fmt.Sprintf("U%032d", i)},
+			"webhookEventId":  fmt.Sprintf("01GNKZ%020d", i),
+			"deliveryContext": map[string]bool{"isRedelivery": false},
+			"replyToken":      fmt.Sprintf("%032x", i),
+			"message":         map[string]string{"id": fmt.Sprint(468789577898262530 + i), "type": "image"},
+		})
+	}
+	b, err := json.Marshal(map[string]interface{}{"destination": "Uxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx", "events": list})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newRequest(body []byte, signature string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("X-Line-Signature", signature)
+	return r
+}
+
+func TestParseRequest(t *testing.T) {
+	body := webhookBody(t, 3)
+	tests := []struct {
+		name      string
+		signature string
+		events    int
+		err       error
+	}{
+		{"valid", sign(body), 3, nil},
+		{"forged", sign([]byte("other")), 0, linebot.ErrInvalidSignature},
+		{"not base64", "!", 0, linebot.ErrInvalidSignature},
+		{"missing", "", 0, linebot.ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := ParseRequest(testSecret, newRequest(body, tt.signature))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ParseRequest error = %v, want %v", err, tt.err)
+			}
+			if len(events) != tt.events {
+				t.Fatalf("ParseRequest = %d events, want %d", len(events), tt.events)
+			}
+			for _, evt := range events {
+				if evt.Type != linebot.EventTypeMessage || evt.ReplyToken == "" || evt.Source.UserID == "" {
+					t.Errorf("event = %+v", evt)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkParseRequest(b *testing.B) {
+	for _, n := range []int{1, 10} {
+		body := webhookBody(b, n)
+		signature := sign(body)
+		b.Run(fmt.Sprintf("events=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				if _, err := ParseRequest(testSecret, newRequest(body, signature)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package lineapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+)
+
+const (
+	AudienceReady      = "READY"
+	AudienceInProgress = "IN_PROGRESS"
+
+	// MaxAudienceUpload is how many user IDs one JSON upload may carry.
+	MaxAudienceUpload = 10000
+)
+
+// Narrowcaster sends to audience groups. The SDK version in use covers these
+// endpoints only partially, so they are called directly.
+type Narrowcaster interface {
+	CreateAudience(ctx context.Context, description string, userIDs []string) (int64, error)
+	AudienceStatus(ctx context.Context, audienceGroupID int64) (string, error)
+	// Narrowcast returns the request ID to poll the progress with.
+	Narrowcast(ctx context.Context, audienceGroupID int64, messages []reply.Message) (string, error)
+	NarrowcastProgress(ctx context.Context, requestID string) (NarrowcastProgress, error)
+}
+
+type NarrowcastProgress struct {
+	Phase             string `json:"phase"`
+	SuccessCount      int64  `json:"successCount"`
+	FailureCount      int64  `json:"failureCount"`
+	TargetCount       int64  `json:"targetCount"`
+	FailedDescription string `json:"failedDescription,omitempty"`
+}
+
+type httpNarrowcaster struct {
+	client             *http.Client
+	endpoints          Endpoints
+	channelAccessToken string
+}
+
+func NewNarrowcaster(channelAccessToken string, endpoints Endpoints) Narrowcaster {
+	return &httpNarrowcaster{client: http.DefaultClient, endpoints: endpoints, channelAccessToken: channelAccessToken}
+}
+
+func (n *httpNarrowcaster) do(ctx context.Context, method string, u *url.URL, reqBody interface{}, respBody interface{}) (http.Header, error) {
+	var body io.Reader
+	if reqBody != nil {
+		b, err := json.Marshal(reqBody)
+		if err != nil {
+			return nil, fmt.Errorf("json.Marshal failed; %w", err)
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+n.channelAccessToken)
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http.Client.Do failed; %w", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s failed; %d %s", method, u.Path, resp.StatusCode, b)
+	}
+	if respBody != nil && len(b) > 0 {
+		if err := json.Unmarshal(b, respBody); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal failed; %w", err)
+		}
+	}
+	return resp.Header, nil
+}
+
+func (n *httpNarrowcaster) CreateAudience(ctx context.Context, description string, userIDs []string) (int64, error) {
+	if len(userIDs) == 0 || len(userIDs) > MaxAudienceUpload {
+		return 0, fmt.Errorf("audience needs 1 to %d users; got %d", MaxAudienceUpload, len(userIDs))
+	}
+	type audience struct {
+		ID string `json:"id"`
+	}
+	audiences := make([]audience, 0, len(userIDs))
+	for _, id := range userIDs {
+		audiences = append(audiences, audience{ID: id})
+	}
+	var resp struct {
+		AudienceGroupID int64 `json:"audienceGroupId"`
+	}
+	reqBody := struct {
+		Description string     `json:"description"`
+		Audiences   []audience `json:"audiences"`
+	}{description, audiences}
+	if _, err := n.do(ctx, http.MethodPost, n.endpoints.API("v2", "bot", "audienceGroup", "upload"), reqBody, &resp); err != nil {
+		return 0, err
+	}
+	return resp.AudienceGroupID, nil
+}
+
+func (n *httpNarrowcaster) AudienceStatus(ctx context.Context, audienceGroupID int64) (string, error) {
+	var resp struct {
+		AudienceGroup struct {
+			Status string `json:"status"`
+		} `json:"audienceGroup"`
+	}
+	if _, err := n.do(ctx, http.MethodGet, n.endpoints.API("v2", "bot", "audienceGroup", strconv.FormatInt(audienceGroupID, 10)), nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.AudienceGroup.Status, nil
+}
+
+func (n *httpNarrowcaster) Narrowcast(ctx context.Context, audienceGroupID int64, messages []reply.Message) (string, error) {
+	sending, err := SendingMessages(messages)
+	if err != nil {
+		return "", err
+	}
+	type recipient struct {
+		Type            string `json:"type"`
+		AudienceGroupID int64  `json:"audienceGroupId"`
+	}
+	reqBody := struct {
+		Messages  interface{} `json:"messages"`
+		Recipient recipient   `json:"recipient"`
+	}{sending, recipient{Type: "audience", AudienceGroupID: audienceGroupID}}
+	header, err := n.do(ctx, http.MethodPost, n.endpoints.API("v2", "bot", "message", "narrowcast"), reqBody, nil)
+	if err != nil {
+		return "", err
+	}
+	return header.Get("X-Line-Request-Id"), nil
+}
+
+func (n *httpNarrowcaster) NarrowcastProgress(ctx context.Context, requestID string) (NarrowcastProgress, error) {
+	var progress NarrowcastProgress
+	u := n.endpoints.API("v2", "bot", "message", "progress", "narrowcast")
+	u.RawQuery = url.Values{"requestId": {requestID}}.Encode()
+	if _, err := n.do(ctx, http.MethodGet, u, nil, &progress); err != nil {
+		return NarrowcastProgress{}, err
+	}
+	return progress, nil
+}
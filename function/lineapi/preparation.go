@@ -0,0 +1,90 @@
+package lineapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/tuning"
+)
+
+// The statuses of the content preparation endpoint.
+const (
+	PreparationProcessing = "processing"
+	PreparationSucceeded  = "succeeded"
+	PreparationFailed     = "failed"
+)
+
+// ContentWaitTimeout caps how long a download waits for LINE to prepare
+// large media, within the deadline of the context.
+var ContentWaitTimeout = 2 * time.Minute
+
+const (
+	firstPreparationPoll = time.Second
+	maxPreparationPoll   = 10 * time.Second
+)
+
+// ErrContentNotPrepared is returned when LINE failed to prepare the content
+// or did not finish within ContentWaitTimeout.
+var ErrContentNotPrepared = errors.New("content not prepared")
+
+// ContentPreparation asks LINE whether the content of a video, audio or
+// file message is ready to download.
+func (c *sdkClient) ContentPreparation(ctx context.Context, messageID string) (string, error) {
+	u := c.endpoints.Data("v2", "bot", "message", messageID, "content", "transcoding")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.channelAccessToken)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("http.Client.Do failed; %w", err)
+	}
+	defer resp.Body.Close()
+	b, err := tuning.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("tuning.ReadAll failed; %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get content preparation failed; %d %s", resp.StatusCode, b)
+	}
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return "", fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	return body.Status, nil
+}
+
+// waitForContent polls the preparation status with a doubling interval
+// until the content is ready.
+func (c *sdkClient) waitForContent(ctx context.Context, messageID string) error {
+	ctx, cancel := context.WithTimeout(ctx, ContentWaitTimeout)
+	defer cancel()
+	interval := firstPreparationPoll
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return fmt.Errorf("%w; %v", ErrContentNotPrepared, ctx.Err())
+		}
+		status, err := c.ContentPreparation(ctx, messageID)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case PreparationSucceeded:
+			return nil
+		case PreparationFailed:
+			return fmt.Errorf("%w; LINE failed to prepare it", ErrContentNotPrepared)
+		}
+		if interval *= 2; interval > maxPreparationPoll {
+			interval = maxPreparationPoll
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package lineapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// ReplyResult is what the reply endpoint answered. The SDK only surfaces the
+// request ID, so the body is captured on the way through the transport.
+type ReplyResult struct {
+	RequestID    string        `json:"requestId,omitempty"`
+	StatusCode   int           `json:"statusCode"`
+	SentMessages []SentMessage `json:"sentMessages,omitempty"`
+	Error        *APIError     `json:"error,omitempty"`
+}
+
+type SentMessage struct {
+	ID         string `json:"id"`
+	QuoteToken string `json:"quoteToken,omitempty"`
+}
+
+type APIError struct {
+	Message string           `json:"message"`
+	Details []APIErrorDetail `json:"details,omitempty"`
+}
+
+type APIErrorDetail struct {
+	Message  string `json:"message"`
+	Property string `json:"property"`
+}
+
+// SentMessageIDs lists the IDs LINE assigned to the delivered messages.
+func (r ReplyResult) SentMessageIDs() []string {
+	ids := make([]string, 0, len(r.SentMessages))
+	for _, m := range r.SentMessages {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+type recorderKey struct{}
+
+type recorder struct {
+	requestID  string
+	statusCode int
+	body       []byte
+}
+
+func withRecorder(ctx context.Context) (context.Context, *recorder) {
+	rec := &recorder{}
+	return context.WithValue(ctx, recorderKey{}, rec), rec
+}
+
+func (rec *recorder) result() ReplyResult {
+	result := ReplyResult{RequestID: rec.requestID, StatusCode: rec.statusCode}
+	if rec.statusCode == http.StatusOK {
+		var body struct {
+			SentMessages []SentMessage `json:"sentMessages"`
+		}
+		if json.Unmarshal(rec.body, &body) == nil {
+			result.SentMessages = body.SentMessages
+		}
+		return result
+	}
+	var apiErr APIError
+	if json.Unmarshal(rec.body, &apiErr) == nil && apiErr.Message != "" {
+		result.Error = &apiErr
+	}
+	return result
+}
+
+// recordingTransport copies the response of requests whose context carries
+// a recorder.
+type recordingTransport struct {
+	base http.RoundTripper
+}
+
+func (t recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	rec, ok := req.Context().Value(recorderKey{}).(*recorder)
+	if err != nil || !ok {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	rec.requestID = resp.Header.Get("X-Line-Request-Id")
+	rec.statusCode = resp.StatusCode
+	rec.body = body
+	return resp, nil
+}
@@ -0,0 +1,132 @@
+// Package linetext cleans up text before it is sent to LINE: characters the
+// apps render poorly are replaced or dropped, the text is NFC normalized, and
+// lines and the whole text are kept within what LINE shows well.
+package linetext
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// MaxTextLength is the limit of a LINE text message, in characters.
+	MaxTextLength = 5000
+	// MaxLineLength is where lines are wrapped; longer ones do not wrap
+	// in some LINE clients and get cut off.
+	MaxLineLength = 1000
+	// blank lines beyond this collapse; LINE shows them as a large gap
+	maxBlankLines = 2
+
+	ellipsis = "\u2026"
+)
+
+// substitutes replace characters LINE renders poorly with ones it shows.
+var substitutes = map[rune]string{
+	'\t':     "    ",
+	'\u00a0': " ",  // no-break space
+	'\u2028': "\n", // line separator
+	'\u2029': "\n", // paragraph separator
+	'\ufffc': "",   // object replacement character
+}
+
+// dropped reports whether r is removed: control characters other than the
+// newline, bidirectional overrides that can reorder the text around them,
+// zero width characters other than the joiners emoji and scripts need, and the
+// private use areas old LINE emoji lived in, which render as boxes now.
+func dropped(r rune) bool {
+	switch {
+	case r == '\n':
+		return false
+	case r == '\u200c', r == '\u200d': // zero width (non-)joiner
+		return false
+	case unicode.IsControl(r):
+		return true
+	case r >= '\u202a' && r <= '\u202e', r >= '\u2066' && r <= '\u2069':
+		return true
+	case r == '\u200b', r == '\u2060', r == '\ufeff':
+		return true
+	case unicode.Is(unicode.Co, r):
+		return true
+	}
+	return false
+}
+
+// Sanitize returns text as it should be sent: CRLF and substitutes replaced,
+// dropped characters removed, NFC normalized, runs of blank lines collapsed,
+// long lines wrapped and the whole cut to MaxTextLength characters. Applying
+// it twice changes nothing more.
+func Sanitize(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	var b strings.Builder
+	b.Grow(len(text))
+	for _, r := range text {
+		if r == utf8.RuneError {
+			continue
+		}
+		if s, ok := substitutes[r]; ok {
+			b.WriteString(s)
+			continue
+		}
+		if dropped(r) {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	text = norm.NFC.String(b.String())
+
+	lines := strings.Split(text, "\n")
+	kept := make([]string, 0, len(lines))
+	blank := 0
+	for _, line := range lines {
+		line = strings.TrimRightFunc(line, unicode.IsSpace)
+		if line == "" {
+			blank++
+			if blank > maxBlankLines {
+				continue
+			}
+		} else {
+			blank = 0
+		}
+		kept = append(kept, wrap(line, MaxLineLength)...)
+	}
+	text = strings.TrimSpace(strings.Join(kept, "\n"))
+	return Truncate(text, MaxTextLength)
+}
+
+// wrap splits line into lines of at most max characters, at the last space
+// when there is one.
+func wrap(line string, max int) []string {
+	var lines []string
+	for utf8.RuneCountInString(line) > max {
+		runes := []rune(line)
+		cut := max
+		for i := max; i > max/2; i-- {
+			if runes[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+		lines = append(lines, strings.TrimRight(string(runes[:cut]), " "))
+		line = strings.TrimLeft(string(runes[cut:]), " ")
+	}
+	return append(lines, line)
+}
+
+// Truncate cuts text to max characters, ending it with an ellipsis when it
+// was longer, without splitting an emoji joined with the zero width joiner.
+func Truncate(text string, max int) string {
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	runes := []rune(text)[:max-utf8.RuneCountInString(ellipsis)]
+	for len(runes) > 0 && runes[len(runes)-1] == '\u200d' {
+		runes = runes[:len(runes)-1]
+	}
+	for len(runes) > 1 && runes[len(runes)-2] == '\u200d' {
+		runes = runes[:len(runes)-2]
+	}
+	return strings.TrimRightFunc(string(runes), unicode.IsSpace) + ellipsis
+}
@@ -0,0 +1,134 @@
+package linetext
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "hello", "hello"},
+		{"crlf", "a\r\nb", "a\nb"},
+		{"tab", "a\tb", "a    b"},
+		{"no-break space", "a\u00a0b", "a b"},
+		{"line separator", "a\u2028b", "a\nb"},
+		{"object replacement", "a\ufffcb", "ab"},
+		{"control", "a\x07b\x00c", "abc"},
+		{"bidi override", "a\u202eb\u2066c", "abc"},
+		{"zero width space", "a\u200bb\ufeff", "ab"},
+		{"joined emoji kept", "\U0001F468\u200d\U0001F469", "\U0001F468\u200d\U0001F469"},
+		{"private use", "a\ue000b", "ab"},
+		{"invalid utf-8", "a\xffb", "ab"},
+		{"nfc", "e\u0301", "\u00e9"},
+		{"blank lines", "a\n\n\n\n\nb", "a\n\n\nb"},
+		{"trailing space", "a  \nb \n", "a\nb"},
+		{"surrounding space", "\n\n  a\n\n", "a"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sanitize(tt.in); got != tt.want {
+				t.Errorf("Sanitize(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"long line", strings.Repeat("a", MaxLineLength*3)},
+		{"long words", strings.Repeat("word ", MaxLineLength)},
+		{"long text", strings.Repeat("a\n", MaxTextLength)},
+		{"long emoji", strings.Repeat("\U0001F468\u200d\U0001F469", MaxTextLength)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Sanitize(tt.in)
+			if n := utf8.RuneCountInString(got); n > MaxTextLength {
+				t.Errorf("%d characters, want at most %d", n, MaxTextLength)
+			}
+			for _, line := range strings.Split(got, "\n") {
+				if n := utf8.RuneCountInString(line); n > MaxLineLength {
+					t.Errorf("line of %d characters, want at most %d", n, MaxLineLength)
+				}
+			}
+		})
+	}
+}
+
+func TestSanitizeIdempotent(t *testing.T) {
+	inputs := []string{
+		"hello",
+		"a\r\n\r\n\r\n\r\nb\t\u00a0c",
+		"e\u0301\u200b\u202e\ue000",
+		"  \u2028\u2029 x \n",
+		strings.Repeat("word ", MaxLineLength),
+		strings.Repeat("a", MaxTextLength+1),
+		strings.Repeat("ab \n\n\n", MaxTextLength),
+		strings.Repeat("\U0001F468\u200d\U0001F469 ", MaxTextLength),
+	}
+	for _, in := range inputs {
+		once := Sanitize(in)
+		if twice := Sanitize(once); twice != once {
+			t.Errorf("Sanitize not idempotent for %.20q: %.40q then %.40q", in, once, twice)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	tests := []struct {
+		line string
+		max  int
+		want []string
+	}{
+		{"", 10, []string{""}},
+		{"short", 10, []string{"short"}},
+		{"aaaa bbbb cccc", 10, []string{"aaaa bbbb", "cccc"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"a bcdefghij", 4, []string{"a bc", "defg", "hij"}},
+		{"ab  cd", 3, []string{"ab", "cd"}},
+		{"\u3042\u3044\u3046\u3048\u304a", 2, []string{"\u3042\u3044", "\u3046\u3048", "\u304a"}},
+	}
+	for _, tt := range tests {
+		if got := wrap(tt.line, tt.max); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("wrap(%q, %d) = %q, want %q", tt.line, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		text string
+		max  int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 5, "hello"},
+		{"hello world", 6, "hello" + ellipsis},
+		{"hello world", 7, "hello" + ellipsis},
+		{"\u3042\u3044\u3046\u3048", 3, "\u3042\u3044" + ellipsis},
+		{"ab\U0001F468\u200d\U0001F469cd", 5, "ab\U0001F468" + ellipsis},
+		{"ab\U0001F468\u200d\U0001F469cd", 6, "ab\U0001F468" + ellipsis},
+	}
+	for _, tt := range tests {
+		got := Truncate(tt.text, tt.max)
+		if got != tt.want {
+			t.Errorf("Truncate(%q, %d) = %q, want %q", tt.text, tt.max, got, tt.want)
+		}
+		if n := utf8.RuneCountInString(got); n > tt.max {
+			t.Errorf("Truncate(%q, %d) has %d characters", tt.text, tt.max, n)
+		}
+		if again := Truncate(got, tt.max); again != got {
+			t.Errorf("Truncate(%q, %d) again = %q", got, tt.max, again)
+		}
+	}
+}
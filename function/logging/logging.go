@@ -0,0 +1,102 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/jsoncodec"
+	"github.com/hsmtkk/ubiquitous-couscous/function/redact"
+)
+
+// Fields are attached to every entry logged with a context carrying them.
+// Cloud Logging picks them up as jsonPayload fields.
+type Fields struct {
+	CorrelationID string `json:"correlationId,omitempty"`
+	UserIDHash    string `json:"userIdHash,omitempty"`
+	ImageID       string `json:"imageId,omitempty"`
+	Function      string `json:"function,omitempty"`
+}
+
+type entry struct {
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Fields
+}
+
+type fieldsKey struct{}
+
+var logger = log.New(os.Stdout, "", 0)
+
+// With returns a context whose fields are those of ctx overwritten by the
+// non-empty values of fields.
+func With(ctx context.Context, fields Fields) context.Context {
+	merged := FromContext(ctx)
+	if fields.CorrelationID != "" {
+		merged.CorrelationID = fields.CorrelationID
+	}
+	if fields.UserIDHash != "" {
+		merged.UserIDHash = fields.UserIDHash
+	}
+	if fields.ImageID != "" {
+		merged.ImageID = fields.ImageID
+	}
+	if fields.Function != "" {
+		merged.Function = fields.Function
+	}
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+// WithoutUser returns a context without the user ID hash of ctx, for entries
+// exported to where user data is not kept.
+func WithoutUser(ctx context.Context) context.Context {
+	fields := FromContext(ctx)
+	fields.UserIDHash = ""
+	return context.WithValue(ctx, fieldsKey{}, fields)
+}
+
+func FromContext(ctx context.Context) Fields {
+	fields, _ := ctx.Value(fieldsKey{}).(Fields)
+	return fields
+}
+
+func Printf(ctx context.Context, format string, v ...any) {
+	output(ctx, "INFO", fmt.Sprintf(format, v...))
+}
+
+// Debugf only logs when LOG_DEBUG is true; use it for payload dumps.
+func Debugf(ctx context.Context, format string, v ...any) {
+	if !DebugEnabled() {
+		return
+	}
+	output(ctx, "DEBUG", fmt.Sprintf(format, v...))
+}
+
+func DebugEnabled() bool {
+	return os.Getenv("LOG_DEBUG") == "true"
+}
+
+func Warnf(ctx context.Context, format string, v ...any) {
+	output(ctx, "WARNING", fmt.Sprintf(format, v...))
+}
+
+func Errorf(ctx context.Context, format string, v ...any) {
+	output(ctx, "ERROR", fmt.Sprintf(format, v...))
+}
+
+func output(ctx context.Context, severity, message string) {
+	e := entry{Severity: severity, Message: redact.Text(redact.ModeFromEnv(), message), Fields: FromContext(ctx)}
+	b, err := jsoncodec.Marshal(e)
+	if err != nil {
+		logger.Printf("jsoncodec.Marshal failed; %v; %s", err, message)
+		return
+	}
+	logger.Print(string(b))
+}
+
+// HashUserID keeps raw LINE user IDs out of the logs while still allowing
+// entries from the same user to be grouped.
+func HashUserID(userID string) string {
+	return redact.Hash(userID)
+}
@@ -0,0 +1,99 @@
+package function
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/conversation"
+	"github.com/hsmtkk/ubiquitous-couscous/function/lineapi"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/messenger"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+)
+
+// messengerFor returns the Messenger of the platform of to, authenticated
+// with the bot token kept in the <platform>-bot-token secret; Slack has one
+// per workspace.
+func messengerFor(ctx context.Context, projectID string, to messenger.Destination) (messenger.Messenger, error) {
+	switch to.Platform {
+	case messenger.PlatformSlack:
+		client, err := slackClient(ctx, projectID, to.Workspace)
+		if err != nil {
+			return nil, err
+		}
+		return messenger.Slack{Token: client.Token}, nil
+	case messenger.PlatformDiscord, messenger.PlatformTelegram:
+	default:
+		return nil, fmt.Errorf("unknown platform; %s", to.Platform)
+	}
+	token, err := getSecret(ctx, projectID, to.Platform+"-bot-token")
+	if err != nil {
+		return nil, err
+	}
+	switch to.Platform {
+	case messenger.PlatformDiscord:
+		return messenger.Discord{Token: token}, nil
+	}
+	return messenger.Telegram{Token: token}, nil
+}
+
+// sendLINE sends msg through the LINE Messenger, replying while the reply
+// window lasts and pushing afterwards.
+func sendLINE(ctx context.Context, lineClient lineapi.LineClient, sendMsg sendMessage, msg messenger.Message) error {
+	to := messenger.Destination{Platform: messenger.PlatformLINE, ChatID: sendMsg.UserIDHash, ThreadID: sendMsg.ReplyToken}
+	m := messenger.LINE{Deliver: func(ctx context.Context, builder *reply.Builder) error {
+		return deliver(ctx, lineClient, to.ChatID, sendMsg.ReceivedAt, builder)
+	}}
+	return m.Send(ctx, to, msg)
+}
+
+// sendElsewhere replies to an image that came from a platform other than
+// LINE with the text and the annotated image; the LINE-only parts of the
+// reply, quick replies and flex messages among them, are left out.
+func sendElsewhere(ctx context.Context, projectID string, sendMsg sendMessage, text string) (err error) {
+	defer func() { trackReply(ctx, sendMsg.ReceivedAt, err) }()
+	to := *sendMsg.Destination
+	msg := messenger.Message{Text: text, ImageURL: sendMsg.AnnotatedImageURL}
+	if sendMsg.Knowledge != nil {
+		msg.Text += "\n\n" + sendMsg.Knowledge.Format()
+	}
+	if dryRunEnabled(ctx) {
+		logging.Printf(ctx, "dry run %s reply: %s", to.Platform, msg.Text)
+		recordDryRun(ctx)
+		return nil
+	}
+	m, err := messengerFor(ctx, projectID, to)
+	if err != nil {
+		return err
+	}
+	if err := m.Send(ctx, to, msg); err != nil {
+		return err
+	}
+	logging.Printf(ctx, "send %s reply", to.Platform)
+	logConversation(ctx, conversation.Item{Kind: conversation.KindReply, Text: msg.Text})
+	return nil
+}
+
+// downloadElsewhere fetches an image that came from a platform other than
+// LINE; its ImageID is what that platform names the file by.
+func downloadElsewhere(ctx context.Context, projectID string, to messenger.Destination, imageID string) ([]byte, error) {
+	var image []byte
+	var err error
+	switch to.Platform {
+	case messenger.PlatformTelegram:
+		var token string
+		if token, err = getSecret(ctx, projectID, "telegram-bot-token"); err != nil {
+			return nil, err
+		}
+		image, err = messenger.Telegram{Token: token}.Download(ctx, imageID)
+	case messenger.PlatformSlack:
+		image, err = downloadSlackImage(ctx, projectID, to.Workspace, imageID)
+	default:
+		return nil, fmt.Errorf("cannot download images from %s", to.Platform)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logging.Printf(ctx, "download image; %d bytes", len(image))
+	return image, nil
+}
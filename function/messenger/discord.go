@@ -0,0 +1,36 @@
+package messenger
+
+import (
+	"context"
+	"net/http"
+)
+
+const DefaultDiscordBaseURL = "https://discord.com/api/v10"
+
+// Discord creates a message in the channel as the bot the token belongs to.
+type Discord struct {
+	Token      string
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+func (d Discord) Send(ctx context.Context, to Destination, msg Message) error {
+	body := map[string]interface{}{
+		"content": truncate(msg.Text, 2000),
+		// labels and OCR text must not ping anyone
+		"allowed_mentions": map[string]interface{}{"parse": []string{}},
+	}
+	if msg.ImageURL != "" {
+		body["embeds"] = []interface{}{map[string]interface{}{"image": map[string]string{"url": msg.ImageURL}}}
+	}
+	if to.ThreadID != "" {
+		// a reply to a message deleted meanwhile is still posted
+		body["message_reference"] = map[string]interface{}{"message_id": to.ThreadID, "fail_if_not_exists": false}
+	}
+	baseURL := d.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultDiscordBaseURL
+	}
+	header := http.Header{"Authorization": {"Bot " + d.Token}}
+	return postJSON(ctx, d.HTTPClient, baseURL+"/channels/"+to.ChatID+"/messages", header, body, nil)
+}
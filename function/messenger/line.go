@@ -0,0 +1,26 @@
+package messenger
+
+import (
+	"context"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+)
+
+// LINE sends through Deliver, which answers the reply token in ThreadID and
+// pushes to the user in ChatID once the token expired.
+type LINE struct {
+	Deliver func(ctx context.Context, builder *reply.Builder) error
+}
+
+// Send sends msg.LINE as built, or a reply of Text and ImageURL without it.
+func (l LINE) Send(ctx context.Context, to Destination, msg Message) error {
+	builder := msg.LINE
+	if builder == nil {
+		builder = reply.NewBuilder(to.ThreadID)
+		if msg.ImageURL != "" {
+			builder.Image(msg.ImageURL, msg.ImageURL)
+		}
+		builder.Text(msg.Text)
+	}
+	return l.Deliver(ctx, builder)
+}
@@ -0,0 +1,96 @@
+// Package messenger sends the reply to an analyzed image to the chat
+// platform it came from. LINE replies are built with the reply package,
+// whose quick replies, flex messages and imagemaps have no counterpart
+// elsewhere, and travel whole in Message.LINE.
+package messenger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+)
+
+const (
+	PlatformLINE     = "line"
+	PlatformSlack    = "slack"
+	PlatformDiscord  = "discord"
+	PlatformTelegram = "telegram"
+)
+
+// Destination is where on Platform the reply goes. It travels in the
+// pipeline messages in place of the reply token of LINE.
+type Destination struct {
+	Platform string `json:"platform"`
+	// Workspace is the Slack team, whose bot token is used.
+	Workspace string `json:"workspace,omitempty"`
+	// ChatID is the Slack or Discord channel, the Telegram chat or the
+	// hashed LINE user ID.
+	ChatID string `json:"chatId"`
+	// ThreadID is the Slack thread or the Discord or Telegram message the
+	// reply answers, or the LINE reply token; empty to post on its own.
+	ThreadID string `json:"threadId,omitempty"`
+}
+
+// Message is a reply reduced to what every platform can show.
+type Message struct {
+	Text     string
+	ImageURL string
+	// LINE is the full reply on LINE; other platforms ignore it.
+	LINE *reply.Builder
+}
+
+type Messenger interface {
+	Send(ctx context.Context, to Destination, msg Message) error
+}
+
+// postJSON posts body to url and decodes the response into resp.
+func postJSON(ctx context.Context, client *http.Client, url string, header http.Header, body, resp interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("json.Marshal failed; %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("http.Client.Do failed; %w", err)
+	}
+	defer res.Body.Close()
+	respBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s failed; %d %s", url, res.StatusCode, respBody)
+	}
+	if resp == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, resp); err != nil {
+		return fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	return nil
+}
+
+// truncate cuts s to at most n runes.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
@@ -0,0 +1,49 @@
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+const DefaultSlackBaseURL = "https://slack.com/api"
+
+// Slack posts with chat.postMessage as the bot the token belongs to.
+type Slack struct {
+	Token      string
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+func (s Slack) Send(ctx context.Context, to Destination, msg Message) error {
+	blocks := []interface{}{
+		map[string]interface{}{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": truncate(msg.Text, 3000)}},
+	}
+	if msg.ImageURL != "" {
+		blocks = append(blocks, map[string]string{"type": "image", "image_url": msg.ImageURL, "alt_text": "annotated image"})
+	}
+	body := map[string]interface{}{
+		"channel": to.ChatID,
+		"text":    msg.Text,
+		"blocks":  blocks,
+	}
+	if to.ThreadID != "" {
+		body["thread_ts"] = to.ThreadID
+	}
+	baseURL := s.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultSlackBaseURL
+	}
+	var resp struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	header := http.Header{"Authorization": {"Bearer " + s.Token}}
+	if err := postJSON(ctx, s.HTTPClient, baseURL+"/chat.postMessage", header, body, &resp); err != nil {
+		return err
+	}
+	if !resp.OK {
+		return fmt.Errorf("slack chat.postMessage failed; %s", resp.Error)
+	}
+	return nil
+}
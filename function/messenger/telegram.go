@@ -0,0 +1,120 @@
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultTelegramBaseURL = "https://api.telegram.org"
+
+	maxTelegramText    = 4096
+	maxTelegramCaption = 1024
+)
+
+// Telegram sends through the Bot API. An image goes as a photo, with the
+// text as its caption when it fits.
+type Telegram struct {
+	Token      string
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+func (t Telegram) Send(ctx context.Context, to Destination, msg Message) error {
+	base := map[string]interface{}{"chat_id": to.ChatID}
+	if to.ThreadID != "" {
+		id, err := strconv.ParseInt(to.ThreadID, 10, 64)
+		if err != nil {
+			return fmt.Errorf("strconv.ParseInt failed; %w", err)
+		}
+		base["reply_to_message_id"] = id
+		base["allow_sending_without_reply"] = true
+	}
+	with := func(fields map[string]interface{}) map[string]interface{} {
+		for k, v := range base {
+			fields[k] = v
+		}
+		return fields
+	}
+	text := msg.Text
+	if msg.ImageURL != "" {
+		photo := with(map[string]interface{}{"photo": msg.ImageURL})
+		if len([]rune(text)) <= maxTelegramCaption {
+			photo["caption"] = text
+			text = ""
+		}
+		if err := t.call(ctx, "sendPhoto", photo); err != nil {
+			return err
+		}
+	}
+	if text == "" {
+		return nil
+	}
+	return t.call(ctx, "sendMessage", with(map[string]interface{}{"text": truncate(text, maxTelegramText)}))
+}
+
+func (t Telegram) call(ctx context.Context, method string, body map[string]interface{}) error {
+	baseURL := t.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultTelegramBaseURL
+	}
+	var resp struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := postJSON(ctx, t.HTTPClient, baseURL+"/bot"+t.Token+"/"+method, nil, body, &resp); err != nil {
+		// the URL carries the token
+		return fmt.Errorf("telegram %s failed; %s", method, strings.ReplaceAll(err.Error(), t.Token, "<token>"))
+	}
+	if !resp.OK {
+		return fmt.Errorf("telegram %s failed; %s", method, resp.Description)
+	}
+	return nil
+}
+
+// Download returns the file fileID names, such as a photo of an update. The
+// Bot API serves files of up to 20MB.
+func (t Telegram) Download(ctx context.Context, fileID string) ([]byte, error) {
+	baseURL := t.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultTelegramBaseURL
+	}
+	var resp struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+		Result      struct {
+			FilePath string `json:"file_path"`
+		} `json:"result"`
+	}
+	if err := postJSON(ctx, t.HTTPClient, baseURL+"/bot"+t.Token+"/getFile", nil, map[string]string{"file_id": fileID}, &resp); err != nil {
+		return nil, fmt.Errorf("telegram getFile failed; %s", strings.ReplaceAll(err.Error(), t.Token, "<token>"))
+	}
+	if !resp.OK || resp.Result.FilePath == "" {
+		return nil, fmt.Errorf("telegram getFile failed; %s", resp.Description)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/file/bot"+t.Token+"/"+resp.Result.FilePath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	client := t.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("telegram file download failed; %s", strings.ReplaceAll(err.Error(), t.Token, "<token>"))
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("telegram file download failed; %d", res.StatusCode)
+	}
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,170 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/multicast"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+)
+
+const (
+	defaultMulticastConcurrency = 10
+	defaultMulticastBatch       = 100
+	// well inside the timeout of send, so that the checkpoint is written
+	defaultMulticastBudget = 40 * time.Second
+	multicastAttempts      = 3
+	multicastBackoff       = time.Second
+	maxMulticastRecipients = 10000
+)
+
+type multicastRequest struct {
+	Text string `json:"text"`
+	// Category picks the recipients like a campaign does; To lists LINE
+	// user IDs instead.
+	Category string   `json:"category"`
+	To       []string `json:"to"`
+}
+
+// multicastHandler starts a multicast on POST, which the send function then
+// works off, and reports its progress on GET ?id=.
+func multicastHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "multicast"})
+	logging.Printf(ctx, "multicast")
+
+	client, err := clients.Firestore(ctx, os.Getenv("PROJECT_ID"))
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	store := multicast.NewStore(client)
+
+	var job *multicast.Job
+	switch r.Method {
+	case http.MethodPost:
+		var req multicastRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			returnError(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		recipients := req.To
+		if req.Category != "" {
+			if recipients, err = segmentUserIDs(ctx, client, req.Category); err != nil {
+				returnError(ctx, w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		if req.Text == "" || len(recipients) == 0 {
+			returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("text and recipients are required"))
+			return
+		}
+		if len(recipients) > maxMulticastRecipients {
+			returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("too many recipients; %d", len(recipients)))
+			return
+		}
+		if job, err = store.Create(ctx, req.Text, recipients); err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		if _, err := publishSendMessage(ctx, sendMessage{CorrelationID: job.ID, MulticastID: job.ID}); err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		logging.Printf(ctx, "multicast %s: %d recipients", job.ID, job.Total)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodGet:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("id is required"))
+			return
+		}
+		if job, err = store.Load(ctx, id); err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+	default:
+		returnError(ctx, w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		logging.Errorf(ctx, "json.Encoder.Encode failed; %v", err)
+	}
+}
+
+func multicastRunner(ctx context.Context, store *multicast.Store) multicast.Runner {
+	setting := func(key string, fallback int) int {
+		if n, err := strconv.Atoi(dynconfig.Get(ctx, key)); err == nil && n > 0 {
+			return n
+		}
+		return fallback
+	}
+	return multicast.Runner{
+		Store:       store,
+		Concurrency: setting("MULTICAST_CONCURRENCY", defaultMulticastConcurrency),
+		BatchSize:   setting("MULTICAST_BATCH", defaultMulticastBatch),
+		Attempts:    multicastAttempts,
+		Backoff:     multicastBackoff,
+		Budget:      time.Duration(setting("MULTICAST_BUDGET_SECONDS", int(defaultMulticastBudget.Seconds()))) * time.Second,
+	}
+}
+
+// sendMulticast is the multi-recipient mode of send. It pushes to the
+// recipients of the job from its last checkpoint on and, when its time is
+// up before the end, publishes the job again for the next run to resume.
+// A run cut off by the function timeout is redelivered and resumes the
+// same way; the retry keys keep recipients of the interrupted batch from
+// getting the message twice.
+func sendMulticast(ctx context.Context, projectID, id string) error {
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	store := multicast.NewStore(client)
+	job, err := store.Load(ctx, id)
+	if err != nil {
+		return err
+	}
+	if job.Status == multicast.StatusDone {
+		logging.Printf(ctx, "skip multicast %s; done", id)
+		return nil
+	}
+	lineClient, err := newLineClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	req, err := reply.NewBuilder("").Text(job.Text).Build()
+	if err != nil {
+		return err
+	}
+	dryRun := dryRunEnabled(ctx)
+	send := func(ctx context.Context, recipient, retryKey string) error {
+		if dryRun {
+			return nil
+		}
+		req := req
+		req.RetryKey = retryKey
+		return lineClient.Push(ctx, recipient, req)
+	}
+	from := job.Next
+	if err := multicastRunner(ctx, store).Run(ctx, job, send); err != nil {
+		return err
+	}
+	logging.Printf(ctx, "multicast %s: %d to %d of %d, %d sent, %d failed", id, from, job.Next, job.Total, job.Sent, job.Failed)
+	if job.Status == multicast.StatusDone {
+		return nil
+	}
+	next := sendMessage{CorrelationID: id + ":" + strconv.Itoa(job.Next), MulticastID: id, Tenant: tenantID(ctx)}
+	if _, err := publishSendMessage(ctx, next); err != nil {
+		return err
+	}
+	logging.Printf(ctx, "multicast %s continues at %d", id, job.Next)
+	return nil
+}
@@ -0,0 +1,199 @@
+package multicast
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	Collection = "multicasts"
+
+	StatusSending = "sending"
+	StatusDone    = "done"
+
+	// failures kept on the job; the count goes on
+	maxFailures = 100
+)
+
+// Job is a message to many recipients. Next is the checkpoint: every
+// recipient before it was tried, the rest still waits.
+type Job struct {
+	ID         string    `firestore:"-" json:"id"`
+	Text       string    `firestore:"text" json:"text"`
+	Recipients []string  `firestore:"recipients" json:"-"`
+	Total      int       `firestore:"total" json:"total"`
+	Next       int       `firestore:"next" json:"next"`
+	Sent       int       `firestore:"sent" json:"sent"`
+	Failed     int       `firestore:"failed" json:"failed"`
+	Failures   []Failure `firestore:"failures" json:"failures,omitempty"`
+	Status     string    `firestore:"status" json:"status"`
+	CreatedAt  time.Time `firestore:"createdAt" json:"createdAt"`
+	UpdatedAt  time.Time `firestore:"updatedAt" json:"updatedAt"`
+}
+
+// Failure names a recipient by its index; the IDs stay out of the logs and
+// the status output.
+type Failure struct {
+	Index int    `firestore:"index" json:"index"`
+	Error string `firestore:"error" json:"error"`
+}
+
+type Store struct {
+	client *firestore.Client
+}
+
+func NewStore(client *firestore.Client) *Store {
+	return &Store{client: client}
+}
+
+func (s *Store) Create(ctx context.Context, text string, recipients []string) (*Job, error) {
+	now := time.Now()
+	job := &Job{Text: text, Recipients: recipients, Total: len(recipients), Status: StatusSending, CreatedAt: now, UpdatedAt: now}
+	ref, _, err := s.client.Collection(namespace.Collection(Collection)).Add(ctx, job)
+	if err != nil {
+		return nil, fmt.Errorf("firestore.CollectionRef.Add failed; %w", err)
+	}
+	job.ID = ref.ID
+	return job, nil
+}
+
+func (s *Store) Load(ctx context.Context, id string) (*Job, error) {
+	snap, err := s.client.Collection(namespace.Collection(Collection)).Doc(id).Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	var job Job
+	if err := snap.DataTo(&job); err != nil {
+		return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+	}
+	job.ID = id
+	return &job, nil
+}
+
+// Checkpoint saves the progress of job; the recipients never change.
+func (s *Store) Checkpoint(ctx context.Context, job *Job) error {
+	job.UpdatedAt = time.Now()
+	_, err := s.client.Collection(namespace.Collection(Collection)).Doc(job.ID).Set(ctx, map[string]interface{}{
+		"next":      job.Next,
+		"sent":      job.Sent,
+		"failed":    job.Failed,
+		"failures":  job.Failures,
+		"status":    job.Status,
+		"updatedAt": job.UpdatedAt,
+	}, firestore.MergeAll)
+	if err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	return nil
+}
+
+// SendFunc sends to one recipient. retryKey is the same on every attempt
+// and every run for that recipient, so the receiving side can drop what it
+// accepted before.
+type SendFunc func(ctx context.Context, recipient, retryKey string) error
+
+// Runner works off a job in batches of BatchSize recipients, Concurrency of
+// them at once, trying each up to Attempts times. After every batch it
+// checkpoints; once Budget has passed it stops there, leaving the job
+// sending for the next run to resume.
+type Runner struct {
+	Store       *Store
+	Concurrency int
+	BatchSize   int
+	Attempts    int
+	Backoff     time.Duration
+	Budget      time.Duration
+}
+
+// Run returns once the job is done or the budget is spent; job tells which.
+// Only failing checkpoints are errors, a recipient that cannot be reached
+// is counted as failed.
+func (r Runner) Run(ctx context.Context, job *Job, send SendFunc) error {
+	stopAt := time.Now().Add(r.Budget)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(stopAt) {
+		stopAt = deadline
+	}
+	for job.Next < len(job.Recipients) {
+		if time.Now().After(stopAt) {
+			return nil
+		}
+		end := job.Next + r.BatchSize
+		if end > len(job.Recipients) {
+			end = len(job.Recipients)
+		}
+		r.runBatch(ctx, job, end, send)
+		job.Next = end
+		if job.Next == len(job.Recipients) {
+			job.Status = StatusDone
+		}
+		if err := r.Store.Checkpoint(ctx, job); err != nil {
+			return err
+		}
+	}
+	if job.Status != StatusDone {
+		job.Status = StatusDone
+		return r.Store.Checkpoint(ctx, job)
+	}
+	return nil
+}
+
+func (r Runner) runBatch(ctx context.Context, job *Job, end int, send SendFunc) {
+	var mu sync.Mutex
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(r.Concurrency)
+	for i := job.Next; i < end; i++ {
+		i := i
+		eg.Go(func() error {
+			err := r.sendWithRetry(egCtx, job.Recipients[i], RetryKey(job.ID, i), send)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				job.Failed++
+				if len(job.Failures) < maxFailures {
+					job.Failures = append(job.Failures, Failure{Index: i, Error: err.Error()})
+				}
+				return nil
+			}
+			job.Sent++
+			return nil
+		})
+	}
+	eg.Wait()
+}
+
+func (r Runner) sendWithRetry(ctx context.Context, recipient, retryKey string, send SendFunc) error {
+	backoff := r.Backoff
+	var err error
+	for attempt := 1; attempt <= r.Attempts; attempt++ {
+		if err = send(ctx, recipient, retryKey); err == nil {
+			return nil
+		}
+		if attempt == r.Attempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+// RetryKey derives a UUID from the job and the index of the recipient.
+func RetryKey(jobID string, index int) string {
+	sum := sha256.Sum256([]byte(jobID + ":" + strconv.Itoa(index)))
+	// version 4 and variant bits so that it parses as any other UUID
+	sum[6] = sum[6]&0x0f | 0x40
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
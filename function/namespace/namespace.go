@@ -0,0 +1,89 @@
+// Package namespace lets several deployments, dev, stage and prod or one per
+// developer, share a GCP project. NAMESPACE is put in front of topic names,
+// Cloud Storage object names, Firestore collection IDs, custom metric types,
+// Secret Manager secrets and Redis keys; without it every name stays as it
+// is. The topics read from the environment are named without it: main.ts
+// creates them, like the functions and jobs of the deployment, under the
+// prefixed names from the same NAMESPACE.
+package namespace
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// short enough to leave room in resource names, and valid in all of them
+var valid = regexp.MustCompile(`^[a-z][a-z0-9-]{0,19}$`)
+
+var current = os.Getenv("NAMESPACE")
+
+// a deployment with a mistyped namespace must not write into another's
+// data, so it does not start at all
+func init() {
+	if err := Validate(current); err != nil {
+		panic(err)
+	}
+}
+
+func Validate(ns string) error {
+	if ns != "" && !valid.MatchString(ns) {
+		return fmt.Errorf("invalid NAMESPACE %q; want up to 20 lowercase letters, digits and hyphens, starting with a letter", ns)
+	}
+	return nil
+}
+
+// Current is the namespace of this deployment, empty for none.
+func Current() string {
+	return current
+}
+
+// Topic is the Pub/Sub topic or subscription name of this deployment.
+func Topic(name string) string {
+	if current == "" || name == "" {
+		return name
+	}
+	return current + "-" + name
+}
+
+// Secret is the Secret Manager secret ID of this deployment.
+func Secret(name string) string {
+	return Topic(name)
+}
+
+// Key is the Redis key of this deployment.
+func Key(key string) string {
+	if current == "" {
+		return key
+	}
+	return current + ":" + key
+}
+
+// Collection is the Firestore collection ID of this deployment, for root
+// collections and subcollections alike so that collection group queries
+// stay within it.
+func Collection(id string) string {
+	if current == "" {
+		return id
+	}
+	return current + "_" + id
+}
+
+// Object is the Cloud Storage object name, or prefix, of this deployment.
+func Object(name string) string {
+	if current == "" {
+		return name
+	}
+	return current + "/" + name
+}
+
+// Metric is the custom metric type of this deployment; built-in metrics are
+// left alone.
+func Metric(metricType string) string {
+	const custom = "custom.googleapis.com/"
+	if current == "" || !strings.HasPrefix(metricType, custom) {
+		return metricType
+	}
+	return custom + current + "/" + strings.TrimPrefix(metricType, custom)
+}
@@ -0,0 +1,111 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	vision "cloud.google.com/go/vision/apiv1"
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/annotate"
+	"github.com/hsmtkk/ubiquitous-couscous/function/imageutil"
+	"github.com/hsmtkk/ubiquitous-couscous/function/labelmerge"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/visionclient"
+	"github.com/hsmtkk/ubiquitous-couscous/function/visionresult"
+	visionpb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// one object localization is billed as one unit
+const objectLocalizationUnits = 1
+
+// objectsStep localizes the objects in the image and, with ANNOTATION_BUCKET
+// set, replies with a copy of the image with their bounding boxes drawn on
+// it unless params["annotate"] is "false" or SafeSearch flags the image.
+// The object names become the labels either way.
+func objectsStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	if err := reserveVision(ctx, state, objectLocalizationUnits); err != nil {
+		return err
+	}
+	boxes, err := localizeObjects(ctx, state.image)
+	if err != nil {
+		return err
+	}
+	found := make([]labelmerge.Label, 0, len(boxes))
+	objects := make([]analysis.Object, 0, len(boxes))
+	for _, box := range boxes {
+		found = append(found, labelmerge.Label{Name: box.Name, Score: box.Score})
+		objects = append(objects, analysis.Object{Name: box.Name, Score: box.Score, MinX: box.MinX, MinY: box.MinY, MaxX: box.MaxX, MaxY: box.MaxY})
+	}
+	state.result.AddFeature(analysis.FeatureObjects)
+	state.result.Labels = mergedLabels(labelmerge.Merge(found))
+	state.result.Objects = objects
+	logging.Printf(ctx, "objects: %v", state.result.LabelNames())
+
+	bucket := tenantEnv(ctx, "ANNOTATION_BUCKET")
+	if bucket == "" || len(boxes) == 0 || params["annotate"] == "false" {
+		return nil
+	}
+	if err := ensureSafeSearch(ctx, state); err != nil {
+		return err
+	}
+	if state.unsafe {
+		logging.Printf(ctx, "no annotated copy of an unsafe image")
+		return nil
+	}
+	img, _, err := imageutil.Decode(state.image)
+	if err != nil {
+		return err
+	}
+	b, err := imageutil.EncodeJPEG(annotate.Draw(img, boxes))
+	if err != nil {
+		return err
+	}
+	url, err := uploadImage(ctx, bucket, annotatedObjectName(state.procMsg.UserIDHash, state.procMsg.ImageID), b)
+	if err != nil {
+		return err
+	}
+	state.annotatedImageURL = url
+	return nil
+}
+
+func annotatedObjectName(userIDHash, imageID string) string {
+	return fmt.Sprintf("annotated/%s/%s.jpg", userIDHash, imageID)
+}
+
+func localizeObjects(ctx context.Context, imageBytes []byte) ([]annotate.Box, error) {
+	client, err := visionclient.Default.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	image, err := vision.NewImageFromReader(bytes.NewReader(imageBytes))
+	if err != nil {
+		return nil, fmt.Errorf("vision.NewImageFromReader failed; %w", err)
+	}
+	req := &visionpb.AnnotateImageRequest{
+		Image:    image,
+		Features: []*visionpb.Feature{{Type: visionpb.Feature_OBJECT_LOCALIZATION, MaxResults: maxLabels}},
+	}
+	release, err := acquireVision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	batch, err := client.BatchAnnotateImages(ctx, &visionpb.BatchAnnotateImagesRequest{Requests: []*visionpb.AnnotateImageRequest{req}})
+	release()
+	if err != nil {
+		return nil, fmt.Errorf("vision.ImageAnnotatorClient.BatchAnnotateImages failed; %w", err)
+	}
+	if n := len(batch.GetResponses()); n != 1 {
+		return nil, fmt.Errorf("vision annotate failed; %d responses", n)
+	}
+	resp := batch.GetResponses()[0]
+	if resp.GetError() != nil {
+		return nil, fmt.Errorf("vision annotate failed; %s", resp.GetError().GetMessage())
+	}
+	archiveVisionResponse(ctx, visionresult.KindObjects, []string{"objects"}, resp)
+	boxes := []annotate.Box{}
+	for _, o := range visionresult.Objects(resp) {
+		boxes = append(boxes, annotate.Box{Name: o.Name, Score: o.Score, MinX: o.MinX, MinY: o.MinY, MaxX: o.MaxX, MaxY: o.MaxY})
+	}
+	return boxes, nil
+}
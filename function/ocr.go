@@ -0,0 +1,106 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+
+	vision "cloud.google.com/go/vision/apiv1"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/costguard"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/imageutil"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/textorient"
+	"github.com/hsmtkk/ubiquitous-couscous/function/visionclient"
+	visionpb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// below this the text of a sideways photo is read again upright
+const defaultOCRMinConfidence = 0.8
+
+func ocrMinConfidence(ctx context.Context) float32 {
+	if v, err := strconv.ParseFloat(dynconfig.Get(ctx, "OCR_MIN_CONFIDENCE"), 32); err == nil && v > 0 {
+		return float32(v)
+	}
+	return defaultOCRMinConfidence
+}
+
+type ocrResult struct {
+	Text       string
+	Locale     string
+	Confidence float32
+	// Rotated is how far the image was turned clockwise to read the text.
+	Rotated int
+}
+
+// detectText reads the text of the image. When the text is turned and read
+// with a low confidence, the image is turned upright and read once more,
+// costing one more Vision unit, and the more confident read wins.
+func detectText(ctx context.Context, projectID string, client visionclient.Annotator, imageBytes []byte) (ocrResult, error) {
+	text, err := documentText(ctx, client, imageBytes)
+	if err != nil {
+		return ocrResult{}, err
+	}
+	result := ocrResult{Text: text.GetText(), Locale: textorient.Locale(text), Confidence: textorient.Confidence(text)}
+	orientation := textorient.Detect(text)
+	if orientation.Degrees == 0 || result.Confidence >= ocrMinConfidence(ctx) {
+		return result, nil
+	}
+	logging.Printf(ctx, "text turned %d degrees (%.0f%%), confidence %.2f; reading upright", orientation.Degrees, orientation.Share*100, result.Confidence)
+
+	budget, err := visionDailyBudget(ctx)
+	if err != nil {
+		return result, err
+	}
+	fsClient, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return result, err
+	}
+	if err := costguard.New(fsClient, budget).Reserve(ctx, 1); err != nil {
+		logging.Errorf(ctx, "upright OCR skipped; %v", err)
+		return result, nil
+	}
+	img, _, err := imageutil.Decode(imageBytes)
+	if err != nil {
+		logging.Errorf(ctx, "upright OCR skipped; %v", err)
+		return result, nil
+	}
+	upright, err := imageutil.EncodeJPEG(imageutil.Rotate(img, orientation.Upright()))
+	if err != nil {
+		return result, err
+	}
+	text, err = documentText(ctx, client, upright)
+	if err != nil {
+		return result, err
+	}
+	if confidence := textorient.Confidence(text); confidence > result.Confidence {
+		logging.Printf(ctx, "upright OCR confidence %.2f", confidence)
+		result = ocrResult{Text: text.GetText(), Locale: textorient.Locale(text), Confidence: confidence, Rotated: orientation.Upright()}
+	}
+	return result, nil
+}
+
+func documentText(ctx context.Context, client visionclient.Annotator, imageBytes []byte) (*visionpb.TextAnnotation, error) {
+	image, err := vision.NewImageFromReader(bytes.NewReader(imageBytes))
+	if err != nil {
+		return nil, fmt.Errorf("vision.NewImageFromReader failed; %w", err)
+	}
+	req := &visionpb.AnnotateImageRequest{
+		Image:    image,
+		Features: []*visionpb.Feature{{Type: visionpb.Feature_DOCUMENT_TEXT_DETECTION}},
+	}
+	batch, err := client.BatchAnnotateImages(ctx, &visionpb.BatchAnnotateImagesRequest{Requests: []*visionpb.AnnotateImageRequest{req}})
+	if err != nil {
+		return nil, fmt.Errorf("vision.ImageAnnotatorClient.BatchAnnotateImages failed; %w", err)
+	}
+	if n := len(batch.GetResponses()); n != 1 {
+		return nil, fmt.Errorf("vision annotate failed; %d responses", n)
+	}
+	resp := batch.GetResponses()[0]
+	if resp.GetError() != nil {
+		return nil, fmt.Errorf("vision annotate failed; %s", resp.GetError().GetMessage())
+	}
+	return resp.GetFullTextAnnotation(), nil
+}
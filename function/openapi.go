@@ -0,0 +1,17 @@
+package function
+
+import (
+	_ "embed"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/openapi"
+)
+
+// openapi.json describes the public HTTP functions. Keep it in step with the
+// handlers: it is served to clients and every request is validated against
+// it before the handler runs. script/generate-clients.bat builds typed
+// clients from it.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+var apiSpec = openapi.MustParse(openAPISpec)
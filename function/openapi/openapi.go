@@ -0,0 +1,165 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spec is the part of an OpenAPI 3 document requests are validated against.
+type Spec struct {
+	raw   []byte
+	Paths map[string]map[string]Operation `json:"paths"`
+}
+
+type Operation struct {
+	OperationID string      `json:"operationId"`
+	Parameters  []Parameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool                       `json:"required"`
+		Content  map[string]json.RawMessage `json:"content"`
+	} `json:"requestBody"`
+}
+
+type Parameter struct {
+	Name     string `json:"name"`
+	In       string `json:"in"`
+	Required bool   `json:"required"`
+	Schema   Schema `json:"schema"`
+}
+
+type Schema struct {
+	Type    string   `json:"type"`
+	Format  string   `json:"format"`
+	Enum    []string `json:"enum"`
+	Minimum *float64 `json:"minimum"`
+	Maximum *float64 `json:"maximum"`
+}
+
+func Parse(b []byte) (*Spec, error) {
+	var spec Spec
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	spec.raw = b
+	return &spec, nil
+}
+
+// MustParse is Parse for the embedded spec, which is known to be valid.
+func MustParse(b []byte) *Spec {
+	spec, err := Parse(b)
+	if err != nil {
+		panic(err)
+	}
+	return spec
+}
+
+// Validate checks r against the operations of path: the method, required
+// parameters and the type, format, enum and range of the parameters given.
+// The body is only checked for its content type; the handler parses it.
+func (s *Spec) Validate(path string, r *http.Request) (int, error) {
+	ops, ok := s.Paths[path]
+	if !ok {
+		return http.StatusNotFound, fmt.Errorf("unknown path; %s", path)
+	}
+	op, ok := ops[strings.ToLower(r.Method)]
+	if !ok {
+		return http.StatusMethodNotAllowed, fmt.Errorf("method not allowed; %s", r.Method)
+	}
+	for _, p := range op.Parameters {
+		var value string
+		var present bool
+		switch p.In {
+		case "query":
+			values, ok := r.URL.Query()[p.Name]
+			present = ok
+			if ok {
+				value = values[0]
+			}
+		case "header":
+			value = r.Header.Get(p.Name)
+			present = value != ""
+		default:
+			continue
+		}
+		if !present {
+			if p.Required {
+				return http.StatusBadRequest, fmt.Errorf("missing %s %s", p.In, p.Name)
+			}
+			continue
+		}
+		if err := p.Schema.check(value); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("invalid %s; %w", p.Name, err)
+		}
+	}
+	if op.RequestBody != nil && op.RequestBody.Required && len(op.RequestBody.Content) > 0 {
+		contentType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+		if _, ok := op.RequestBody.Content[contentType]; !ok {
+			return http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type; %s", contentType)
+		}
+	}
+	return http.StatusOK, nil
+}
+
+func (s Schema) check(value string) error {
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			found = found || e == value
+		}
+		if !found {
+			return fmt.Errorf("%s is not one of %s", value, strings.Join(s.Enum, ", "))
+		}
+	}
+	switch {
+	case s.Type == "integer" || s.Type == "number":
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || (s.Type == "integer" && n != float64(int64(n))) {
+			return fmt.Errorf("%s is not an %s", value, s.Type)
+		}
+		if s.Minimum != nil && n < *s.Minimum {
+			return fmt.Errorf("%s is below %v", value, *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return fmt.Errorf("%s is above %v", value, *s.Maximum)
+		}
+	case s.Type == "boolean":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%s is not a boolean", value)
+		}
+	case s.Format == "date-time":
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return fmt.Errorf("%s is not an RFC 3339 date-time", value)
+		}
+	}
+	return nil
+}
+
+// Handler serves the spec as given to Parse.
+func (s *Spec) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(s.raw)
+	}
+}
+
+// Middleware serves the spec at /openapi.json and rejects requests to next
+// that do not match the operations of path. Failures are answered as plain
+// text, like the handlers themselves do.
+func (s *Spec) Middleware(path string, next http.HandlerFunc) http.HandlerFunc {
+	serve := s.Handler()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/openapi.json") {
+			serve(w, r)
+			return
+		}
+		if code, err := s.Validate(path, r); err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,83 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/queue"
+	"google.golang.org/api/iterator"
+)
+
+const collection = "outbox"
+
+// Entry is a message that could not be published when it was received.
+type Entry struct {
+	Topic string `firestore:"topic"`
+	Data  []byte `firestore:"data"`
+	// Attributes are published along with Data.
+	Attributes map[string]string `firestore:"attributes"`
+	CreatedAt  time.Time         `firestore:"createdAt"`
+	Attempts   int               `firestore:"attempts"`
+	LastError  string            `firestore:"lastError"`
+}
+
+type Store struct {
+	client *firestore.Client
+}
+
+func New(client *firestore.Client) *Store {
+	return &Store{client: client}
+}
+
+func (s *Store) Put(ctx context.Context, topic string, data []byte, attrs map[string]string, cause error) (string, error) {
+	entry := Entry{Topic: topic, Data: data, Attributes: attrs, CreatedAt: time.Now(), Attempts: 1, LastError: cause.Error()}
+	ref, _, err := s.client.Collection(namespace.Collection(collection)).Add(ctx, entry)
+	if err != nil {
+		return "", fmt.Errorf("firestore.CollectionRef.Add failed; %w", err)
+	}
+	return ref.ID, nil
+}
+
+// Drain republishes up to limit of the oldest entries, deleting each one
+// once it has been published. Entries that fail again stay in the outbox
+// with their attempt count bumped.
+func (s *Store) Drain(ctx context.Context, q queue.Queue, limit int) (int, int, error) {
+	iter := s.client.Collection(namespace.Collection(collection)).OrderBy("createdAt", firestore.Asc).Limit(limit).Documents(ctx)
+	defer iter.Stop()
+	sent, failed := 0, 0
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return sent, failed, nil
+		}
+		if err != nil {
+			return sent, failed, fmt.Errorf("firestore.DocumentIterator.Next failed; %w", err)
+		}
+		var entry Entry
+		if err := snap.DataTo(&entry); err != nil {
+			return sent, failed, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+		}
+		id, err := queue.PublishAttributes(ctx, q, entry.Topic, entry.Data, entry.Attributes)
+		if err != nil {
+			failed++
+			logging.Errorf(ctx, "republish %s failed; %v", snap.Ref.ID, err)
+			update := []firestore.Update{
+				{Path: "attempts", Value: firestore.Increment(1)},
+				{Path: "lastError", Value: err.Error()},
+			}
+			if _, err := snap.Ref.Update(ctx, update); err != nil {
+				return sent, failed, fmt.Errorf("firestore.DocumentRef.Update failed; %w", err)
+			}
+			continue
+		}
+		if _, err := snap.Ref.Delete(ctx); err != nil {
+			return sent, failed, fmt.Errorf("firestore.DocumentRef.Delete failed; %w", err)
+		}
+		sent++
+		logging.Printf(ctx, "republish %s: %s", snap.Ref.ID, id)
+	}
+}
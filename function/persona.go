@@ -0,0 +1,31 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/persona"
+)
+
+const personaOff = "off"
+
+// choosePersona handles "/persona <name>" and returns the text answering it.
+func choosePersona(ctx context.Context, client *firestore.Client, userIDHash, name string) (string, error) {
+	choices := strings.Join(append(persona.Names(), personaOff), ", ")
+	if name == personaOff {
+		if err := savePreference(ctx, client, userIDHash, "persona", ""); err != nil {
+			return "", err
+		}
+		return "Replies are back to the default tone.", nil
+	}
+	tone, ok := persona.Lookup(name)
+	if !ok {
+		return fmt.Sprintf("Choose a tone with /persona and one of: %s", choices), nil
+	}
+	if err := savePreference(ctx, client, userIDHash, "persona", tone.Name); err != nil {
+		return "", err
+	}
+	return tone.Frame(fmt.Sprintf("Replies now use the %s tone.", tone.Name)), nil
+}
@@ -0,0 +1,92 @@
+package persona
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"sort"
+	"text/template"
+)
+
+// Reply keys a persona may reword.
+const (
+	KeyNoLabels       = "noLabels"
+	KeyBudgetExceeded = "budgetExceeded"
+	// KeyDuplicate gets .Date and .Labels.
+	KeyDuplicate = "duplicate"
+)
+
+//go:embed personas.json
+var personasJSON []byte
+
+// Persona is a tone of voice for replies. The zero Persona leaves every text
+// as it is.
+type Persona struct {
+	Name string `json:"persona"`
+	// Templates holds text/template variants of the fixed replies by key.
+	Templates map[string]string `json:"templates"`
+	// Opening and Closing frame the free texts, like the list of labels.
+	Opening string `json:"opening"`
+	Closing string `json:"closing"`
+
+	parsed map[string]*template.Template
+}
+
+var personas = mustLoad()
+
+func mustLoad() map[string]Persona {
+	var ps []Persona
+	if err := json.Unmarshal(personasJSON, &ps); err != nil {
+		panic(err)
+	}
+	m := map[string]Persona{}
+	for _, p := range ps {
+		p.parsed = map[string]*template.Template{}
+		for key, text := range p.Templates {
+			p.parsed[key] = template.Must(template.New(p.Name + "." + key).Parse(text))
+		}
+		m[p.Name] = p
+	}
+	return m
+}
+
+// Lookup returns the named persona and whether it exists; unknown names get
+// the zero Persona.
+func Lookup(name string) (Persona, bool) {
+	p, ok := personas[name]
+	return p, ok
+}
+
+func Names() []string {
+	names := make([]string, 0, len(personas))
+	for name := range personas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Text renders the persona's variant of the reply named key with data,
+// falling back to text.
+func (p Persona) Text(key, text string, data interface{}) string {
+	tmpl, ok := p.parsed[key]
+	if !ok {
+		return text
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return text
+	}
+	return buf.String()
+}
+
+// Frame puts the persona's opening and closing around text.
+func (p Persona) Frame(text string) string {
+	if p.Opening != "" {
+		text = p.Opening + "\n" + text
+	}
+	if p.Closing != "" {
+		text = text + "\n" + p.Closing
+	}
+	return text
+}
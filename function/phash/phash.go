@@ -0,0 +1,149 @@
+package phash
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+)
+
+const (
+	sampleSize = 32
+	hashSize   = 8
+)
+
+// Hash is a 64 bit DCT based perceptual hash. Visually similar images have a
+// small Hamming distance between their hashes.
+type Hash uint64
+
+func FromBytes(imageBytes []byte) (Hash, error) {
+	img, _, err := image.Decode(bytes.NewReader(imageBytes))
+	if err != nil {
+		return 0, fmt.Errorf("image.Decode failed; %w", err)
+	}
+	return Compute(img), nil
+}
+
+func Compute(img image.Image) Hash {
+	pixels := grayscale(img)
+	coeffs := dct2D(pixels)
+
+	lowFreq := make([]float64, 0, hashSize*hashSize)
+	for y := 0; y < hashSize; y++ {
+		for x := 0; x < hashSize; x++ {
+			lowFreq = append(lowFreq, coeffs[y][x])
+		}
+	}
+	// the DC term dominates and says nothing about structure
+	median := median(lowFreq[1:])
+
+	var hash Hash
+	for i, c := range lowFreq {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+func Distance(a, b Hash) int {
+	return bits.OnesCount64(uint64(a ^ b))
+}
+
+func (h Hash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+func Parse(s string) (Hash, error) {
+	v, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("strconv.ParseUint failed; %w", err)
+	}
+	return Hash(v), nil
+}
+
+// grayscale scales img down to sampleSize x sampleSize by box averaging and
+// returns its luminance.
+func grayscale(img image.Image) [][]float64 {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	pixels := make([][]float64, sampleSize)
+	for y := 0; y < sampleSize; y++ {
+		pixels[y] = make([]float64, sampleSize)
+		y0 := bounds.Min.Y + y*h/sampleSize
+		y1 := bounds.Min.Y + (y+1)*h/sampleSize
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < sampleSize; x++ {
+			x0 := bounds.Min.X + x*w/sampleSize
+			x1 := bounds.Min.X + (x+1)*w/sampleSize
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var sum float64
+			var n int
+			for py := y0; py < y1; py++ {
+				for px := x0; px < x1; px++ {
+					r, g, b, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+					n++
+				}
+			}
+			pixels[y][x] = sum / float64(n)
+		}
+	}
+	return pixels
+}
+
+func dct2D(pixels [][]float64) [][]float64 {
+	n := len(pixels)
+	rows := make([][]float64, n)
+	for y := 0; y < n; y++ {
+		rows[y] = dct1D(pixels[y])
+	}
+	result := make([][]float64, n)
+	for y := range result {
+		result[y] = make([]float64, n)
+	}
+	col := make([]float64, n)
+	for x := 0; x < n; x++ {
+		for y := 0; y < n; y++ {
+			col[y] = rows[y][x]
+		}
+		transformed := dct1D(col)
+		for y := 0; y < n; y++ {
+			result[y][x] = transformed[y]
+		}
+	}
+	return result
+}
+
+func dct1D(values []float64) []float64 {
+	n := len(values)
+	result := make([]float64, n)
+	for k := 0; k < n; k++ {
+		var sum float64
+		for i, v := range values {
+			sum += v * math.Cos(math.Pi/float64(n)*(float64(i)+0.5)*float64(k))
+		}
+		result[k] = sum
+	}
+	return result
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
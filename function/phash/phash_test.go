@@ -0,0 +1,147 @@
+package phash
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// scene draws a picture of size w x h: a diagonal gradient with a dark
+// square whose position is given as a fraction of the size.
+func scene(w, h int, squareX, squareY float64) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x*255/w + y*255/h) / 2)
+			img.Set(x, y, color.RGBA{v, v, 255 - v, 255})
+		}
+	}
+	x0, y0 := int(squareX*float64(w)), int(squareY*float64(h))
+	for y := y0; y < y0+h/4; y++ {
+		for x := x0; x < x0+w/4; x++ {
+			img.Set(x, y, color.RGBA{20, 20, 20, 255})
+		}
+	}
+	return img
+}
+
+func stripes(w, h int) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if (x/(w/8))%2 == 0 {
+				img.SetGray(x, y, color.Gray{255})
+			}
+		}
+	}
+	return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image, quality int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDistance(t *testing.T) {
+	original := encodePNG(t, scene(320, 240, 0.2, 0.3))
+	tests := []struct {
+		name    string
+		other   []byte
+		similar bool
+	}{
+		{"same bytes", original, true},
+		{"recompressed", encodeJPEG(t, scene(320, 240, 0.2, 0.3), 40), true},
+		{"scaled down", encodePNG(t, scene(160, 120, 0.2, 0.3)), true},
+		{"scaled up", encodeJPEG(t, scene(1024, 768, 0.2, 0.3), 90), true},
+		{"moved square", encodePNG(t, scene(320, 240, 0.7, 0.6)), false},
+		{"other picture", encodePNG(t, stripes(320, 240)), false},
+	}
+	a, err := FromBytes(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := FromBytes(tt.other)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := Distance(a, b)
+			if similar := d <= 6; similar != tt.similar {
+				t.Errorf("distance %d, similar %v, want %v", d, similar, tt.similar)
+			}
+		})
+	}
+}
+
+func TestDistanceBits(t *testing.T) {
+	tests := []struct {
+		a, b Hash
+		want int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0xff, 0x0f, 4},
+		{0, ^Hash(0), 64},
+	}
+	for _, tt := range tests {
+		if got := Distance(tt.a, tt.b); got != tt.want {
+			t.Errorf("Distance(%v, %v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := Distance(tt.b, tt.a); got != tt.want {
+			t.Errorf("Distance(%v, %v) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Hash
+		wantErr bool
+	}{
+		{"0000000000000000", 0, false},
+		{"00000000000000ff", 0xff, false},
+		{"ffffffffffffffff", ^Hash(0), false},
+		{"", 0, true},
+		{"xyz", 0, true},
+		{"1ffffffffffffffff", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q) error %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("Parse(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+		if err == nil && got.String() != tt.in {
+			t.Errorf("Parse(%q).String() = %q", tt.in, got.String())
+		}
+	}
+}
+
+func TestFromBytesInvalid(t *testing.T) {
+	for _, b := range [][]byte{nil, []byte("not an image"), encodePNG(t, scene(8, 8, 0, 0))[:20]} {
+		if _, err := FromBytes(b); err == nil {
+			t.Errorf("FromBytes(%d bytes) succeeded", len(b))
+		}
+	}
+}
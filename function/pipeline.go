@@ -0,0 +1,360 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/translate"
+	vision "cloud.google.com/go/vision/apiv1"
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/costguard"
+	"github.com/hsmtkk/ubiquitous-couscous/function/exif"
+	"github.com/hsmtkk/ubiquitous-couscous/function/imageutil"
+	"github.com/hsmtkk/ubiquitous-couscous/function/knowledge"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/visionclient"
+	"github.com/hsmtkk/ubiquitous-couscous/function/workflow"
+	"golang.org/x/text/language"
+	visionpb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+//go:embed workflows.json
+var defaultWorkflows []byte
+
+// one DetectSafeSearch call is billed as one unit
+const safeSearchUnits = 1
+
+// pipelineState is what the workflow steps of process read and write.
+type pipelineState struct {
+	projectID        string
+	procMsg          processMessage
+	image            []byte
+	result           analysis.Result
+	summary          string
+	exif             *exif.Metadata
+	previouslySentAt time.Time
+	budgetExceeded   bool
+	unsafe           bool
+	safeSearched     bool
+	gameImageURL     string
+	translateTo      string
+	captioned        bool
+	// minScore is the lowest label confidence the user wants to see.
+	minScore float32
+	// archiveURL is set once archiveStep stored the image.
+	archiveURL string
+	// duplicateOf is the image ID of the earlier near-duplicate, if any.
+	duplicateOf string
+	// annotatedImageURL points to the image with object boxes drawn on it.
+	annotatedImageURL string
+	// imagemap is the tappable version of the annotated image.
+	imagemap *objectImagemap
+	// knowledge is the Knowledge Graph entity of the top label, if any.
+	knowledge *knowledge.Entity
+	// echo is set for users who want the image back with its labels on it.
+	echo bool
+	// funFact is set for users who want a fun fact about the top label,
+	// funFactText is the fact picked for them.
+	funFact     bool
+	funFactText string
+	// spam is set when spamStep dropped the image.
+	spam bool
+	// captionLength and captionStyle are what the user chose with /caption.
+	captionLength string
+	captionStyle  string
+}
+
+func (s *pipelineState) Condition(name string) bool {
+	switch name {
+	case "unsafe":
+		return s.unsafe
+	case "duplicate":
+		return !s.previouslySentAt.IsZero()
+	case "budgetExceeded":
+		return s.budgetExceeded
+	case "labels":
+		return len(s.result.Labels) > 0
+	case "exif":
+		return s.exif != nil
+	case "captioned":
+		return s.captioned
+	case "echo":
+		return s.echo
+	}
+	return false
+}
+
+func newPipeline() *workflow.Engine[*pipelineState] {
+	engine := workflow.NewEngine[*pipelineState]()
+	engine.OnStep = func(ctx context.Context, step workflow.Step) {
+		logging.Printf(ctx, "step: %s", step.Name)
+	}
+	engine.Register("download", downloadStep)
+	engine.Register("spam", spamStep)
+	engine.Register("exif", exifStep)
+	engine.Register("resize", resizeStep)
+	engine.Register("safesearch", safeSearchStep)
+	engine.Register("labels", labelsStep)
+	engine.Register("describe", describeStep)
+	engine.Register("caption", captionStep)
+	engine.Register("compare", compareStep)
+	engine.Register("diff", diffStep)
+	engine.Register("objects", objectsStep)
+	engine.Register("imagemap", imagemapStep)
+	engine.Register("echo", echoStep)
+	engine.Register("knowledge", knowledgeStep)
+	engine.Register("funfact", funFactStep)
+	engine.Register("translate", translateStep)
+	engine.Register("format", formatStep)
+	engine.Register("reject", rejectStep)
+	engine.Register("game", gameStep)
+	engine.Register("archive", archiveStep)
+	engine.Register("sheet", sheetStep)
+	return engine
+}
+
+// loadWorkflows reads the file named by WORKFLOW_FILE, falling back to the
+// embedded workflows.json.
+func loadWorkflows(engine *workflow.Engine[*pipelineState]) (workflow.Config, error) {
+	b := defaultWorkflows
+	if path := os.Getenv("WORKFLOW_FILE"); path != "" {
+		var err error
+		b, err = os.ReadFile(path)
+		if err != nil {
+			return workflow.Config{}, fmt.Errorf("os.ReadFile failed; %w", err)
+		}
+	}
+	cfg, err := workflow.ParseConfig(b)
+	if err != nil {
+		return workflow.Config{}, err
+	}
+	if err := engine.Validate(cfg); err != nil {
+		return workflow.Config{}, err
+	}
+	return cfg, nil
+}
+
+// downloadStep fetches the image from LINE, or the platform it came from,
+// unless the caller, like upload, already put it on the state.
+func downloadStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	image := state.image
+	if image == nil && state.procMsg.Destination != nil {
+		var err error
+		if image, err = downloadElsewhere(ctx, state.projectID, *state.procMsg.Destination, state.procMsg.ImageID); err != nil {
+			return err
+		}
+	}
+	if image == nil {
+		lineClient, err := newLineClient(ctx, state.projectID)
+		if err != nil {
+			return err
+		}
+		if state.procMsg.MediaType == mediaVideo {
+			image, err = downloadVideoFrame(ctx, lineClient, state.procMsg.ImageID)
+		} else {
+			image, err = downloadImage(ctx, lineClient, state.procMsg.ImageID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	converted, format, err := imageutil.Normalize(image)
+	if err != nil {
+		// a redelivery would download the same bytes again
+		logging.Errorf(ctx, "cannot read %s image; %v", format, err)
+		state.summary = "Sorry, this image format cannot be read."
+		return workflow.ErrStop
+	}
+	if format != imageutil.FormatJPEG {
+		logging.Printf(ctx, "image format: %s", format)
+	}
+	state.image = converted
+	return nil
+}
+
+func exifStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	state.exif = extractExif(ctx, state.image)
+	return nil
+}
+
+func resizeStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	maxSize, err := strconv.Atoi(params["maxSize"])
+	if err != nil {
+		return fmt.Errorf("invalid maxSize; %w", err)
+	}
+	img, _, err := imageutil.Decode(state.image)
+	if err != nil {
+		return err
+	}
+	resized := imageutil.Resize(img, maxSize)
+	if resized == img {
+		return nil
+	}
+	b, err := imageutil.EncodeJPEG(resized)
+	if err != nil {
+		return err
+	}
+	logging.Printf(ctx, "resized %d -> %d bytes", len(state.image), len(b))
+	state.image = b
+	return nil
+}
+
+func safeSearchStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	if err := reserveVision(ctx, state, safeSearchUnits); err != nil {
+		return err
+	}
+	client, err := visionclient.Default.Get(ctx)
+	if err != nil {
+		return err
+	}
+	image, err := vision.NewImageFromReader(bytes.NewReader(state.image))
+	if err != nil {
+		return fmt.Errorf("vision.NewImageFromReader failed; %w", err)
+	}
+	release, err := acquireVision(ctx)
+	if err != nil {
+		return err
+	}
+	annotation, err := client.DetectSafeSearch(ctx, image, nil)
+	release()
+	if err != nil {
+		return fmt.Errorf("vision.ImageAnnotatorClient.DetectSafeSearch failed; %w", err)
+	}
+	state.unsafe = annotation.GetAdult() >= visionpb.Likelihood_LIKELY || annotation.GetViolence() >= visionpb.Likelihood_LIKELY
+	state.safeSearched = true
+	state.result.AddFeature(analysis.FeatureSafeSearch)
+	state.result.SafeSearch = &analysis.SafeSearch{
+		Adult:    annotation.GetAdult().String(),
+		Violence: annotation.GetViolence().String(),
+		Racy:     annotation.GetRacy().String(),
+		Unsafe:   state.unsafe,
+	}
+	logging.Printf(ctx, "unsafe: %t", state.unsafe)
+	return nil
+}
+
+// ensureSafeSearch runs SafeSearch unless the workflow already did, for the
+// steps that store a copy of the image and must know whether it is unsafe.
+func ensureSafeSearch(ctx context.Context, state *pipelineState) error {
+	if state.safeSearched {
+		return nil
+	}
+	return safeSearchStep(ctx, state, nil)
+}
+
+func labelsStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	labels, duplicate, err := labelImage(ctx, state.projectID, state.procMsg.UserIDHash, state.procMsg.ImageID, state.image, state.minScore)
+	if err != nil {
+		return budgetStop(state, err)
+	}
+	state.result.AddFeature(analysis.FeatureLabels)
+	state.result.Labels = labels
+	if duplicate != nil {
+		state.previouslySentAt, state.duplicateOf = duplicate.CreatedAt, duplicate.ImageID
+	}
+	return nil
+}
+
+func describeStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	desc, err := describeImage(ctx, state.projectID, state.image)
+	if err != nil {
+		return budgetStop(state, err)
+	}
+	state.summary = desc.Summary
+	state.result.AddFeature(analysis.FeatureText)
+	state.result.AddFeature(analysis.FeatureColors)
+	state.result.TextBlocks = desc.TextBlocks
+	state.result.Colors = desc.Colors
+	offerTranslation(ctx, state, desc)
+	return nil
+}
+
+func translateStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	if len(state.result.Labels) == 0 {
+		return nil
+	}
+	names, err := translateTexts(ctx, state.result.LabelNames(), params["target"])
+	if err != nil {
+		return err
+	}
+	// the scores stay with their translated names
+	for i, name := range names {
+		state.result.Labels[i].Name = name
+	}
+	return nil
+}
+
+func translateTexts(ctx context.Context, texts []string, targetLanguage string) ([]string, error) {
+	target, err := language.Parse(targetLanguage)
+	if err != nil {
+		return nil, fmt.Errorf("language.Parse failed; %w", err)
+	}
+	client, err := translate.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("translate.NewClient failed; %w", err)
+	}
+	defer client.Close()
+	translations, err := client.Translate(ctx, texts, target, nil)
+	if err != nil {
+		return nil, fmt.Errorf("translate.Client.Translate failed; %w", err)
+	}
+	results := make([]string, len(translations))
+	for i, translation := range translations {
+		results[i] = translation.Text
+	}
+	return results, nil
+}
+
+// formatStep renders params["template"] over the labels and summary so far
+// into the reply text.
+func formatStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	tmpl, err := template.New("format").Parse(params["template"])
+	if err != nil {
+		return fmt.Errorf("template.Parse failed; %w", err)
+	}
+	var buf bytes.Buffer
+	data := struct {
+		Labels  []string
+		Summary string
+	}{state.result.LabelNames(), state.summary}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return fmt.Errorf("template.Execute failed; %w", err)
+	}
+	state.summary = buf.String()
+	return nil
+}
+
+func rejectStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	state.summary = params["text"]
+	return workflow.ErrStop
+}
+
+func reserveVision(ctx context.Context, state *pipelineState, units int64) error {
+	budget, err := visionDailyBudget(ctx)
+	if err != nil {
+		return err
+	}
+	client, err := clients.Firestore(ctx, state.projectID)
+	if err != nil {
+		return err
+	}
+	return budgetStop(state, costguard.New(client, budget).Reserve(ctx, units))
+}
+
+// budgetStop turns costguard.ErrBudgetExceeded into the end of the workflow
+// so that the user is told about the limit instead of the event failing.
+func budgetStop(state *pipelineState, err error) error {
+	if errors.Is(err, costguard.ErrBudgetExceeded) {
+		state.budgetExceeded = true
+		return workflow.ErrStop
+	}
+	return err
+}
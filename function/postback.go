@@ -0,0 +1,133 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/hsmtkk/ubiquitous-couscous/function/decode"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/postback"
+	"github.com/hsmtkk/ubiquitous-couscous/function/queue"
+	"github.com/hsmtkk/ubiquitous-couscous/function/redact"
+)
+
+const actionDescribe = "describe"
+
+type postbackMessage struct {
+	CorrelationID string
+	UserIDHash    string
+	GroupIDHash   string
+	ReplyToken    string
+	Data          string
+	Tenant        string `json:",omitempty"`
+}
+
+func (m postbackMessage) Validate() []decode.FieldError {
+	return append(decode.Required("ReplyToken", m.ReplyToken), decode.Required("Data", m.Data)...)
+}
+
+func handlePostback(ctx context.Context, evt event.Event) error {
+	ctx = logging.With(ctx, logging.Fields{Function: "postback"})
+	logging.Printf(ctx, "postback")
+
+	var subMsg messagePublishedData
+	if err := evt.DataAs(&subMsg); err != nil {
+		return fmt.Errorf("event.Event.DataAs failed; %w", err)
+	}
+	logging.Debugf(ctx, "request: %s", redact.JSON(redact.ModeFromEnv(), subMsg.Message.Data))
+	return postbackData(queue.WithAttributes(ctx, subMsg.Message.Attributes), subMsg.Message.Data)
+}
+
+func postbackData(ctx context.Context, data []byte) (err error) {
+	defer func() { recordOutcome(ctx, "postback", err) }()
+
+	var pbMsg postbackMessage
+	if ok, err := decodePayload(ctx, "postback", data, &pbMsg); !ok {
+		return err
+	}
+	ctx = logging.With(ctx, logging.Fields{CorrelationID: pbMsg.CorrelationID, UserIDHash: pbMsg.UserIDHash})
+	if ctx, err = withTenant(ctx, pbMsg.Tenant); err != nil {
+		// retrying cannot bring the tenant back
+		logging.Errorf(ctx, "drop message; %v", err)
+		return nil
+	}
+	projectID := projectIDOf(ctx)
+
+	codec, err := newPostbackCodec(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	payload, err := codec.Decode(pbMsg.Data)
+	if err != nil {
+		// retrying cannot fix forged or stale data
+		logging.Errorf(ctx, "drop postback; %v", err)
+		return nil
+	}
+	logging.Printf(ctx, "postback action: %s", payload.Action)
+	if variant := payload.Param("variant"); variant != "" {
+		recordExperiment(ctx, variant, true)
+	}
+
+	pbEvt := postback.Event{CorrelationID: pbMsg.CorrelationID, UserIDHash: pbMsg.UserIDHash, GroupIDHash: pbMsg.GroupIDHash, ReplyToken: pbMsg.ReplyToken}
+	if err := postbackRouter().Dispatch(ctx, pbEvt, payload); err != nil {
+		if errors.Is(err, postback.ErrUnknownAction) {
+			logging.Errorf(ctx, "drop postback; %v", err)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// buttons older than this are rejected rather than acted on
+const defaultPostbackMaxAge = 7 * 24 * time.Hour
+
+// postbackMaxAge is POSTBACK_MAX_AGE_HOURS, 7 days by default.
+func postbackMaxAge(ctx context.Context) time.Duration {
+	if n, err := strconv.Atoi(dynconfig.Get(ctx, "POSTBACK_MAX_AGE_HOURS")); err == nil && n > 0 {
+		return time.Duration(n) * time.Hour
+	}
+	return defaultPostbackMaxAge
+}
+
+func newPostbackCodec(ctx context.Context, projectID string) (*postback.Codec, error) {
+	key, err := getSecret(ctx, projectID, "postback-key")
+	if err != nil {
+		return nil, err
+	}
+	return postback.NewCodec([]byte(key), postbackMaxAge(ctx)), nil
+}
+
+func postbackRouter() *postback.Router {
+	router := postback.NewRouter()
+	router.Handle(actionDescribe, describeAction)
+	router.Handle(actionExifLocation, exifLocationAction)
+	router.Handle(actionGameReveal, gameRevealAction)
+	router.Handle(actionTranslate, translateAction)
+	router.Handle(actionConsent, consentAction)
+	router.Handle(actionDeleteData, deleteDataAction)
+	return router
+}
+
+// describeAction sends the image back through process in describe mode,
+// answering with the postback's own reply token.
+func describeAction(ctx context.Context, evt postback.Event, payload postback.Payload) error {
+	imageID := payload.Param("imageId")
+	if imageID == "" {
+		return fmt.Errorf("describe postback without imageId")
+	}
+	msg := processMessage{
+		CorrelationID: evt.CorrelationID,
+		UserIDHash:    evt.UserIDHash,
+		ImageID:       imageID,
+		ReplyToken:    evt.ReplyToken,
+		Mode:          modeDescribe,
+	}
+	_, err := publishProcessMessage(ctx, msg)
+	return err
+}
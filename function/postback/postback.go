@@ -0,0 +1,156 @@
+package postback
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	version = "v1"
+	// LINE rejects postback data longer than this
+	maxDataLength = 300
+	macLength     = 16
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported postback version")
+	ErrInvalidSignature   = errors.New("invalid postback signature")
+	ErrUnknownAction      = errors.New("unknown postback action")
+	ErrExpired            = errors.New("postback data expired")
+)
+
+// clockSkew is how far ahead of this instance another may have issued data.
+const clockSkew = time.Minute
+
+// Payload is the structured data carried by a postback action. Keys are
+// kept short because the encoded form must fit in 300 characters.
+type Payload struct {
+	Action   string            `json:"a"`
+	Params   map[string]string `json:"p,omitempty"`
+	IssuedAt int64             `json:"t"`
+}
+
+func (p Payload) Param(key string) string {
+	return p.Params[key]
+}
+
+// Codec encodes payloads as "v1.<base64 JSON>.<base64 HMAC>" so that data
+// coming back from LINE can be trusted not to have been forged. Decode
+// rejects data issued more than maxAge ago; zero means no limit.
+type Codec struct {
+	key    []byte
+	maxAge time.Duration
+}
+
+func NewCodec(key []byte, maxAge time.Duration) *Codec {
+	return &Codec{key: key, maxAge: maxAge}
+}
+
+func (c *Codec) Encode(action string, params map[string]string) (string, error) {
+	payload := Payload{Action: action, Params: params, IssuedAt: time.Now().Unix()}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal failed; %w", err)
+	}
+	encodedBody := base64.RawURLEncoding.EncodeToString(body)
+	data := version + "." + encodedBody + "." + base64.RawURLEncoding.EncodeToString(c.mac(version, encodedBody))
+	if len(data) > maxDataLength {
+		return "", fmt.Errorf("postback data too long; %d > %d", len(data), maxDataLength)
+	}
+	return data, nil
+}
+
+func (c *Codec) Decode(data string) (Payload, error) {
+	parts := strings.Split(data, ".")
+	if len(parts) != 3 {
+		return Payload{}, fmt.Errorf("malformed postback data")
+	}
+	if parts[0] != version {
+		return Payload{}, fmt.Errorf("%w; %s", ErrUnsupportedVersion, parts[0])
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(mac, c.mac(parts[0], parts[1])) {
+		return Payload{}, ErrInvalidSignature
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Payload{}, fmt.Errorf("base64.Encoding.DecodeString failed; %w", err)
+	}
+	var payload Payload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return Payload{}, fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	if c.maxAge > 0 {
+		if err := checkAge(payload, c.maxAge, time.Now()); err != nil {
+			return Payload{}, err
+		}
+	}
+	return payload, nil
+}
+
+// DecodeAction is Decode for data that must carry action and have been
+// issued within maxAge of now, such as an OAuth state or a session.
+func (c *Codec) DecodeAction(data, action string, maxAge time.Duration, now time.Time) (Payload, error) {
+	payload, err := c.Decode(data)
+	if err != nil {
+		return Payload{}, err
+	}
+	if payload.Action != action {
+		return Payload{}, fmt.Errorf("%w; %s", ErrUnknownAction, payload.Action)
+	}
+	if err := checkAge(payload, maxAge, now); err != nil {
+		return Payload{}, err
+	}
+	return payload, nil
+}
+
+func checkAge(payload Payload, maxAge time.Duration, now time.Time) error {
+	if age := now.Sub(time.Unix(payload.IssuedAt, 0)); age < -clockSkew || age > maxAge {
+		return fmt.Errorf("%w; issued %s ago", ErrExpired, age.Round(time.Second))
+	}
+	return nil
+}
+
+func (c *Codec) mac(version, encodedBody string) []byte {
+	h := hmac.New(sha256.New, c.key)
+	h.Write([]byte(version + "." + encodedBody))
+	return h.Sum(nil)[:macLength]
+}
+
+// Event is what an action handler gets to know about the postback.
+type Event struct {
+	CorrelationID string
+	UserIDHash    string
+	// GroupIDHash is set for postbacks from group chats.
+	GroupIDHash string
+	ReplyToken  string
+}
+
+type Handler func(ctx context.Context, evt Event, payload Payload) error
+
+type Router struct {
+	handlers map[string]Handler
+}
+
+func NewRouter() *Router {
+	return &Router{handlers: map[string]Handler{}}
+}
+
+func (r *Router) Handle(action string, handler Handler) {
+	r.handlers[action] = handler
+}
+
+func (r *Router) Dispatch(ctx context.Context, evt Event, payload Payload) error {
+	handler, ok := r.handlers[payload.Action]
+	if !ok {
+		return fmt.Errorf("%w; %s", ErrUnknownAction, payload.Action)
+	}
+	return handler(ctx, evt, payload)
+}
@@ -0,0 +1,76 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// userPreferences live on the users/{userIdHash} document.
+type userPreferences struct {
+	ExifLocation bool `firestore:"exifLocation"`
+	// Language is the base language the user reads, DEFAULT_LANGUAGE when unset.
+	Language string `firestore:"language"`
+	// DebugTiming appends the pipeline stage timings to replies.
+	DebugTiming bool `firestore:"debugTiming"`
+	// Persona names the tone of the replies, see the persona package.
+	Persona string `firestore:"persona"`
+	// MinScore is the lowest label confidence shown, LABEL_MIN_SCORE when 0.
+	MinScore float64 `firestore:"minScore"`
+	// Emoji replies with emojis for the labels instead of text.
+	Emoji bool `firestore:"emoji"`
+	// Echo replies with the image itself, its top labels written on it.
+	Echo bool `firestore:"echo"`
+	// FunFact appends a fun fact about the top label when FUN_FACTS is on.
+	FunFact bool `firestore:"funFact"`
+	// CaptionLength and CaptionStyle shape the captions of the caption mode,
+	// see captionLengths and captionStyles.
+	CaptionLength string `firestore:"captionLength"`
+	CaptionStyle  string `firestore:"captionStyle"`
+	// Consent is the answer to the privacy notice, consentAccepted or
+	// consentDeclined; empty until the user decided.
+	Consent        string    `firestore:"consent"`
+	ConsentAskedAt time.Time `firestore:"consentAskedAt"`
+	// Following is false once the user blocked the bot.
+	Following bool `firestore:"following"`
+}
+
+func loadPreferences(ctx context.Context, client *firestore.Client, userIDHash string) (userPreferences, error) {
+	var prefs userPreferences
+	snap, err := client.Collection(namespace.Collection("users")).Doc(userIDHash).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return prefs, nil
+	}
+	if err != nil {
+		return prefs, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	if err := snap.DataTo(&prefs); err != nil {
+		return prefs, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+	}
+	return prefs, nil
+}
+
+func savePreference(ctx context.Context, client *firestore.Client, userIDHash, field string, value interface{}) error {
+	if _, err := client.Collection(namespace.Collection("users")).Doc(userIDHash).Set(ctx, map[string]interface{}{field: value}, firestore.MergeAll); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	return nil
+}
+
+// preferencesOf loads the preferences through the shared client.
+func preferencesOf(ctx context.Context, projectID, userIDHash string) (userPreferences, error) {
+	if userIDHash == "" {
+		return userPreferences{}, nil
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return userPreferences{}, err
+	}
+	return loadPreferences(ctx, client, userIDHash)
+}
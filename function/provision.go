@@ -0,0 +1,151 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/queue"
+	"google.golang.org/api/googleapi"
+	pubsubapi "google.golang.org/api/pubsub/v1"
+)
+
+const (
+	provisionTimeout        = 30 * time.Second
+	defaultProvisionAckSecs = 60
+)
+
+// pipelineTopicEnvs name the topics the functions publish to or are
+// triggered by. Topics of tenants are not checked; they are named in the
+// tenant configuration, which is only read per request.
+var pipelineTopicEnvs = []string{
+	"WAIT_PROCESS_TOPIC",
+	"WAIT_SEND_TOPIC",
+	"WAIT_POSTBACK_TOPIC",
+	"WAIT_GUESS_TOPIC",
+	"WAIT_BEACON_TOPIC",
+	"OVERFLOW_TOPIC",
+	"QUARANTINE_TOPIC",
+	"DEAD_LETTER_TOPIC",
+}
+
+// pullTopicEnvs are the topics subscribePipeline pulls from with
+// PUBSUB_PULL=true, each through the subscription named after it with a
+// "-pull" suffix.
+var pullTopicEnvs = []string{
+	"WAIT_PROCESS_TOPIC",
+	"WAIT_SEND_TOPIC",
+	"WAIT_POSTBACK_TOPIC",
+	"WAIT_GUESS_TOPIC",
+	"WAIT_BEACON_TOPIC",
+}
+
+// checkPubSubAtStartup is a no-op unless STARTUP_CHECK or AUTO_PROVISION is
+// true; it then checks the configured topics and pull subscriptions exist,
+// creating those missing with AUTO_PROVISION=true, and exits when any is
+// missing so that the instance fails at cold start rather than on the first
+// publish.
+func checkPubSubAtStartup() {
+	autoProvision := os.Getenv("AUTO_PROVISION") == "true"
+	if os.Getenv("STARTUP_CHECK") != "true" && !autoProvision {
+		return
+	}
+	if queue.ConfigFromEnv().Backend != queue.BackendPubSub {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), provisionTimeout)
+	defer cancel()
+	if err := provisionPubSub(ctx, os.Getenv("PROJECT_ID"), autoProvision); err != nil {
+		logging.Errorf(ctx, "pubsub startup check failed; %v", err)
+		os.Exit(1)
+	}
+}
+
+// provisionPubSub returns every missing topic and subscription at once, each
+// with the variable that names it.
+func provisionPubSub(ctx context.Context, projectID string, create bool) error {
+	client, err := clients.PubSub(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	problems := []string{}
+	for _, env := range pipelineTopicEnvs {
+		name := os.Getenv(env)
+		if name == "" {
+			continue
+		}
+		topicID := namespace.Topic(name)
+		err := topicExists(ctx, client, topicID)
+		if err == nil {
+			continue
+		}
+		hint := "create it or set AUTO_PROVISION=true"
+		if create {
+			if _, err = client.CreateTopic(ctx, topicID); err == nil {
+				logging.Printf(ctx, "created topic %s", topicID)
+				continue
+			}
+			err = fmt.Errorf("pubsub.Client.CreateTopic failed; %w", err)
+			hint = "grant roles/pubsub.editor to the service account or create it"
+		}
+		problems = append(problems, fmt.Sprintf("topic %s (%s): %v; %s", topicID, env, err, hint))
+	}
+	if os.Getenv("PUBSUB_PULL") == "true" {
+		for _, env := range pullTopicEnvs {
+			name := os.Getenv(env)
+			if name == "" {
+				continue
+			}
+			topicID := namespace.Topic(name)
+			if err := provisionSubscription(ctx, projectID, topicID, topicID+"-pull", create); err != nil {
+				problems = append(problems, fmt.Sprintf("subscription %s-pull (%s): %v", topicID, env, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// provisionSubscription creates a missing pull subscription with
+// PROVISION_ACK_DEADLINE_SECONDS, through the REST API.
+func provisionSubscription(ctx context.Context, projectID, topicID, subscriptionID string, create bool) error {
+	service, err := pubsubapi.NewService(ctx)
+	if err != nil {
+		return fmt.Errorf("pubsub.NewService failed; %w", err)
+	}
+	name := fmt.Sprintf("projects/%s/subscriptions/%s", projectID, subscriptionID)
+	_, err = service.Projects.Subscriptions.Get(name).Context(ctx).Do()
+	if err == nil {
+		return nil
+	}
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+		return fmt.Errorf("pubsub.ProjectsSubscriptionsGetCall.Do failed; %w", err)
+	}
+	if !create {
+		return fmt.Errorf("not found; create it or set AUTO_PROVISION=true")
+	}
+	ackDeadline := defaultProvisionAckSecs
+	if n, err := strconv.Atoi(os.Getenv("PROVISION_ACK_DEADLINE_SECONDS")); err == nil && n >= 10 && n <= 600 {
+		ackDeadline = n
+	}
+	sub := &pubsubapi.Subscription{
+		Topic:              fmt.Sprintf("projects/%s/topics/%s", projectID, topicID),
+		AckDeadlineSeconds: int64(ackDeadline),
+	}
+	if _, err := service.Projects.Subscriptions.Create(name, sub).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("pubsub.ProjectsSubscriptionsCreateCall.Do failed; %w; grant roles/pubsub.editor to the service account or create it", err)
+	}
+	logging.Printf(ctx, "created subscription %s", subscriptionID)
+	return nil
+}
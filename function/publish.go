@@ -0,0 +1,51 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/backpressure"
+	"github.com/hsmtkk/ubiquitous-couscous/function/jsoncodec"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/queue"
+	"github.com/hsmtkk/ubiquitous-couscous/function/topics"
+)
+
+// publishProcessMessage hands msg to process through WAIT_PROCESS_TOPIC, or
+// the topic of the tenant.
+func publishProcessMessage(ctx context.Context, msg processMessage) (string, error) {
+	return publishPipeline(ctx, processTopic, msg.CorrelationID, msg)
+}
+
+// publishSendMessage hands msg to send through WAIT_SEND_TOPIC, or the topic
+// of the tenant.
+func publishSendMessage(ctx context.Context, msg sendMessage) (string, error) {
+	return publishPipeline(ctx, sendTopic, msg.CorrelationID, msg)
+}
+
+// publishReceived is publishPipeline for receive, whose messages go to the
+// topic of their event type and are buffered in the outbox when the queue
+// is unavailable. q is nil when it could not be opened.
+func publishReceived(ctx context.Context, q queue.Queue, topic, correlationID string, msg interface{}) error {
+	data, err := jsoncodec.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("jsoncodec.Marshal failed; %w", err)
+	}
+	// the outbox stays with the deployment, whose drainOutbox empties it
+	return publishOrBuffer(ctx, q, os.Getenv("PROJECT_ID"), topic, data, envelope(ctx, correlationID))
+}
+
+// publishPipeline publishes msg in the pipeline envelope and feeds the
+// publish latency to the backpressure signal.
+func publishPipeline[T any](ctx context.Context, topic topics.Topic[T], correlationID string, msg T) (string, error) {
+	start := time.Now()
+	id, err := topic.PublishAttributes(ctx, msg, envelope(ctx, correlationID))
+	backpressure.Default.ObservePublish(time.Since(start))
+	if err != nil {
+		return "", fmt.Errorf("publish to %s failed; %w", topic.NameFor(ctx), err)
+	}
+	logging.Printf(ctx, "publish: %s", id)
+	return id, nil
+}
@@ -0,0 +1,82 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/auth"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/queue"
+)
+
+// pushRequest is the body Pub/Sub POSTs to a push subscription endpoint.
+type pushRequest struct {
+	Message      pushMessage `json:"message"`
+	Subscription string      `json:"subscription"`
+}
+
+type pushMessage struct {
+	Data       []byte            `json:"data"`
+	MessageID  string            `json:"messageId"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+func processPush(w http.ResponseWriter, r *http.Request) {
+	handlePush(w, r, "processPush", processWithRetries)
+}
+
+func sendPush(w http.ResponseWriter, r *http.Request) {
+	handlePush(w, r, "sendPush", sendWithRetries)
+}
+
+func handlePush(w http.ResponseWriter, r *http.Request, name string, handle func(ctx context.Context, data []byte) error) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: name})
+	logging.Printf(ctx, "%s", name)
+	if err := validatePushToken(r); err != nil {
+		returnError(ctx, w, http.StatusUnauthorized, err)
+		return
+	}
+
+	reqBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	var pushReq pushRequest
+	if err := json.Unmarshal(reqBody, &pushReq); err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	logging.Printf(ctx, "subscription: %s", pushReq.Subscription)
+	logging.Printf(ctx, "message ID: %s", pushReq.Message.MessageID)
+
+	ctx = queue.WithAttributes(ctx, pushReq.Message.Attributes)
+	// any non 2xx status makes Pub/Sub redeliver the message
+	if err := handle(ctx, pushReq.Message.Data); err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validatePushToken checks the OIDC token Pub/Sub attaches to push requests.
+// PUSH_AUDIENCE must match the audience configured on the subscription and
+// PUSH_SERVICE_ACCOUNT, when set, restricts which service account may push.
+// Without PUSH_AUDIENCE every request is refused, since an empty audience
+// would accept a token minted for any service.
+func validatePushToken(r *http.Request) error {
+	audience := os.Getenv("PUSH_AUDIENCE")
+	if audience == "" {
+		return fmt.Errorf("PUSH_AUDIENCE is not set")
+	}
+	cfg := auth.Config{Audience: audience}
+	if serviceAccount := os.Getenv("PUSH_SERVICE_ACCOUNT"); serviceAccount != "" {
+		cfg.Principals = []string{serviceAccount}
+	}
+	_, err := auth.Validate(r.Context(), r, cfg)
+	return err
+}
@@ -0,0 +1,58 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/decode"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/queue"
+	"github.com/hsmtkk/ubiquitous-couscous/function/topics"
+)
+
+type quarantineMessage struct {
+	Function string
+	Error    string
+	Fields   []decode.FieldError
+	Payload  []byte
+	At       time.Time
+}
+
+var quarantineTopic = topics.New[quarantineMessage]("QUARANTINE_TOPIC")
+
+// decodePayload decodes a pipeline message with decode.JSON. Invalid
+// payloads go to QUARANTINE_TOPIC, or only to the log without one, and are
+// then acknowledged since redelivery cannot fix them: ok is false, err nil.
+// So are messages whose envelope has a version this code does not know;
+// messages without one predate the envelope.
+func decodePayload(ctx context.Context, function string, data []byte, v interface{}) (ok bool, err error) {
+	if version := queue.AttributesFrom(ctx)[topics.AttrVersion]; version != "" && version != topics.Version {
+		return false, quarantine(ctx, function, data, fmt.Errorf("unsupported envelope version %q", version), nil)
+	}
+	err = decode.JSON(data, v)
+	if err == nil {
+		return true, nil
+	}
+	var decodeErr *decode.Error
+	if !errors.As(err, &decodeErr) {
+		return false, err
+	}
+	return false, quarantine(ctx, function, data, err, decodeErr.Fields)
+}
+
+func quarantine(ctx context.Context, function string, data []byte, cause error, fields []decode.FieldError) error {
+	logging.Errorf(ctx, "quarantine %s payload; %v", function, cause)
+	if os.Getenv("QUARANTINE_TOPIC") == "" {
+		return nil
+	}
+	msg := quarantineMessage{Function: function, Error: cause.Error(), Fields: fields, Payload: data, At: time.Now()}
+	id, err := quarantineTopic.Publish(ctx, msg)
+	if err != nil {
+		return err
+	}
+	logging.Printf(ctx, "quarantine: %s", id)
+	return nil
+}
@@ -0,0 +1,63 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+var sharedMemory = NewMemory()
+
+// Memory delivers messages synchronously to the handlers subscribed in this
+// process and keeps every published message for inspection.
+type Memory struct {
+	mu        sync.Mutex
+	seq       int
+	handlers  map[string][]Handler
+	published map[string][][]byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{handlers: map[string][]Handler{}, published: map[string][][]byte{}}
+}
+
+func (q *Memory) Publish(ctx context.Context, topic string, data []byte) (string, error) {
+	return q.PublishAttributes(ctx, topic, data, nil)
+}
+
+// PublishAttributes hands attrs to the handlers; Published keeps the data
+// only.
+func (q *Memory) PublishAttributes(ctx context.Context, topic string, data []byte, attrs map[string]string) (string, error) {
+	q.mu.Lock()
+	q.seq++
+	id := fmt.Sprintf("%d", q.seq)
+	q.published[topic] = append(q.published[topic], data)
+	handlers := append([]Handler(nil), q.handlers[topic]...)
+	q.mu.Unlock()
+
+	ctx = WithAttributes(ctx, attrs)
+	for _, handler := range handlers {
+		if err := handler(ctx, data); err != nil {
+			return "", fmt.Errorf("handle %s failed; %w", topic, err)
+		}
+	}
+	return id, nil
+}
+
+func (q *Memory) Subscribe(ctx context.Context, topic string, handler Handler) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[topic] = append(q.handlers[topic], handler)
+	return nil
+}
+
+func (q *Memory) Published(topic string) [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([][]byte(nil), q.published[topic]...)
+}
+
+// Close is a no-op; the memory queue lives as long as the process.
+func (q *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,68 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/nats-io/nats.go"
+)
+
+type natsQueue struct {
+	conn *nats.Conn
+}
+
+func newNATS(url string) (*natsQueue, error) {
+	if url == "" {
+		url = nats.DefaultURL
+	}
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, fmt.Errorf("nats.Connect failed; %w", err)
+	}
+	return &natsQueue{conn: conn}, nil
+}
+
+// Publish waits for the server to acknowledge the flush so that an error is
+// reported the same way a failed Pub/Sub publish is.
+func (q *natsQueue) Publish(ctx context.Context, topic string, data []byte) (string, error) {
+	return q.PublishAttributes(ctx, topic, data, nil)
+}
+
+// PublishAttributes carries the attributes as message headers.
+func (q *natsQueue) PublishAttributes(ctx context.Context, topic string, data []byte, attrs map[string]string) (string, error) {
+	msg := nats.NewMsg(topic)
+	msg.Data = data
+	for k, v := range attrs {
+		msg.Header.Set(k, v)
+	}
+	if err := q.conn.PublishMsg(msg); err != nil {
+		return "", fmt.Errorf("nats.Conn.PublishMsg failed; %w", err)
+	}
+	if err := q.conn.FlushWithContext(ctx); err != nil {
+		return "", fmt.Errorf("nats.Conn.FlushWithContext failed; %w", err)
+	}
+	return "", nil
+}
+
+// Subscribe joins a queue group named after the topic so that each message
+// is handled by one subscriber only, like a Pub/Sub subscription.
+func (q *natsQueue) Subscribe(ctx context.Context, topic string, handler Handler) error {
+	_, err := q.conn.QueueSubscribe(topic, topic, func(msg *nats.Msg) {
+		attrs := map[string]string{}
+		for k := range msg.Header {
+			attrs[k] = msg.Header.Get(k)
+		}
+		if err := handler(WithAttributes(ctx, attrs), msg.Data); err != nil {
+			logging.Errorf(ctx, "handle %s failed; %v", topic, err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("nats.Conn.QueueSubscribe failed; %w", err)
+	}
+	return nil
+}
+
+func (q *natsQueue) Close() error {
+	return q.conn.Drain()
+}
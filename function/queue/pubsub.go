@@ -0,0 +1,86 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"google.golang.org/api/option"
+)
+
+type pubSubQueue struct {
+	client *pubsub.Client
+	mu     sync.Mutex
+	topics map[string]*pubsub.Topic
+}
+
+func newPubSub(ctx context.Context, projectID string, opts ...option.ClientOption) (*pubSubQueue, error) {
+	client, err := pubsub.NewClient(ctx, projectID, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub.NewClient failed; %w", err)
+	}
+	return &pubSubQueue{client: client, topics: map[string]*pubsub.Topic{}}, nil
+}
+
+func (q *pubSubQueue) topic(id string) *pubsub.Topic {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t, ok := q.topics[id]
+	if !ok {
+		t = q.client.Topic(id)
+		// pipeline messages are published one at a time and a user waits
+		// for each; do not hold them back for batching
+		t.PublishSettings.CountThreshold = 1
+		t.PublishSettings.DelayThreshold = time.Millisecond
+		q.topics[id] = t
+	}
+	return t
+}
+
+func (q *pubSubQueue) Publish(ctx context.Context, topic string, data []byte) (string, error) {
+	return q.PublishAttributes(ctx, topic, data, nil)
+}
+
+func (q *pubSubQueue) PublishAttributes(ctx context.Context, topic string, data []byte, attrs map[string]string) (string, error) {
+	result := q.topic(topic).Publish(ctx, &pubsub.Message{Data: data, Attributes: attrs})
+	id, err := result.Get(ctx)
+	if err != nil {
+		return "", fmt.Errorf("pubsub.PublishResult.Get failed; %w", err)
+	}
+	return id, nil
+}
+
+// Subscribe pulls from the subscription named after the topic with a
+// "-pull" suffix, for running the pipeline as workers instead of behind
+// Eventarc. A message is acked only after handler returned nil and nacked
+// otherwise. The client library in use does not confirm acks, so delivery
+// stays at-least-once and handlers skip redeliveries by completion markers.
+func (q *pubSubQueue) Subscribe(ctx context.Context, topic string, handler Handler) error {
+	sub := q.client.Subscription(topic + "-pull")
+	go func() {
+		err := sub.Receive(context.Background(), func(msgCtx context.Context, msg *pubsub.Message) {
+			if err := handler(WithAttributes(msgCtx, msg.Attributes), msg.Data); err != nil {
+				logging.Errorf(msgCtx, "handle %s failed; %v", topic, err)
+				msg.Nack()
+				return
+			}
+			msg.Ack()
+		})
+		if err != nil {
+			logging.Errorf(ctx, "pubsub.Subscription.Receive failed; %v", err)
+		}
+	}()
+	return nil
+}
+
+func (q *pubSubQueue) Close() error {
+	q.mu.Lock()
+	for _, t := range q.topics {
+		t.Stop()
+	}
+	q.mu.Unlock()
+	return q.client.Close()
+}
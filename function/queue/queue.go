@@ -0,0 +1,103 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/api/option"
+)
+
+const (
+	BackendPubSub = "pubsub"
+	BackendNATS   = "nats"
+	BackendMemory = "memory"
+)
+
+// Queue carries pipeline messages between the functions.
+type Queue interface {
+	// Publish returns the ID assigned by the backend, if it has one.
+	Publish(ctx context.Context, topic string, data []byte) (string, error)
+	Close() error
+}
+
+// Subscriber is implemented by backends that deliver messages to handlers
+// in this process. Pub/Sub usually delivers through Eventarc instead and
+// pulls only for workers started with PUBSUB_PULL.
+type Subscriber interface {
+	Subscribe(ctx context.Context, topic string, handler Handler) error
+}
+
+type Handler func(ctx context.Context, data []byte) error
+
+type Config struct {
+	Backend   string
+	ProjectID string
+	NATSURL   string
+	// ClientOptions go to the Pub/Sub client.
+	ClientOptions []option.ClientOption
+}
+
+func ConfigFromEnv() Config {
+	cfg := Config{
+		Backend:   os.Getenv("QUEUE_BACKEND"),
+		ProjectID: os.Getenv("PROJECT_ID"),
+		NATSURL:   os.Getenv("NATS_URL"),
+	}
+	if cfg.Backend == "" {
+		cfg.Backend = BackendPubSub
+	}
+	return cfg
+}
+
+// Open returns the queue of cfg.Backend, which puts the NAMESPACE in front
+// of every topic it is given.
+func Open(ctx context.Context, cfg Config) (Queue, error) {
+	q, err := open(ctx, cfg)
+	if err != nil || namespace.Current() == "" {
+		return q, err
+	}
+	return namespaced{q}, nil
+}
+
+func open(ctx context.Context, cfg Config) (Queue, error) {
+	switch cfg.Backend {
+	case BackendPubSub:
+		q, err := newPubSub(ctx, cfg.ProjectID, cfg.ClientOptions...)
+		if err != nil {
+			return nil, err
+		}
+		return q, nil
+	case BackendNATS:
+		q, err := newNATS(cfg.NATSURL)
+		if err != nil {
+			return nil, err
+		}
+		return q, nil
+	case BackendMemory:
+		return sharedMemory, nil
+	default:
+		return nil, fmt.Errorf("unknown queue backend; %s", cfg.Backend)
+	}
+}
+
+type namespaced struct {
+	Queue
+}
+
+func (q namespaced) Publish(ctx context.Context, topic string, data []byte) (string, error) {
+	return q.Queue.Publish(ctx, namespace.Topic(topic), data)
+}
+
+func (q namespaced) PublishAttributes(ctx context.Context, topic string, data []byte, attrs map[string]string) (string, error) {
+	return PublishAttributes(ctx, q.Queue, namespace.Topic(topic), data, attrs)
+}
+
+func (q namespaced) Subscribe(ctx context.Context, topic string, handler Handler) error {
+	subscriber, ok := q.Queue.(Subscriber)
+	if !ok {
+		return fmt.Errorf("queue backend cannot subscribe")
+	}
+	return subscriber.Subscribe(ctx, namespace.Topic(topic), handler)
+}
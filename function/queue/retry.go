@@ -0,0 +1,123 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// The attributes a message republished after a failure carries, so that the
+// handler and a dead letter handler know its history.
+const (
+	AttrRetryCount = "retryCount"
+	AttrFirstSeen  = "firstSeenTimestamp"
+	AttrLastError  = "lastError"
+)
+
+// Pub/Sub caps attribute values at 1024 bytes
+const maxLastError = 1024
+
+// Retry is the retry metadata of a message; the zero value is a message on
+// its first attempt.
+type Retry struct {
+	// Count is how many attempts failed before.
+	Count     int
+	FirstSeen time.Time
+	LastError string
+}
+
+// RetryFromAttributes reads the metadata, ignoring attributes that do not
+// parse.
+func RetryFromAttributes(attrs map[string]string) Retry {
+	var r Retry
+	if n, err := strconv.Atoi(attrs[AttrRetryCount]); err == nil && n > 0 {
+		r.Count = n
+	}
+	if t, err := time.Parse(time.RFC3339Nano, attrs[AttrFirstSeen]); err == nil {
+		r.FirstSeen = t
+	}
+	r.LastError = attrs[AttrLastError]
+	return r
+}
+
+// Attributes returns the metadata as message attributes.
+func (r Retry) Attributes() map[string]string {
+	attrs := map[string]string{AttrRetryCount: strconv.Itoa(r.Count)}
+	if !r.FirstSeen.IsZero() {
+		attrs[AttrFirstSeen] = r.FirstSeen.UTC().Format(time.RFC3339Nano)
+	}
+	if r.LastError != "" {
+		attrs[AttrLastError] = r.LastError
+	}
+	return attrs
+}
+
+// Next is the metadata after an attempt that started at startedAt failed
+// with err.
+func (r Retry) Next(startedAt time.Time, err error) Retry {
+	next := Retry{Count: r.Count + 1, FirstSeen: r.FirstSeen, LastError: truncateBytes(err.Error(), maxLastError)}
+	if next.FirstSeen.IsZero() {
+		next.FirstSeen = startedAt
+	}
+	return next
+}
+
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[:n]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+type (
+	retryKey      struct{}
+	attributesKey struct{}
+)
+
+// WithAttributes hands all attributes of the message being handled to the
+// handler, its retry metadata included.
+func WithAttributes(ctx context.Context, attrs map[string]string) context.Context {
+	return WithRetry(context.WithValue(ctx, attributesKey{}, attrs), RetryFromAttributes(attrs))
+}
+
+// AttributesFrom returns a copy of the attributes WithAttributes put in ctx,
+// to be published again with updated values.
+func AttributesFrom(ctx context.Context) map[string]string {
+	attrs, _ := ctx.Value(attributesKey{}).(map[string]string)
+	copied := make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		copied[k] = v
+	}
+	return copied
+}
+
+// WithRetry hands the metadata of the message being handled to the handler.
+func WithRetry(ctx context.Context, r Retry) context.Context {
+	return context.WithValue(ctx, retryKey{}, r)
+}
+
+// RetryFrom returns the metadata WithRetry put in ctx.
+func RetryFrom(ctx context.Context) Retry {
+	r, _ := ctx.Value(retryKey{}).(Retry)
+	return r
+}
+
+// AttributePublisher is implemented by backends that carry attributes along
+// with the data.
+type AttributePublisher interface {
+	PublishAttributes(ctx context.Context, topic string, data []byte, attrs map[string]string) (string, error)
+}
+
+// PublishAttributes publishes data with attrs, dropping the attributes on
+// backends that cannot carry them.
+func PublishAttributes(ctx context.Context, q Queue, topic string, data []byte, attrs map[string]string) (string, error) {
+	if publisher, ok := q.(AttributePublisher); ok {
+		return publisher.PublishAttributes(ctx, topic, data, attrs)
+	}
+	return q.Publish(ctx, topic, data)
+}
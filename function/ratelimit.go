@@ -0,0 +1,44 @@
+package function
+
+import (
+	"context"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/ratelimit"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+)
+
+const rateLimitWindow = time.Minute
+
+// openRateLimiter returns nil when per user limiting is not configured.
+func openRateLimiter(ctx context.Context) (ratelimit.Limiter, error) {
+	limit, err := ratelimit.PerMinuteFrom(settingsGetter(ctx))
+	if err != nil || limit <= 0 {
+		return nil, err
+	}
+	return ratelimit.Open(ctx, cache.ConfigFromEnv(), limit, rateLimitWindow)
+}
+
+// allowImage fails open: a broken limiter must not stop the bot.
+func allowImage(ctx context.Context, limiter ratelimit.Limiter, userIDHash string) bool {
+	if limiter == nil || userIDHash == "" {
+		return true
+	}
+	allowed, err := limiter.Allow(ctx, userIDHash)
+	if err != nil {
+		logging.Errorf(ctx, "rate limit check failed; %v", err)
+		return true
+	}
+	return allowed
+}
+
+func replySlowDown(ctx context.Context, projectID, replyToken string) error {
+	lineClient, err := newLineClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	builder := reply.NewBuilder(replyToken).Text("You are sending images too fast. Please wait a minute and try again.")
+	return sendReply(ctx, lineClient, builder)
+}
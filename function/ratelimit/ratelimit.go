@@ -0,0 +1,148 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Limiter allows at most Limit events per key within a sliding Window.
+type Limiter interface {
+	// Allow records an event for key and reports whether it is within the limit.
+	// Rejected events are not recorded, so a user who slows down gets through
+	// again once the window has moved on.
+	Allow(ctx context.Context, key string) (bool, error)
+	Close() error
+}
+
+// PerMinuteFromEnv reads RATE_LIMIT_PER_MINUTE; zero disables limiting.
+func PerMinuteFromEnv() (int, error) {
+	return PerMinuteFrom(os.Getenv)
+}
+
+// PerMinuteFrom reads the setting of PerMinuteFromEnv through get.
+func PerMinuteFrom(get func(key string) string) (int, error) {
+	value := get("RATE_LIMIT_PER_MINUTE")
+	if value == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid RATE_LIMIT_PER_MINUTE; %w", err)
+	}
+	return limit, nil
+}
+
+// Open keeps the windows in Redis when the cache is configured for it and in
+// Firestore otherwise.
+func Open(ctx context.Context, cfg cache.Config, limit int, window time.Duration) (Limiter, error) {
+	if cfg.Redis() {
+		client, err := cache.RedisClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &redisLimiter{client: client, limit: limit, window: window}, nil
+	}
+	client, err := clients.Firestore(ctx, cfg.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+	return &firestoreLimiter{client: client, limit: limit, window: window}, nil
+}
+
+type firestoreLimiter struct {
+	client *firestore.Client
+	limit  int
+	window time.Duration
+}
+
+type window struct {
+	Events []time.Time `firestore:"events"`
+}
+
+func (l *firestoreLimiter) Allow(ctx context.Context, key string) (bool, error) {
+	ref := l.client.Collection(namespace.Collection("rateLimits")).Doc(key)
+	allowed := false
+	err := l.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		now := time.Now()
+		var w window
+		snap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			if err := snap.DataTo(&w); err != nil {
+				return err
+			}
+		}
+		events := []time.Time{}
+		for _, t := range w.Events {
+			if now.Sub(t) < l.window {
+				events = append(events, t)
+			}
+		}
+		allowed = len(events) < l.limit
+		if !allowed {
+			return nil
+		}
+		return tx.Set(ref, window{Events: append(events, now)})
+	})
+	if err != nil {
+		return false, fmt.Errorf("firestore.Client.RunTransaction failed; %w", err)
+	}
+	return allowed, nil
+}
+
+// Close leaves the shared client open.
+func (l *firestoreLimiter) Close() error {
+	return nil
+}
+
+// allowScript trims the events that left the window, then records one more
+// unless the limit is reached, in one step so that concurrent callers cannot
+// all see room for the last event.
+// KEYS[1] key; ARGV window start, now, limit, member, window in ms.
+var allowScript = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[4])
+redis.call("PEXPIRE", KEYS[1], ARGV[5])
+return 1
+`)
+
+// redisLimiter keeps a sorted set of event times per key.
+type redisLimiter struct {
+	client *redis.Client
+	limit  int
+	window time.Duration
+}
+
+func (l *redisLimiter) Allow(ctx context.Context, key string) (bool, error) {
+	key = namespace.Key("ratelimit:" + key)
+	now := time.Now()
+	// events of other instances in the same nanosecond stay apart
+	member := fmt.Sprintf("%d-%d", now.UnixNano(), rand.Int63())
+	allowed, err := allowScript.Run(ctx, l.client, []string{key},
+		strconv.FormatInt(now.Add(-l.window).UnixNano(), 10), strconv.FormatInt(now.UnixNano(), 10), l.limit, member, l.window.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("redis.Script.Run failed; %w", err)
+	}
+	return allowed == 1, nil
+}
+
+func (l *redisLimiter) Close() error {
+	return l.client.Close()
+}
@@ -0,0 +1,76 @@
+package function
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/auth"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/recent"
+)
+
+const (
+	defaultRecentEvents = 100
+	recentEventsPath    = "/debug/recent"
+)
+
+// recentEvents holds what this instance handled last, RECENT_EVENTS of
+// them, so that a warm instance can be asked before its logs are ingested.
+var recentEvents = recent.New(recentEventsSize())
+
+func recentEventsSize() int {
+	if n, err := strconv.Atoi(os.Getenv("RECENT_EVENTS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultRecentEvents
+}
+
+func recordRecent(fields logging.Fields, function string, outcome error) {
+	s := recent.Summary{
+		At:            time.Now(),
+		Function:      function,
+		CorrelationID: fields.CorrelationID,
+		UserIDHash:    fields.UserIDHash,
+		ImageID:       fields.ImageID,
+	}
+	if outcome != nil {
+		s.Error = outcome.Error()
+	}
+	recentEvents.Add(s)
+}
+
+// withRecentEvents serves GET .../debug/recent?limit=N, for internal
+// principals only, in front of an HTTP function. Each instance answers with
+// its own buffer; the events CloudEvent functions handled are not reachable.
+func withRecentEvents(next http.HandlerFunc) http.HandlerFunc {
+	serve := auth.Require(auth.ConfigFromEnv(), recentEventsHandler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, recentEventsPath) {
+			serve(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func recentEventsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "recentEvents"})
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("invalid limit; %s", value))
+			return
+		}
+		limit = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(recentEvents.Recent(limit)); err != nil {
+		logging.Errorf(ctx, "json.Encoder.Encode failed; %v", err)
+	}
+}
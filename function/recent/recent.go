@@ -0,0 +1,61 @@
+package recent
+
+import (
+	"sync"
+	"time"
+)
+
+// Summary is what is kept of one handled event: enough to find its logs.
+type Summary struct {
+	At            time.Time `json:"at"`
+	Function      string    `json:"function"`
+	CorrelationID string    `json:"correlationId,omitempty"`
+	UserIDHash    string    `json:"userIdHash,omitempty"`
+	ImageID       string    `json:"imageId,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// Ring keeps the last summaries of this instance; the oldest is overwritten
+// once it is full.
+type Ring struct {
+	mu        sync.Mutex
+	summaries []Summary
+	next      int
+	full      bool
+}
+
+func New(size int) *Ring {
+	if size < 1 {
+		size = 1
+	}
+	return &Ring{summaries: make([]Summary, size)}
+}
+
+func (r *Ring) Add(s Summary) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.summaries[r.next] = s
+	r.next = (r.next + 1) % len(r.summaries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Recent returns up to limit summaries, newest first; all of them when
+// limit is not positive.
+func (r *Ring) Recent(limit int) []Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.summaries)
+	}
+	if limit <= 0 || limit > n {
+		limit = n
+	}
+	out := make([]Summary, 0, limit)
+	for i := 1; i <= limit; i++ {
+		out = append(out, r.summaries[(r.next-i+len(r.summaries))%len(r.summaries)])
+	}
+	return out
+}
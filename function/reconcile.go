@@ -0,0 +1,162 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/intent"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	reconcileBatchSize = 100
+	// a reply token is only valid for about a minute
+	defaultReconcileAfter = 5 * time.Minute
+)
+
+// beginReplyIntent records that the reply of the current event is about to
+// be sent. It returns the function completing the record; recording is best
+// effort and never stands in the way of the reply.
+func beginReplyIntent(ctx context.Context) func(replyErr error) {
+	fields := logging.FromContext(ctx)
+	projectID := projectIDOf(ctx)
+	if fields.CorrelationID == "" || projectID == "" {
+		return func(error) {}
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		logging.Errorf(ctx, "clients.Firestore failed; %v", err)
+		return func(error) {}
+	}
+	store := intent.New(client)
+	if err := store.Begin(ctx, fields.CorrelationID, fields.UserIDHash); err != nil {
+		logging.Errorf(ctx, "begin reply intent failed; %v", err)
+		return func(error) {}
+	}
+	return func(replyErr error) {
+		if err := store.Complete(ctx, fields.CorrelationID, replyErr); err != nil {
+			logging.Errorf(ctx, "complete reply intent failed; %v", err)
+		}
+	}
+}
+
+// recordLostReply records the reply of the current event as lost with cause,
+// so that it shows up next to the losses the reconciler finds.
+func recordLostReply(ctx context.Context, cause error) {
+	fields := logging.FromContext(ctx)
+	projectID := projectIDOf(ctx)
+	if fields.CorrelationID == "" || projectID == "" {
+		return
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		logging.Errorf(ctx, "clients.Firestore failed; %v", err)
+		return
+	}
+	store := intent.New(client)
+	if err := store.Begin(ctx, fields.CorrelationID, fields.UserIDHash); err != nil {
+		logging.Errorf(ctx, "begin reply intent failed; %v", err)
+		return
+	}
+	if err := store.Resolve(ctx, fields.CorrelationID, intent.StateLost, cause); err != nil {
+		logging.Errorf(ctx, "resolve reply intent failed; %v", err)
+	}
+}
+
+// reconcileReplies is invoked by Cloud Scheduler. Replies begun more than
+// RECONCILE_AFTER_MINUTES ago and never completed get a fallback push
+// message, for users whose LINE user ID is known, and are marked lost
+// otherwise, so losses show up instead of going unnoticed. A tenant gets its
+// own job with the tenant query parameter.
+func reconcileReplies(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "reconcileReplies"})
+	logging.Printf(ctx, "reconcileReplies")
+
+	ctx, err := requestTenant(ctx, r)
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	projectID := projectIDOf(ctx)
+	after := defaultReconcileAfter
+	if n, err := strconv.Atoi(os.Getenv("RECONCILE_AFTER_MINUTES")); err == nil && n > 0 {
+		after = time.Duration(n) * time.Minute
+	}
+
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	store := intent.New(client)
+	stale, err := store.Stale(ctx, time.Now().Add(-after), reconcileBatchSize)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(stale) == 0 {
+		fmt.Fprint(w, "fallback 0, lost 0")
+		return
+	}
+	lineClient, err := newLineClient(ctx, projectID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	text := replyTemplate(ctx, "REPLY_FALLBACK", "Sorry, something went wrong with your last message. Please send it again.")
+	fallback := reply.Request{Messages: []reply.Message{reply.NewText(text)}}
+
+	pushed, lost := 0, 0
+	for id, in := range stale {
+		intentCtx := logging.With(ctx, logging.Fields{CorrelationID: id, UserIDHash: in.UserIDHash})
+		state, cause := intent.StateLost, fmt.Errorf("LINE user ID unknown")
+		if userID, err := lineUserID(intentCtx, client, in.UserIDHash); err != nil {
+			cause = err
+		} else if userID != "" {
+			cause = lineClient.Push(intentCtx, userID, fallback)
+			if cause == nil {
+				state = intent.StateFallback
+			}
+		}
+		if state == intent.StateLost {
+			lost++
+			logging.Warnf(intentCtx, "reply lost; %v", cause)
+		} else {
+			pushed++
+			logging.Printf(intentCtx, "fallback pushed")
+		}
+		if err := store.Resolve(intentCtx, id, state, cause); err != nil {
+			returnError(intentCtx, w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	logging.Printf(ctx, "reconcile: %d fallback, %d lost", pushed, lost)
+	fmt.Fprintf(w, "fallback %d, lost %d", pushed, lost)
+}
+
+// lineUserID returns the LINE user ID remembered for campaigns, empty when
+// there is none.
+func lineUserID(ctx context.Context, client *firestore.Client, userIDHash string) (string, error) {
+	if userIDHash == "" {
+		return "", nil
+	}
+	snap, err := client.Collection(namespace.Collection("users")).Doc(userIDHash).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	userID, _ := snap.Data()["lineUserId"].(string)
+	return userID, nil
+}
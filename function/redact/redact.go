@@ -0,0 +1,173 @@
+package redact
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Mode selects how identifiers are hidden. Secrets such as tokens are always
+// masked unless redaction is turned off.
+type Mode string
+
+const (
+	ModeHash Mode = "hash"
+	ModeMask Mode = "mask"
+	ModeOff  Mode = "off"
+)
+
+func ModeFromEnv() Mode {
+	switch mode := Mode(os.Getenv("LOG_REDACTION")); mode {
+	case ModeMask, ModeOff:
+		return mode
+	default:
+		return ModeHash
+	}
+}
+
+// Hash is a stable, non reversible stand-in for an identifier.
+func Hash(s string) string {
+	if s == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func Identifier(mode Mode, s string) string {
+	switch mode {
+	case ModeOff:
+		return s
+	case ModeMask:
+		return mask(s)
+	default:
+		return Hash(s)
+	}
+}
+
+func Secret(mode Mode, s string) string {
+	if mode == ModeOff {
+		return s
+	}
+	return mask(s)
+}
+
+func mask(s string) string {
+	if s == "" {
+		return ""
+	}
+	if len(s) <= 8 {
+		return "***"
+	}
+	return s[:4] + "***"
+}
+
+var (
+	identifierKeys = map[string]bool{"userId": true, "groupId": true, "roomId": true}
+	secretKeys     = map[string]bool{"replyToken": true, "ReplyToken": true, "channelAccessToken": true, "accessToken": true, "token": true}
+
+	bearerPattern = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`)
+	secretPattern = regexp.MustCompile(`("(?:replyToken|ReplyToken|channelAccessToken|accessToken)"\s*:\s*")([^"]*)(")`)
+	userIDPattern = regexp.MustCompile(`\bU[0-9a-f]{32}\b`)
+)
+
+// Text scrubs tokens and LINE user IDs from free text. It is the safety net
+// applied to every log entry.
+func Text(mode Mode, s string) string {
+	if mode == ModeOff {
+		return s
+	}
+	s = bearerPattern.ReplaceAllStringFunc(s, func(m string) string {
+		parts := bearerPattern.FindStringSubmatch(m)
+		return parts[1] + "***"
+	})
+	s = secretPattern.ReplaceAllStringFunc(s, func(m string) string {
+		parts := secretPattern.FindStringSubmatch(m)
+		return parts[1] + mask(parts[2]) + parts[3]
+	})
+	return userIDPattern.ReplaceAllStringFunc(s, func(m string) string {
+		return Identifier(mode, m)
+	})
+}
+
+// JSON redacts identifier and secret fields anywhere in a JSON document.
+// Bodies that are not JSON are scrubbed as text.
+func JSON(mode Mode, body []byte) []byte {
+	if mode == ModeOff {
+		return body
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return []byte(Text(mode, string(body)))
+	}
+	redacted, err := json.Marshal(redactValue(mode, v))
+	if err != nil {
+		return []byte(Text(mode, string(body)))
+	}
+	return redacted
+}
+
+func redactValue(mode Mode, v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for key, value := range t {
+			s, isString := value.(string)
+			switch {
+			case isString && identifierKeys[key]:
+				t[key] = Identifier(mode, s)
+			case isString && secretKeys[key]:
+				t[key] = Secret(mode, s)
+			default:
+				t[key] = redactValue(mode, value)
+			}
+		}
+		return t
+	case []interface{}:
+		for i := range t {
+			t[i] = redactValue(mode, t[i])
+		}
+		return t
+	case string:
+		return Text(mode, t)
+	default:
+		return v
+	}
+}
+
+var secretHeaders = map[string]bool{"Authorization": true, "X-Line-Signature": true, "Cookie": true}
+
+// Request renders a request like httputil.DumpRequest with secret headers
+// masked and the body redacted. The body is restored so it can still be read.
+func Request(mode Mode, r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s %s\n", r.Method, r.URL.RequestURI(), r.Proto)
+	keys := make([]string, 0, len(r.Header))
+	for key := range r.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := strings.Join(r.Header[key], ", ")
+		if secretHeaders[key] {
+			value = Secret(mode, value)
+		}
+		fmt.Fprintf(&buf, "%s: %s\n", key, value)
+	}
+	buf.WriteString("\n")
+	buf.Write(JSON(mode, body))
+	return buf.Bytes(), nil
+}
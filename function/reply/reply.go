@@ -0,0 +1,338 @@
+package reply
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/linetext"
+)
+
+// limits of the LINE Messaging API reply endpoint
+const (
+	MaxMessages       = 5
+	maxTextLength     = 5000
+	maxURLLength      = 2000
+	maxAltTextLength  = 400
+	maxTitleLength    = 100
+	maxAddressLength  = 100
+	maxFlexJSONLength = 30000
+	maxQuickReplies   = 13
+	maxQuickLabel     = 20
+	maxPostbackData   = 300
+	maxImagemapAreas  = 50
+)
+
+type Message interface {
+	validate() error
+}
+
+type TextMessage struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type ImageMessage struct {
+	Type               string `json:"type"`
+	OriginalContentURL string `json:"originalContentUrl"`
+	PreviewImageURL    string `json:"previewImageUrl"`
+}
+
+type StickerMessage struct {
+	Type      string `json:"type"`
+	PackageID string `json:"packageId"`
+	StickerID string `json:"stickerId"`
+}
+
+type FlexMessage struct {
+	Type     string          `json:"type"`
+	AltText  string          `json:"altText"`
+	Contents json.RawMessage `json:"contents"`
+}
+
+type LocationMessage struct {
+	Type      string  `json:"type"`
+	Title     string  `json:"title"`
+	Address   string  `json:"address"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// ImagemapMessage shows the images under BaseURL, which LINE fetches as
+// BaseURL/1040, BaseURL/700 and so on for each display width. Tapping an
+// area sends its text as if the user had typed it.
+type ImagemapMessage struct {
+	Type     string           `json:"type"`
+	BaseURL  string           `json:"baseUrl"`
+	AltText  string           `json:"altText"`
+	BaseSize ImagemapSize     `json:"baseSize"`
+	Actions  []ImagemapAction `json:"actions"`
+}
+
+type ImagemapSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// ImagemapAction is a message action on an area given in pixels of the
+// base size.
+type ImagemapAction struct {
+	Label  string `json:"label,omitempty"`
+	Text   string `json:"text"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// QuickReplyItem is a postback button shown above the keyboard with the
+// last message.
+type QuickReplyItem struct {
+	Label       string
+	Data        string
+	DisplayText string
+	// URI opens the link, such as a LIFF app, instead of posting Data back.
+	URI string
+}
+
+// Request is the body of POST /v2/bot/message/reply.
+type Request struct {
+	ReplyToken string           `json:"replyToken"`
+	Messages   []Message        `json:"messages"`
+	QuickReply []QuickReplyItem `json:"-"`
+	// RetryKey, a UUID, makes LINE accept a push or broadcast only once
+	// however often it is sent.
+	RetryKey string `json:"-"`
+}
+
+// Builder composes the messages sent with one reply token. Problems are
+// collected and reported together by Build.
+type Builder struct {
+	replyToken   string
+	messages     []Message
+	quickReplies []QuickReplyItem
+}
+
+func NewBuilder(replyToken string) *Builder {
+	return &Builder{replyToken: replyToken}
+}
+
+// NewText returns a text message of text as linetext.Sanitize leaves it.
+// Messages sent without a Builder are made with it too.
+func NewText(text string) TextMessage {
+	return TextMessage{Type: "text", Text: linetext.Sanitize(text)}
+}
+
+// NewFlex returns a Flex message with altText sanitized and cut to the
+// length LINE accepts, and every text in contents sanitized.
+func NewFlex(altText string, contents json.RawMessage) FlexMessage {
+	return FlexMessage{Type: "flex", AltText: linetext.Truncate(linetext.Sanitize(altText), maxAltTextLength), Contents: sanitizeFlexContents(contents)}
+}
+
+// sanitizeFlexContents sanitizes the "text" and "altText" strings at any
+// depth of contents. Contents that are not JSON are left for validate.
+func sanitizeFlexContents(contents json.RawMessage) json.RawMessage {
+	var v interface{}
+	if err := json.Unmarshal(contents, &v); err != nil {
+		return contents
+	}
+	b, err := json.Marshal(sanitizeFlexValue(v))
+	if err != nil {
+		return contents
+	}
+	return b
+}
+
+func sanitizeFlexValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if s, ok := value.(string); ok && (key == "text" || key == "altText") {
+				v[key] = linetext.Sanitize(s)
+				continue
+			}
+			v[key] = sanitizeFlexValue(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = sanitizeFlexValue(value)
+		}
+	}
+	return v
+}
+
+// Text adds text as linetext.Sanitize leaves it.
+func (b *Builder) Text(text string) *Builder {
+	return b.Add(NewText(text))
+}
+
+func (b *Builder) Image(originalContentURL, previewImageURL string) *Builder {
+	return b.Add(ImageMessage{Type: "image", OriginalContentURL: originalContentURL, PreviewImageURL: previewImageURL})
+}
+
+func (b *Builder) Sticker(packageID, stickerID string) *Builder {
+	return b.Add(StickerMessage{Type: "sticker", PackageID: packageID, StickerID: stickerID})
+}
+
+// Flex adds the message NewFlex makes.
+func (b *Builder) Flex(altText string, contents json.RawMessage) *Builder {
+	return b.Add(NewFlex(altText, contents))
+}
+
+func (b *Builder) Location(title, address string, latitude, longitude float64) *Builder {
+	return b.Add(LocationMessage{Type: "location", Title: title, Address: address, Latitude: latitude, Longitude: longitude})
+}
+
+func (b *Builder) Imagemap(baseURL, altText string, baseSize ImagemapSize, actions ...ImagemapAction) *Builder {
+	return b.Add(ImagemapMessage{Type: "imagemap", BaseURL: baseURL, AltText: altText, BaseSize: baseSize, Actions: actions})
+}
+
+func (b *Builder) Add(msg Message) *Builder {
+	b.messages = append(b.messages, msg)
+	return b
+}
+
+func (b *Builder) QuickReply(items ...QuickReplyItem) *Builder {
+	b.quickReplies = append(b.quickReplies, items...)
+	return b
+}
+
+func (b *Builder) Len() int {
+	return len(b.messages)
+}
+
+func (b *Builder) Build() (Request, error) {
+	var problems []string
+	if b.replyToken == "" {
+		problems = append(problems, "empty reply token")
+	}
+	if len(b.messages) == 0 {
+		problems = append(problems, "no messages")
+	}
+	if len(b.messages) > MaxMessages {
+		problems = append(problems, fmt.Sprintf("too many messages; %d > %d", len(b.messages), MaxMessages))
+	}
+	for i, msg := range b.messages {
+		if err := msg.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("message %d; %v", i, err))
+		}
+	}
+	if len(b.quickReplies) > maxQuickReplies {
+		problems = append(problems, fmt.Sprintf("too many quick replies; %d > %d", len(b.quickReplies), maxQuickReplies))
+	}
+	for i, item := range b.quickReplies {
+		if err := item.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("quick reply %d; %v", i, err))
+		}
+	}
+	if len(problems) > 0 {
+		return Request{}, fmt.Errorf("invalid reply; %s", strings.Join(problems, "; "))
+	}
+	return Request{ReplyToken: b.replyToken, Messages: b.messages, QuickReply: b.quickReplies}, nil
+}
+
+func (m TextMessage) validate() error {
+	if strings.TrimSpace(m.Text) == "" {
+		return errors.New("empty text")
+	}
+	return checkLength("text", m.Text, maxTextLength)
+}
+
+func (m ImageMessage) validate() error {
+	if err := checkURL("originalContentUrl", m.OriginalContentURL); err != nil {
+		return err
+	}
+	return checkURL("previewImageUrl", m.PreviewImageURL)
+}
+
+func (m StickerMessage) validate() error {
+	if m.PackageID == "" || m.StickerID == "" {
+		return errors.New("packageId and stickerId are required")
+	}
+	return nil
+}
+
+func (m FlexMessage) validate() error {
+	if m.AltText == "" {
+		return errors.New("empty altText")
+	}
+	if err := checkLength("altText", m.AltText, maxAltTextLength); err != nil {
+		return err
+	}
+	if !json.Valid(m.Contents) {
+		return errors.New("contents is not valid JSON")
+	}
+	if len(m.Contents) > maxFlexJSONLength {
+		return fmt.Errorf("contents too large; %d bytes", len(m.Contents))
+	}
+	return nil
+}
+
+func (m LocationMessage) validate() error {
+	if err := checkLength("title", m.Title, maxTitleLength); err != nil {
+		return err
+	}
+	if err := checkLength("address", m.Address, maxAddressLength); err != nil {
+		return err
+	}
+	if m.Latitude < -90 || m.Latitude > 90 || m.Longitude < -180 || m.Longitude > 180 {
+		return fmt.Errorf("invalid coordinates; %f, %f", m.Latitude, m.Longitude)
+	}
+	return nil
+}
+
+func (m ImagemapMessage) validate() error {
+	if err := checkURL("baseUrl", m.BaseURL); err != nil {
+		return err
+	}
+	if m.AltText == "" {
+		return errors.New("empty altText")
+	}
+	if err := checkLength("altText", m.AltText, maxAltTextLength); err != nil {
+		return err
+	}
+	if m.BaseSize.Width <= 0 || m.BaseSize.Height <= 0 {
+		return fmt.Errorf("invalid baseSize; %dx%d", m.BaseSize.Width, m.BaseSize.Height)
+	}
+	if len(m.Actions) == 0 {
+		return errors.New("no actions")
+	}
+	if len(m.Actions) > maxImagemapAreas {
+		return fmt.Errorf("too many actions; %d > %d", len(m.Actions), maxImagemapAreas)
+	}
+	for i, a := range m.Actions {
+		if strings.TrimSpace(a.Text) == "" {
+			return fmt.Errorf("action %d; empty text", i)
+		}
+		if a.X < 0 || a.Y < 0 || a.Width <= 0 || a.Height <= 0 || a.X+a.Width > m.BaseSize.Width || a.Y+a.Height > m.BaseSize.Height {
+			return fmt.Errorf("action %d; area outside baseSize", i)
+		}
+	}
+	return nil
+}
+
+func (i QuickReplyItem) validate() error {
+	if i.Label == "" || i.Data == "" {
+		return errors.New("label and data are required")
+	}
+	if err := checkLength("label", i.Label, maxQuickLabel); err != nil {
+		return err
+	}
+	return checkLength("data", i.Data, maxPostbackData)
+}
+
+func checkLength(field, value string, max int) error {
+	if n := utf8.RuneCountInString(value); n > max {
+		return fmt.Errorf("%s too long; %d > %d", field, n, max)
+	}
+	return nil
+}
+
+func checkURL(field, url string) error {
+	if !strings.HasPrefix(url, "https://") {
+		return fmt.Errorf("%s must be an HTTPS URL", field)
+	}
+	return checkLength(field, url, maxURLLength)
+}
@@ -0,0 +1,223 @@
+package function
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	defaultResultsLimit = 20
+	maxResultsLimit     = 100
+)
+
+type result struct {
+	ImageID    string   `json:"imageId"`
+	UserIDHash string   `json:"userIdHash"`
+	Labels     []string `json:"labels"`
+	Categories []string `json:"categories"`
+	// Result has the label scores; for records older than it only the
+	// labels are filled in, without scores.
+	Result    analysis.Result `json:"result"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+type resultsPage struct {
+	Data []result `json:"data"`
+	// NextPageToken is passed as pageToken for the following page; empty on
+	// the last one.
+	NextPageToken string `json:"nextPageToken,omitempty"`
+}
+
+// resultsQuery selects past analysis results, newest first. All fields are
+// optional.
+type resultsQuery struct {
+	ImageID    string
+	UserIDHash string
+	Label      string
+	From, To   time.Time
+	Limit      int
+	PageToken  string
+}
+
+func parseResultsQuery(r *http.Request) (resultsQuery, error) {
+	values := r.URL.Query()
+	q := resultsQuery{
+		ImageID:    values.Get("imageId"),
+		UserIDHash: values.Get("user"),
+		Label:      values.Get("label"),
+		Limit:      defaultResultsLimit,
+		PageToken:  values.Get("pageToken"),
+	}
+	for name, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		value := values.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return q, fmt.Errorf("invalid %s; %s", name, value)
+		}
+		*t = parsed
+	}
+	if value := values.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxResultsLimit {
+			return q, fmt.Errorf("invalid limit; %s", value)
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+// results serves the duplicate detection records as a read-only JSON API for
+// the dashboard and other tools, with the status token as a bearer token.
+func results(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "results"})
+	logging.Printf(ctx, "results")
+
+	ctx, err := requestTenant(ctx, r)
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	projectID := projectIDOf(ctx)
+
+	if r.Method != http.MethodGet {
+		returnError(ctx, w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed; %s", r.Method))
+		return
+	}
+	statusToken, err := getSecret(ctx, projectID, "status-token")
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	if !validStatusToken(r, statusToken) {
+		returnError(ctx, w, http.StatusUnauthorized, fmt.Errorf("invalid status token"))
+		return
+	}
+	q, err := parseResultsQuery(r)
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	page, err := listResults(ctx, client, q)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		logging.Errorf(ctx, "json.Encoder.Encode failed; %v", err)
+	}
+}
+
+// pageCursor is where a page ended: the createdAt of its last result, and the
+// document, which breaks ties between results created at the same time.
+type pageCursor struct {
+	CreatedAt  time.Time `json:"t"`
+	UserIDHash string    `json:"u"`
+	ImageID    string    `json:"i"`
+}
+
+func (c pageCursor) token() (string, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal failed; %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func parsePageToken(token string) (pageCursor, error) {
+	var c pageCursor
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.UserIDHash == "" || c.ImageID == "" {
+		return pageCursor{}, fmt.Errorf("invalid pageToken; %s", token)
+	}
+	return c, nil
+}
+
+// listResults pages by createdAt and then the document; the page token is
+// the pageCursor of the last result returned.
+func listResults(ctx context.Context, client *firestore.Client, q resultsQuery) (resultsPage, error) {
+	query := client.CollectionGroup(namespace.Collection("images")).Query
+	if q.UserIDHash != "" {
+		query = userImages(client, q.UserIDHash).Query
+	}
+	if q.ImageID != "" {
+		query = query.Where("imageId", "==", q.ImageID)
+	}
+	if q.Label != "" {
+		query = query.Where("labels", "array-contains", q.Label)
+	}
+	if !q.From.IsZero() {
+		query = query.Where("createdAt", ">=", q.From)
+	}
+	if !q.To.IsZero() {
+		query = query.Where("createdAt", "<", q.To)
+	}
+	query = query.OrderBy("createdAt", firestore.Desc).OrderBy(firestore.DocumentID, firestore.Desc)
+	if q.PageToken != "" {
+		after, err := parsePageToken(q.PageToken)
+		if err != nil {
+			return resultsPage{}, err
+		}
+		query = query.StartAfter(after.CreatedAt, userImages(client, after.UserIDHash).Doc(after.ImageID))
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultResultsLimit
+	}
+
+	page := resultsPage{Data: []result{}}
+	iter := query.Limit(limit + 1).Documents(ctx)
+	defer iter.Stop()
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return page, nil
+		}
+		if err != nil {
+			return resultsPage{}, fmt.Errorf("firestore.DocumentIterator.Next failed; %w", err)
+		}
+		if len(page.Data) == limit {
+			last := page.Data[limit-1]
+			token, err := pageCursor{CreatedAt: last.CreatedAt, UserIDHash: last.UserIDHash, ImageID: last.ImageID}.token()
+			if err != nil {
+				return resultsPage{}, err
+			}
+			page.NextPageToken = token
+			return page, nil
+		}
+		var record imageRecord
+		if err := snap.DataTo(&record); err != nil {
+			return resultsPage{}, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+		}
+		// records live on users/{userIdHash}/images/{imageId}
+		page.Data = append(page.Data, result{
+			ImageID:    record.ImageID,
+			UserIDHash: snap.Ref.Parent.Parent.ID,
+			Labels:     record.Labels,
+			Categories: record.Categories,
+			Result:     record.analysisResult(),
+			CreatedAt:  record.CreatedAt,
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/queue"
+	"github.com/hsmtkk/ubiquitous-couscous/function/topics"
+)
+
+const (
+	// attrFunction names the handler a dead letter failed in.
+	attrFunction = "function"
+	// Pub/Sub sets this on messages its own dead letter policy forwards
+	attrDeliveryCount = "CloudPubSubDeadLetterSourceDeliveryCount"
+
+	maxRetryBackoff = 30 * time.Second
+)
+
+// retryPolicy is MAX_ATTEMPTS and MAX_MESSAGE_AGE; zero means no limit.
+func retryPolicy(ctx context.Context) (maxAttempts int, maxAge time.Duration) {
+	if n, err := strconv.Atoi(dynconfig.Get(ctx, "MAX_ATTEMPTS")); err == nil && n > 0 {
+		maxAttempts = n
+	}
+	if d, err := time.ParseDuration(dynconfig.Get(ctx, "MAX_MESSAGE_AGE")); err == nil && d > 0 {
+		maxAge = d
+	}
+	return maxAttempts, maxAge
+}
+
+func processWithRetries(ctx context.Context, data []byte) error {
+	return handleWithRetries(ctx, "process", processTopic.NameFor(ctx), data, processData)
+}
+
+func sendWithRetries(ctx context.Context, data []byte) error {
+	return handleWithRetries(ctx, "send", sendTopic.NameFor(ctx), data, sendData)
+}
+
+// handleWithRetries runs handle and, when it fails under a retry policy,
+// republishes the message to topic with its retry metadata updated instead
+// of leaving the retry to the backend, whose redeliveries carry no count.
+// The other attributes of the message, its envelope, go along unchanged.
+// Once the policy is exhausted the message goes to DEAD_LETTER_TOPIC, or is
+// dropped without one. Either way the failed delivery is acknowledged.
+func handleWithRetries(ctx context.Context, function, topic string, data []byte, handle func(context.Context, []byte) error) error {
+	startedAt := time.Now()
+	retry := queue.RetryFrom(ctx)
+	if retry.Count > 0 {
+		logging.Printf(ctx, "retry %d of a message first seen at %s; %s", retry.Count, retry.FirstSeen.Format(time.RFC3339), retry.LastError)
+	}
+	err := handle(ctx, data)
+	if err == nil {
+		return nil
+	}
+	maxAttempts, maxAge := retryPolicy(ctx)
+	if (maxAttempts == 0 && maxAge == 0) || topic == "" {
+		return err
+	}
+	next := retry.Next(startedAt, err)
+	if (maxAttempts > 0 && next.Count >= maxAttempts) || (maxAge > 0 && time.Since(next.FirstSeen) >= maxAge) {
+		return deadLetter(ctx, function, data, next)
+	}
+
+	backoff := time.Duration(1<<(next.Count-1)) * time.Second
+	if backoff > maxRetryBackoff || backoff <= 0 {
+		backoff = maxRetryBackoff
+	}
+	select {
+	case <-time.After(backoff):
+	case <-ctx.Done():
+		return err
+	}
+	q, qErr := topics.Queue(ctx)
+	if qErr != nil {
+		logging.Errorf(ctx, "topics.Queue failed; %v", qErr)
+		return err
+	}
+	id, pubErr := queue.PublishAttributes(ctx, q, topic, data, retryAttributes(ctx, next))
+	if pubErr != nil {
+		// the backend redelivers the message with its old metadata
+		logging.Errorf(ctx, "republish failed; %v", pubErr)
+		return err
+	}
+	logging.Printf(ctx, "republish attempt %d: %s", next.Count+1, id)
+	return nil
+}
+
+// retryAttributes are the attributes of the message being handled with its
+// retry metadata replaced by retry.
+func retryAttributes(ctx context.Context, retry queue.Retry) map[string]string {
+	attrs := queue.AttributesFrom(ctx)
+	for k, v := range retry.Attributes() {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// deadLetter gives up on a message after retry.Count failed attempts.
+func deadLetter(ctx context.Context, function string, data []byte, retry queue.Retry) error {
+	topic := os.Getenv("DEAD_LETTER_TOPIC")
+	if topic == "" {
+		logging.Errorf(ctx, "drop message after %d attempts; %s", retry.Count, retry.LastError)
+		return nil
+	}
+	q, err := topics.Queue(ctx)
+	if err != nil {
+		return err
+	}
+	attrs := retryAttributes(ctx, retry)
+	attrs[attrFunction] = function
+	id, err := queue.PublishAttributes(ctx, q, topic, data, attrs)
+	if err != nil {
+		return err
+	}
+	logging.Errorf(ctx, "dead letter after %d attempts: %s; %s", retry.Count, id, retry.LastError)
+	return nil
+}
+
+// deadLetterRecord lives on deadLetters/{messageId}. UserIDHash, read from
+// the payload, lets a purge find the records of a user; cleanup deletes the
+// others after RETENTION_DAYS_DEADLETTERS.
+type deadLetterRecord struct {
+	Function   string    `firestore:"function"`
+	UserIDHash string    `firestore:"userIdHash,omitempty"`
+	Attempts   int       `firestore:"attempts"`
+	FirstSeen  time.Time `firestore:"firstSeen"`
+	LastError  string    `firestore:"lastError"`
+	Payload    []byte    `firestore:"payload"`
+	At         time.Time `firestore:"at"`
+}
+
+// deadLetters is triggered by DEAD_LETTER_TOPIC and reports how many attempts
+// each message consumed, counting those of a Pub/Sub dead letter policy
+// forwarding to the topic as well.
+func deadLetters(ctx context.Context, evt event.Event) (err error) {
+	ctx = logging.With(ctx, logging.Fields{Function: "deadLetters"})
+	defer func() { recordOutcome(ctx, "deadLetters", err) }()
+
+	var subMsg messagePublishedData
+	if err := evt.DataAs(&subMsg); err != nil {
+		return fmt.Errorf("event.Event.DataAs failed; %w", err)
+	}
+	attrs := subMsg.Message.Attributes
+	retry := queue.RetryFromAttributes(attrs)
+	record := deadLetterRecord{
+		Function:  attrs[attrFunction],
+		Attempts:  retry.Count,
+		FirstSeen: retry.FirstSeen,
+		LastError: retry.LastError,
+		Payload:   subMsg.Message.Data,
+		At:        time.Now(),
+	}
+	if n, err := strconv.Atoi(attrs[attrDeliveryCount]); err == nil {
+		record.Attempts += n
+	}
+	// process and send messages both name the user this way
+	var payload struct{ UserIDHash string }
+	if err := json.Unmarshal(subMsg.Message.Data, &payload); err == nil {
+		record.UserIDHash = payload.UserIDHash
+	}
+	logging.Errorf(ctx, "dead letter from %s after %d attempts since %s; %s", record.Function, record.Attempts, record.FirstSeen.Format(time.RFC3339), record.LastError)
+
+	client, err := clients.Firestore(ctx, os.Getenv("PROJECT_ID"))
+	if err != nil {
+		return err
+	}
+	doc := client.Collection(namespace.Collection("deadLetters")).NewDoc()
+	if subMsg.Message.MessageID != "" {
+		doc = client.Collection(namespace.Collection("deadLetters")).Doc(subMsg.Message.MessageID)
+	}
+	if _, err := doc.Set(ctx, record); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	return nil
+}
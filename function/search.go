@@ -0,0 +1,61 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cas"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+	"github.com/hsmtkk/ubiquitous-couscous/function/taxonomy"
+)
+
+const (
+	searchCommand = "/search"
+	maxSearchHits = 10
+	// the text listing the hits takes one message of the reply
+	maxSearchImages = reply.MaxMessages - 1
+	searchImageTTL  = time.Hour
+)
+
+// searchArchive handles "/search <label>", where label may also be a
+// taxonomy category, and returns the text listing the user's archived images
+// found, newest first, with signed URLs of the newest of them to show.
+func searchArchive(ctx context.Context, client *firestore.Client, userIDHash, label string) (string, []string, error) {
+	if label == "" {
+		return "Usage: /search <label>, e.g. /search dog or /search animal", nil, nil
+	}
+	if userIDHash == "" || tenantEnv(ctx, "ARCHIVE_BUCKET") == "" {
+		return "Search is not available.", nil, nil
+	}
+	category := taxonomy.IsCategory(label)
+	entries, err := cas.NewIndex(client).Search(ctx, userIDHash, label, category, maxSearchHits)
+	if err != nil {
+		return "", nil, err
+	}
+	logging.Printf(ctx, "search %q: %d hits", label, len(entries))
+	if len(entries) == 0 {
+		return fmt.Sprintf("No archived photos of %s.", label), nil, nil
+	}
+	lines := []string{fmt.Sprintf("Your photos of %s:", label)}
+	for _, e := range entries {
+		lines = append(lines, fmt.Sprintf("%s %s", e.CreatedAt.Format("2006-01-02 15:04"), strings.Join(e.Labels, ", ")))
+	}
+	urls := []string{}
+	for _, e := range entries {
+		if len(urls) == maxSearchImages {
+			break
+		}
+		url, err := signedURL(ctx, tenantEnv(ctx, "ARCHIVE_BUCKET"), e.Name(), searchImageTTL)
+		if err != nil {
+			// the dates are worth answering without the images
+			logging.Errorf(ctx, "sign archived image failed; %v", err)
+			break
+		}
+		urls = append(urls, url)
+	}
+	return strings.Join(lines, "\n"), urls, nil
+}
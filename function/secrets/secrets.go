@@ -0,0 +1,201 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Provider looks secrets up by name, such as "channel-secret".
+type Provider interface {
+	Get(ctx context.Context, name string) (string, error)
+}
+
+// Writer is implemented by providers that can store secrets too.
+type Writer interface {
+	Put(ctx context.Context, name, value string) error
+}
+
+// Put stores value as the secret name with provider, an error for the read
+// only providers.
+func Put(ctx context.Context, provider Provider, name, value string) error {
+	w, ok := provider.(Writer)
+	if !ok {
+		return fmt.Errorf("%T cannot store secrets", provider)
+	}
+	return w.Put(ctx, name, value)
+}
+
+// FromEnv picks the provider SECRET_BACKEND names: env, file, vault or
+// secretmanager, the default.
+func FromEnv(projectID string) (Provider, error) {
+	switch backend := os.Getenv("SECRET_BACKEND"); backend {
+	case "", "secretmanager":
+		return SecretManager{ProjectID: projectID}, nil
+	case "env":
+		return Env{}, nil
+	case "file":
+		dir := os.Getenv("SECRET_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("SECRET_DIR is not set")
+		}
+		return File{Dir: dir}, nil
+	case "vault":
+		v := Vault{
+			Addr:      os.Getenv("VAULT_ADDR"),
+			Token:     os.Getenv("VAULT_TOKEN"),
+			Namespace: os.Getenv("VAULT_NAMESPACE"),
+			Mount:     os.Getenv("VAULT_MOUNT"),
+			Path:      os.Getenv("VAULT_PATH"),
+		}
+		if v.Addr == "" || v.Token == "" {
+			return nil, fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set")
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unknown SECRET_BACKEND %q", backend)
+	}
+}
+
+// Env reads "channel-secret" from SECRET_CHANNEL_SECRET, for local runs.
+type Env struct{}
+
+func (Env) Get(ctx context.Context, name string) (string, error) {
+	key := "SECRET_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return "", fmt.Errorf("%s is not set", key)
+	}
+	return value, nil
+}
+
+// File reads secrets mounted as one file per secret in Dir, as Kubernetes
+// and Cloud Run volume mounts lay them out.
+type File struct {
+	Dir string
+}
+
+func (f File) Get(ctx context.Context, name string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(f.Dir, name))
+	if err != nil {
+		return "", fmt.Errorf("os.ReadFile failed; %w", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// SecretManager reads the latest version from Google Secret Manager, of the
+// secret of the deployment's namespace.
+type SecretManager struct {
+	ProjectID string
+}
+
+func (s SecretManager) Get(ctx context.Context, name string) (string, error) {
+	clt, err := clients.SecretManager(ctx)
+	if err != nil {
+		return "", err
+	}
+	req := &secretmanagerpb.AccessSecretVersionRequest{
+		Name: fmt.Sprintf("projects/%s/secrets/%s/versions/latest", s.ProjectID, namespace.Secret(name)),
+	}
+	resp, err := clt.AccessSecretVersion(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("secretmanager.Client.AccessSecretVersion failed; %w", err)
+	}
+	return string(resp.Payload.Data), nil
+}
+
+// Put adds value as the latest version of the secret name, creating the
+// secret first when it does not exist yet.
+func (s SecretManager) Put(ctx context.Context, name, value string) error {
+	clt, err := clients.SecretManager(ctx)
+	if err != nil {
+		return err
+	}
+	name = namespace.Secret(name)
+	_, err = clt.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/" + s.ProjectID,
+		SecretId: name,
+		Secret: &secretmanagerpb.Secret{
+			Replication: &secretmanagerpb.Replication{
+				Replication: &secretmanagerpb.Replication_Automatic_{Automatic: &secretmanagerpb.Replication_Automatic{}},
+			},
+		},
+	})
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		return fmt.Errorf("secretmanager.Client.CreateSecret failed; %w", err)
+	}
+	_, err = clt.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent:  fmt.Sprintf("projects/%s/secrets/%s", s.ProjectID, name),
+		Payload: &secretmanagerpb.SecretPayload{Data: []byte(value)},
+	})
+	if err != nil {
+		return fmt.Errorf("secretmanager.Client.AddSecretVersion failed; %w", err)
+	}
+	return nil
+}
+
+// Vault reads the "value" key of the secret {Path}/{name} from a KV version 2
+// engine mounted at Mount ("secret" by default).
+type Vault struct {
+	Addr      string
+	Token     string
+	Namespace string
+	Mount     string
+	Path      string
+}
+
+type vaultResponse struct {
+	Data struct {
+		Data map[string]interface{} `json:"data"`
+	} `json:"data"`
+}
+
+func (v Vault) Get(ctx context.Context, name string) (string, error) {
+	mount := v.Mount
+	if mount == "" {
+		mount = "secret"
+	}
+	secretPath := strings.Trim(v.Path+"/"+name, "/")
+	url := fmt.Sprintf("%s/v1/%s/data/%s", strings.TrimRight(v.Addr, "/"), mount, secretPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("http.Client.Do failed; %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// the body names the path only, never the secret
+		return "", fmt.Errorf("vault read %s failed; %d %s", secretPath, resp.StatusCode, body)
+	}
+	var vaultResp vaultResponse
+	if err := json.Unmarshal(body, &vaultResp); err != nil {
+		return "", fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	value, ok := vaultResp.Data.Data["value"].(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no value", secretPath)
+	}
+	return value, nil
+}
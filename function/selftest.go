@@ -0,0 +1,145 @@
+package function
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/lineapi"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+)
+
+//go:embed testdata/selftest.jpeg
+var selftestImage []byte
+
+const (
+	selftestReplyToken    = "selftest-reply-token"
+	selftestChannelToken  = "selftest-channel-token"
+	selftestChannelSecret = "selftest-channel-secret"
+)
+
+type selftestResult struct {
+	Passed bool           `json:"passed"`
+	Steps  []selftestStep `json:"steps"`
+}
+
+type selftestStep struct {
+	Name       string `json:"name"`
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"durationMs"`
+}
+
+// selftest runs the bundled image through Vision and replies to a local mock
+// of the LINE reply API, so it can be called right after a deploy.
+func selftest(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "selftest", CorrelationID: newCorrelationID()})
+	logging.Printf(ctx, "selftest")
+
+	projectID := os.Getenv("PROJECT_ID")
+
+	statusToken, err := getSecret(ctx, projectID, "status-token")
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	if !validStatusToken(r, statusToken) {
+		returnError(ctx, w, http.StatusUnauthorized, fmt.Errorf("invalid status token"))
+		return
+	}
+
+	result := runSelftest(ctx)
+	var outcome error
+	if !result.Passed {
+		outcome = fmt.Errorf("selftest failed")
+	}
+	recordOutcome(ctx, "selftest", outcome)
+	logging.Printf(ctx, "selftest passed: %t", result.Passed)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Passed {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		logging.Errorf(ctx, "json.Encoder.Encode failed; %v", err)
+	}
+}
+
+func runSelftest(ctx context.Context) selftestResult {
+	result := selftestResult{Passed: true}
+	step := func(name string, f func() error) {
+		start := time.Now()
+		err := f()
+		s := selftestStep{Name: name, OK: err == nil, DurationMS: time.Since(start).Milliseconds()}
+		if err != nil {
+			s.Error = err.Error()
+			result.Passed = false
+			logging.Errorf(ctx, "selftest %s failed; %v", name, err)
+		}
+		result.Steps = append(result.Steps, s)
+	}
+
+	var labels []analysis.Label
+	step("analyze", func() error {
+		var err error
+		labels, err = analyzeImage(ctx, selftestImage, 0)
+		if err == nil && len(labels) == 0 {
+			err = fmt.Errorf("no labels")
+		}
+		return err
+	})
+	if !result.Passed {
+		return result
+	}
+
+	step("reply", func() error {
+		server := httptest.NewServer(http.HandlerFunc(mockReplyAPI))
+		defer server.Close()
+		endpoints, err := lineapi.ParseEndpoints(server.URL, server.URL)
+		if err != nil {
+			return err
+		}
+		lineClient, err := lineapi.New(selftestChannelSecret, selftestChannelToken, endpoints)
+		if err != nil {
+			return err
+		}
+		builder := reply.NewBuilder(selftestReplyToken).Text(strings.Join(analysis.Names(labels), "\n"))
+		return sendReply(ctx, lineClient, builder)
+	})
+	return result
+}
+
+// mockReplyAPI checks a reply request the way the LINE API would.
+func mockReplyAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+selftestChannelToken {
+		http.Error(w, "bad authorization", http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var replyReq struct {
+		ReplyToken string            `json:"replyToken"`
+		Messages   []json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &replyReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if replyReq.ReplyToken != selftestReplyToken || len(replyReq.Messages) == 0 || len(replyReq.Messages) > reply.MaxMessages {
+		http.Error(w, "invalid reply", http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte("{}"))
+}
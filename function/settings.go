@@ -0,0 +1,24 @@
+package function
+
+import (
+	"context"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+)
+
+// settingsGetter adapts the dynamic config to the get functions the
+// subpackages read their settings through.
+func settingsGetter(ctx context.Context) func(key string) string {
+	return func(key string) string {
+		return dynconfig.Get(ctx, key)
+	}
+}
+
+// replyTemplate lets operators reword a fixed reply through the config
+// document without a redeploy.
+func replyTemplate(ctx context.Context, key, fallback string) string {
+	if text := dynconfig.Get(ctx, key); text != "" {
+		return text
+	}
+	return fallback
+}
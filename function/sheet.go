@@ -0,0 +1,75 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/sheets"
+	"github.com/hsmtkk/ubiquitous-couscous/function/tenant"
+)
+
+const (
+	sheetFlushBatchSize = 500
+	defaultSheetRange   = "Sheet1!A:D"
+)
+
+// sheetStep buffers a row for SHEET_ID, a no-op without it. Rows reach the
+// sheet when flushSheet runs.
+func sheetStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	// flushSheet only reads the deployment's own project
+	if _, ok := tenant.FromContext(ctx); ok || os.Getenv("SHEET_ID") == "" || !recordingAllowed(ctx) {
+		return nil
+	}
+	client, err := clients.Firestore(ctx, state.projectID)
+	if err != nil {
+		return err
+	}
+	row := sheets.Row{At: time.Now(), UserIDHash: state.procMsg.UserIDHash, Labels: state.result.LabelNames(), Link: state.archiveURL}
+	if err := sheets.NewBuffer(client).Add(ctx, row); err != nil {
+		// the sheet is a convenience view, the reply goes out regardless
+		logging.Errorf(ctx, "buffer sheet row failed; %v", err)
+	}
+	return nil
+}
+
+// flushSheet is invoked by Cloud Scheduler and appends the buffered rows to
+// the sheet in one call.
+func flushSheet(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "flushSheet"})
+	logging.Printf(ctx, "flushSheet")
+
+	projectID := os.Getenv("PROJECT_ID")
+	sheetID := os.Getenv("SHEET_ID")
+	if sheetID == "" {
+		fmt.Fprint(w, "sheet disabled")
+		return
+	}
+	sheetRange := os.Getenv("SHEET_RANGE")
+	if sheetRange == "" {
+		sheetRange = defaultSheetRange
+	}
+
+	writer, err := sheets.NewWriter(ctx, sheetID, sheetRange)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+
+	n, err := sheets.NewBuffer(client).Flush(ctx, writer, sheetFlushBatchSize)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	logging.Printf(ctx, "flush: %d rows", n)
+	fmt.Fprintf(w, "appended %d", n)
+}
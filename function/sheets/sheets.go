@@ -0,0 +1,112 @@
+package sheets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	gsheets "google.golang.org/api/sheets/v4"
+)
+
+const collection = "sheetRows"
+
+// Row is one analysis as it appears in the sheet.
+type Row struct {
+	At         time.Time `firestore:"at"`
+	UserIDHash string    `firestore:"userIdHash"`
+	Labels     []string  `firestore:"labels"`
+	Link       string    `firestore:"link"`
+}
+
+func (r Row) values() []interface{} {
+	return []interface{}{r.At.UTC().Format(time.RFC3339), r.UserIDHash, strings.Join(r.Labels, ", "), r.Link}
+}
+
+// Buffer holds rows in Firestore until they are flushed, so that the sheet
+// gets one append per batch rather than one per analysis and stays under the
+// Sheets API write quota.
+type Buffer struct {
+	client *firestore.Client
+}
+
+func NewBuffer(client *firestore.Client) *Buffer {
+	return &Buffer{client: client}
+}
+
+func (b *Buffer) Add(ctx context.Context, row Row) error {
+	if _, _, err := b.client.Collection(namespace.Collection(collection)).Add(ctx, row); err != nil {
+		return fmt.Errorf("firestore.CollectionRef.Add failed; %w", err)
+	}
+	return nil
+}
+
+// Flush appends up to limit of the oldest rows to the sheet and deletes them
+// once the append succeeded. A failed append leaves every row buffered.
+func (b *Buffer) Flush(ctx context.Context, w *Writer, limit int) (int, error) {
+	iter := b.client.Collection(namespace.Collection(collection)).OrderBy("at", firestore.Asc).Limit(limit).Documents(ctx)
+	defer iter.Stop()
+	refs := []*firestore.DocumentRef{}
+	rows := []Row{}
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("firestore.DocumentIterator.Next failed; %w", err)
+		}
+		var row Row
+		if err := snap.DataTo(&row); err != nil {
+			return 0, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+		}
+		refs = append(refs, snap.Ref)
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	if err := w.Append(ctx, rows); err != nil {
+		return 0, err
+	}
+	batch := b.client.Batch()
+	for _, ref := range refs {
+		batch.Delete(ref)
+	}
+	if _, err := batch.Commit(ctx); err != nil {
+		return len(rows), fmt.Errorf("firestore.WriteBatch.Commit failed; %w", err)
+	}
+	return len(rows), nil
+}
+
+// Writer appends rows to a range of a spreadsheet the service account has
+// been given edit access to.
+type Writer struct {
+	service       *gsheets.Service
+	spreadsheetID string
+	sheetRange    string
+}
+
+func NewWriter(ctx context.Context, spreadsheetID, sheetRange string) (*Writer, error) {
+	service, err := gsheets.NewService(ctx, option.WithScopes(gsheets.SpreadsheetsScope))
+	if err != nil {
+		return nil, fmt.Errorf("sheets.NewService failed; %w", err)
+	}
+	return &Writer{service: service, spreadsheetID: spreadsheetID, sheetRange: sheetRange}, nil
+}
+
+func (w *Writer) Append(ctx context.Context, rows []Row) error {
+	values := make([][]interface{}, 0, len(rows))
+	for _, row := range rows {
+		values = append(values, row.values())
+	}
+	call := w.service.Spreadsheets.Values.Append(w.spreadsheetID, w.sheetRange, &gsheets.ValueRange{Values: values})
+	if _, err := call.ValueInputOption("RAW").InsertDataOption("INSERT_ROWS").Context(ctx).Do(); err != nil {
+		return fmt.Errorf("sheets.SpreadsheetsValuesAppendCall.Do failed; %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/messenger"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/postback"
+	"github.com/hsmtkk/ubiquitous-couscous/function/slackapi"
+)
+
+const (
+	// a slash command looks this far back for the image to analyze
+	slackHistoryLimit = 20
+
+	slackAuthorizeURL = "https://slack.com/oauth/v2/authorize"
+	// the scopes the app asks for unless SLACK_SCOPES names others
+	defaultSlackScopes = "channels:history,chat:write,commands,files:read"
+	// an install has this long from "Add to Slack" to coming back
+	slackStateTTL    = 10 * time.Minute
+	slackStateAction = "slack-install"
+)
+
+// slackWorkspace on slackWorkspaces/{teamId} records an install of the app;
+// the bot token itself is kept in the secret TokenSecret names.
+type slackWorkspace struct {
+	TeamID      string    `firestore:"teamId"`
+	TeamName    string    `firestore:"teamName"`
+	BotUserID   string    `firestore:"botUserId"`
+	Scope       string    `firestore:"scope"`
+	TokenSecret string    `firestore:"tokenSecret"`
+	InstalledAt time.Time `firestore:"installedAt"`
+}
+
+// slackTokenSecret names the secret with the bot token of teamID. Without a
+// team, the app installed to a single workspace, it is slack-bot-token.
+func slackTokenSecret(teamID string) string {
+	if teamID == "" {
+		return "slack-bot-token"
+	}
+	return "slack-bot-token-" + strings.ToLower(teamID)
+}
+
+func slackClient(ctx context.Context, projectID, teamID string) (slackapi.Client, error) {
+	token, err := getSecret(ctx, projectID, slackTokenSecret(teamID))
+	if err != nil {
+		return slackapi.Client{}, err
+	}
+	return slackapi.Client{Token: token}, nil
+}
+
+// slackEvents receives the Events API callbacks and the slash command of
+// the Slack app, both signed with the slack-signing-secret secret. A
+// file_shared image, or for the slash command the latest image of the
+// channel, goes through the pipeline and is answered in its thread.
+func slackEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "slack"})
+	logging.Printf(ctx, "slack")
+
+	projectID := os.Getenv("PROJECT_ID")
+	signingSecret, err := getSecret(ctx, projectID, "slack-signing-secret")
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("io.ReadAll failed; %w", err))
+		return
+	}
+	if err := slackapi.Verify(signingSecret, r.Header, body, time.Now()); err != nil {
+		returnError(ctx, w, http.StatusUnauthorized, err)
+		return
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		slackCommand(ctx, w, projectID, body)
+		return
+	}
+
+	var callback struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		TeamID    string `json:"team_id"`
+		EventID   string `json:"event_id"`
+		Event     struct {
+			Type      string `json:"type"`
+			FileID    string `json:"file_id"`
+			UserID    string `json:"user_id"`
+			ChannelID string `json:"channel_id"`
+		} `json:"event"`
+	}
+	if err := json.Unmarshal(body, &callback); err != nil {
+		returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("json.Unmarshal failed; %w", err))
+		return
+	}
+	switch {
+	case callback.Type == "url_verification":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(callback.Challenge))
+		return
+	case callback.Type != "event_callback" || callback.Event.Type != "file_shared":
+		logging.Printf(ctx, "skip slack %s %s", callback.Type, callback.Event.Type)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	evt := callback.Event
+	client, err := slackClient(ctx, projectID, callback.TeamID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	file, err := client.FileInfo(ctx, evt.FileID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	if !strings.HasPrefix(file.Mimetype, "image/") {
+		logging.Printf(ctx, "skip slack file; %s", file.Mimetype)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	thread := ""
+	if share, ok := file.ShareIn(evt.ChannelID); ok {
+		thread = share.ThreadTS
+		if thread == "" {
+			thread = share.TS
+		}
+	}
+	// Slack retries a callback it got no answer for with the same event ID,
+	// which the completion markers recognize
+	if err := enqueueSlackImage(ctx, callback.EventID, callback.TeamID, evt.UserID, evt.ChannelID, thread, evt.FileID); err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// slackCommand answers the slash command by analyzing the latest image
+// posted in the channel.
+func slackCommand(ctx context.Context, w http.ResponseWriter, projectID string, body []byte) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("url.ParseQuery failed; %w", err))
+		return
+	}
+	teamID, channelID, userID := form.Get("team_id"), form.Get("channel_id"), form.Get("user_id")
+	respond := func(text string) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]string{"response_type": "ephemeral", "text": text}); err != nil {
+			logging.Errorf(ctx, "json.Encoder.Encode failed; %v", err)
+		}
+	}
+	client, err := slackClient(ctx, projectID, teamID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	messages, err := client.History(ctx, channelID, slackHistoryLimit)
+	if err != nil {
+		// most likely the bot is not a member of the channel
+		logging.Errorf(ctx, "slack history failed; %v", err)
+		respond("I cannot read this channel. Invite me to it first.")
+		return
+	}
+	for _, m := range messages {
+		for _, f := range m.Files {
+			if !strings.HasPrefix(f.Mimetype, "image/") {
+				continue
+			}
+			thread := m.ThreadTS
+			if thread == "" {
+				thread = m.TS
+			}
+			if err := enqueueSlackImage(ctx, newCorrelationID(), teamID, userID, channelID, thread, f.ID); err != nil {
+				returnError(ctx, w, http.StatusInternalServerError, err)
+				return
+			}
+			respond("Looking at the latest image; the labels will be posted in its thread.")
+			return
+		}
+	}
+	respond("No image among the recent messages of this channel. Share one and try again.")
+}
+
+func enqueueSlackImage(ctx context.Context, correlationID, teamID, userID, channelID, thread, fileID string) error {
+	userIDHash := logging.HashUserID("slack:" + teamID + ":" + userID)
+	ctx = logging.With(ctx, logging.Fields{CorrelationID: correlationID, UserIDHash: userIDHash, ImageID: fileID})
+	mode := dynconfig.Get(ctx, "ANALYSIS_MODE")
+	if mode == "" {
+		mode = modeLabels
+	}
+	msg := processMessage{
+		CorrelationID: correlationID,
+		UserIDHash:    userIDHash,
+		ImageID:       fileID,
+		Mode:          mode,
+		ReceivedAt:    time.Now(),
+		Destination: &messenger.Destination{
+			Platform:  messenger.PlatformSlack,
+			Workspace: teamID,
+			ChatID:    channelID,
+			ThreadID:  thread,
+		},
+	}
+	_, err := publishProcessMessage(ctx, msg)
+	recordRecent(logging.FromContext(ctx), "slack", err)
+	return err
+}
+
+// downloadSlackImage fetches the file fileID of the workspace teamID.
+func downloadSlackImage(ctx context.Context, projectID, teamID, fileID string) ([]byte, error) {
+	client, err := slackClient(ctx, projectID, teamID)
+	if err != nil {
+		return nil, err
+	}
+	file, err := client.FileInfo(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	return client.Download(ctx, file.URLPrivateDownload)
+}
+
+// slackInstall is what the app's "Add to Slack" button links to. Without
+// a code it sends the browser on to Slack with a state signed with the
+// client secret; Slack sends it back with the code, which is exchanged for
+// the bot token of the workspace once the state checks out. The token is
+// kept with the SECRET_BACKEND, the install itself on
+// slackWorkspaces/{teamId}.
+func slackInstall(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "slackInstall"})
+	logging.Printf(ctx, "slack install")
+
+	projectID := os.Getenv("PROJECT_ID")
+	clientSecret, err := getSecret(ctx, projectID, "slack-client-secret")
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	codec := postback.NewCodec([]byte(clientSecret), 0)
+	query := r.URL.Query()
+	code := query.Get("code")
+	if code == "" && query.Get("error") == "" {
+		state, err := codec.Encode(slackStateAction, nil)
+		if err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		scopes := os.Getenv("SLACK_SCOPES")
+		if scopes == "" {
+			scopes = defaultSlackScopes
+		}
+		authorize := url.Values{"client_id": {os.Getenv("SLACK_CLIENT_ID")}, "scope": {scopes}, "state": {state}}
+		if redirectURI := os.Getenv("SLACK_REDIRECT_URI"); redirectURI != "" {
+			authorize.Set("redirect_uri", redirectURI)
+		}
+		http.Redirect(w, r, slackAuthorizeURL+"?"+authorize.Encode(), http.StatusFound)
+		return
+	}
+	if code == "" {
+		returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("missing code; %s", query.Get("error")))
+		return
+	}
+	// the state slackInstall signed less than slackStateTTL ago
+	if _, err := codec.DecodeAction(query.Get("state"), slackStateAction, slackStateTTL, time.Now()); err != nil {
+		returnError(ctx, w, http.StatusForbidden, fmt.Errorf("invalid state; %w", err))
+		return
+	}
+	install, err := slackapi.Client{}.OAuthAccess(ctx, os.Getenv("SLACK_CLIENT_ID"), clientSecret, code, os.Getenv("SLACK_REDIRECT_URI"))
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	workspace := slackWorkspace{
+		TeamID:      install.Team.ID,
+		TeamName:    install.Team.Name,
+		BotUserID:   install.BotUserID,
+		Scope:       install.Scope,
+		TokenSecret: slackTokenSecret(install.Team.ID),
+		InstalledAt: time.Now(),
+	}
+	if err := putSecret(ctx, projectID, workspace.TokenSecret, install.AccessToken); err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := client.Collection(namespace.Collection("slackWorkspaces")).Doc(workspace.TeamID).Set(ctx, workspace); err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, fmt.Errorf("firestore.DocumentRef.Set failed; %w", err))
+		return
+	}
+	logging.Printf(ctx, "slack workspace %s installed", workspace.TeamID)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Installed to %s. Share an image in a channel the bot is in.", workspace.TeamName)
+}
@@ -0,0 +1,210 @@
+// Package slackapi is the part of the Slack Web API the bot takes images
+// in with: request signatures, files, channel history and the OAuth
+// install. Replies go through messenger.Slack.
+package slackapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultBaseURL = "https://slack.com/api"
+
+// maxSkew is how old a signed request may be before it counts as a replay.
+const maxSkew = 5 * time.Minute
+
+var ErrInvalidSignature = errors.New("invalid slack signature")
+
+// Verify checks the X-Slack-Signature of a request against the app's
+// signing secret.
+func Verify(signingSecret string, header http.Header, body []byte, now time.Time) error {
+	ts := header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if skew := now.Sub(time.Unix(sec, 0)); skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("%w; timestamp %s", ErrInvalidSignature, ts)
+	}
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	fmt.Fprintf(mac, "v0:%s:", ts)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// File is what files.info and message events tell about a file.
+type File struct {
+	ID                 string `json:"id"`
+	Mimetype           string `json:"mimetype"`
+	URLPrivateDownload string `json:"url_private_download"`
+	Shares             struct {
+		Public  map[string][]Share `json:"public"`
+		Private map[string][]Share `json:"private"`
+	} `json:"shares"`
+}
+
+// Share is a message the file was posted with.
+type Share struct {
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+}
+
+// ShareIn returns the first message the file was posted with in channel.
+func (f File) ShareIn(channel string) (Share, bool) {
+	for _, shares := range []map[string][]Share{f.Shares.Public, f.Shares.Private} {
+		if s := shares[channel]; len(s) > 0 {
+			return s[0], true
+		}
+	}
+	return Share{}, false
+}
+
+// Message is a message of conversations.history.
+type Message struct {
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+	User     string `json:"user"`
+	Files    []File `json:"files"`
+}
+
+// Client calls the Web API with the bot token of a workspace.
+type Client struct {
+	Token      string
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+func (c Client) FileInfo(ctx context.Context, fileID string) (File, error) {
+	var resp struct {
+		File File `json:"file"`
+	}
+	if err := c.call(ctx, "files.info", url.Values{"file": {fileID}}, &resp); err != nil {
+		return File{}, err
+	}
+	return resp.File, nil
+}
+
+// History returns the latest limit messages of channel, newest first.
+func (c Client) History(ctx context.Context, channel string, limit int) ([]Message, error) {
+	var resp struct {
+		Messages []Message `json:"messages"`
+	}
+	if err := c.call(ctx, "conversations.history", url.Values{"channel": {channel}, "limit": {strconv.Itoa(limit)}}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Messages, nil
+}
+
+// Download fetches a private file URL, which needs the bot token.
+func (c Client) Download(ctx context.Context, fileURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http.Client.Do failed; %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s failed; %d", fileURL, res.StatusCode)
+	}
+	// without a valid token Slack answers with its login page
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		return nil, fmt.Errorf("GET %s failed; not authorized", fileURL)
+	}
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	return b, nil
+}
+
+// Installation is the result of installing the app to a workspace.
+type Installation struct {
+	AccessToken string `json:"access_token"`
+	BotUserID   string `json:"bot_user_id"`
+	Scope       string `json:"scope"`
+	Team        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"team"`
+}
+
+// OAuthAccess exchanges the code of the OAuth redirect for the bot token of
+// the workspace that installed the app. Client needs no token for it.
+func (c Client) OAuthAccess(ctx context.Context, clientID, clientSecret, code, redirectURI string) (Installation, error) {
+	form := url.Values{"client_id": {clientID}, "client_secret": {clientSecret}, "code": {code}}
+	if redirectURI != "" {
+		form.Set("redirect_uri", redirectURI)
+	}
+	var resp Installation
+	if err := c.call(ctx, "oauth.v2.access", form, &resp); err != nil {
+		return Installation{}, err
+	}
+	return resp, nil
+}
+
+func (c Client) call(ctx context.Context, method string, form url.Values, resp interface{}) error {
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/"+method, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("http.Client.Do failed; %w", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack %s failed; %d %s", method, res.StatusCode, body)
+	}
+	var status struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	if !status.OK {
+		return fmt.Errorf("slack %s failed; %s", method, status.Error)
+	}
+	if err := json.Unmarshal(body, resp); err != nil {
+		return fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	return nil
+}
+
+func (c Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
@@ -0,0 +1,186 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/slo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// sloReply is met by replies delivered within SLO_REPLY_SECONDS of
+	// the webhook.
+	sloReply = "reply"
+	// sloPipeline is met by messages the pipeline events record as replied
+	// rather than failed.
+	sloPipeline = "pipeline"
+
+	defaultSLOTarget       = 0.99
+	defaultSLOReplyLatency = 10 * time.Second
+	defaultSLOWindow       = 24 * time.Hour
+	defaultSLOAlertRepeat  = time.Hour
+)
+
+// sloTracking turns on recording events for the SLOs, SLO_TRACKING.
+func sloTracking(ctx context.Context) bool {
+	return dynconfig.Get(ctx, "SLO_TRACKING") == "true"
+}
+
+func sloStepObjective(step string) string {
+	return "step:" + step
+}
+
+func sloFunctionObjective(function string) string {
+	return "function:" + function
+}
+
+// trackSLO records events; failing to is only logged.
+func trackSLO(ctx context.Context, events ...slo.Event) {
+	if !sloTracking(ctx) || len(events) == 0 {
+		return
+	}
+	client, err := clients.Firestore(ctx, projectIDOf(ctx))
+	if err != nil {
+		logging.Errorf(ctx, "clients.Firestore failed; %v", err)
+		return
+	}
+	if err := slo.NewTracker(client).Record(ctx, time.Now(), events...); err != nil {
+		logging.Errorf(ctx, "record SLO events failed; %v", err)
+	}
+}
+
+// trackReply counts a reply as good when it was delivered within the reply
+// latency objective; replies without a receive time are not counted.
+func trackReply(ctx context.Context, receivedAt time.Time, err error) {
+	if receivedAt.IsZero() {
+		return
+	}
+	trackSLO(ctx, slo.Event{Objective: sloReply, Good: err == nil && time.Since(receivedAt) <= sloReplyLatency(ctx)})
+}
+
+func sloReplyLatency(ctx context.Context) time.Duration {
+	if n, err := strconv.ParseFloat(dynconfig.Get(ctx, "SLO_REPLY_SECONDS"), 64); err == nil && n > 0 {
+		return time.Duration(n * float64(time.Second))
+	}
+	return defaultSLOReplyLatency
+}
+
+// sloTarget reads SLO_TARGET_<OBJECTIVE>, e.g. SLO_TARGET_STEP_LABELS, and
+// falls back to SLO_TARGET and then to 99%.
+func sloTarget(ctx context.Context, objective string) float64 {
+	key := "SLO_TARGET_" + strings.ToUpper(strings.NewReplacer(":", "_", "-", "_").Replace(objective))
+	for _, k := range []string{key, "SLO_TARGET"} {
+		if v, err := strconv.ParseFloat(dynconfig.Get(ctx, k), 64); err == nil && v > 0 && v < 1 {
+			return v
+		}
+	}
+	return defaultSLOTarget
+}
+
+func sloWindow(ctx context.Context) time.Duration {
+	if n, err := strconv.Atoi(dynconfig.Get(ctx, "SLO_WINDOW_HOURS")); err == nil && n > 0 {
+		return time.Duration(n) * time.Hour
+	}
+	return defaultSLOWindow
+}
+
+func sloStatuses(ctx context.Context, client *firestore.Client) ([]slo.Status, error) {
+	target := func(objective string) float64 { return sloTarget(ctx, objective) }
+	return slo.NewTracker(client).Evaluate(ctx, time.Now(), sloWindow(ctx), target, slo.DefaultAlerts)
+}
+
+// sloAlert remembers on sloAlerts/{objective} when an objective was last
+// alerted on.
+type sloAlert struct {
+	At       time.Time `firestore:"at"`
+	Alerting []string  `firestore:"alerting"`
+}
+
+// sloCheck is invoked by Cloud Scheduler and notifies the admins of the
+// objectives whose error budget burns faster than an alert allows, at most
+// once per SLO_ALERT_REPEAT_MINUTES for each.
+func sloCheck(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "sloCheck"})
+	logging.Printf(ctx, "slo check")
+
+	projectID := os.Getenv("PROJECT_ID")
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	statuses, err := sloStatuses(ctx, client)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	repeat := defaultSLOAlertRepeat
+	if n, err := strconv.Atoi(dynconfig.Get(ctx, "SLO_ALERT_REPEAT_MINUTES")); err == nil && n > 0 {
+		repeat = time.Duration(n) * time.Minute
+	}
+	alerted := []string{}
+	for _, s := range statuses {
+		if len(s.Alerting) == 0 {
+			continue
+		}
+		ref := client.Collection(namespace.Collection("sloAlerts")).Doc(s.Objective)
+		snap, err := ref.Get(ctx)
+		if err != nil && status.Code(err) != codes.NotFound {
+			returnError(ctx, w, http.StatusInternalServerError, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err))
+			return
+		}
+		var last sloAlert
+		if err == nil {
+			if err := snap.DataTo(&last); err != nil {
+				returnError(ctx, w, http.StatusInternalServerError, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err))
+				return
+			}
+		}
+		if time.Since(last.At) < repeat {
+			continue
+		}
+		logging.Warnf(ctx, "SLO %s burning its error budget; %v", s.Objective, s.BurnRates)
+		if err := notifyAdmins(ctx, formatSLOAlert(s)); err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		if _, err := ref.Set(ctx, sloAlert{At: time.Now(), Alerting: s.Alerting}); err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, fmt.Errorf("firestore.DocumentRef.Set failed; %w", err))
+			return
+		}
+		alerted = append(alerted, s.Objective)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"statuses": statuses, "alerted": alerted}); err != nil {
+		logging.Errorf(ctx, "json.Encoder.Encode failed; %v", err)
+	}
+}
+
+func formatSLOAlert(s slo.Status) string {
+	lines := []string{
+		fmt.Sprintf("SLO alert: %s", s.Objective),
+		fmt.Sprintf("%.2f%% good of %d in %.0fh, target %.2f%%", s.Compliance*100, s.Total, s.WindowHours, s.Target*100),
+		fmt.Sprintf("error budget left: %.0f%%", s.BudgetRemaining*100),
+	}
+	for _, window := range s.Alerting {
+		lines = append(lines, fmt.Sprintf("burn rate over %s: %.1f", window, s.BurnRates[window]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatSLOStatus(s slo.Status) string {
+	return fmt.Sprintf("%s: %.2f%% of %d (target %.2f%%, budget %.0f%%)", s.Objective, s.Compliance*100, s.Total, s.Target*100, s.BudgetRemaining*100)
+}
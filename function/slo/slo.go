@@ -0,0 +1,201 @@
+// Package slo keeps good and bad events per objective in five minute
+// buckets and evaluates them against a target, the fraction of events that
+// must be good, over a rolling window.
+package slo
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	Collection = "sloWindows"
+	BucketSize = 5 * time.Minute
+	// every event of an instance lands in one bucket, so writes are spread
+	// over shards to stay below a document's sustained write rate
+	bucketShards = 16
+)
+
+// Event is one outcome of an objective, such as a reply or a pipeline step.
+type Event struct {
+	Objective string
+	Good      bool
+}
+
+type Counts struct {
+	Good  int64 `firestore:"good" json:"good"`
+	Total int64 `firestore:"total" json:"total"`
+}
+
+func (c Counts) Bad() int64 {
+	return c.Total - c.Good
+}
+
+// Compliance is the fraction of good events, 1 without any.
+func (c Counts) Compliance() float64 {
+	if c.Total == 0 {
+		return 1
+	}
+	return float64(c.Good) / float64(c.Total)
+}
+
+func (c *Counts) add(o Counts) {
+	c.Good += o.Good
+	c.Total += o.Total
+}
+
+// BurnRate is how many times faster than the target allows the error budget
+// is spent; 1 uses it up exactly at the end of the window.
+func BurnRate(c Counts, target float64) float64 {
+	if c.Total == 0 || target >= 1 {
+		return 0
+	}
+	return float64(c.Bad()) / float64(c.Total) / (1 - target)
+}
+
+// Alert fires when the budget burns faster than BurnRate over Window.
+type Alert struct {
+	Window   time.Duration
+	BurnRate float64
+}
+
+// DefaultAlerts page when a 30 day budget would be gone within about two
+// days, or within five days if it keeps up for six hours.
+var DefaultAlerts = []Alert{{Window: time.Hour, BurnRate: 14.4}, {Window: 6 * time.Hour, BurnRate: 6}}
+
+type Status struct {
+	Objective   string  `json:"objective"`
+	Target      float64 `json:"target"`
+	WindowHours float64 `json:"windowHours"`
+	Counts
+	Compliance float64 `json:"compliance"`
+	// BudgetRemaining is the fraction of the window's error budget left,
+	// below 0 once it is overspent.
+	BudgetRemaining float64 `json:"budgetRemaining"`
+	// BurnRates are keyed by the alert window, such as "1h0m0s".
+	BurnRates map[string]float64 `json:"burnRates"`
+	// Alerting names the alert windows whose burn rate is exceeded.
+	Alerting []string `json:"alerting,omitempty"`
+}
+
+type bucket struct {
+	Start      time.Time         `firestore:"start"`
+	Objectives map[string]Counts `firestore:"objectives"`
+}
+
+type Tracker struct {
+	client *firestore.Client
+}
+
+func NewTracker(client *firestore.Client) *Tracker {
+	return &Tracker{client: client}
+}
+
+// Record adds events to a random shard of the bucket of at in a single
+// write. Evaluate sums the shards.
+func (t *Tracker) Record(ctx context.Context, at time.Time, events ...Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	start := at.UTC().Truncate(BucketSize)
+	objectives := map[string]interface{}{}
+	good := map[string]int64{}
+	total := map[string]int64{}
+	for _, e := range events {
+		total[e.Objective]++
+		if e.Good {
+			good[e.Objective]++
+		}
+	}
+	for objective, n := range total {
+		objectives[objective] = map[string]interface{}{
+			"good":  firestore.Increment(good[objective]),
+			"total": firestore.Increment(n),
+		}
+	}
+	data := map[string]interface{}{"start": start, "objectives": objectives}
+	if _, err := t.client.Collection(namespace.Collection(Collection)).Doc(fmt.Sprintf("%s-%02d", start.Format("20060102T1504"), rand.Intn(bucketShards))).Set(ctx, data, firestore.MergeAll); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Set failed; %w", err)
+	}
+	return nil
+}
+
+// Evaluate returns the status of every objective with events in the window
+// ending at now. target gives the target of an objective.
+func (t *Tracker) Evaluate(ctx context.Context, now time.Time, window time.Duration, target func(objective string) float64, alerts []Alert) ([]Status, error) {
+	longest := window
+	for _, a := range alerts {
+		if a.Window > longest {
+			longest = a.Window
+		}
+	}
+	buckets, err := t.buckets(ctx, now.Add(-longest))
+	if err != nil {
+		return nil, err
+	}
+	sum := func(objective string, since time.Time) Counts {
+		var c Counts
+		for _, b := range buckets {
+			// a bucket counts once it started within the window
+			if !b.Start.Before(since.Truncate(BucketSize)) {
+				c.add(b.Objectives[objective])
+			}
+		}
+		return c
+	}
+	names := []string{}
+	seen := map[string]bool{}
+	for _, b := range buckets {
+		for objective := range b.Objectives {
+			if !seen[objective] {
+				seen[objective] = true
+				names = append(names, objective)
+			}
+		}
+	}
+
+	sort.Strings(names)
+	statuses := make([]Status, 0, len(names))
+	for _, objective := range names {
+		s := Status{Objective: objective, Target: target(objective), WindowHours: window.Hours(), BurnRates: map[string]float64{}}
+		s.Counts = sum(objective, now.Add(-window))
+		s.Compliance = s.Counts.Compliance()
+		s.BudgetRemaining = 1 - BurnRate(s.Counts, s.Target)
+		for _, a := range alerts {
+			rate := BurnRate(sum(objective, now.Add(-a.Window)), s.Target)
+			s.BurnRates[a.Window.String()] = rate
+			if rate > a.BurnRate {
+				s.Alerting = append(s.Alerting, a.Window.String())
+			}
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+func (t *Tracker) buckets(ctx context.Context, since time.Time) ([]bucket, error) {
+	iter := t.client.Collection(namespace.Collection(Collection)).Where("start", ">=", since.UTC().Truncate(BucketSize)).Documents(ctx)
+	defer iter.Stop()
+	buckets := []bucket{}
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return buckets, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestore.DocumentIterator.Next failed; %w", err)
+		}
+		var b bucket
+		if err := snap.DataTo(&b); err != nil {
+			return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+		}
+		buckets = append(buckets, b)
+	}
+}
@@ -0,0 +1,200 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/phash"
+	"github.com/hsmtkk/ubiquitous-couscous/function/ratelimit"
+	"github.com/hsmtkk/ubiquitous-couscous/function/spam"
+	"github.com/hsmtkk/ubiquitous-couscous/function/workflow"
+)
+
+const (
+	defaultSpamSharedImageUsers = 20
+	defaultSpamMaxPerHour       = 200
+	// a rate limited sender gets one picture analyzed per interval
+	defaultSpamLimitInterval = 10 * time.Minute
+
+	spamActionLimit = "limit"
+
+	defaultSpamFlags = 50
+	maxSpamFlags     = 500
+	// flags expire this long after the last picture that raised them,
+	// RETENTION_DAYS_SPAMFLAGS
+	defaultSpamFlagDays = 30
+)
+
+func spamCheckEnabled(ctx context.Context) bool {
+	return dynconfig.Get(ctx, "SPAM_CHECK") == "true"
+}
+
+func spamSetting(ctx context.Context, key string, fallback int) int {
+	if n, err := strconv.Atoi(dynconfig.Get(ctx, key)); err == nil && n >= 0 {
+		return n
+	}
+	return fallback
+}
+
+// spamConfig reads SPAM_SHARED_IMAGE_USERS and SPAM_BAD_HASHES, a comma
+// separated list of perceptual hashes.
+func spamConfig(ctx context.Context) spam.Config {
+	cfg := spam.Config{
+		SharedImageUsers: spamSetting(ctx, "SPAM_SHARED_IMAGE_USERS", defaultSpamSharedImageUsers),
+		Distance:         duplicateDistance,
+		FlagTTL:          retention("spamFlags", defaultSpamFlagDays),
+	}
+	for _, s := range strings.Split(dynconfig.Get(ctx, "SPAM_BAD_HASHES"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		hash, err := phash.Parse(s)
+		if err != nil {
+			logging.Errorf(ctx, "invalid SPAM_BAD_HASHES entry %q; %v", s, err)
+			continue
+		}
+		cfg.BadHashes = append(cfg.BadHashes, hash)
+	}
+	return cfg
+}
+
+// spamStep flags senders of pictures that look like spam, a no-op unless
+// SPAM_CHECK=true. Flagged senders are dropped silently, or with
+// SPAM_ACTION=limit get one picture analyzed per SPAM_LIMIT_INTERVAL. The
+// check fails open: a broken check must not stop the bot.
+func spamStep(ctx context.Context, state *pipelineState, params map[string]string) error {
+	userIDHash := state.procMsg.UserIDHash
+	if !spamCheckEnabled(ctx) || userIDHash == "" {
+		return nil
+	}
+	hash, err := phash.FromBytes(state.image)
+	if err != nil {
+		logging.Printf(ctx, "skip spam check; %v", err)
+		return nil
+	}
+	client, err := clients.Firestore(ctx, state.projectID)
+	if err != nil {
+		return err
+	}
+	detector := spam.New(client, spamConfig(ctx))
+	flag, err := detector.Flagged(ctx, userIDHash)
+	if err != nil {
+		logging.Errorf(ctx, "spam check failed; %v", err)
+		return nil
+	}
+	reason, err := detector.Check(ctx, userIDHash, hash)
+	if err != nil {
+		logging.Errorf(ctx, "spam check failed; %v", err)
+		return nil
+	}
+	if reason == "" && tooFrequent(ctx, userIDHash) {
+		reason = spam.ReasonFrequency
+	}
+	if reason != "" {
+		logging.Warnf(ctx, "spam flagged; %s", reason)
+		if err := detector.Flag(ctx, userIDHash, state.procMsg.ImageID, reason); err != nil {
+			logging.Errorf(ctx, "spam flag failed; %v", err)
+			return nil
+		}
+	} else if flag == nil {
+		return nil
+	}
+
+	if dynconfig.Get(ctx, "SPAM_ACTION") == spamActionLimit {
+		interval := defaultSpamLimitInterval
+		if d, err := time.ParseDuration(dynconfig.Get(ctx, "SPAM_LIMIT_INTERVAL")); err == nil && d > 0 {
+			interval = d
+		}
+		allowed, err := detector.Allow(ctx, userIDHash, interval)
+		if err != nil {
+			logging.Errorf(ctx, "spam limit failed; %v", err)
+			return nil
+		}
+		if allowed {
+			return nil
+		}
+	}
+	logging.Warnf(ctx, "drop spam")
+	state.spam = true
+	return workflow.ErrStop
+}
+
+// tooFrequent counts the picture against SPAM_MAX_PER_HOUR, apart from the
+// per minute RATE_LIMIT_PER_MINUTE.
+func tooFrequent(ctx context.Context, userIDHash string) bool {
+	limit := spamSetting(ctx, "SPAM_MAX_PER_HOUR", defaultSpamMaxPerHour)
+	if limit == 0 {
+		return false
+	}
+	limiter, err := ratelimit.Open(ctx, cache.ConfigFromEnv(), limit, time.Hour)
+	if err != nil {
+		logging.Errorf(ctx, "spam frequency check failed; %v", err)
+		return false
+	}
+	defer limiter.Close()
+	return !allowImage(ctx, limiter, "spam-"+userIDHash)
+}
+
+// spamFlags lets admins review flagged senders: GET lists them, most
+// recently flagged first, and DELETE with userIdHash clears one.
+func spamFlags(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "spamFlags"})
+	logging.Printf(ctx, "spam flags")
+
+	ctx, err := requestTenant(ctx, r)
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	client, err := clients.Firestore(ctx, projectIDOf(ctx))
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	detector := spam.New(client, spam.Config{})
+
+	switch r.Method {
+	case http.MethodGet:
+		limit := defaultSpamFlags
+		if value := r.URL.Query().Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 || n > maxSpamFlags {
+				returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("invalid limit; %s", value))
+				return
+			}
+			limit = n
+		}
+		flags, err := detector.List(ctx, limit)
+		if err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"flags": flags}); err != nil {
+			logging.Errorf(ctx, "json.Encoder.Encode failed; %v", err)
+		}
+	case http.MethodDelete:
+		userIDHash := r.URL.Query().Get("userIdHash")
+		if userIDHash == "" {
+			returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("userIdHash is required"))
+			return
+		}
+		if err := detector.Clear(ctx, userIDHash); err != nil {
+			returnError(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		logging.Printf(ctx, "spam flag cleared; %s", userIDHash)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		returnError(ctx, w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed; %s", r.Method))
+	}
+}
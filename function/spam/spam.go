@@ -0,0 +1,263 @@
+// Package spam flags senders whose images look like spam: the same picture
+// sent by many users, known bad pictures, or far too many pictures.
+package spam
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/phash"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ReasonSharedImage = "shared-image"
+	ReasonBadHash     = "bad-hash"
+	ReasonFrequency   = "frequency"
+)
+
+const (
+	FlagsCollection  = "spamFlags"
+	ImagesCollection = "spamImages"
+	// SharedImageWindow is how recently the users of a picture must have
+	// sent it to count towards SharedImageUsers.
+	SharedImageWindow = 24 * time.Hour
+)
+
+type Config struct {
+	// SharedImageUsers is how many users sending the same picture on one
+	// day makes it spam; 0 turns the check off.
+	SharedImageUsers int
+	// BadHashes are perceptual hashes of known spam pictures.
+	BadHashes []phash.Hash
+	// Distance is how many bits hashes may differ in to be the same picture.
+	Distance int
+	// FlagTTL is how long a flag holds after the last picture that raised
+	// it; 0 keeps flags until they are cleared.
+	FlagTTL time.Duration
+}
+
+// Flag lives on spamFlags/{userIdHash} until an admin clears it or it
+// expires.
+type Flag struct {
+	UserIDHash     string    `firestore:"-" json:"userIdHash"`
+	Reason         string    `firestore:"reason" json:"reason"`
+	Count          int       `firestore:"count" json:"count"`
+	FirstFlaggedAt time.Time `firestore:"firstFlaggedAt" json:"firstFlaggedAt"`
+	LastFlaggedAt  time.Time `firestore:"lastFlaggedAt" json:"lastFlaggedAt"`
+	LastImageID    string    `firestore:"lastImageId" json:"lastImageId"`
+	// LastAllowedAt is when a rate limited sender last got through.
+	LastAllowedAt time.Time `firestore:"lastAllowedAt" json:"lastAllowedAt,omitempty"`
+}
+
+// sharedImage lives on spamImages/{hash}. Users are those who sent the
+// picture within SharedImageWindow, SentAt when each last did. Once enough
+// did, the picture is Spam for everyone sending it, whenever they do, and
+// Users stops growing.
+type sharedImage struct {
+	Users      []string             `firestore:"users"`
+	SentAt     map[string]time.Time `firestore:"sentAt"`
+	Spam       bool                 `firestore:"spam"`
+	LastSentAt time.Time            `firestore:"lastSentAt"`
+}
+
+type Detector struct {
+	client *firestore.Client
+	cfg    Config
+}
+
+func New(client *firestore.Client, cfg Config) *Detector {
+	return &Detector{client: client, cfg: cfg}
+}
+
+func (d *Detector) flags() *firestore.CollectionRef {
+	return d.client.Collection(namespace.Collection(FlagsCollection))
+}
+
+func (d *Detector) images() *firestore.CollectionRef {
+	return d.client.Collection(namespace.Collection(ImagesCollection))
+}
+
+// Check records that userIDHash sent a picture of hash and returns why it
+// looks like spam, "" if it does not.
+func (d *Detector) Check(ctx context.Context, userIDHash string, hash phash.Hash) (string, error) {
+	for _, bad := range d.cfg.BadHashes {
+		if phash.Distance(hash, bad) <= d.cfg.Distance {
+			return ReasonBadHash, nil
+		}
+	}
+	if d.cfg.SharedImageUsers <= 0 {
+		return "", nil
+	}
+	// exact hashes only; near duplicates across users would need a scan
+	ref := d.images().Doc(hash.String())
+	shared := false
+	err := d.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var image sharedImage
+		snap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			if err := snap.DataTo(&image); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		shared = image.Spam
+		if image.Spam {
+			return tx.Update(ref, []firestore.Update{{Path: "lastSentAt", Value: now}})
+		}
+		users := []string{}
+		sentAt := map[string]time.Time{}
+		for _, user := range image.Users {
+			if at := image.SentAt[user]; user != userIDHash && now.Sub(at) < SharedImageWindow {
+				users = append(users, user)
+				sentAt[user] = at
+			}
+		}
+		image.Users = append(users, userIDHash)
+		sentAt[userIDHash] = now
+		image.SentAt = sentAt
+		image.LastSentAt = now
+		image.Spam = len(image.Users) >= d.cfg.SharedImageUsers
+		shared = image.Spam
+		return tx.Set(ref, image)
+	})
+	if err != nil {
+		return "", fmt.Errorf("firestore.Client.RunTransaction failed; %w", err)
+	}
+	if shared {
+		return ReasonSharedImage, nil
+	}
+	return "", nil
+}
+
+// Flagged returns the flag of userIDHash, nil if the sender is not flagged.
+func (d *Detector) Flagged(ctx context.Context, userIDHash string) (*Flag, error) {
+	snap, err := d.flags().Doc(userIDHash).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	var flag Flag
+	if err := snap.DataTo(&flag); err != nil {
+		return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+	}
+	if d.cfg.FlagTTL > 0 && time.Since(flag.LastFlaggedAt) > d.cfg.FlagTTL {
+		// expired, cleanup deletes it
+		return nil, nil
+	}
+	flag.UserIDHash = userIDHash
+	return &flag, nil
+}
+
+// Flag records that the picture imageID of userIDHash looked like spam.
+func (d *Detector) Flag(ctx context.Context, userIDHash, imageID, reason string) error {
+	now := time.Now()
+	ref := d.flags().Doc(userIDHash)
+	err := d.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		flag := Flag{FirstFlaggedAt: now}
+		snap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			if err := snap.DataTo(&flag); err != nil {
+				return err
+			}
+		}
+		flag.Reason = reason
+		flag.Count++
+		flag.LastFlaggedAt = now
+		flag.LastImageID = imageID
+		return tx.Set(ref, flag)
+	})
+	if err != nil {
+		return fmt.Errorf("firestore.Client.RunTransaction failed; %w", err)
+	}
+	return nil
+}
+
+// Allow lets a flagged sender through at most once per interval.
+func (d *Detector) Allow(ctx context.Context, userIDHash string, interval time.Duration) (bool, error) {
+	ref := d.flags().Doc(userIDHash)
+	allowed := false
+	err := d.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var flag Flag
+		if err := snap.DataTo(&flag); err != nil {
+			return err
+		}
+		now := time.Now()
+		if allowed = now.Sub(flag.LastAllowedAt) >= interval; !allowed {
+			return nil
+		}
+		return tx.Update(ref, []firestore.Update{{Path: "lastAllowedAt", Value: now}})
+	})
+	if err != nil {
+		return false, fmt.Errorf("firestore.Client.RunTransaction failed; %w", err)
+	}
+	return allowed, nil
+}
+
+// List returns at most limit flags, most recently flagged first.
+func (d *Detector) List(ctx context.Context, limit int) ([]Flag, error) {
+	flags := []Flag{}
+	it := d.flags().OrderBy("lastFlaggedAt", firestore.Desc).Limit(limit).Documents(ctx)
+	defer it.Stop()
+	for {
+		snap, err := it.Next()
+		if err == iterator.Done {
+			return flags, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestore.DocumentIterator.Next failed; %w", err)
+		}
+		var flag Flag
+		if err := snap.DataTo(&flag); err != nil {
+			return nil, fmt.Errorf("firestore.DocumentSnapshot.DataTo failed; %w", err)
+		}
+		flag.UserIDHash = snap.Ref.ID
+		flags = append(flags, flag)
+	}
+}
+
+// ForgetSender removes userIDHash from the senders of shared pictures and
+// returns from how many.
+func (d *Detector) ForgetSender(ctx context.Context, userIDHash string) (int, error) {
+	touched := 0
+	snaps, err := d.images().Where("users", "array-contains", userIDHash).Documents(ctx).GetAll()
+	if err != nil {
+		return touched, fmt.Errorf("firestore.DocumentIterator.GetAll failed; %w", err)
+	}
+	for _, snap := range snaps {
+		update := []firestore.Update{
+			{Path: "users", Value: firestore.ArrayRemove(userIDHash)},
+			{FieldPath: firestore.FieldPath{"sentAt", userIDHash}, Value: firestore.Delete},
+		}
+		if _, err := snap.Ref.Update(ctx, update); err != nil {
+			return touched, fmt.Errorf("firestore.DocumentRef.Update failed; %w", err)
+		}
+		touched++
+	}
+	return touched, nil
+}
+
+// Clear removes the flag of a sender found not to be a spammer.
+func (d *Detector) Clear(ctx context.Context, userIDHash string) error {
+	if _, err := d.flags().Doc(userIDHash).Delete(ctx); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Delete failed; %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package function
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/conversation"
+	"github.com/hsmtkk/ubiquitous-couscous/function/health"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/slo"
+)
+
+const (
+	defaultStatusErrors = 20
+	maxStatusErrors     = 100
+)
+
+type statusReport struct {
+	GeneratedAt  time.Time                `json:"generatedAt"`
+	Counts       map[string]health.Counts `json:"counts"`
+	RecentErrors []health.ErrorEntry      `json:"recentErrors"`
+	Checks       []dependencyCheck        `json:"checks"`
+	SLOs         []slo.Status             `json:"slos"`
+}
+
+type dependencyCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"percent": func(c health.Counts) string { return fmt.Sprintf("%.1f%%", c.SuccessRate()*100) },
+	"ratio":   func(v float64) string { return fmt.Sprintf("%.2f%%", v*100) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>ubiquitous-couscous status</title>
+<style>body{font-family:sans-serif;margin:1em}td,th{padding:2px 8px;text-align:left}.ng{color:#c00}</style>
+</head>
+<body>
+<h1>Status</h1>
+<p>{{.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}</p>
+<h2>Dependencies</h2>
+<table>
+{{range .Checks}}<tr><td>{{.Name}}</td>{{if .OK}}<td>OK</td>{{else}}<td class="ng">NG {{.Error}}</td>{{end}}</tr>
+{{end}}</table>
+<h2>Today</h2>
+<table>
+<tr><th>function</th><th>success</th><th>failure</th><th>rate</th></tr>
+{{range $name, $c := .Counts}}<tr><td>{{$name}}</td><td>{{$c.Success}}</td><td>{{$c.Failure}}</td><td>{{percent $c}}</td></tr>
+{{end}}</table>
+<h2>SLOs</h2>
+<table>
+<tr><th>objective</th><th>good</th><th>total</th><th>compliance</th><th>target</th><th>budget left</th></tr>
+{{range .SLOs}}<tr><td>{{.Objective}}</td><td>{{.Good}}</td><td>{{.Total}}</td><td>{{ratio .Compliance}}</td><td>{{ratio .Target}}</td>{{if .Alerting}}<td class="ng">{{ratio .BudgetRemaining}}</td>{{else}}<td>{{ratio .BudgetRemaining}}</td>{{end}}</tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+<h2>Recent errors</h2>
+<table>
+{{range .RecentErrors}}<tr><td>{{.At.Format "01-02 15:04:05"}}</td><td>{{.Function}}</td><td>{{.CorrelationID}}</td><td>{{.Message}}</td></tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func statusPage(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "status"})
+	logging.Printf(ctx, "status")
+
+	projectID := os.Getenv("PROJECT_ID")
+
+	statusToken, err := getSecret(ctx, projectID, "status-token")
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	if !validStatusToken(r, statusToken) {
+		returnError(ctx, w, http.StatusUnauthorized, fmt.Errorf("invalid status token"))
+		return
+	}
+
+	limit := defaultStatusErrors
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxStatusErrors {
+			returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("invalid limit; %s", value))
+			return
+		}
+		limit = n
+	}
+
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	recorder := health.NewRecorder(client)
+
+	report := statusReport{GeneratedAt: time.Now(), Checks: checkDependencies(ctx, projectID)}
+	if report.Counts, err = recorder.Counts(ctx); err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	if report.RecentErrors, err = recorder.RecentErrors(ctx, limit); err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	if report.SLOs, err = sloStatuses(ctx, client); err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			logging.Errorf(ctx, "json.Encoder.Encode failed; %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, report); err != nil {
+		logging.Errorf(ctx, "template.Template.Execute failed; %v", err)
+	}
+}
+
+// validStatusToken accepts the token as a bearer token or, so that the page
+// can be bookmarked on a phone, as the token query parameter.
+func validStatusToken(r *http.Request, statusToken string) bool {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(statusToken)) == 1
+}
+
+func checkDependencies(ctx context.Context, projectID string) []dependencyCheck {
+	checks := []dependencyCheck{}
+	add := func(name string, err error) {
+		check := dependencyCheck{Name: name, OK: err == nil}
+		if err != nil {
+			check.Error = err.Error()
+		}
+		checks = append(checks, check)
+	}
+
+	_, err := getSecret(ctx, projectID, "channel-secret")
+	add("secret manager", err)
+	if channelID := tenantEnv(ctx, "LINE_CHANNEL_ID"); channelID != "" {
+		add("channel access token", verifyChannelToken(ctx, projectID, channelID))
+	}
+
+	client, err := clients.PubSub(ctx, projectID)
+	if err != nil {
+		add("pubsub", err)
+		return checks
+	}
+	for _, env := range []string{"WAIT_PROCESS_TOPIC", "WAIT_SEND_TOPIC"} {
+		topicID := namespace.Topic(os.Getenv(env))
+		add("topic "+topicID, topicExists(ctx, client, topicID))
+	}
+	// the pull subscriptions workers started with PUBSUB_PULL rely on
+	for _, id := range strings.Split(os.Getenv("PULL_SUBSCRIPTIONS"), ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		id = namespace.Topic(id)
+		add("subscription "+id, subscriptionExists(ctx, client, id))
+	}
+	return checks
+}
+
+func subscriptionExists(ctx context.Context, client *pubsub.Client, id string) error {
+	ok, err := client.Subscription(id).Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("pubsub.Subscription.Exists failed; %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("not found")
+	}
+	return nil
+}
+
+func topicExists(ctx context.Context, client *pubsub.Client, topicID string) error {
+	if topicID == "" {
+		return fmt.Errorf("not configured")
+	}
+	ok, err := client.Topic(topicID).Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("pubsub.Topic.Exists failed; %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("not found")
+	}
+	return nil
+}
+
+// recordOutcome feeds the status page and has the shared clients recreated
+// when the outcome says their connection broke; failing to record is only
+// logged so that it never changes the outcome of the pipeline itself.
+func recordOutcome(ctx context.Context, function string, outcome error) {
+	clients.Recover(ctx, outcome)
+	recordRecent(logging.FromContext(ctx), function, outcome)
+	client, err := clients.Firestore(ctx, os.Getenv("PROJECT_ID"))
+	if err != nil {
+		logging.Errorf(ctx, "clients.Firestore failed; %v", err)
+		return
+	}
+	if err := health.NewRecorder(client).Record(ctx, function, logging.FromContext(ctx).CorrelationID, outcome); err != nil {
+		logging.Errorf(ctx, "record outcome failed; %v", err)
+	}
+	trackSLO(ctx, slo.Event{Objective: sloFunctionObjective(function), Good: outcome == nil})
+	if outcome != nil {
+		logConversation(ctx, conversation.Item{Kind: conversation.KindError, Text: outcome.Error()})
+	}
+}
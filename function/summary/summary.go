@@ -0,0 +1,157 @@
+package summary
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const maxTextLength = 200
+
+type Color struct {
+	R, G, B  uint8
+	Fraction float64
+}
+
+type Input struct {
+	Labels []string
+	Text   string
+	Colors []Color
+}
+
+var funcs = template.FuncMap{
+	"article": article,
+	"list":    list,
+	"lower":   strings.ToLower,
+}
+
+// Each section renders to an empty string when it has nothing to say; the
+// non-empty ones are joined with a space.
+var sections = []*template.Template{
+	template.Must(template.New("labels").Funcs(funcs).Parse(
+		`{{with .Labels}}A photo of {{article (index . 0)}} {{lower (index . 0)}}{{with slice . 1}} with {{list .}}{{end}}.{{end}}`)),
+	template.Must(template.New("text").Funcs(funcs).Parse(
+		`{{with .Text}}Text found: "{{.}}".{{end}}`)),
+	template.Must(template.New("colors").Funcs(funcs).Parse(
+		`{{with .ColorNames}}Dominant colors: {{list .}}.{{end}}`)),
+}
+
+type templateData struct {
+	Labels     []string
+	Text       string
+	ColorNames []string
+}
+
+func Compose(in Input) (string, error) {
+	data := templateData{
+		Labels:     limit(in.Labels, 4),
+		Text:       shorten(strings.Join(strings.Fields(in.Text), " "), maxTextLength),
+		ColorNames: colorNames(in.Colors, 3),
+	}
+	parts := []string{}
+	for _, section := range sections {
+		var buf bytes.Buffer
+		if err := section.Execute(&buf, data); err != nil {
+			return "", fmt.Errorf("template.Template.Execute failed; %w", err)
+		}
+		if buf.Len() > 0 {
+			parts = append(parts, buf.String())
+		}
+	}
+	if len(parts) == 0 {
+		return "Nothing recognizable was found in this image.", nil
+	}
+	return strings.Join(parts, " "), nil
+}
+
+func article(word string) string {
+	if word != "" && strings.ContainsRune("aeiouAEIOU", rune(word[0])) {
+		return "an"
+	}
+	return "a"
+}
+
+func list(items []string) string {
+	lowered := make([]string, len(items))
+	for i, item := range items {
+		lowered[i] = strings.ToLower(item)
+	}
+	switch len(lowered) {
+	case 0:
+		return ""
+	case 1:
+		return lowered[0]
+	default:
+		return strings.Join(lowered[:len(lowered)-1], ", ") + " and " + lowered[len(lowered)-1]
+	}
+}
+
+func limit(items []string, n int) []string {
+	if len(items) > n {
+		return items[:n]
+	}
+	return items
+}
+
+func shorten(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n]) + "…"
+}
+
+var palette = []struct {
+	name    string
+	r, g, b float64
+}{
+	{"black", 0, 0, 0},
+	{"white", 255, 255, 255},
+	{"gray", 128, 128, 128},
+	{"red", 200, 30, 30},
+	{"orange", 240, 140, 30},
+	{"yellow", 240, 220, 50},
+	{"green", 50, 160, 60},
+	{"blue", 40, 90, 200},
+	{"sky blue", 130, 190, 235},
+	{"purple", 130, 60, 170},
+	{"pink", 240, 150, 180},
+	{"brown", 120, 80, 40},
+	{"beige", 220, 200, 160},
+}
+
+// colorNames maps the colors to the nearest palette names, most dominant
+// first, without repeating a name.
+func colorNames(colors []Color, n int) []string {
+	sorted := append([]Color(nil), colors...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Fraction > sorted[j].Fraction })
+	seen := map[string]bool{}
+	names := []string{}
+	for _, c := range sorted {
+		name := nearestColor(c)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+		if len(names) == n {
+			break
+		}
+	}
+	return names
+}
+
+func nearestColor(c Color) string {
+	best := ""
+	bestDistance := -1.0
+	for _, p := range palette {
+		dr, dg, db := float64(c.R)-p.r, float64(c.G)-p.g, float64(c.B)-p.b
+		d := dr*dr + dg*dg + db*db
+		if bestDistance < 0 || d < bestDistance {
+			best, bestDistance = p.name, d
+		}
+	}
+	return best
+}
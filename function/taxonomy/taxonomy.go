@@ -0,0 +1,89 @@
+package taxonomy
+
+import (
+	_ "embed"
+	"encoding/json"
+	"strings"
+)
+
+// Other collects labels that match no category.
+const Other = "other"
+
+//go:embed taxonomy.json
+var taxonomyJSON []byte
+
+type category struct {
+	Name     string   `json:"category"`
+	Keywords []string `json:"keywords"`
+}
+
+var categories = mustLoad()
+
+func mustLoad() []category {
+	var cs []category
+	if err := json.Unmarshal(taxonomyJSON, &cs); err != nil {
+		panic(err)
+	}
+	return cs
+}
+
+type Group struct {
+	Category string
+	Labels   []string
+}
+
+// Categorize returns the first category with a keyword that is the label or
+// a run of its words, so "Dog breed" and "Sports car" are found by "dog" and
+// "car" but "Cartoon" is not.
+func Categorize(label string) string {
+	words := " " + strings.ToLower(strings.Join(strings.Fields(label), " ")) + " "
+	for _, c := range categories {
+		for _, keyword := range c.Keywords {
+			if strings.Contains(words, " "+keyword+" ") {
+				return c.Name
+			}
+		}
+	}
+	return Other
+}
+
+// GroupLabels keeps the order of labels within a category and lists the
+// categories in taxonomy order with Other last.
+func GroupLabels(labels []string) []Group {
+	byCategory := map[string][]string{}
+	for _, label := range labels {
+		name := Categorize(label)
+		byCategory[name] = append(byCategory[name], label)
+	}
+	groups := []Group{}
+	for _, c := range categories {
+		if ls, ok := byCategory[c.Name]; ok {
+			groups = append(groups, Group{Category: c.Name, Labels: ls})
+		}
+	}
+	if ls, ok := byCategory[Other]; ok {
+		groups = append(groups, Group{Category: Other, Labels: ls})
+	}
+	return groups
+}
+
+// IsCategory reports whether name, in any case, is one of the categories.
+func IsCategory(name string) bool {
+	for _, c := range categories {
+		if strings.EqualFold(c.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Categories lists the categories of labels without Other.
+func Categories(labels []string) []string {
+	names := []string{}
+	for _, group := range GroupLabels(labels) {
+		if group.Category != Other {
+			names = append(names, group.Category)
+		}
+	}
+	return names
+}
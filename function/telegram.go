@@ -0,0 +1,99 @@
+package function
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/messenger"
+)
+
+// telegramUpdate is the part of a Bot API update the bot reads.
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		MessageID int64 `json:"message_id"`
+		From      *struct {
+			ID int64 `json:"id"`
+		} `json:"from"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		// Photo lists the sizes of the photo, the largest last.
+		Photo []struct {
+			FileID string `json:"file_id"`
+		} `json:"photo"`
+	} `json:"message"`
+}
+
+// telegramWebhook receives the updates of the Telegram bot, registered with
+// setWebhook and the secret_token kept in the telegram-webhook-secret
+// secret, and sends photos through the same pipeline as LINE images. The
+// reply goes back through the Telegram messenger.
+func telegramWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "telegram"})
+	logging.Printf(ctx, "telegram")
+
+	projectID := os.Getenv("PROJECT_ID")
+	secret, err := getSecret(ctx, projectID, "telegram-webhook-secret")
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	token := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		returnError(ctx, w, http.StatusUnauthorized, fmt.Errorf("invalid secret token"))
+		return
+	}
+	var update telegramUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Telegram retries anything but a success, so updates the bot does not
+	// answer are acknowledged as well
+	msg := update.Message
+	if msg == nil || len(msg.Photo) == 0 {
+		logging.Printf(ctx, "skip update %d", update.UpdateID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	photo := msg.Photo[len(msg.Photo)-1]
+	var userIDHash string
+	if msg.From != nil {
+		userIDHash = logging.HashUserID("telegram:" + strconv.FormatInt(msg.From.ID, 10))
+	}
+	correlationID := fmt.Sprintf("telegram-%d", update.UpdateID)
+	ctx = logging.With(ctx, logging.Fields{CorrelationID: correlationID, UserIDHash: userIDHash, ImageID: photo.FileID})
+
+	mode := dynconfig.Get(ctx, "ANALYSIS_MODE")
+	if mode == "" {
+		mode = modeLabels
+	}
+	procMsg := processMessage{
+		CorrelationID: correlationID,
+		UserIDHash:    userIDHash,
+		ImageID:       photo.FileID,
+		Mode:          mode,
+		ReceivedAt:    time.Now(),
+		Destination: &messenger.Destination{
+			Platform: messenger.PlatformTelegram,
+			ChatID:   strconv.FormatInt(msg.Chat.ID, 10),
+			ThreadID: strconv.FormatInt(msg.MessageID, 10),
+		},
+	}
+	_, err = publishProcessMessage(ctx, procMsg)
+	recordRecent(logging.FromContext(ctx), "telegram", err)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
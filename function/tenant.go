@@ -0,0 +1,136 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/lineapi"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/tenant"
+	"github.com/hsmtkk/ubiquitous-couscous/function/topics"
+)
+
+// LINE clients are kept this long so that rotated secrets are picked up
+const lineClientTTL = 10 * time.Minute
+
+var (
+	tenantsOnce sync.Once
+	tenants     *tenant.Registry
+
+	lineClientsMu sync.Mutex
+	lineClients   = map[string]cachedLineClient{}
+)
+
+type cachedLineClient struct {
+	client  lineapi.LineClient
+	expires time.Time
+}
+
+// tenantRegistry loads TENANTS once per instance. A broken registry is
+// logged and treated as empty, which rejects every tenant webhook.
+func tenantRegistry() *tenant.Registry {
+	tenantsOnce.Do(func() {
+		r, err := tenant.FromEnv()
+		if err != nil {
+			logging.Errorf(context.Background(), "load tenants failed; %v", err)
+			r = &tenant.Registry{}
+		}
+		tenants = r
+	})
+	return tenants
+}
+
+// projectIDOf is the project holding the data of the tenant ctx is served
+// for, PROJECT_ID for the deployment's own channel.
+func projectIDOf(ctx context.Context) string {
+	if t, ok := tenant.FromContext(ctx); ok {
+		return t.ProjectID
+	}
+	return os.Getenv("PROJECT_ID")
+}
+
+// tenantEnv is os.Getenv with the overrides of the tenant ctx is served for.
+func tenantEnv(ctx context.Context, key string) string {
+	if t, ok := tenant.FromContext(ctx); ok {
+		return t.Getenv(key)
+	}
+	return os.Getenv(key)
+}
+
+// withTenant restores the tenant a pipeline message was published for. An
+// empty ID is the deployment's own channel.
+func withTenant(ctx context.Context, id string) (context.Context, error) {
+	if id == "" {
+		return ctx, nil
+	}
+	t, ok := tenantRegistry().Get(id)
+	if !ok {
+		return ctx, fmt.Errorf("unknown tenant; %s", id)
+	}
+	return topics.WithNames(tenant.WithContext(ctx, t), t.Env), nil
+}
+
+// requestTenant picks the tenant an operator, scheduler or LIFF request
+// names in its tenant query parameter; without one the request is served
+// for the deployment's own channel.
+func requestTenant(ctx context.Context, r *http.Request) (context.Context, error) {
+	return withTenant(ctx, r.URL.Query().Get("tenant"))
+}
+
+// receiveTenant picks the tenant of a webhook by the destination of body,
+// as readWebhook decoded it; the signature is checked afterwards with the
+// secret of the tenant. Without tenants configured every webhook is for the
+// deployment's own channel.
+func receiveTenant(ctx context.Context, body []byte) (context.Context, error) {
+	if tenantRegistry().Empty() {
+		return ctx, nil
+	}
+	var webhook struct {
+		Destination string `json:"destination"`
+	}
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return ctx, fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	t, ok := tenantRegistry().Resolve(webhook.Destination)
+	if !ok {
+		return ctx, fmt.Errorf("unknown destination; %s", webhook.Destination)
+	}
+	logging.Printf(ctx, "tenant: %s", t.ID)
+	return topics.WithNames(tenant.WithContext(ctx, t), t.Env), nil
+}
+
+// tenantID is what pipeline messages carry to find the tenant again.
+func tenantID(ctx context.Context) string {
+	t, _ := tenant.FromContext(ctx)
+	return t.ID
+}
+
+// tenantSecretName prefixes secretName for the tenant ctx is served for.
+func tenantSecretName(ctx context.Context, secretName string) string {
+	if t, ok := tenant.FromContext(ctx); ok {
+		return t.SecretPrefix + secretName
+	}
+	return secretName
+}
+
+// cachedLineClientFor shares LINE clients per tenant and project within an
+// instance.
+func cachedLineClientFor(ctx context.Context, projectID string, create func() (lineapi.LineClient, error)) (lineapi.LineClient, error) {
+	key := tenantID(ctx) + "/" + projectID
+	lineClientsMu.Lock()
+	defer lineClientsMu.Unlock()
+	if c, ok := lineClients[key]; ok && time.Now().Before(c.expires) {
+		return c.client, nil
+	}
+	client, err := create()
+	if err != nil {
+		return nil, err
+	}
+	lineClients[key] = cachedLineClient{client: client, expires: time.Now().Add(lineClientTTL)}
+	return client, nil
+}
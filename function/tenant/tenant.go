@@ -0,0 +1,106 @@
+package tenant
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Config is one customer served by a shared deployment.
+type Config struct {
+	ID string `json:"id"`
+	// Destination is the bot user ID LINE sends as the destination of the
+	// tenant's webhooks.
+	Destination string `json:"destination"`
+	// ProjectID holds the tenant's Firestore, buckets and secrets.
+	ProjectID string `json:"projectId"`
+	// SecretPrefix is put before secret names, e.g. "acme-" reads
+	// acme-channel-secret.
+	SecretPrefix string `json:"secretPrefix,omitempty"`
+	// Env overrides environment variables such as WAIT_PROCESS_TOPIC or
+	// ARCHIVE_BUCKET for the tenant. Topics named here need their own
+	// triggers to the same functions.
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// Getenv is the tenant's value of key, falling back to the environment.
+func (c Config) Getenv(key string) string {
+	if v, ok := c.Env[key]; ok {
+		return v
+	}
+	return os.Getenv(key)
+}
+
+type Registry struct {
+	byID          map[string]Config
+	byDestination map[string]Config
+}
+
+// Load parses a JSON array of Config. IDs and destinations must be unique.
+func Load(b []byte) (*Registry, error) {
+	var configs []Config
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	r := &Registry{byID: map[string]Config{}, byDestination: map[string]Config{}}
+	for _, c := range configs {
+		if c.ID == "" || c.Destination == "" || c.ProjectID == "" {
+			return nil, fmt.Errorf("tenant needs id, destination and projectId; %+v", c)
+		}
+		if _, ok := r.byID[c.ID]; ok {
+			return nil, fmt.Errorf("duplicate tenant id; %s", c.ID)
+		}
+		if _, ok := r.byDestination[c.Destination]; ok {
+			return nil, fmt.Errorf("duplicate tenant destination; %s", c.Destination)
+		}
+		r.byID[c.ID] = c
+		r.byDestination[c.Destination] = c
+	}
+	return r, nil
+}
+
+// FromEnv loads the tenants from the file TENANTS_FILE names or the JSON in
+// TENANTS. Without either the registry is empty and the deployment serves
+// only its own project.
+func FromEnv() (*Registry, error) {
+	b := []byte(os.Getenv("TENANTS"))
+	if path := os.Getenv("TENANTS_FILE"); path != "" {
+		var err error
+		b, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("os.ReadFile failed; %w", err)
+		}
+	}
+	if len(b) == 0 {
+		return &Registry{}, nil
+	}
+	return Load(b)
+}
+
+func (r *Registry) Empty() bool {
+	return len(r.byID) == 0
+}
+
+func (r *Registry) Resolve(destination string) (Config, bool) {
+	c, ok := r.byDestination[destination]
+	return c, ok
+}
+
+func (r *Registry) Get(id string) (Config, bool) {
+	c, ok := r.byID[id]
+	return c, ok
+}
+
+type contextKey struct{}
+
+func WithContext(ctx context.Context, c Config) context.Context {
+	return context.WithValue(ctx, contextKey{}, c)
+}
+
+// FromContext returns the tenant a request is served for; false means the
+// deployment's own project.
+func FromContext(ctx context.Context) (Config, bool) {
+	c, ok := ctx.Value(contextKey{}).(Config)
+	return c, ok
+}
@@ -0,0 +1,113 @@
+// Package textorient tells from the text Vision found which way an image is
+// turned, so that sideways photos of text can be read again upright.
+package textorient
+
+import (
+	"math"
+
+	visionpb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// Orientation is how the text of an image is turned.
+type Orientation struct {
+	// Degrees the text is turned clockwise: 0, 90, 180 or 270.
+	Degrees int
+	// Share is the part of the text, by the length of its blocks, that is
+	// turned that way.
+	Share float64
+}
+
+// Upright is the clockwise rotation that turns the text upright.
+func (o Orientation) Upright() int {
+	return (360 - o.Degrees) % 360
+}
+
+// Detect votes over the blocks of text. Vision gives the corners of a block
+// starting at its top left as the text is read, so the direction from the
+// first corner to the second is the reading direction; longer blocks weigh
+// more. Text without blocks is taken as upright.
+func Detect(text *visionpb.TextAnnotation) Orientation {
+	votes := map[int]float64{}
+	total := 0.0
+	for _, page := range text.GetPages() {
+		for _, block := range page.GetBlocks() {
+			dx, dy, ok := readingDirection(block.GetBoundingBox())
+			if !ok {
+				continue
+			}
+			length := math.Hypot(dx, dy)
+			votes[degrees(dx, dy)] += length
+			total += length
+		}
+	}
+	if total == 0 {
+		return Orientation{Share: 1}
+	}
+	best := Orientation{}
+	for _, d := range []int{0, 90, 180, 270} {
+		if share := votes[d] / total; share > best.Share {
+			best = Orientation{Degrees: d, Share: share}
+		}
+	}
+	return best
+}
+
+func readingDirection(poly *visionpb.BoundingPoly) (dx, dy float64, ok bool) {
+	if vs := poly.GetVertices(); len(vs) == 4 {
+		return float64(vs[1].GetX() - vs[0].GetX()), float64(vs[1].GetY() - vs[0].GetY()), true
+	}
+	if vs := poly.GetNormalizedVertices(); len(vs) == 4 {
+		return float64(vs[1].GetX() - vs[0].GetX()), float64(vs[1].GetY() - vs[0].GetY()), true
+	}
+	return 0, 0, false
+}
+
+// degrees maps a reading direction, y pointing down, to the rotation of the
+// text: right is upright, down is turned a quarter clockwise.
+func degrees(dx, dy float64) int {
+	if math.Abs(dx) >= math.Abs(dy) {
+		if dx >= 0 {
+			return 0
+		}
+		return 180
+	}
+	if dy > 0 {
+		return 90
+	}
+	return 270
+}
+
+// Confidence is the mean block confidence weighted by the number of
+// symbols of each block, 0 for no text.
+func Confidence(text *visionpb.TextAnnotation) float32 {
+	var sum, symbols float32
+	for _, page := range text.GetPages() {
+		for _, block := range page.GetBlocks() {
+			n := float32(0)
+			for _, paragraph := range block.GetParagraphs() {
+				for _, word := range paragraph.GetWords() {
+					n += float32(len(word.GetSymbols()))
+				}
+			}
+			if n == 0 {
+				n = 1
+			}
+			sum += block.GetConfidence() * n
+			symbols += n
+		}
+	}
+	if symbols == 0 {
+		return 0
+	}
+	return sum / symbols
+}
+
+// Locale is the language Vision detected first on the first page.
+func Locale(text *visionpb.TextAnnotation) string {
+	for _, page := range text.GetPages() {
+		for _, lang := range page.GetProperty().GetDetectedLanguages() {
+			return lang.GetLanguageCode()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,94 @@
+package textorient
+
+import (
+	"math"
+	"testing"
+
+	visionpb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// box is a block whose corners start at (x0, y0) and go round to the other
+// corner (x1, y1) the way Vision lists them for text read from (x0, y0)
+// towards the second corner.
+func box(x0, y0, x1, y1 int32, along string) *visionpb.Block {
+	var vs []*visionpb.Vertex
+	switch along {
+	case "x":
+		vs = []*visionpb.Vertex{{X: x0, Y: y0}, {X: x1, Y: y0}, {X: x1, Y: y1}, {X: x0, Y: y1}}
+	case "y":
+		vs = []*visionpb.Vertex{{X: x0, Y: y0}, {X: x0, Y: y1}, {X: x1, Y: y1}, {X: x1, Y: y0}}
+	}
+	return &visionpb.Block{BoundingBox: &visionpb.BoundingPoly{Vertices: vs}}
+}
+
+func annotation(blocks ...*visionpb.Block) *visionpb.TextAnnotation {
+	return &visionpb.TextAnnotation{Pages: []*visionpb.Page{{Blocks: blocks}}}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    *visionpb.TextAnnotation
+		degrees int
+		share   float64
+	}{
+		{"nil", nil, 0, 1},
+		{"no blocks", annotation(), 0, 1},
+		{"upright", annotation(box(0, 0, 100, 20, "x")), 0, 1},
+		{"quarter clockwise", annotation(box(20, 0, 0, 100, "y")), 90, 1},
+		{"upside down", annotation(box(100, 20, 0, 0, "x")), 180, 1},
+		{"quarter counterclockwise", annotation(box(0, 100, 20, 0, "y")), 270, 1},
+		{"longer block wins", annotation(box(0, 0, 100, 20, "x"), box(20, 0, 0, 50, "y")), 0, 100.0 / 150},
+		{"more blocks win", annotation(box(100, 20, 0, 0, "x"), box(20, 0, 0, 80, "y"), box(20, 100, 0, 180, "y")), 90, 160.0 / 260},
+		{"block without box ignored", annotation(&visionpb.Block{}, box(20, 0, 0, 100, "y")), 90, 1},
+		{"normalized", annotation(&visionpb.Block{BoundingBox: &visionpb.BoundingPoly{NormalizedVertices: []*visionpb.NormalizedVertex{
+			{X: 0.9, Y: 0.1}, {X: 0.1, Y: 0.1}, {X: 0.1, Y: 0}, {X: 0.9, Y: 0},
+		}}}), 180, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Detect(tt.text)
+			if got.Degrees != tt.degrees || math.Abs(got.Share-tt.share) > 1e-9 {
+				t.Errorf("Detect() = %+v, want %d degrees, share %v", got, tt.degrees, tt.share)
+			}
+		})
+	}
+}
+
+func TestUpright(t *testing.T) {
+	tests := []struct{ degrees, want int }{
+		{0, 0},
+		{90, 270},
+		{180, 180},
+		{270, 90},
+	}
+	for _, tt := range tests {
+		if got := (Orientation{Degrees: tt.degrees}).Upright(); got != tt.want {
+			t.Errorf("Orientation{%d}.Upright() = %d, want %d", tt.degrees, got, tt.want)
+		}
+	}
+}
+
+func TestConfidence(t *testing.T) {
+	word := func(symbols int) *visionpb.Word {
+		return &visionpb.Word{Symbols: make([]*visionpb.Symbol, symbols)}
+	}
+	block := func(confidence float32, words ...*visionpb.Word) *visionpb.Block {
+		return &visionpb.Block{Confidence: confidence, Paragraphs: []*visionpb.Paragraph{{Words: words}}}
+	}
+	tests := []struct {
+		name string
+		text *visionpb.TextAnnotation
+		want float32
+	}{
+		{"nil", nil, 0},
+		{"one block", annotation(block(0.8, word(3))), 0.8},
+		{"weighted by symbols", annotation(block(1, word(3)), block(0.5, word(1))), 0.875},
+		{"block without symbols", annotation(block(0.4), block(0.6)), 0.5},
+	}
+	for _, tt := range tests {
+		if got := Confidence(tt.text); math.Abs(float64(got-tt.want)) > 1e-6 {
+			t.Errorf("%s: Confidence() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+)
+
+const defaultLabelMinScore = 0.5
+
+// labelMinScore is the user's own threshold or LABEL_MIN_SCORE.
+func labelMinScore(ctx context.Context, prefs userPreferences) float32 {
+	if prefs.MinScore > 0 {
+		return float32(prefs.MinScore)
+	}
+	if score, err := strconv.ParseFloat(dynconfig.Get(ctx, "LABEL_MIN_SCORE"), 32); err == nil && score >= 0 && score <= 1 {
+		return float32(score)
+	}
+	return defaultLabelMinScore
+}
+
+// chooseThreshold handles "/threshold <score|off>" and returns the text
+// answering it.
+func chooseThreshold(ctx context.Context, client *firestore.Client, userIDHash, arg string) (string, error) {
+	usage := "Set the lowest label confidence with /threshold and a number between 0 and 1, e.g. /threshold 0.8, or /threshold off."
+	if arg == "off" {
+		if err := savePreference(ctx, client, userIDHash, "minScore", 0); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Labels are filtered with the default threshold %.2f again.", labelMinScore(ctx, userPreferences{})), nil
+	}
+	score, err := strconv.ParseFloat(arg, 64)
+	if err != nil || score <= 0 || score > 1 {
+		return usage, nil
+	}
+	if err := savePreference(ctx, client, userIDHash, "minScore", score); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Only labels with a confidence of at least %.2f are shown now.", score), nil
+}
@@ -0,0 +1,23 @@
+package function
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+)
+
+// newStageTiming is one entry of the breakdown appended to replies of users
+// in debug mode.
+func newStageTiming(stage string, d time.Duration) analysis.Timing {
+	return analysis.Timing{Stage: stage, Millis: d.Milliseconds()}
+}
+
+func formatTimings(timings []analysis.Timing) string {
+	parts := make([]string, 0, len(timings))
+	for _, t := range timings {
+		parts = append(parts, fmt.Sprintf("%s %dms", t.Stage, t.Millis))
+	}
+	return "timing: " + strings.Join(parts, ", ")
+}
@@ -0,0 +1,127 @@
+package topics
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/jsoncodec"
+	"github.com/hsmtkk/ubiquitous-couscous/function/queue"
+	"google.golang.org/api/option"
+)
+
+// shared is left out of clients.Recover: pipeline subscriptions live on it.
+var shared = clients.NewLazy("queue", func(ctx context.Context, opts ...option.ClientOption) (queue.Queue, error) {
+	cfg := queue.ConfigFromEnv()
+	cfg.ClientOptions = opts
+	return queue.Open(ctx, cfg)
+}, queue.Queue.Close)
+
+// Queue returns the queue shared by every request of this instance, opening
+// it on first use. Callers must not close it; Shutdown does.
+func Queue(ctx context.Context) (queue.Queue, error) {
+	return shared.Get(ctx)
+}
+
+// Warm opens the shared queue in the background.
+func Warm() {
+	shared.Warm()
+}
+
+// Shutdown flushes pending messages and closes the shared queue.
+func Shutdown() {
+	shared.Reset(context.Background())
+}
+
+// ShutdownOnSignal calls Shutdown when the instance receives SIGTERM and
+// then lets the signal take its default course, or exits where the signal
+// cannot be raised again.
+func ShutdownOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		Shutdown()
+		signal.Reset(syscall.SIGTERM)
+		if p, err := os.FindProcess(os.Getpid()); err == nil && p.Signal(sig) == nil {
+			return
+		}
+		os.Exit(1)
+	}()
+}
+
+// Topic publishes messages of type T as JSON to the topic named by an
+// environment variable.
+type Topic[T any] struct {
+	env string
+}
+
+func New[T any](env string) Topic[T] {
+	return Topic[T]{env: env}
+}
+
+func (t Topic[T]) Name() string {
+	return os.Getenv(t.env)
+}
+
+type namesKey struct{}
+
+// WithNames makes topics published with the returned context use names[env]
+// instead of the environment variable env, e.g. for the topics of a tenant.
+func WithNames(ctx context.Context, names map[string]string) context.Context {
+	return context.WithValue(ctx, namesKey{}, names)
+}
+
+// NameFor is Name with the overrides of WithNames applied.
+func (t Topic[T]) NameFor(ctx context.Context) string {
+	if names, ok := ctx.Value(namesKey{}).(map[string]string); ok {
+		if name, ok := names[t.env]; ok {
+			return name
+		}
+	}
+	return t.Name()
+}
+
+// The attributes of the envelope every pipeline message is published in.
+const (
+	AttrCorrelationID = "correlationId"
+	AttrVersion       = "version"
+	AttrContentType   = "contentType"
+	// AttrDryRun is "true" on messages of a webhook replayed as a dry run.
+	AttrDryRun = "dryRun"
+
+	// Version is bumped when the message types change incompatibly.
+	Version     = "1"
+	ContentType = "application/json"
+)
+
+// Envelope returns the attributes of a message with correlationID.
+func Envelope(correlationID string) map[string]string {
+	attrs := map[string]string{AttrVersion: Version, AttrContentType: ContentType}
+	if correlationID != "" {
+		attrs[AttrCorrelationID] = correlationID
+	}
+	return attrs
+}
+
+// Publish returns the ID assigned by the queue backend, if it has one.
+func (t Topic[T]) Publish(ctx context.Context, msg T) (string, error) {
+	return t.PublishAttributes(ctx, msg, nil)
+}
+
+// PublishAttributes is Publish with attributes, dropped on backends that
+// cannot carry them.
+func (t Topic[T]) PublishAttributes(ctx context.Context, msg T, attrs map[string]string) (string, error) {
+	data, err := jsoncodec.Marshal(msg)
+	if err != nil {
+		return "", fmt.Errorf("jsoncodec.Marshal failed; %w", err)
+	}
+	q, err := Queue(ctx)
+	if err != nil {
+		return "", err
+	}
+	return queue.PublishAttributes(ctx, q, t.NameFor(ctx), data, attrs)
+}
@@ -0,0 +1,169 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/translate"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/langdetect"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/postback"
+	"github.com/hsmtkk/ubiquitous-couscous/function/reply"
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+const (
+	actionTranslate = "translate"
+	// OCR text waits this long in the cache for the translate quick reply
+	ocrTextTTL = 24 * time.Hour
+	// LINE limits quick reply labels to 20 characters
+	maxQuickReplyLabel = 20
+	maxDetectRunes     = 500
+	// below this Cloud Translation is guessing
+	minDetectConfidence = 0.5
+)
+
+func ocrTextKey(imageID string) string {
+	return "ocr:" + imageID
+}
+
+func userLanguage(ctx context.Context, projectID, userIDHash string) (string, error) {
+	fallback := dynconfig.Get(ctx, "DEFAULT_LANGUAGE")
+	if fallback == "" {
+		fallback = "en"
+	}
+	if userIDHash == "" {
+		return fallback, nil
+	}
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return "", err
+	}
+	prefs, err := loadPreferences(ctx, client, userIDHash)
+	if err != nil {
+		return "", err
+	}
+	if prefs.Language == "" {
+		return fallback, nil
+	}
+	return prefs.Language, nil
+}
+
+// offerTranslation keeps OCR text that is not in the user's language for the
+// translate postback, which cannot carry it within LINE's 300 byte limit.
+// The offer is optional: without the user's preferences it assumes
+// DEFAULT_LANGUAGE, and without the cache the description goes out alone.
+func offerTranslation(ctx context.Context, state *pipelineState, desc description) {
+	if desc.Text == "" || desc.Language == "" {
+		return
+	}
+	target, err := userLanguage(ctx, state.projectID, state.procMsg.UserIDHash)
+	if err != nil {
+		logging.Errorf(ctx, "user language failed, assuming the default; %v", err)
+		target, _ = userLanguage(ctx, state.projectID, "")
+	}
+	logging.Printf(ctx, "text language: %s, user language: %s", desc.Language, target)
+	if desc.Language == target {
+		return
+	}
+	c, err := cache.Open(ctx, cache.ConfigFromEnv())
+	if err != nil {
+		logging.Errorf(ctx, "cache.Open failed, not offering translation; %v", err)
+		return
+	}
+	defer c.Close()
+	if err := c.Set(ctx, ocrTextKey(state.procMsg.ImageID), []byte(desc.Text), ocrTextTTL); err != nil {
+		logging.Errorf(ctx, "cache set failed, not offering translation; %v", err)
+		return
+	}
+	state.translateTo = target
+}
+
+// detectLanguage asks Cloud Translation for the language of text, for the
+// Latin script text langdetect cannot tell apart. It returns "" when the
+// detection is not confident.
+func detectLanguage(ctx context.Context, text string) (string, error) {
+	// the start of the text is enough and keeps the characters billed down
+	if runes := []rune(text); len(runes) > maxDetectRunes {
+		text = string(runes[:maxDetectRunes])
+	}
+	client, err := translate.NewClient(ctx)
+	if err != nil {
+		return "", fmt.Errorf("translate.NewClient failed; %w", err)
+	}
+	defer client.Close()
+	detections, err := client.DetectLanguage(ctx, []string{text})
+	if err != nil {
+		return "", fmt.Errorf("translate.Client.DetectLanguage failed; %w", err)
+	}
+	if len(detections) == 0 || len(detections[0]) == 0 || detections[0][0].Confidence < minDetectConfidence {
+		return "", nil
+	}
+	return langdetect.Base(detections[0][0].Language.String()), nil
+}
+
+func translateQuickReply(sendMsg sendMessage, codec *postback.Codec) (reply.QuickReplyItem, error) {
+	data, err := codec.Encode(actionTranslate, map[string]string{"imageId": sendMsg.ImageID, "target": sendMsg.TranslateTo})
+	if err != nil {
+		return reply.QuickReplyItem{}, err
+	}
+	text := "Translate to " + languageName(sendMsg.TranslateTo)
+	label := text
+	if utf8.RuneCountInString(label) > maxQuickReplyLabel {
+		label = "Translate"
+	}
+	return reply.QuickReplyItem{Label: label, Data: data, DisplayText: text}, nil
+}
+
+func languageName(code string) string {
+	tag, err := language.Parse(code)
+	if err != nil {
+		return code
+	}
+	if name := display.English.Languages().Name(tag); name != "" {
+		return name
+	}
+	return code
+}
+
+// translateAction answers with the cached OCR text of the image translated
+// to the language chosen when the quick reply was offered.
+func translateAction(ctx context.Context, evt postback.Event, payload postback.Payload) error {
+	projectID := projectIDOf(ctx)
+	imageID := payload.Param("imageId")
+	target := payload.Param("target")
+	if imageID == "" || target == "" {
+		return fmt.Errorf("translate postback without imageId or target")
+	}
+
+	c, err := cache.Open(ctx, cache.ConfigFromEnv())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	text := "The text of this image is no longer available."
+	value, err := c.Get(ctx, ocrTextKey(imageID))
+	if err != nil && !errors.Is(err, cache.ErrMiss) {
+		return err
+	}
+	if err == nil {
+		translated, err := translateTexts(ctx, []string{string(value)}, target)
+		if err != nil {
+			return err
+		}
+		text = translated[0]
+	}
+
+	lineClient, err := newLineClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	return sendReply(ctx, lineClient, reply.NewBuilder(evt.ReplyToken).Text(text))
+}
@@ -0,0 +1,48 @@
+package function
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/tuning"
+)
+
+const defaultVisionConcurrency = 4
+
+// visionLimiter keeps bursts from holding more images in flight than a
+// small instance has memory for.
+var visionLimiter = tuning.NewLimiter("vision", visionConcurrency())
+
+func visionConcurrency() int {
+	n, err := strconv.Atoi(os.Getenv("VISION_CONCURRENCY"))
+	if err != nil || n < 1 {
+		return defaultVisionConcurrency
+	}
+	return n
+}
+
+func applyTuning(ctx context.Context) {
+	limit, err := tuning.ApplyMemoryLimit()
+	if err != nil {
+		logging.Errorf(ctx, "apply memory limit failed; %v", err)
+		return
+	}
+	logging.Debugf(ctx, "memory limit: %d", limit)
+}
+
+// acquireVision takes a Vision slot, logging how long the call queued so
+// that a log based metric can chart it.
+func acquireVision(ctx context.Context) (func(), error) {
+	release, waited, err := visionLimiter.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if waited > 0 {
+		stats := visionLimiter.Stats()
+		mem := tuning.ReadMemoryStats()
+		logging.Warnf(ctx, "vision call queued for %s; waiting=%d inFlight=%d heapAlloc=%d limit=%d", waited, stats.Waiting, stats.InFlight, mem.HeapAlloc, mem.Limit)
+	}
+	return release, nil
+}
@@ -0,0 +1,154 @@
+package tuning
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limiter bounds the number of concurrent calls within an instance and keeps
+// track of how long callers queue for a slot.
+type Limiter struct {
+	name       string
+	slots      chan struct{}
+	inFlight   atomic.Int64
+	waiting    atomic.Int64
+	maxWaiting atomic.Int64
+	queued     atomic.Int64
+	waitNanos  atomic.Int64
+}
+
+type Stats struct {
+	Name       string        `json:"name"`
+	Capacity   int           `json:"capacity"`
+	InFlight   int64         `json:"inFlight"`
+	Waiting    int64         `json:"waiting"`
+	MaxWaiting int64         `json:"maxWaiting"`
+	Queued     int64         `json:"queued"`
+	TotalWait  time.Duration `json:"totalWait"`
+}
+
+func NewLimiter(name string, capacity int) *Limiter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Limiter{name: name, slots: make(chan struct{}, capacity)}
+}
+
+// Acquire blocks until a slot is free or ctx is done. The returned function
+// gives the slot back and must be called exactly once.
+func (l *Limiter) Acquire(ctx context.Context) (func(), time.Duration, error) {
+	select {
+	case l.slots <- struct{}{}:
+		l.inFlight.Add(1)
+		return l.release, 0, nil
+	default:
+	}
+
+	start := time.Now()
+	waiting := l.waiting.Add(1)
+	for {
+		max := l.maxWaiting.Load()
+		if waiting <= max || l.maxWaiting.CompareAndSwap(max, waiting) {
+			break
+		}
+	}
+	defer l.waiting.Add(-1)
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, time.Since(start), fmt.Errorf("%s limiter; %w", l.name, ctx.Err())
+	}
+	waited := time.Since(start)
+	l.queued.Add(1)
+	l.waitNanos.Add(int64(waited))
+	l.inFlight.Add(1)
+	return l.release, waited, nil
+}
+
+func (l *Limiter) release() {
+	l.inFlight.Add(-1)
+	<-l.slots
+}
+
+func (l *Limiter) Stats() Stats {
+	return Stats{
+		Name:       l.name,
+		Capacity:   cap(l.slots),
+		InFlight:   l.inFlight.Load(),
+		Waiting:    l.waiting.Load(),
+		MaxWaiting: l.maxWaiting.Load(),
+		Queued:     l.queued.Load(),
+		TotalWait:  time.Duration(l.waitNanos.Load()),
+	}
+}
+
+// buffers that grew beyond this are left to the GC rather than pinned in the pool
+const maxPooledBuffer = 8 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// ReadAll reads r through a pooled buffer and returns an exactly sized copy,
+// avoiding the repeated slice growth of io.ReadAll for large images.
+func ReadAll(r io.Reader) ([]byte, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledBuffer {
+			bufferPool.Put(buf)
+		}
+	}()
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	b := make([]byte, buf.Len())
+	copy(b, buf.Bytes())
+	return b, nil
+}
+
+// memoryLimitFraction leaves headroom for non heap memory below the instance limit.
+const memoryLimitFraction = 0.9
+
+// ApplyMemoryLimit sets the soft memory limit of the runtime from
+// FUNCTION_MEMORY_MB unless GOMEMLIMIT already set one, so that the GC works
+// harder before the instance runs out of memory. It returns the limit in
+// effect, math.MaxInt64 when there is none.
+func ApplyMemoryLimit() (int64, error) {
+	if os.Getenv("GOMEMLIMIT") != "" {
+		return debug.SetMemoryLimit(-1), nil
+	}
+	value := os.Getenv("FUNCTION_MEMORY_MB")
+	if value == "" {
+		return debug.SetMemoryLimit(-1), nil
+	}
+	mb, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid FUNCTION_MEMORY_MB; %w", err)
+	}
+	limit := int64(float64(mb<<20) * memoryLimitFraction)
+	debug.SetMemoryLimit(limit)
+	return limit, nil
+}
+
+type MemoryStats struct {
+	HeapAlloc uint64 `json:"heapAlloc"`
+	Sys       uint64 `json:"sys"`
+	NumGC     uint32 `json:"numGC"`
+	Limit     int64  `json:"limit"`
+}
+
+func ReadMemoryStats() MemoryStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return MemoryStats{HeapAlloc: m.HeapAlloc, Sys: m.Sys, NumGC: m.NumGC, Limit: debug.SetMemoryLimit(-1)}
+}
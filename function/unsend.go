@@ -0,0 +1,104 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cache"
+	"github.com/hsmtkk/ubiquitous-couscous/function/cas"
+	"github.com/hsmtkk/ubiquitous-couscous/function/clients"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/namespace"
+	"github.com/hsmtkk/ubiquitous-couscous/function/visionresult"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// alreadyHandled tells whether a redelivered event was replied to before;
+// interactions/{correlationId} is keyed by the webhook event ID, which LINE
+// keeps across redeliveries.
+func alreadyHandled(ctx context.Context, projectID, correlationID string) (bool, error) {
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return false, err
+	}
+	_, err = client.Collection(namespace.Collection("interactions")).Doc(correlationID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("firestore.DocumentRef.Get failed; %w", err)
+	}
+	return true, nil
+}
+
+// forgetMessage deletes what was kept about an image the user unsent: the
+// duplicate detection record, the imagemap objects, the cached OCR text and
+// the archived, annotated, echoed and game copies. The archived blob stays
+// while other messages refer to it. Missing data is not an error; most
+// images have only some of it.
+func forgetMessage(ctx context.Context, projectID, userIDHash, groupIDHash, messageID string) error {
+	client, err := clients.Firestore(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	store, release, err := openImageStore(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := store.deleteImage(ctx, userIDHash, messageID); err != nil {
+		return err
+	}
+	if _, err := imagemapDoc(client, userIDHash, messageID).Delete(ctx); err != nil {
+		return fmt.Errorf("firestore.DocumentRef.Delete failed; %w", err)
+	}
+
+	c, err := cache.Open(ctx, cache.ConfigFromEnv())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.Delete(ctx, ocrTextKey(messageID)); err != nil {
+		return err
+	}
+
+	if _, err := forgetArchivedImages(ctx, client, tenantEnv(ctx, "ARCHIVE_BUCKET"), []cas.Entry{{UserIDHash: userIDHash, ImageID: messageID}}); err != nil {
+		return err
+	}
+	objects := []struct{ bucket, name string }{
+		{tenantEnv(ctx, "ARCHIVE_BUCKET"), legacyArchiveName(userIDHash, messageID)},
+		{tenantEnv(ctx, "ARCHIVE_BUCKET"), archiveResultName(userIDHash, messageID)},
+		{tenantEnv(ctx, "ARCHIVE_BUCKET"), visionresult.Name(userIDHash, messageID, visionresult.KindLabels)},
+		{tenantEnv(ctx, "ARCHIVE_BUCKET"), visionresult.Name(userIDHash, messageID, visionresult.KindObjects)},
+		{tenantEnv(ctx, "ANNOTATION_BUCKET"), annotatedObjectName(userIDHash, messageID)},
+		{tenantEnv(ctx, "ANNOTATION_BUCKET"), echoObjectName(userIDHash, messageID)},
+	}
+	for _, width := range imagemapWidths {
+		objects = append(objects, struct{ bucket, name string }{tenantEnv(ctx, "ANNOTATION_BUCKET"), imagemapObjectName(userIDHash, messageID, width)})
+	}
+	if groupIDHash != "" {
+		objects = append(objects, struct{ bucket, name string }{tenantEnv(ctx, "GAME_BUCKET"), fmt.Sprintf("games/%s/%s.jpg", groupIDHash, messageID)})
+	}
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("storage.NewClient failed; %w", err)
+	}
+	defer storageClient.Close()
+	for _, o := range objects {
+		if o.bucket == "" {
+			continue
+		}
+		err := storageClient.Bucket(o.bucket).Object(namespace.Object(o.name)).Delete(ctx)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("storage.ObjectHandle.Delete failed; %w", err)
+		}
+		logging.Printf(ctx, "deleted gs://%s/%s", o.bucket, o.name)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package function
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/exif"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/taxonomy"
+	"github.com/hsmtkk/ubiquitous-couscous/function/tuning"
+)
+
+// LINE accepts images up to 10MB; uploads get the same limit
+const maxUploadBytes = 10 << 20
+
+type uploadResponse struct {
+	ImageID        string         `json:"imageId"`
+	Labels         []string       `json:"labels"`
+	Categories     []string       `json:"categories"`
+	Summary        string         `json:"summary,omitempty"`
+	Exif           *exif.Metadata `json:"exif,omitempty"`
+	Unsafe         bool           `json:"unsafe"`
+	BudgetExceeded bool           `json:"budgetExceeded,omitempty"`
+	// Result carries the scores and everything else found; Labels and
+	// Categories stay for existing clients.
+	Result analysis.Result `json:"result"`
+}
+
+// upload analyzes an image posted as the "image" field of a multipart form,
+// for clients other than LINE. The X-API-Key header must carry the
+// upload-api-key secret. The optional "mode" field picks the workflow.
+func upload(w http.ResponseWriter, r *http.Request) {
+	ctx := logging.With(r.Context(), logging.Fields{Function: "upload"})
+	logging.Printf(ctx, "upload")
+
+	projectID := os.Getenv("PROJECT_ID")
+
+	if r.Method != http.MethodPost {
+		returnError(ctx, w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed; %s", r.Method))
+		return
+	}
+	apiKey, err := getSecret(ctx, projectID, "upload-api-key")
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	key := r.Header.Get("X-API-Key")
+	if key == "" || subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) != 1 {
+		returnError(ctx, w, http.StatusUnauthorized, fmt.Errorf("invalid API key"))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	file, _, err := r.FormFile("image")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		returnError(ctx, w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("http.Request.FormFile failed; %w", err))
+		return
+	}
+	defer file.Close()
+	image, err := tuning.ReadAll(file)
+	if err != nil {
+		returnError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+
+	mode := r.FormValue("mode")
+	if mode == "" {
+		mode = modeLabels
+	}
+	// games need a group chat to post the round to
+	if mode == modeGame {
+		returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("unsupported mode; %s", mode))
+		return
+	}
+	pipeline := newPipeline()
+	workflows, err := loadWorkflows(pipeline)
+	if err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, ok := workflows.Modes[mode]; !ok {
+		returnError(ctx, w, http.StatusBadRequest, fmt.Errorf("unknown mode; %s", mode))
+		return
+	}
+
+	imageID := newCorrelationID()
+	procMsg := processMessage{
+		CorrelationID: imageID,
+		// every upload client shares one identity for duplicate detection
+		// and rate limits
+		UserIDHash: logging.HashUserID("upload"),
+		ImageID:    imageID,
+		Mode:       mode,
+	}
+	ctx = logging.With(ctx, logging.Fields{CorrelationID: procMsg.CorrelationID, UserIDHash: procMsg.UserIDHash, ImageID: imageID})
+	state := &pipelineState{projectID: projectID, procMsg: procMsg, image: image, result: analysis.New(), minScore: labelMinScore(ctx, userPreferences{})}
+	if err := pipeline.Run(ctx, workflows, mode, state); err != nil {
+		returnError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := uploadResponse{
+		ImageID:        imageID,
+		Labels:         state.result.LabelNames(),
+		Categories:     taxonomy.Categories(state.result.LabelNames()),
+		Summary:        state.summary,
+		Exif:           state.exif,
+		Unsafe:         state.unsafe,
+		BudgetExceeded: state.budgetExceeded,
+		Result:         state.result,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logging.Errorf(ctx, "json.Encoder.Encode failed; %v", err)
+	}
+}
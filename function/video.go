@@ -0,0 +1,78 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/lineapi"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+const (
+	mediaImage = "image"
+	mediaVideo = "video"
+)
+
+// mediaOf returns the content ID and media type of the messages process
+// analyzes, empty for others.
+func mediaOf(message linebot.Message) (string, string) {
+	switch m := message.(type) {
+	case *linebot.ImageMessage:
+		return m.ID, mediaImage
+	case *linebot.VideoMessage:
+		return m.ID, mediaVideo
+	}
+	return "", ""
+}
+
+// downloadVideoFrame returns the preview LINE made for the video. Should
+// that fail and FFMPEG_PATH name an ffmpeg binary, the first frame is cut
+// from the video itself instead.
+func downloadVideoFrame(ctx context.Context, lineClient lineapi.LineClient, messageID string) ([]byte, error) {
+	preview, err := lineClient.GetMessagePreview(ctx, messageID)
+	if err == nil {
+		logging.Printf(ctx, "download video preview; %d bytes", len(preview))
+		return preview, nil
+	}
+	ffmpeg := os.Getenv("FFMPEG_PATH")
+	if ffmpeg == "" {
+		return nil, err
+	}
+	logging.Warnf(ctx, "video preview failed, extracting first frame; %v", err)
+	video, err := lineClient.GetMessageContent(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	return firstFrame(ctx, ffmpeg, video)
+}
+
+// firstFrame has ffmpeg read the video from a temporary file rather than
+// stdin: videos from phones often keep the moov atom at the end, and ffmpeg
+// cannot seek back to the frames once it has read that far down a pipe.
+func firstFrame(ctx context.Context, ffmpeg string, video []byte) ([]byte, error) {
+	f, err := os.CreateTemp("", "video-*")
+	if err != nil {
+		return nil, fmt.Errorf("os.CreateTemp failed; %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(video); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("os.File.Write failed; %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("os.File.Close failed; %w", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, "-loglevel", "error", "-i", f.Name(), "-frames:v", "1", "-f", "image2", "-c:v", "mjpeg", "pipe:1")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed; %w; %s", err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
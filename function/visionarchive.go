@@ -0,0 +1,51 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/hsmtkk/ubiquitous-couscous/function/visionresult"
+	visionpb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+type visionSubjectKey struct{}
+
+type visionSubject struct {
+	userIDHash string
+	imageID    string
+}
+
+// withVisionSubject names the image the Vision responses of ctx are
+// archived under; responses without one are not archived.
+func withVisionSubject(ctx context.Context, userIDHash, imageID string) context.Context {
+	return context.WithValue(ctx, visionSubjectKey{}, visionSubject{userIDHash: userIDHash, imageID: imageID})
+}
+
+// archiveVisionResponse keeps resp in ARCHIVE_BUCKET when VISION_RAW_ARCHIVE
+// is on, for cmd/visionbackfill to derive results from later. Failing to is
+// only logged; the reply does not depend on it.
+func archiveVisionResponse(ctx context.Context, kind string, features []string, resp *visionpb.AnnotateImageResponse) {
+	bucket := tenantEnv(ctx, "ARCHIVE_BUCKET")
+	subject, ok := ctx.Value(visionSubjectKey{}).(visionSubject)
+	if bucket == "" || !ok || dynconfig.Get(ctx, "VISION_RAW_ARCHIVE") != "true" || !recordingAllowed(ctx) {
+		return
+	}
+	record, err := visionresult.NewRecord(subject.userIDHash, subject.imageID, kind, features, resp)
+	if err != nil {
+		logging.Errorf(ctx, "archive vision response failed; %v", err)
+		return
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		logging.Errorf(ctx, "json.Marshal failed; %v", err)
+		return
+	}
+	name := visionresult.Name(subject.userIDHash, subject.imageID, kind)
+	if err := writeObject(ctx, bucket, name, "application/json", b, nil); err != nil {
+		logging.Errorf(ctx, "archive vision response failed; %v", err)
+		return
+	}
+	logging.Printf(ctx, "archived gs://%s/%s", bucket, name)
+}
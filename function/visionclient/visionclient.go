@@ -0,0 +1,180 @@
+package visionclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	vision "cloud.google.com/go/vision/apiv1"
+	gax "github.com/googleapis/gax-go/v2"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	visionpb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// consecutive connection level failures after which the client is replaced
+const defaultMaxFailures = 3
+
+// Annotator is the part of the Vision client the functions call. Handlers get
+// it from a Pool and never close it.
+type Annotator interface {
+	BatchAnnotateImages(ctx context.Context, req *visionpb.BatchAnnotateImagesRequest, opts ...gax.CallOption) (*visionpb.BatchAnnotateImagesResponse, error)
+	DetectLabels(ctx context.Context, img *visionpb.Image, ictx *visionpb.ImageContext, maxResults int, opts ...gax.CallOption) ([]*visionpb.EntityAnnotation, error)
+	DetectTexts(ctx context.Context, img *visionpb.Image, ictx *visionpb.ImageContext, maxResults int, opts ...gax.CallOption) ([]*visionpb.EntityAnnotation, error)
+	DetectImageProperties(ctx context.Context, img *visionpb.Image, ictx *visionpb.ImageContext, opts ...gax.CallOption) (*visionpb.ImageProperties, error)
+	DetectSafeSearch(ctx context.Context, img *visionpb.Image, ictx *visionpb.ImageContext, opts ...gax.CallOption) (*visionpb.SafeSearchAnnotation, error)
+}
+
+type client interface {
+	Annotator
+	Close() error
+}
+
+// Pool keeps one gRPC backed Vision client per instance. A client whose
+// calls keep failing at the connection level is closed and dialed again on
+// the next Get.
+type Pool struct {
+	dial        func(ctx context.Context) (client, error)
+	maxFailures int
+
+	mu       sync.Mutex
+	client   client
+	failures int
+}
+
+func NewPool(maxFailures int) *Pool {
+	dial := func(ctx context.Context) (client, error) {
+		return vision.NewImageAnnotatorClient(ctx)
+	}
+	return &Pool{dial: dial, maxFailures: maxFailures}
+}
+
+var Default = NewPool(defaultMaxFailures)
+
+// Get returns the shared client, dialing it first if needed and again when
+// the connection of the current one is broken. The client outlives ctx.
+func (p *Pool) Get(ctx context.Context) (Annotator, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client != nil && !healthy(p.client) {
+		logging.Warnf(ctx, "vision connection broken")
+		p.closeLocked(ctx)
+	}
+	if p.client == nil {
+		c, err := p.dial(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("vision.NewImageAnnotatorClient failed; %w", err)
+		}
+		logging.Printf(ctx, "vision client created")
+		p.client = c
+		p.failures = 0
+	}
+	return pooled{pool: p, client: p.client}, nil
+}
+
+// Warm dials the shared client in the background so that the first image
+// does not wait for it.
+func (p *Pool) Warm() {
+	go func() {
+		if _, err := p.Get(context.Background()); err != nil {
+			logging.Warnf(context.Background(), "warm vision client failed; %v", err)
+		}
+	}()
+}
+
+// healthy checks the connection state where the client exposes it.
+func healthy(c client) bool {
+	conn, ok := c.(interface{ Connection() *grpc.ClientConn })
+	if !ok {
+		return true
+	}
+	state := conn.Connection().GetState()
+	return state != connectivity.TransientFailure && state != connectivity.Shutdown
+}
+
+// report counts the outcome of a call made with c.
+func (p *Pool) report(ctx context.Context, c client, err error) {
+	p.mu.Lock()
+	if p.client != c {
+		p.mu.Unlock()
+		return
+	}
+	if !persistent(err) {
+		p.failures = 0
+		p.mu.Unlock()
+		return
+	}
+	p.failures++
+	failures := p.failures
+	p.mu.Unlock()
+	if failures >= p.maxFailures {
+		logging.Warnf(ctx, "vision client failed %d times in a row; %v", failures, err)
+		p.reset(ctx, c)
+	}
+}
+
+// reset drops c unless it has been replaced already. Calls still in flight
+// on it fail, as they most likely would have anyway.
+func (p *Pool) reset(ctx context.Context, c client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client == c {
+		p.closeLocked(ctx)
+	}
+}
+
+func (p *Pool) closeLocked(ctx context.Context) {
+	if err := p.client.Close(); err != nil {
+		logging.Errorf(ctx, "vision client close failed; %v", err)
+	}
+	p.client = nil
+	p.failures = 0
+	logging.Printf(ctx, "vision client reset")
+}
+
+// persistent tells errors of the connection from those of the request.
+func persistent(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Unknown, codes.Internal:
+		return true
+	}
+	return false
+}
+
+type pooled struct {
+	pool   *Pool
+	client client
+}
+
+func (a pooled) BatchAnnotateImages(ctx context.Context, req *visionpb.BatchAnnotateImagesRequest, opts ...gax.CallOption) (*visionpb.BatchAnnotateImagesResponse, error) {
+	resp, err := a.client.BatchAnnotateImages(ctx, req, opts...)
+	a.pool.report(ctx, a.client, err)
+	return resp, err
+}
+
+func (a pooled) DetectLabels(ctx context.Context, img *visionpb.Image, ictx *visionpb.ImageContext, maxResults int, opts ...gax.CallOption) ([]*visionpb.EntityAnnotation, error) {
+	labels, err := a.client.DetectLabels(ctx, img, ictx, maxResults, opts...)
+	a.pool.report(ctx, a.client, err)
+	return labels, err
+}
+
+func (a pooled) DetectTexts(ctx context.Context, img *visionpb.Image, ictx *visionpb.ImageContext, maxResults int, opts ...gax.CallOption) ([]*visionpb.EntityAnnotation, error) {
+	texts, err := a.client.DetectTexts(ctx, img, ictx, maxResults, opts...)
+	a.pool.report(ctx, a.client, err)
+	return texts, err
+}
+
+func (a pooled) DetectImageProperties(ctx context.Context, img *visionpb.Image, ictx *visionpb.ImageContext, opts ...gax.CallOption) (*visionpb.ImageProperties, error) {
+	props, err := a.client.DetectImageProperties(ctx, img, ictx, opts...)
+	a.pool.report(ctx, a.client, err)
+	return props, err
+}
+
+func (a pooled) DetectSafeSearch(ctx context.Context, img *visionpb.Image, ictx *visionpb.ImageContext, opts ...gax.CallOption) (*visionpb.SafeSearchAnnotation, error) {
+	annotation, err := a.client.DetectSafeSearch(ctx, img, ictx, opts...)
+	a.pool.report(ctx, a.client, err)
+	return annotation, err
+}
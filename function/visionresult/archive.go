@@ -0,0 +1,53 @@
+package visionresult
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	visionpb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Prefix is where the raw responses live in the archive bucket.
+const Prefix = "vision/"
+
+const (
+	KindLabels  = "labels"
+	KindObjects = "objects"
+)
+
+// Record is a Vision response as it came, kept so that later versions of
+// the pipeline can derive results from it without calling Vision again.
+// Kind names the call and Features the features it requested.
+type Record struct {
+	ImageID    string          `json:"imageId"`
+	UserIDHash string          `json:"userIdHash"`
+	Kind       string          `json:"kind"`
+	Features   []string        `json:"features,omitempty"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	Response   json.RawMessage `json:"response"`
+}
+
+func Name(userIDHash, imageID, kind string) string {
+	return fmt.Sprintf("%s%s/%s/%s.json", Prefix, userIDHash, imageID, kind)
+}
+
+// NewRecord keeps resp in the protobuf JSON mapping, which stays readable
+// by any later version of the client library.
+func NewRecord(userIDHash, imageID, kind string, features []string, resp *visionpb.AnnotateImageResponse) (Record, error) {
+	b, err := protojson.Marshal(resp)
+	if err != nil {
+		return Record{}, fmt.Errorf("protojson.Marshal failed; %w", err)
+	}
+	return Record{ImageID: imageID, UserIDHash: userIDHash, Kind: kind, Features: features, CreatedAt: time.Now(), Response: b}, nil
+}
+
+func (r Record) Decode() (*visionpb.AnnotateImageResponse, error) {
+	resp := &visionpb.AnnotateImageResponse{}
+	// fields added to the API after this build are skipped
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(r.Response, resp); err != nil {
+		return nil, fmt.Errorf("protojson.Unmarshal failed; %w", err)
+	}
+	return resp, nil
+}
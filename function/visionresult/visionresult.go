@@ -0,0 +1,73 @@
+package visionresult
+
+import (
+	"math"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/analysis"
+	"github.com/hsmtkk/ubiquitous-couscous/function/labelmerge"
+	visionpb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// Feature is a Vision feature labels are taken from, with the weight its
+// scores count for when merged with the others.
+type Feature struct {
+	Type   visionpb.Feature_Type
+	Weight float32
+}
+
+// Features are the features VISION_FEATURES may name. Web entity scores are
+// relevance rather than confidence, so they count for less.
+var Features = map[string]Feature{
+	"labels":  {visionpb.Feature_LABEL_DETECTION, 1},
+	"objects": {visionpb.Feature_OBJECT_LOCALIZATION, 1},
+	"web":     {visionpb.Feature_WEB_DETECTION, 0.8},
+}
+
+// Labels merges what the named features found in resp and keeps at most
+// max of those scoring minScore or more.
+func Labels(resp *visionpb.AnnotateImageResponse, features []string, minScore float32, max int) []labelmerge.Label {
+	groups := [][]labelmerge.Label{}
+	for _, name := range features {
+		found := []labelmerge.Label{}
+		switch Features[name].Type {
+		case visionpb.Feature_LABEL_DETECTION:
+			for _, a := range resp.GetLabelAnnotations() {
+				found = append(found, labelmerge.Label{Name: a.GetDescription(), Score: a.GetScore()})
+			}
+		case visionpb.Feature_OBJECT_LOCALIZATION:
+			for _, a := range resp.GetLocalizedObjectAnnotations() {
+				found = append(found, labelmerge.Label{Name: a.GetName(), Score: a.GetScore()})
+			}
+		case visionpb.Feature_WEB_DETECTION:
+			for _, e := range resp.GetWebDetection().GetWebEntities() {
+				found = append(found, labelmerge.Label{Name: e.GetDescription(), Score: e.GetScore()})
+			}
+		}
+		groups = append(groups, labelmerge.Weighted(found, Features[name].Weight))
+	}
+	merged := labelmerge.Above(labelmerge.Merge(groups...), minScore)
+	if len(merged) > max {
+		merged = merged[:max]
+	}
+	return merged
+}
+
+// Objects returns the localized objects of resp with their bounding boxes,
+// in coordinates relative to the image size.
+func Objects(resp *visionpb.AnnotateImageResponse) []analysis.Object {
+	objects := []analysis.Object{}
+	for _, a := range resp.GetLocalizedObjectAnnotations() {
+		vertices := a.GetBoundingPoly().GetNormalizedVertices()
+		if len(vertices) == 0 {
+			continue
+		}
+		o := analysis.Object{Name: a.GetName(), Score: a.GetScore(), MinX: 1, MinY: 1}
+		for _, v := range vertices {
+			x, y := float64(v.GetX()), float64(v.GetY())
+			o.MinX, o.MaxX = math.Min(o.MinX, x), math.Max(o.MaxX, x)
+			o.MinY, o.MaxY = math.Min(o.MinY, y), math.Max(o.MaxY, y)
+		}
+		objects = append(objects, o)
+	}
+	return objects
+}
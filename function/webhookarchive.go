@@ -0,0 +1,51 @@
+package function
+
+import (
+	"context"
+	"time"
+
+	"github.com/hsmtkk/ubiquitous-couscous/function/dynconfig"
+	"github.com/hsmtkk/ubiquitous-couscous/function/logging"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// webhookArchivePrefix is followed by the UTC hour the webhook arrived in,
+// so that cmd/replay can list a time range without listing everything.
+const webhookArchivePrefix = "webhooks/"
+
+// webhookArchiveLayout names an archived webhook by when it arrived.
+const webhookArchiveLayout = "2006/01/02/15/150405.000000"
+
+// archiveWebhook keeps the raw body of a webhook whose signature checked out
+// in ARCHIVE_BUCKET with WEBHOOK_ARCHIVE on, for cmd/replay to send through
+// the pipeline again. Failing to is only logged.
+func archiveWebhook(ctx context.Context, body []byte, events []*linebot.Event) {
+	bucket := tenantEnv(ctx, "ARCHIVE_BUCKET")
+	if bucket == "" || len(events) == 0 || dynconfig.Get(ctx, "WEBHOOK_ARCHIVE") != "true" {
+		return
+	}
+	// a webhook is archived whole, so only with the consent of every user in it
+	for _, evt := range events {
+		if evt.Source != nil && evt.Source.UserID != "" && !recordingAllowedFor(ctx, logging.HashUserID(evt.Source.UserID)) {
+			return
+		}
+	}
+	id := events[0].WebhookEventID
+	if id == "" {
+		id = newCorrelationID()
+	}
+	name := webhookArchivePrefix + time.Now().UTC().Format(webhookArchiveLayout) + "-" + id + ".json"
+	if err := writeObject(ctx, bucket, name, "application/json", body, nil); err != nil {
+		logging.Errorf(ctx, "archive webhook failed; %v", err)
+	}
+}
+
+// receivedAt is when the event is taken to have arrived. Redelivered events,
+// LINE's own or those cmd/replay sends, count from when they happened: their
+// reply tokens are most likely expired, so the reply is pushed instead.
+func receivedAt(evt *linebot.Event) time.Time {
+	if evt.DeliveryContext.IsRedelivery && !evt.Timestamp.IsZero() {
+		return evt.Timestamp
+	}
+	return time.Now()
+}
@@ -0,0 +1,98 @@
+package function
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxWebhookBytes bounds the decoded body, which a small gzip body can
+// inflate to many times its size.
+const maxWebhookBytes = 5 << 20
+
+var (
+	errUnsupportedWebhook = errors.New("unsupported webhook body")
+	errWebhookTooLarge    = errors.New("webhook body too large")
+)
+
+// readWebhook returns the webhook JSON, the body the signature is computed
+// over, and leaves it to be read again for the signature check. Proxies in
+// front of receive may gzip the body or post it as the payload field of a
+// form; only UTF-8 is accepted.
+func readWebhook(r *http.Request) ([]byte, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("%w; mime.ParseMediaType failed; %v", errUnsupportedWebhook, err)
+	}
+	if charset := params["charset"]; charset != "" && !strings.EqualFold(charset, "utf-8") {
+		return nil, fmt.Errorf("%w; charset %s", errUnsupportedWebhook, charset)
+	}
+
+	// the raw body is read before its signature is checked
+	raw := http.MaxBytesReader(nil, r.Body, maxWebhookBytes)
+	reader := io.Reader(raw)
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(raw)
+		if err != nil {
+			return nil, fmt.Errorf("gzip.NewReader failed; %w", err)
+		}
+		defer gz.Close()
+		reader = gz
+	default:
+		return nil, fmt.Errorf("%w; content encoding %s", errUnsupportedWebhook, encoding)
+	}
+	body, err := io.ReadAll(io.LimitReader(reader, maxWebhookBytes+1))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, errWebhookTooLarge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	if len(body) > maxWebhookBytes {
+		return nil, errWebhookTooLarge
+	}
+
+	switch mediaType {
+	case "application/json":
+	case "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("url.ParseQuery failed; %w", err)
+		}
+		payload := form.Get("payload")
+		if payload == "" {
+			return nil, fmt.Errorf("missing payload")
+		}
+		body = []byte(payload)
+	default:
+		return nil, fmt.Errorf("%w; content type %s", errUnsupportedWebhook, mediaType)
+	}
+	if !utf8.Valid(body) {
+		return nil, fmt.Errorf("webhook body is not valid UTF-8")
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.Header.Del("Content-Encoding")
+	r.Header.Set("Content-Type", "application/json")
+	return body, nil
+}
+
+func webhookErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnsupportedWebhook):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, errWebhookTooLarge):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,158 @@
+package webhooksim
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Event types New accepts.
+const (
+	TypeImage  = "image"
+	TypeText   = "text"
+	TypeFollow = "follow"
+)
+
+type Source struct {
+	Type    string `json:"type"`
+	UserID  string `json:"userId"`
+	GroupID string `json:"groupId,omitempty"`
+}
+
+type Message struct {
+	ID              string           `json:"id"`
+	Type            string           `json:"type"`
+	Text            string           `json:"text,omitempty"`
+	ContentProvider *ContentProvider `json:"contentProvider,omitempty"`
+}
+
+type ContentProvider struct {
+	Type string `json:"type"`
+}
+
+type DeliveryContext struct {
+	IsRedelivery bool `json:"isRedelivery"`
+}
+
+// Event is a webhook event as LINE sends it. WebhookEventID doubles as the
+// correlation ID of everything the pipeline records about the event.
+type Event struct {
+	Type            string          `json:"type"`
+	Mode            string          `json:"mode"`
+	Timestamp       int64           `json:"timestamp"`
+	Source          Source          `json:"source"`
+	WebhookEventID  string          `json:"webhookEventId"`
+	DeliveryContext DeliveryContext `json:"deliveryContext"`
+	ReplyToken      string          `json:"replyToken"`
+	Message         *Message        `json:"message,omitempty"`
+}
+
+// Options describe the event to craft. Empty IDs are made up.
+type Options struct {
+	Type      string
+	UserID    string
+	GroupID   string
+	Text      string
+	MessageID string
+}
+
+// New crafts an event of opts.Type from a user chat, or a group chat when
+// opts.GroupID is set.
+func New(opts Options) (Event, error) {
+	evt := Event{
+		Type:           "message",
+		Mode:           "active",
+		Timestamp:      time.Now().UnixMilli(),
+		Source:         Source{Type: "user", UserID: opts.UserID},
+		WebhookEventID: randomID(13),
+		ReplyToken:     randomID(16),
+	}
+	if evt.Source.UserID == "" {
+		evt.Source.UserID = "U" + randomID(16)
+	}
+	if opts.GroupID != "" {
+		evt.Source.Type = "group"
+		evt.Source.GroupID = opts.GroupID
+	}
+	messageID := opts.MessageID
+	if messageID == "" {
+		messageID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	switch opts.Type {
+	case TypeImage:
+		evt.Message = &Message{ID: messageID, Type: "image", ContentProvider: &ContentProvider{Type: "line"}}
+	case TypeText:
+		evt.Message = &Message{ID: messageID, Type: "text", Text: opts.Text}
+	case TypeFollow:
+		evt.Type = "follow"
+	default:
+		return Event{}, fmt.Errorf("unknown event type; %s", opts.Type)
+	}
+	return evt, nil
+}
+
+// Sign returns the X-Line-Signature of body: its base64 HMAC-SHA256 keyed
+// with the channel secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Post sends events in one signed webhook request and returns the status
+// code and body of the response.
+func Post(ctx context.Context, client *http.Client, url, secret string, events ...Event) (int, []byte, error) {
+	body, err := json.Marshal(struct {
+		Destination string  `json:"destination"`
+		Events      []Event `json:"events"`
+	}{"Usimulator", events})
+	if err != nil {
+		return 0, nil, fmt.Errorf("json.Marshal failed; %w", err)
+	}
+	return PostBody(ctx, client, url, secret, body)
+}
+
+// PostBody sends body, a whole webhook request body, signed with secret.
+func PostBody(ctx context.Context, client *http.Client, url, secret string, body []byte) (int, []byte, error) {
+	return PostBodyHeader(ctx, client, url, secret, body, nil)
+}
+
+// PostBodyHeader is PostBody with header added to the request.
+func PostBodyHeader(ctx context.Context, client *http.Client, url, secret string, body []byte, header http.Header) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, fmt.Errorf("http.NewRequestWithContext failed; %w", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Line-Signature", Sign(secret, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("http.Client.Do failed; %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("io.ReadAll failed; %w", err)
+	}
+	return resp.StatusCode, respBody, nil
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,119 @@
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrStop ends a run early without failing it.
+var ErrStop = errors.New("stop workflow")
+
+// Config declares the steps run for each analysis mode.
+type Config struct {
+	Modes map[string][]Step `json:"modes"`
+}
+
+// Step names a registered step. If, when set, names a condition of the
+// state ("unsafe"), optionally negated ("!unsafe"); the step is skipped when
+// the condition does not hold.
+type Step struct {
+	Name   string            `json:"step"`
+	If     string            `json:"if,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+func ParseConfig(b []byte) (Config, error) {
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return Config{}, fmt.Errorf("json.Unmarshal failed; %w", err)
+	}
+	return cfg, nil
+}
+
+type Conditioner interface {
+	Condition(name string) bool
+}
+
+type StepFunc[S Conditioner] func(ctx context.Context, state S, params map[string]string) error
+
+type Engine[S Conditioner] struct {
+	steps map[string]StepFunc[S]
+	// OnStep, when set, is called before each step that runs.
+	OnStep func(ctx context.Context, step Step)
+	// AfterStep, when set, is called after each step that ran with the error
+	// it failed with, nil also for a step that stopped the workflow.
+	AfterStep func(ctx context.Context, step Step, elapsed time.Duration, err error)
+}
+
+func NewEngine[S Conditioner]() *Engine[S] {
+	return &Engine[S]{steps: map[string]StepFunc[S]{}}
+}
+
+func (e *Engine[S]) Register(name string, fn StepFunc[S]) {
+	e.steps[name] = fn
+}
+
+// Validate reports steps the config uses that are not registered.
+func (e *Engine[S]) Validate(cfg Config) error {
+	unknown := []string{}
+	for mode, steps := range cfg.Modes {
+		for _, step := range steps {
+			if _, ok := e.steps[step.Name]; !ok {
+				unknown = append(unknown, mode+"/"+step.Name)
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown workflow steps; %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+func (e *Engine[S]) Run(ctx context.Context, cfg Config, mode string, state S) error {
+	steps, ok := cfg.Modes[mode]
+	if !ok {
+		return fmt.Errorf("no workflow for mode; %s", mode)
+	}
+	for _, step := range steps {
+		if !holds(state, step.If) {
+			continue
+		}
+		fn, ok := e.steps[step.Name]
+		if !ok {
+			return fmt.Errorf("unknown workflow step; %s", step.Name)
+		}
+		if e.OnStep != nil {
+			e.OnStep(ctx, step)
+		}
+		start := time.Now()
+		err := fn(ctx, state, step.Params)
+		if e.AfterStep != nil {
+			outcome := err
+			if errors.Is(err, ErrStop) {
+				outcome = nil
+			}
+			e.AfterStep(ctx, step, time.Since(start), outcome)
+		}
+		if errors.Is(err, ErrStop) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("workflow step %s failed; %w", step.Name, err)
+		}
+	}
+	return nil
+}
+
+func holds(state Conditioner, condition string) bool {
+	if condition == "" {
+		return true
+	}
+	if strings.HasPrefix(condition, "!") {
+		return !state.Condition(condition[1:])
+	}
+	return state.Condition(condition)
+}
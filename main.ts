@@ -7,6 +7,33 @@ import * as path from 'path';
 
 const project = 'ubiquitous-couscous';
 const region = 'asia-northeast1';
+// Google accounts allowed to open the dashboard, e.g. 'user:someone@example.com'
+const operators: string[] = [];
+// OAuth client of type web application operators sign in to the dashboard with; its redirect URI is the dashboard URL
+const dashboardClientId = '';
+// LINE user IDs allowed to run admin commands such as /stats in chat
+const admins: string[] = [];
+// spreadsheet every analysis is appended to, shared with the function service account; empty turns it off
+const sheetId = '';
+// Pub/Sub subscriptions Eventarc created for the process and send triggers; empty leaves the function out of the autoscaling advice
+const processSubscription = '';
+const sendSubscription = '';
+// client ID of the Slack app, shown on its Basic Information page
+const slackClientId = '';
+// LIFF app whose endpoint URL is the liff function, and the LINE Login channel it belongs to; empty leaves out "View details"
+const liffId = '';
+const liffChannelId = '';
+// NAMESPACE lets several deployments, e.g. dev and prod, share the project; the functions prefix what they read and write the same way (function/namespace)
+const namespace = process.env.NAMESPACE ?? '';
+if (namespace && !/^[a-z][a-z0-9-]{0,19}$/.test(namespace)) {
+  throw new Error(`invalid NAMESPACE ${namespace}`);
+}
+// topics, functions, jobs, secrets and buckets of this deployment
+const ns = (name: string) => namespace ? `${namespace}-${name}` : name;
+// Firestore collection IDs, as namespace.Collection
+const collection = (id: string) => namespace ? `${namespace}_${id}` : id;
+// days the pipeline events exported to BigQuery are kept
+const pipelineEventsDays = 30;
 // const repository = 'ubiquitous-couscous';
 
 class MyStack extends TerraformStack {
@@ -19,42 +46,230 @@ class MyStack extends TerraformStack {
     });
 
     const service_runner = new google.serviceAccount.ServiceAccount(this, 'service-runner', {
-      accountId: 'service-runner',
+      accountId: namespace ? `${namespace}-runner` : 'service-runner',
     });
 
-    new google.projectIamBinding.ProjectIamBinding(this, 'allow-secret-manager', {
-      members: [`serviceAccount:${service_runner.email}`],
+    // members rather than bindings, so that deployments sharing the project keep each other's grants
+    new google.projectIamMember.ProjectIamMember(this, 'allow-secret-manager', {
+      member: `serviceAccount:${service_runner.email}`,
       project,
       role: 'roles/secretmanager.secretAccessor',
     });
 
-    new google.projectIamBinding.ProjectIamBinding(this, 'allow-pubsub-publish', {
-      members: [`serviceAccount:${service_runner.email}`],
+    new google.projectIamMember.ProjectIamMember(this, 'allow-vertex-ai', {
+      member: `serviceAccount:${service_runner.email}`,
+      project,
+      role: 'roles/aiplatform.user',
+    });
+
+    new google.projectIamMember.ProjectIamMember(this, 'allow-pubsub-publish', {
+      member: `serviceAccount:${service_runner.email}`,
       project,
       role: 'roles/pubsub.publisher',
     });
 
-    new google.projectIamBinding.ProjectIamBinding(this, 'allow-pubsub-subscribe', {
-      members: [`serviceAccount:${service_runner.email}`],
+    new google.projectIamMember.ProjectIamMember(this, 'allow-pubsub-subscribe', {
+      member: `serviceAccount:${service_runner.email}`,
       project,
       role: 'roles/pubsub.subscriber',
     });
 
+    new google.projectIamMember.ProjectIamMember(this, 'allow-datastore-user', {
+      member: `serviceAccount:${service_runner.email}`,
+      project,
+      role: 'roles/datastore.user',
+    });
+
+    new google.projectIamMember.ProjectIamMember(this, 'allow-run-invoke', {
+      member: `serviceAccount:${service_runner.email}`,
+      project,
+      role: 'roles/run.invoker',
+    });
+
+    new google.projectIamMember.ProjectIamMember(this, 'allow-metric-writer', {
+      member: `serviceAccount:${service_runner.email}`,
+      project,
+      role: 'roles/monitoring.metricWriter',
+    });
+
+    new google.projectIamMember.ProjectIamMember(this, 'allow-monitoring-viewer', {
+      member: `serviceAccount:${service_runner.email}`,
+      project,
+      role: 'roles/monitoring.viewer',
+    });
+
+    // slack-install keeps the bot token of each workspace as a secret of its own
+    new google.projectIamMember.ProjectIamMember(this, 'allow-secret-write', {
+      member: `serviceAccount:${service_runner.email}`,
+      project,
+      role: 'roles/secretmanager.admin',
+    });
+
+    // export links are signed through the IAM signBlob API as the runner itself
+    new google.serviceAccountIamMember.ServiceAccountIamMember(this, 'allow-sign-blob', {
+      serviceAccountId: service_runner.name,
+      member: `serviceAccount:${service_runner.email}`,
+      role: 'roles/iam.serviceAccountTokenCreator',
+    });
+
     const wait_process = new google.pubsubTopic.PubsubTopic(this, 'wait-process', {
-      name: 'wait-process',
+      name: ns('wait-process'),
     });    
 
     const wait_send = new google.pubsubTopic.PubsubTopic(this, 'wait-send', {
-      name: 'wait-send',
+      name: ns('wait-send'),
+    });
+
+    const wait_postback = new google.pubsubTopic.PubsubTopic(this, 'wait-postback', {
+      name: ns('wait-postback'),
+    });
+
+    const wait_guess = new google.pubsubTopic.PubsubTopic(this, 'wait-guess', {
+      name: ns('wait-guess'),
+    });
+
+    const wait_beacon = new google.pubsubTopic.PubsubTopic(this, 'wait-beacon', {
+      name: ns('wait-beacon'),
+    });
+
+    const overflow = new google.pubsubTopic.PubsubTopic(this, 'overflow', {
+      name: ns('overflow'),
+    });
+
+    const quarantine = new google.pubsubTopic.PubsubTopic(this, 'quarantine', {
+      name: ns('quarantine'),
+    });
+
+    // process and send messages that failed MAX_ATTEMPTS times
+    const dead_letter = new google.pubsubTopic.PubsubTopic(this, 'dead-letter', {
+      name: ns('dead-letter'),
     });
 
     const channel_access_token = new google.secretManagerSecret.SecretManagerSecret(this, 'channel-access-token', {
-      secretId: 'channel-access-token',
+      secretId: ns('channel-access-token'),
+      replication: {
+        automatic: true,
+      },
+    });
+
+    // the JWK channel access tokens v2.1 are issued with once LINE_CHANNEL_ID is set
+    new google.secretManagerSecret.SecretManagerSecret(this, 'channel-assertion-key', {
+      secretId: ns('channel-assertion-key'),
+      replication: {
+        automatic: true,
+      },
+    });
+
+    new google.secretManagerSecret.SecretManagerSecret(this, 'channel-secret', {
+      secretId: ns('channel-secret'),
+      replication: {
+        automatic: true,
+      },
+    });
+
+    new google.secretManagerSecret.SecretManagerSecret(this, 'postback-key', {
+      secretId: ns('postback-key'),
+      replication: {
+        automatic: true,
+      },
+    });
+
+    new google.secretManagerSecret.SecretManagerSecret(this, 'status-token', {
+      secretId: ns('status-token'),
+      replication: {
+        automatic: true,
+      },
+    });
+
+    new google.secretManagerSecret.SecretManagerSecret(this, 'upload-api-key', {
+      secretId: ns('upload-api-key'),
+      replication: {
+        automatic: true,
+      },
+    });
+
+    new google.secretManagerSecret.SecretManagerSecret(this, 'telegram-bot-token', {
+      secretId: ns('telegram-bot-token'),
+      replication: {
+        automatic: true,
+      },
+    });
+
+    new google.secretManagerSecret.SecretManagerSecret(this, 'telegram-webhook-secret', {
+      secretId: ns('telegram-webhook-secret'),
+      replication: {
+        automatic: true,
+      },
+    });
+
+    new google.secretManagerSecret.SecretManagerSecret(this, 'slack-signing-secret', {
+      secretId: ns('slack-signing-secret'),
+      replication: {
+        automatic: true,
+      },
+    });
+
+    new google.secretManagerSecret.SecretManagerSecret(this, 'slack-client-secret', {
+      secretId: ns('slack-client-secret'),
+      replication: {
+        automatic: true,
+      },
+    });
+
+    new google.secretManagerSecret.SecretManagerSecret(this, 'dashboard-oauth-client-secret', {
+      secretId: ns('dashboard-oauth-client-secret'),
+      replication: {
+        automatic: true,
+      },
+    });
+
+    new google.secretManagerSecret.SecretManagerSecret(this, 'kg-api-key', {
+      secretId: ns('kg-api-key'),
       replication: {
         automatic: true,
       },
     });
 
+    const game_bucket = new google.storageBucket.StorageBucket(this, 'game-bucket', {
+      location: region,
+      name: ns(`game-${project}`),
+      uniformBucketLevelAccess: true,
+      lifecycleRule: [{
+        condition: {
+          age: 1,
+        },
+        action: {
+          type: 'Delete',
+        },
+      }],
+    });
+
+    new google.storageBucketIamMember.StorageBucketIamMember(this, 'game-bucket-writer', {
+      bucket: game_bucket.name,
+      member: `serviceAccount:${service_runner.email}`,
+      role: 'roles/storage.objectAdmin',
+    });
+
+    const export_bucket = new google.storageBucket.StorageBucket(this, 'export-bucket', {
+      location: region,
+      name: ns(`export-${project}`),
+      uniformBucketLevelAccess: true,
+      lifecycleRule: [{
+        condition: {
+          age: 2,
+        },
+        action: {
+          type: 'Delete',
+        },
+      }],
+    });
+
+    new google.storageBucketIamMember.StorageBucketIamMember(this, 'export-bucket-writer', {
+      bucket: export_bucket.name,
+      member: `serviceAccount:${service_runner.email}`,
+      role: 'roles/storage.objectAdmin',
+    });
+
     const function_asset = new TerraformAsset(this, 'function-asset', {
       path: path.resolve('function'),
       type: AssetType.ARCHIVE,
@@ -62,7 +277,7 @@ class MyStack extends TerraformStack {
 
     const function_bucket = new google.storageBucket.StorageBucket(this, 'function-bucket', {
       location: region,
-      name: `source-${project}`,
+      name: ns(`source-${project}`),
       lifecycleRule: [{
         condition: {
           age: 1,
@@ -91,11 +306,18 @@ class MyStack extends TerraformStack {
         },
       },
       location: region,
-      name: 'receive-function',
+      name: ns('receive-function'),
       serviceConfig: {
         environmentVariables: {
           'PROJECT_ID': project,
-          'WAIT_PROCESS_TOPIC': wait_process.name,
+          'NAMESPACE': namespace,
+          'WAIT_PROCESS_TOPIC': 'wait-process',
+          'WAIT_POSTBACK_TOPIC': 'wait-postback',
+          'WAIT_GUESS_TOPIC': 'wait-guess',
+          'WAIT_BEACON_TOPIC': 'wait-beacon',
+          'RATE_LIMIT_PER_MINUTE': '10',
+          'BACKPRESSURE': 'overflow',
+          'OVERFLOW_TOPIC': 'overflow',
         },
         minInstanceCount: 0,
         maxInstanceCount: 1,
@@ -116,6 +338,131 @@ class MyStack extends TerraformStack {
       service: receive_function.name,
     });
 
+    const telegram_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'telegram-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'telegram',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('telegram-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'WAIT_PROCESS_TOPIC': 'wait-process',
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudRunServiceIamPolicy.CloudRunServiceIamPolicy(this, 'telegram-noauth', {
+      location: region,
+      policyData: cloudrun_noauth.policyData,
+      service: telegram_function.name,
+    });
+
+    const slack_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'slack-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'slack',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('slack-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'WAIT_PROCESS_TOPIC': 'wait-process',
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudRunServiceIamPolicy.CloudRunServiceIamPolicy(this, 'slack-noauth', {
+      location: region,
+      policyData: cloudrun_noauth.policyData,
+      service: slack_function.name,
+    });
+
+    const slack_install_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'slack-install-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'slackInstall',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('slack-install-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'SLACK_CLIENT_ID': slackClientId,
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudRunServiceIamPolicy.CloudRunServiceIamPolicy(this, 'slack-install-noauth', {
+      location: region,
+      policyData: cloudrun_noauth.policyData,
+      service: slack_install_function.name,
+    });
+
+    // LINE fetches imagemap images from here; game_bucket is not readable
+    const imagemap_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'imagemap-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'imagemap',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('imagemap-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'ANNOTATION_BUCKET': game_bucket.name,
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudRunServiceIamPolicy.CloudRunServiceIamPolicy(this, 'imagemap-noauth', {
+      location: region,
+      policyData: cloudrun_noauth.policyData,
+      service: imagemap_function.name,
+    });
+
     new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'process-function', {
       buildConfig: {
         runtime: 'go119',
@@ -132,12 +479,74 @@ class MyStack extends TerraformStack {
         pubsubTopic: wait_process.id,
       },
       location: region,
-      name: 'process-function',
+      name: ns('process-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'QUARANTINE_TOPIC': 'quarantine',
+          'WAIT_PROCESS_TOPIC': 'wait-process',
+          'WAIT_SEND_TOPIC': 'wait-send',
+          'DEAD_LETTER_TOPIC': 'dead-letter',
+          'MAX_ATTEMPTS': '5',
+          'MAX_MESSAGE_AGE': '10m',
+          'VISION_DAILY_BUDGET': '100',
+          'GAME_BUCKET': game_bucket.name,
+          'ANNOTATION_BUCKET': game_bucket.name,
+          'IMAGEMAP_URL': imagemap_function.serviceConfig.uri,
+          'FUNCTION_MEMORY_MB': '256',
+          'SHEET_ID': sheetId,
+          'VISION_CONCURRENCY': '4',
+          'BACKPRESSURE': 'overflow',
+        },
+        availableMemory: '256M',
+        maxInstanceRequestConcurrency: 8,
+        availableCpu: '1',
+        ingressSettings: 'ALLOW_INTERNAL_ONLY',
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },      
+    });
+
+    new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'overflow-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'process',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      eventTrigger: {
+        eventType: 'google.cloud.pubsub.topic.v1.messagePublished',
+        pubsubTopic: overflow.id,
+      },
+      location: region,
+      name: ns('overflow-function'),
       serviceConfig: {
         environmentVariables: {
           'PROJECT_ID': project,
-          'WAIT_SEND_TOPIC': wait_send.name,
+          'NAMESPACE': namespace,
+          'QUARANTINE_TOPIC': 'quarantine',
+          'WAIT_PROCESS_TOPIC': 'wait-process',
+          'WAIT_SEND_TOPIC': 'wait-send',
+          'DEAD_LETTER_TOPIC': 'dead-letter',
+          'MAX_ATTEMPTS': '5',
+          'MAX_MESSAGE_AGE': '10m',
+          'VISION_DAILY_BUDGET': '100',
+          'GAME_BUCKET': game_bucket.name,
+          'ANNOTATION_BUCKET': game_bucket.name,
+          'IMAGEMAP_URL': imagemap_function.serviceConfig.uri,
+          'FUNCTION_MEMORY_MB': '256',
+          'SHEET_ID': sheetId,
+          'VISION_CONCURRENCY': '4',
         },
+        availableMemory: '256M',
+        maxInstanceRequestConcurrency: 4,
+        availableCpu: '1',
         ingressSettings: 'ALLOW_INTERNAL_ONLY',
         minInstanceCount: 0,
         maxInstanceCount: 1,
@@ -161,11 +570,18 @@ class MyStack extends TerraformStack {
         pubsubTopic: wait_send.id,
       },
       location: region,
-      name: 'send-function',
+      name: ns('send-function'),
       serviceConfig: {
         environmentVariables: {
           'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'QUARANTINE_TOPIC': 'quarantine',
           'CHANNEL_ACCESS_TOKEN': channel_access_token.name,
+          'LIFF_ID': liffId,
+          'WAIT_SEND_TOPIC': 'wait-send',
+          'DEAD_LETTER_TOPIC': 'dead-letter',
+          'MAX_ATTEMPTS': '5',
+          'MAX_MESSAGE_AGE': '10m',
         },
         ingressSettings: 'ALLOW_INTERNAL_ONLY',
         minInstanceCount: 0,
@@ -174,6 +590,776 @@ class MyStack extends TerraformStack {
       },      
     });
 
+    new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'postback-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'postback',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      eventTrigger: {
+        eventType: 'google.cloud.pubsub.topic.v1.messagePublished',
+        pubsubTopic: wait_postback.id,
+      },
+      location: region,
+      name: ns('postback-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'QUARANTINE_TOPIC': 'quarantine',
+          'WAIT_PROCESS_TOPIC': 'wait-process',
+          'ANNOTATION_BUCKET': game_bucket.name,
+          'EXPORT_BUCKET': export_bucket.name,
+        },
+        ingressSettings: 'ALLOW_INTERNAL_ONLY',
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'guess-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'guess',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      eventTrigger: {
+        eventType: 'google.cloud.pubsub.topic.v1.messagePublished',
+        pubsubTopic: wait_guess.id,
+      },
+      location: region,
+      name: ns('guess-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'ADMIN_USER_IDS': admins.join(','),
+          'EXPORT_BUCKET': export_bucket.name,
+          'QUARANTINE_TOPIC': 'quarantine',
+        },
+        ingressSettings: 'ALLOW_INTERNAL_ONLY',
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'beacon-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'beacon',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      eventTrigger: {
+        eventType: 'google.cloud.pubsub.topic.v1.messagePublished',
+        pubsubTopic: wait_beacon.id,
+      },
+      location: region,
+      name: ns('beacon-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'QUARANTINE_TOPIC': 'quarantine',
+          'BEACON_COOLDOWN': '1h',
+        },
+        ingressSettings: 'ALLOW_INTERNAL_ONLY',
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'dead-letters-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'deadLetters',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      eventTrigger: {
+        eventType: 'google.cloud.pubsub.topic.v1.messagePublished',
+        pubsubTopic: dead_letter.id,
+      },
+      location: region,
+      name: ns('dead-letters-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+        },
+        ingressSettings: 'ALLOW_INTERNAL_ONLY',
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    const status_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'status-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'status',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('status-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'WAIT_PROCESS_TOPIC': 'wait-process',
+          'WAIT_SEND_TOPIC': 'wait-send',
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudRunServiceIamPolicy.CloudRunServiceIamPolicy(this, 'status-noauth', {
+      location: region,
+      policyData: cloudrun_noauth.policyData,
+      service: status_function.name,
+    });
+
+    const selftest_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'selftest-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'selftest',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('selftest-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudRunServiceIamPolicy.CloudRunServiceIamPolicy(this, 'selftest-noauth', {
+      location: region,
+      policyData: cloudrun_noauth.policyData,
+      service: selftest_function.name,
+    });
+
+    const drain_outbox_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'drain-outbox-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'drainOutbox',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('drain-outbox-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'INTERNAL_PRINCIPALS': service_runner.email,
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudSchedulerJob.CloudSchedulerJob(this, 'drain-outbox-schedule', {
+      name: ns('drain-outbox'),
+      region,
+      schedule: '*/5 * * * *',
+      httpTarget: {
+        uri: drain_outbox_function.serviceConfig.uri,
+        httpMethod: 'POST',
+        oidcToken: {
+          serviceAccountEmail: service_runner.email,
+        },
+      },
+    });
+
+    const reconcile_replies_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'reconcile-replies-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'reconcileReplies',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('reconcile-replies-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'INTERNAL_PRINCIPALS': service_runner.email,
+          'RECONCILE_AFTER_MINUTES': '5',
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudSchedulerJob.CloudSchedulerJob(this, 'reconcile-replies-schedule', {
+      name: ns('reconcile-replies'),
+      region,
+      schedule: '*/5 * * * *',
+      httpTarget: {
+        uri: reconcile_replies_function.serviceConfig.uri,
+        httpMethod: 'POST',
+        oidcToken: {
+          serviceAccountEmail: service_runner.email,
+        },
+      },
+    });
+
+    const flush_sheet_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'flush-sheet-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'flushSheet',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('flush-sheet-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'INTERNAL_PRINCIPALS': service_runner.email,
+          'SHEET_ID': sheetId,
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudSchedulerJob.CloudSchedulerJob(this, 'flush-sheet-schedule', {
+      name: ns('flush-sheet'),
+      region,
+      schedule: '*/10 * * * *',
+      httpTarget: {
+        uri: flush_sheet_function.serviceConfig.uri,
+        httpMethod: 'POST',
+        oidcToken: {
+          serviceAccountEmail: service_runner.email,
+        },
+      },
+    });
+
+    const autoscale_signals_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'autoscale-signals-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'autoscaleSignals',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('autoscale-signals-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'INTERNAL_PRINCIPALS': service_runner.email,
+          'AUTOSCALE_FUNCTIONS': 'process,send',
+          'PROCESS_SUBSCRIPTION': processSubscription,
+          'PROCESS_MIN_INSTANCES': '0',
+          'PROCESS_MAX_INSTANCES': '1',
+          'PROCESS_CONCURRENCY': '8',
+          'SEND_SUBSCRIPTION': sendSubscription,
+          'SEND_MIN_INSTANCES': '0',
+          'SEND_MAX_INSTANCES': '1',
+          'SEND_CONCURRENCY': '1',
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudSchedulerJob.CloudSchedulerJob(this, 'autoscale-signals-schedule', {
+      name: ns('autoscale-signals'),
+      region,
+      schedule: '*/5 * * * *',
+      httpTarget: {
+        uri: autoscale_signals_function.serviceConfig.uri,
+        httpMethod: 'POST',
+        oidcToken: {
+          serviceAccountEmail: service_runner.email,
+        },
+      },
+    });
+
+    const slo_check_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'slo-check-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'sloCheck',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('slo-check-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'INTERNAL_PRINCIPALS': service_runner.email,
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudSchedulerJob.CloudSchedulerJob(this, 'slo-check-schedule', {
+      name: ns('slo-check'),
+      region,
+      schedule: '*/5 * * * *',
+      httpTarget: {
+        uri: slo_check_function.serviceConfig.uri,
+        httpMethod: 'POST',
+        oidcToken: {
+          serviceAccountEmail: service_runner.email,
+        },
+      },
+    });
+
+    // the "pipeline event" log entries, one per state transition while PIPELINE_EVENTS is on
+    const pipeline_events_dataset = new google.bigqueryDataset.BigqueryDataset(this, 'pipeline-events-dataset', {
+      datasetId: namespace ? `${namespace.replace(/-/g, '_')}_pipeline_events` : 'pipeline_events',
+      location: region,
+      // exported events are not kept beyond the retention
+      defaultTableExpirationMs: pipelineEventsDays * 24 * 60 * 60 * 1000,
+      defaultPartitionExpirationMs: pipelineEventsDays * 24 * 60 * 60 * 1000,
+    });
+
+    // delete-user-data purges the rows of a user from the export
+    new google.bigqueryDatasetIamMember.BigqueryDatasetIamMember(this, 'pipeline-events-purger', {
+      datasetId: pipeline_events_dataset.datasetId,
+      role: 'roles/bigquery.dataEditor',
+      member: `serviceAccount:${service_runner.email}`,
+    });
+
+    new google.projectIamMember.ProjectIamMember(this, 'allow-bigquery-jobs', {
+      member: `serviceAccount:${service_runner.email}`,
+      project,
+      role: 'roles/bigquery.jobUser',
+    });
+
+    new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'delete-user-data-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'deleteUserData',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('delete-user-data-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'INTERNAL_PRINCIPALS': service_runner.email,
+          'ANNOTATION_BUCKET': game_bucket.name,
+          'EXPORT_BUCKET': export_bucket.name,
+          'PIPELINE_EVENTS_DATASET': pipeline_events_dataset.datasetId,
+        },
+        timeoutSeconds: 540,
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'spam-flags-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'spamFlags',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('spam-flags-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'INTERNAL_PRINCIPALS': service_runner.email,
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'message-events-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'messageEvents',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('message-events-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'INTERNAL_PRINCIPALS': service_runner.email,
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'analyze-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'analyze',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('analyze-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          // comma separated service accounts of the services allowed to call it
+          'INTERNAL_PRINCIPALS': service_runner.email,
+          // comma separated buckets a gcsUri may name; none without it
+          'ANALYZE_GCS_BUCKETS': '',
+          'VISION_DAILY_BUDGET': '100',
+          'VISION_CONCURRENCY': '4',
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    // /search looks up the archive index of a user by label or by category, newest first
+    ['searchLabels', 'categories'].forEach((field) => {
+      new google.firestoreIndex.FirestoreIndex(this, `archive-index-${field}`, {
+        collection: collection('archiveIndex'),
+        fields: [
+          { fieldPath: 'userIdHash', order: 'ASCENDING' },
+          { fieldPath: field, arrayConfig: 'CONTAINS' },
+          { fieldPath: 'createdAt', order: 'DESCENDING' },
+        ],
+      });
+    });
+
+    const pipeline_events_sink = new google.loggingProjectSink.LoggingProjectSink(this, 'pipeline-events-sink', {
+      name: ns('pipeline-events'),
+      destination: `bigquery.googleapis.com/projects/${project}/datasets/${pipeline_events_dataset.datasetId}`,
+      // only the functions of this deployment that record events
+      filter: `resource.type="cloud_run_revision" AND resource.labels.service_name=(${['receive-function', 'process-function', 'overflow-function', 'send-function'].map((f) => `"${ns(f)}"`).join(' OR ')}) AND jsonPayload.message=~"^pipeline event: "`,
+      uniqueWriterIdentity: true,
+      bigqueryOptions: {
+        usePartitionedTables: true,
+      },
+    });
+
+    new google.bigqueryDatasetIamMember.BigqueryDatasetIamMember(this, 'pipeline-events-writer', {
+      datasetId: pipeline_events_dataset.datasetId,
+      role: 'roles/bigquery.dataEditor',
+      member: pipeline_events_sink.writerIdentity,
+    });
+
+    const cleanup_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'cleanup-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'cleanup',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('cleanup-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'INTERNAL_PRINCIPALS': service_runner.email,
+          'GAME_BUCKET': game_bucket.name,
+          'ANNOTATION_BUCKET': game_bucket.name,
+        },
+        timeoutSeconds: 540,
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudSchedulerJob.CloudSchedulerJob(this, 'cleanup-schedule', {
+      name: ns('cleanup'),
+      region,
+      schedule: '0 3 * * *',
+      timeZone: 'Asia/Tokyo',
+      httpTarget: {
+        uri: cleanup_function.serviceConfig.uri,
+        httpMethod: 'POST',
+        oidcToken: {
+          serviceAccountEmail: service_runner.email,
+        },
+      },
+    });
+
+    new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'campaign-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'campaign',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('campaign-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'INTERNAL_PRINCIPALS': service_runner.email,
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'multicast-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'multicast',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('multicast-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'INTERNAL_PRINCIPALS': service_runner.email,
+          'WAIT_SEND_TOPIC': 'wait-send',
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    const upload_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'upload-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'upload',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('upload-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'VISION_DAILY_BUDGET': '100',
+          'FUNCTION_MEMORY_MB': '256',
+          'VISION_CONCURRENCY': '4',
+        },
+        availableMemory: '256M',
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudRunServiceIamPolicy.CloudRunServiceIamPolicy(this, 'upload-noauth', {
+      location: region,
+      policyData: cloudrun_noauth.policyData,
+      service: upload_function.name,
+    });
+
+    const results_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'results-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'results',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('results-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudRunServiceIamPolicy.CloudRunServiceIamPolicy(this, 'results-noauth', {
+      location: region,
+      policyData: cloudrun_noauth.policyData,
+      service: results_function.name,
+    });
+
+    const liff_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'liff-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'liff',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('liff-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'LIFF_ID': liffId,
+          'LIFF_CHANNEL_ID': liffChannelId,
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    new google.cloudRunServiceIamPolicy.CloudRunServiceIamPolicy(this, 'liff-noauth', {
+      location: region,
+      policyData: cloudrun_noauth.policyData,
+      service: liff_function.name,
+    });
+
+    const dashboard_function = new google.cloudfunctions2Function.Cloudfunctions2Function(this, 'dashboard-function', {
+      buildConfig: {
+        runtime: 'go119',
+        entryPoint: 'dashboard',
+        source: {
+          storageSource: {
+            bucket: function_bucket.name,
+            object: function_object.name,
+          },
+        },
+      },
+      location: region,
+      name: ns('dashboard-function'),
+      serviceConfig: {
+        environmentVariables: {
+          'PROJECT_ID': project,
+          'NAMESPACE': namespace,
+          'INTERNAL_PRINCIPALS': operators.map((member) => member.replace(/^user:/, '')).join(','),
+          'DASHBOARD_OAUTH_CLIENT_ID': dashboardClientId,
+        },
+        minInstanceCount: 0,
+        maxInstanceCount: 1,
+        serviceAccountEmail: service_runner.email,
+      },
+    });
+
+    // browsers cannot send identity tokens; the function signs operators in with Google itself
+    new google.cloudRunServiceIamPolicy.CloudRunServiceIamPolicy(this, 'dashboard-noauth', {
+      location: region,
+      policyData: cloudrun_noauth.policyData,
+      service: dashboard_function.name,
+    });
+
   }
 }
 
@@ -182,6 +1368,6 @@ const stack = new MyStack(app, "ubiquitous-couscous");
 new CloudBackend(stack, {
   hostname: "app.terraform.io",
   organization: "hsmtkkdefault",
-  workspaces: new NamedCloudWorkspace("ubiquitous-couscous")
+  workspaces: new NamedCloudWorkspace(ns("ubiquitous-couscous"))
 });
 app.synth();
@@ -1,3 +1,17 @@
 call gcloud functions delete receive-function --gen2 --region asia-northeast1 --quiet
 call gcloud functions delete process-function --gen2 --region asia-northeast1 --quiet
 call gcloud functions delete send-function --gen2 --region asia-northeast1 --quiet
+call gcloud functions delete status-function --gen2 --region asia-northeast1 --quiet
+call gcloud functions delete selftest-function --gen2 --region asia-northeast1 --quiet
+call gcloud functions delete drain-outbox-function --gen2 --region asia-northeast1 --quiet
+call gcloud functions delete postback-function --gen2 --region asia-northeast1 --quiet
+call gcloud functions delete guess-function --gen2 --region asia-northeast1 --quiet
+call gcloud functions delete cleanup-function --gen2 --region asia-northeast1 --quiet
+call gcloud functions delete campaign-function --gen2 --region asia-northeast1 --quiet
+call gcloud functions delete upload-function --gen2 --region asia-northeast1 --quiet
+call gcloud functions delete results-function --gen2 --region asia-northeast1 --quiet
+call gcloud functions delete dashboard-function --gen2 --region asia-northeast1 --quiet
+call gcloud functions delete reconcile-replies-function --gen2 --region asia-northeast1 --quiet
+call gcloud functions delete beacon-function --gen2 --region asia-northeast1 --quiet
+call gcloud functions delete flush-sheet-function --gen2 --region asia-northeast1 --quiet
+call gcloud functions delete overflow-function --gen2 --region asia-northeast1 --quiet
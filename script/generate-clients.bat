@@ -0,0 +1,2 @@
+call npx @openapitools/openapi-generator-cli generate -i function/openapi.json -g go -o clients/go --package-name couscous
+call npx @openapitools/openapi-generator-cli generate -i function/openapi.json -g typescript-fetch -o clients/typescript
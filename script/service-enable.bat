@@ -1 +1 @@
-call gcloud services enable vision.googleapis.com cloudfunctions.googleapis.com cloudbuild.googleapis.com run.googleapis.com secretmanager.googleapis.com artifactregistry.googleapis.com eventarc.googleapis.com
+call gcloud services enable vision.googleapis.com cloudfunctions.googleapis.com cloudbuild.googleapis.com run.googleapis.com secretmanager.googleapis.com artifactregistry.googleapis.com eventarc.googleapis.com firestore.googleapis.com cloudscheduler.googleapis.com translate.googleapis.com aiplatform.googleapis.com sheets.googleapis.com iamcredentials.googleapis.com kgsearch.googleapis.com